@@ -19,6 +19,7 @@ import (
 
 	"github.com/bamiaux/rez"
 	"github.com/beevik/etree"
+	"github.com/pgaskin/kepubify/v4/internal/kobopath"
 	"github.com/pgaskin/koboutils/v2/kobo"
 	"github.com/spf13/pflag"
 )
@@ -31,6 +32,7 @@ func main() {
 	ar := pflag.Float64P("aspect-ratio", "a", 0, "Stretch the covers to fit a specific aspect ratio (for example 1.3, 1.5, 1.6)")
 	fgrayscale := pflag.BoolP("grayscale", "g", false, "Convert images to grayscale")
 	finvert := pflag.BoolP("invert", "i", false, "Invert images")
+	sd := pflag.StringP("sd", "s", "", "Path to the SD card in the Kobo eReader (covers will be generated for the books on it too)")
 	help := pflag.BoolP("help", "h", false, "Show this help message")
 	pflag.Parse()
 
@@ -73,6 +75,22 @@ func main() {
 
 	sort.Strings(epubs)
 
+	// the books on the SD card go after the ones on the device
+	nd := len(epubs)
+	if *sd != "" {
+		fmt.Println("Finding epubs on the SD card")
+		sdEpubs, err := scan(*sd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not find epubs on the SD card: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+		fmt.Printf("... Found %d epubs\n", len(sdEpubs))
+
+		sort.Strings(sdEpubs)
+		epubs = append(epubs, sdEpubs...)
+	}
+
 	var nt, ntc, nu, ne, ns, nn int
 	fmt.Println("Generating covers")
 	nt = len(epubs)
@@ -80,7 +98,12 @@ func main() {
 	for i, epub := range epubs {
 		fmt.Printf("[%3d/%3d] %s\n", i+1, nt, epub)
 
-		iid, err := imageID(kp, epub)
+		root, external := kp, i >= nd
+		if external {
+			root = *sd
+		}
+
+		iid, err := imageID(root, epub, external)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "--------- Could not generate ImageId: %v.\n", err)
 			ne += len(kobo.CoverTypes())
@@ -89,7 +112,7 @@ func main() {
 
 		var origCover image.Image
 		for _, ct := range kobo.CoverTypes() {
-			cp, exists, err := check(ct, kp, iid)
+			cp, exists, err := check(ct, root, iid, external)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "--------- Could not check if cover exists: %v.\n", err)
 				ne++
@@ -220,16 +243,16 @@ func scan(root string) ([]string, error) {
 	return epubs, err
 }
 
-func imageID(kp, book string) (string, error) {
-	rel, err := filepath.Rel(kp, book)
+func imageID(root, book string, external bool) (string, error) {
+	rel, err := filepath.Rel(root, book)
 	if err != nil {
 		return "", fmt.Errorf("could not resolve book path relative to kobo: %w", err)
 	}
-	return kobo.ContentIDToImageID(kobo.PathToContentID(rel)), nil
+	return kobopath.ImageID(rel, external), nil
 }
 
-func check(ct kobo.CoverType, kp, iid string) (string, bool, error) {
-	cp := filepath.Join(kp, filepath.FromSlash(ct.GeneratePath(false, iid)))
+func check(ct kobo.CoverType, root, iid string, external bool) (string, bool, error) {
+	cp := filepath.Join(root, filepath.FromSlash(ct.GeneratePath(external, iid)))
 	if _, err := os.Stat(cp); err == nil {
 		return cp, true, nil
 	} else if os.IsNotExist(err) {
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+	"github.com/pgaskin/kepubify/v4/internal/kobopath"
+	"github.com/spf13/pflag"
+)
+
+func export(args []string) {
+	fs := pflag.NewFlagSet("export", pflag.ContinueOnError)
+	format := fs.StringP("format", "f", "markdown", "The output format (markdown: a file for each book, json: a single file)")
+	output := fs.StringP("output", "o", "", "The output directory for markdown or file for json, or - for stdout (default: highlights or highlights.json)")
+	contentID := fs.String("content-id", "", "Only export the book with the specified ContentID")
+	help := fs.BoolP("help", "h", false, "Show this help message")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+		return
+	}
+
+	if *help || fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: highlights export [options] [kobo_path]\n\nOptions:\n%s", fs.FlagUsages())
+		fmt.Fprintf(os.Stderr, "\nArguments:\n  kobo_path is the path to the Kobo eReader. If not specified, highlights will try to automatically detect the Kobo.\n")
+		fmt.Fprintf(os.Stderr, "\nFor sideloaded KEPUBs, the highlighted text is read from the book on the device. Otherwise, the text stored in the database is used.\n")
+		if *help {
+			os.Exit(0)
+		} else {
+			os.Exit(2)
+		}
+		return
+	}
+
+	switch *format {
+	case "markdown", "md":
+		if *output == "" {
+			*output = "highlights"
+		}
+	case "json":
+		if *output == "" {
+			*output = "highlights.json"
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q\n", *format)
+		os.Exit(2)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Opening kobo")
+	kp, err := findKobo(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not find Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+	k, err := kobodb.Open(kp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Reading highlights")
+	books, err := exportBookmarks(k.DB, k.Path, *contentID, func(id string, err error) {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v, using the text from the database.\n", id, err)
+	})
+	k.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read highlights: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Writing highlights")
+	if *format == "json" {
+		buf, err := json.MarshalIndent(books, "", "  ")
+		if err == nil {
+			err = writeOutput(*output, append(buf, '\n'))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write highlights: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d books\n", len(books))
+		return
+	}
+
+	if *output != "-" {
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not create output directory: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+	}
+	names := map[string]bool{}
+	for i, book := range books {
+		var buf bytes.Buffer
+		fn := "-"
+		if *output != "-" {
+			fn = filepath.Join(*output, markdownName(book, names))
+		} else if i != 0 {
+			buf.WriteString("\n")
+		}
+		writeMarkdown(&buf, book)
+		if err := writeOutput(fn, buf.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write highlights for %q: %v.\n", book.Title, err)
+			os.Exit(1)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[%3d/%3d] %s: %d bookmarks\n", i+1, len(books), book.Title, len(book.Bookmarks))
+	}
+}
+
+// writeOutput writes buf to the file fn, or stdout if fn is -.
+func writeOutput(fn string, buf []byte) error {
+	if fn == "-" {
+		_, err := os.Stdout.Write(buf)
+		return err
+	}
+	return os.WriteFile(fn, buf, 0644)
+}
+
+// exportBook is a book with bookmarks.
+type exportBook struct {
+	VolumeID  string           `json:"volume_id"`
+	Title     string           `json:"title"`
+	Author    string           `json:"author,omitempty"`
+	Bookmarks []exportBookmark `json:"bookmarks"`
+}
+
+// exportBookmark is a highlight, note, or bookmark.
+type exportBookmark struct {
+	BookmarkID string  `json:"id"`
+	Type       string  `json:"type"`           // highlight, note, or dogear (a bookmark)
+	File       string  `json:"file,omitempty"` // the content document in the KEPUB, if it was found
+	Text       string  `json:"text,omitempty"`
+	Annotation string  `json:"annotation,omitempty"`
+	Progress   float64 `json:"chapter_progress"`
+	Created    string  `json:"created,omitempty"`
+	Resolved   bool    `json:"resolved"` // whether the text was read from the KEPUB rather than the database
+}
+
+// exportBookmarks reads the bookmarks from the database, optionally only for
+// the book volumeID. The text is read from the sideloaded KEPUBs under the
+// Kobo at kp if possible, and warn is called if it couldn't be for a book or
+// bookmark. Books are sorted by title, and the bookmarks are in reading order
+// if they were resolved, then by date.
+func exportBookmarks(db *sql.DB, kp, volumeID string, warn func(id string, err error)) ([]exportBook, error) {
+	q := `
+		SELECT b.BookmarkID, b.VolumeID, b.ContentID, b.StartContainerPath, b.StartOffset, b.EndContainerPath, b.EndOffset,
+		       b.Text, b.Annotation, b.Type, b.DateCreated, b.ChapterProgress, c.Title, c.Attribution
+		FROM Bookmark b
+		LEFT JOIN content c ON c.ContentID = b.VolumeID AND c.ContentType = 6`
+	var qa []interface{}
+	if volumeID != "" {
+		q += ` WHERE b.VolumeID = ?`
+		qa = append(qa, volumeID)
+	}
+	q += ` ORDER BY b.DateCreated`
+
+	rows, err := db.Query(q, qa...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type bookmark struct {
+		exportBookmark
+		ContentID string
+		Pos       bookmarkPosition
+		Doc       int // index of the content document, or -1 if not resolved
+		Start     int // offset from the start of the content document
+	}
+
+	var books []*exportBook
+	bookIndex := map[string]int{}
+	bookmarks := map[string][]bookmark{}
+	for rows.Next() {
+		var (
+			b                                         bookmark
+			vid                                       string
+			startPath, endPath, text, annotation, typ sql.NullString
+			created, title, author                    sql.NullString
+			startOffset, endOffset                    sql.NullInt64
+			progress                                  sql.NullFloat64
+		)
+		if err := rows.Scan(&b.BookmarkID, &vid, &b.ContentID, &startPath, &startOffset, &endPath, &endOffset, &text, &annotation, &typ, &created, &progress, &title, &author); err != nil {
+			return nil, err
+		}
+		b.Pos = bookmarkPosition{startPath.String, int(startOffset.Int64), endPath.String, int(endOffset.Int64)}
+		b.Type, b.Text, b.Annotation, b.Created, b.Progress = typ.String, text.String, annotation.String, created.String, progress.Float64
+		b.Doc = -1
+
+		if _, ok := bookIndex[vid]; !ok {
+			bookIndex[vid] = len(books)
+			books = append(books, &exportBook{
+				VolumeID: vid,
+				Title:    title.String,
+				Author:   author.String,
+			})
+			if title.String == "" {
+				books[len(books)-1].Title = path.Base(vid)
+			}
+		}
+		bookmarks[vid] = append(bookmarks[vid], b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, book := range books {
+		bs := bookmarks[book.VolumeID]
+
+		if fn, ok := contentIDToPath(kp, book.VolumeID); ok && strings.HasSuffix(strings.ToLower(fn), ".kepub.epub") {
+			if sdocs, err := exportSpans(fn); err != nil {
+				warn(book.VolumeID, fmt.Errorf("read kepub: %w", err))
+			} else {
+				docs := map[string]*spanDoc{}
+				docIndex := map[string]int{}
+				for i, sdoc := range sdocs {
+					docs[sdoc.File] = newSpanDoc(sdoc)
+					docIndex[sdoc.File] = i
+				}
+				for i := range bs {
+					b := &bs[i]
+					if b.Pos.StartPath == "" {
+						continue
+					}
+					dfn, ok := bookmarkFile(sdocs, book.VolumeID, b.ContentID)
+					if !ok {
+						warn(b.BookmarkID, fmt.Errorf("could not find content file for %q", b.ContentID))
+						continue
+					}
+					start, end, text, err := docs[dfn].resolve(b.Pos)
+					if err != nil {
+						warn(b.BookmarkID, err)
+						continue
+					}
+					b.File, b.Doc, b.Start = dfn, docIndex[dfn], start
+					if end > start {
+						b.Text, b.Resolved = text, true
+					}
+				}
+			}
+		}
+
+		sort.SliceStable(bs, func(i, j int) bool {
+			switch a, b := bs[i], bs[j]; {
+			case a.Doc == -1 || b.Doc == -1:
+				return a.Doc != -1 && b.Doc == -1
+			case a.Doc != b.Doc:
+				return a.Doc < b.Doc
+			default:
+				return a.Start < b.Start
+			}
+		})
+		book.Bookmarks = make([]exportBookmark, len(bs))
+		for i, b := range bs {
+			book.Bookmarks[i] = b.exportBookmark
+		}
+	}
+
+	res := make([]exportBook, len(books))
+	for i, book := range books {
+		res[i] = *book
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Title != res[j].Title {
+			return res[i].Title < res[j].Title
+		}
+		return res[i].VolumeID < res[j].VolumeID
+	})
+	return res, nil
+}
+
+// contentIDToPath gets the path to a sideloaded book on the Kobo at kp. Books on
+// the SD card aren't supported.
+func contentIDToPath(kp, contentID string) (string, bool) {
+	rel, sd, ok := kobopath.Path(contentID)
+	if !ok || sd {
+		return "", false
+	}
+	return filepath.Join(kp, rel), true
+}
+
+// writeMarkdown writes the bookmarks for a book as Markdown.
+func writeMarkdown(w io.Writer, book exportBook) {
+	fmt.Fprintf(w, "# %s\n", book.Title)
+	if book.Author != "" {
+		fmt.Fprintf(w, "\n*%s*\n", book.Author)
+	}
+	for _, b := range book.Bookmarks {
+		fmt.Fprintf(w, "\n")
+		if b.Text != "" {
+			for i, line := range strings.Split(strings.TrimSpace(b.Text), "\n") {
+				if i != 0 {
+					fmt.Fprintf(w, ">\n")
+				}
+				fmt.Fprintf(w, "> %s\n", strings.TrimSpace(line))
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		if b.Annotation != "" {
+			fmt.Fprintf(w, "%s\n\n", strings.TrimSpace(b.Annotation))
+		}
+
+		var kind string
+		switch b.Type {
+		case "highlight":
+			kind = "Highlight"
+		case "note":
+			kind = "Note"
+		case "dogear":
+			kind = "Bookmark"
+		default:
+			kind = b.Type
+		}
+		if b.File != "" {
+			kind += " in " + b.File
+		}
+		if len(b.Created) >= 10 {
+			kind += ", " + b.Created[:10]
+		}
+		fmt.Fprintf(w, "— *%s*\n", kind)
+	}
+}
+
+// markdownName gets a unique filename for the Markdown for a book.
+func markdownName(book exportBook, used map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(book.Title))
+	if name == "" {
+		name = "Untitled"
+	}
+	fn := name + ".md"
+	for i := 2; used[strings.ToLower(fn)]; i++ {
+		fn = fmt.Sprintf("%s (%d).md", name, i)
+	}
+	used[strings.ToLower(fn)] = true
+	return fn
+}
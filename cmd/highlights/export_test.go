@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+)
+
+func TestExport(t *testing.T) {
+	kp := t.TempDir()
+
+	buf, _ := testKEPUB(t, map[string]string{
+		"ch1.xhtml": `<p>It was a dark and stormy night. The rain fell in torrents.</p><p>Except at occasional intervals.</p>`,
+		"ch2.xhtml": `<p>When it was checked by a violent gust of wind.</p>`,
+	})
+	if err := os.MkdirAll(filepath.Join(kp, ".kobo"), 0755); err != nil {
+		t.Fatalf("create kobo: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(kp, "Books"), 0755); err != nil {
+		t.Fatalf("create kobo: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(kp, "Books", "test.kepub.epub"), buf, 0644); err != nil {
+		t.Fatalf("write kepub: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(kp, "Books", "broken.kepub.epub"), []byte("not a zip"), 0644); err != nil {
+		t.Fatalf("write kepub: %v", err)
+	}
+
+	k, err := kobodb.Open(kp)
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	defer k.Close()
+
+	const (
+		book   = "file:///mnt/onboard/Books/test.kepub.epub"
+		broken = "file:///mnt/onboard/Books/broken.kepub.epub"
+		store  = "0a1b2c3d-0000-0000-0000-000000000000"
+	)
+	if _, err := k.DB.Exec(`
+		CREATE TABLE content (
+			ContentID TEXT NOT NULL, ContentType TEXT NOT NULL, Title TEXT, Attribution TEXT,
+			PRIMARY KEY (ContentID)
+		);
+		CREATE TABLE Bookmark (
+			BookmarkID TEXT NOT NULL, VolumeID TEXT NOT NULL, ContentID TEXT NOT NULL,
+			StartContainerPath TEXT NOT NULL, StartContainerChildIndex INTEGER NOT NULL, StartOffset INTEGER NOT NULL,
+			EndContainerPath TEXT NOT NULL, EndContainerChildIndex INTEGER NOT NULL, EndOffset INTEGER NOT NULL,
+			Text TEXT, Annotation TEXT, ChapterProgress REAL NOT NULL DEFAULT 0, Type TEXT, DateCreated TEXT,
+			PRIMARY KEY (BookmarkID)
+		);
+		INSERT INTO content VALUES
+			('` + book + `', 6, 'Paul Clifford', 'Edward Bulwer-Lytton'),
+			('` + book + `!OEBPS!ch1.xhtml', 9, 'Chapter 1', NULL),
+			('` + store + `', 6, 'A Store Book', 'Someone');
+		INSERT INTO Bookmark VALUES
+			('a', '` + book + `', '` + book + `!OEBPS!ch2.xhtml', 'span#kobo\.1\.1', -99, 25, 'span#kobo\.1\.1', -99, 37, 'stale text', NULL, 0.5, 'highlight', '2020-01-01T00:00:01Z'),
+			('b', '` + book + `', '` + book + `!OEBPS!ch1.xhtml', 'span#kobo\.1\.2', -99, 0, 'span#kobo\.2\.1', -99, 31, NULL, 'Two paragraphs.', 0.1, 'note', '2020-01-02T00:00:02Z'),
+			('c', '` + book + `', '` + book + `!OEBPS!ch1.xhtml', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 0, NULL, NULL, 0, 'dogear', '2020-01-03T00:00:03Z'),
+			('d', '` + book + `', '` + book + `!OEBPS!missing.xhtml', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 4, 'from db', NULL, 0, 'highlight', '2020-01-04T00:00:04Z'),
+			('e', '` + store + `', '` + store + `', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 4, 'Store text', NULL, 0, 'highlight', '2020-01-05T00:00:05Z'),
+			('f', '` + broken + `', '` + broken + `!ch1.xhtml', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 4, 'Broken text', NULL, 0, 'highlight', '2020-01-06T00:00:06Z');
+	`); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+
+	var warnings []string
+	books, err := exportBookmarks(k.DB, k.Path, "", func(id string, err error) {
+		warnings = append(warnings, id+": "+err.Error())
+	})
+	if err != nil {
+		t.Fatalf("export: unexpected error: %v", err)
+	}
+
+	var res []string
+	for _, b := range books {
+		res = append(res, b.Title+" ("+b.Author+")")
+		for _, m := range b.Bookmarks {
+			res = append(res, "  "+m.BookmarkID+" "+m.Type+" "+m.File+" "+strings.ReplaceAll(m.Text, "\n", `\n`)+" ["+m.Annotation+"]")
+		}
+	}
+	exp := []string{
+		`A Store Book (Someone)`,
+		`  e highlight  Store text []`,
+		`Paul Clifford (Edward Bulwer-Lytton)`,
+		`  c dogear OEBPS/ch1.xhtml  []`,
+		`  b note OEBPS/ch1.xhtml The rain fell in torrents.\nExcept at occasional intervals. [Two paragraphs.]`,
+		`  a highlight OEBPS/ch2.xhtml violent gust []`,
+		`  d highlight  from db []`,
+		`broken.kepub.epub ()`,
+		`  f highlight  Broken text []`,
+	}
+	if a, b := strings.Join(res, "\n"), strings.Join(exp, "\n"); a != b {
+		t.Errorf("incorrect results:\n%s\n---\nexpected:\n%s", a, b)
+	}
+	if len(warnings) != 2 || !strings.HasPrefix(warnings[0], "d: could not find content file") || !strings.HasPrefix(warnings[1], broken+": read kepub:") {
+		t.Errorf("incorrect warnings: %q", warnings)
+	}
+
+	if books, err := exportBookmarks(k.DB, k.Path, store, func(string, error) {}); err != nil {
+		t.Errorf("export single book: unexpected error: %v", err)
+	} else if len(books) != 1 || books[0].VolumeID != store || len(books[0].Bookmarks) != 1 {
+		t.Errorf("export single book: incorrect result %+v", books)
+	}
+
+	var md bytes.Buffer
+	writeMarkdown(&md, books[1])
+	if a, b := md.String(), strings.Join([]string{
+		`# Paul Clifford`,
+		``,
+		`*Edward Bulwer-Lytton*`,
+		``,
+		`— *Bookmark in OEBPS/ch1.xhtml, 2020-01-03*`,
+		``,
+		`> The rain fell in torrents.`,
+		`>`,
+		`> Except at occasional intervals.`,
+		``,
+		`Two paragraphs.`,
+		``,
+		`— *Note in OEBPS/ch1.xhtml, 2020-01-02*`,
+		``,
+		`> violent gust`,
+		``,
+		`— *Highlight in OEBPS/ch2.xhtml, 2020-01-01*`,
+		``,
+		`> from db`,
+		``,
+		`— *Highlight, 2020-01-04*`,
+		``,
+	}, "\n"); a != b {
+		t.Errorf("incorrect markdown:\n%s\n---\nexpected:\n%s", a, b)
+	}
+}
+
+func TestMarkdownName(t *testing.T) {
+	used := map[string]bool{}
+	for _, c := range []struct {
+		Title string
+		Exp   string
+	}{
+		{"Title", "Title.md"},
+		{"title", "title (2).md"},
+		{"Title: A/B?", "Title_ A_B_.md"},
+		{"  ", "Untitled.md"},
+		{"Title", "Title (3).md"},
+	} {
+		if act := markdownName(exportBook{Title: c.Title}, used); act != c.Exp {
+			t.Errorf("markdown name for %q: expected %q, got %q", c.Title, c.Exp, act)
+		}
+	}
+}
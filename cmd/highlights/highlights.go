@@ -0,0 +1,108 @@
+// Command highlights works with the highlights, notes, and bookmarks for
+// sideloaded KEPUBs in the Kobo database.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+	"github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/pgaskin/koboutils/v2/kobo"
+)
+
+var version = "dev"
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			export(os.Args[2:])
+			return
+		case "remap":
+			remap(os.Args[2:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: highlights command [options] [arguments]\n\nVersion:\n  highlights %s\n\nCommands:\n", version)
+	fmt.Fprintf(os.Stderr, "  export  Export highlights, notes, and bookmarks to Markdown or JSON\n")
+	fmt.Fprintf(os.Stderr, "  remap   Update highlights and bookmarks for a book which was reconverted or updated on the device (use --restore to undo it)\n")
+	fmt.Fprintf(os.Stderr, "\nUse highlights command --help for more details.\n")
+	if len(os.Args) > 1 && os.Args[1] != "-h" && os.Args[1] != "--help" {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// findKobo returns the specified path, or finds a Kobo eReader if it is empty.
+func findKobo(kp string) (string, error) {
+	if kp != "" {
+		return kp, nil
+	}
+	kobos, err := kobo.Find()
+	if err != nil {
+		return "", fmt.Errorf("could not automatically detect a Kobo eReader: %w", err)
+	} else if len(kobos) == 0 {
+		return "", fmt.Errorf("could not automatically detect a Kobo eReader")
+	}
+	return kobos[0], nil
+}
+
+// exportSpans reads the spans from a KEPUB.
+func exportSpans(fn string) ([]kepub.SpanDocument, error) {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return kepub.ExportSpans(zr)
+}
+
+// bookmarkFile finds the content document in docs for the ContentID of a
+// bookmark in the book VolumeID. For KEPUBs, the ContentID is the VolumeID
+// followed by the path of the content document with the slashes replaced
+// by exclamation marks (and sometimes a fragment).
+func bookmarkFile(docs []kepub.SpanDocument, volumeID, contentID string) (string, bool) {
+	rest := strings.TrimPrefix(contentID, volumeID)
+	if i := strings.IndexByte(rest, '#'); i != -1 {
+		rest = rest[:i]
+	}
+	rest = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(rest, "!", "/")), "/")
+	for _, doc := range docs {
+		if doc.File == rest {
+			return doc.File, true
+		}
+	}
+	for _, doc := range docs {
+		if strings.HasSuffix("/"+doc.File, "/"+rest) || strings.HasSuffix("/"+rest, "/"+doc.File) {
+			return doc.File, true
+		}
+	}
+	return "", false
+}
+
+// parseContainerPath gets the span id from a container path in a bookmark
+// (e.g., span#kobo\.1\.2).
+func parseContainerPath(s string) (string, bool) {
+	i := strings.LastIndexByte(s, '#')
+	if i == -1 {
+		return "", false
+	}
+	id := strings.ReplaceAll(s[i+1:], `\.`, ".")
+	if !strings.HasPrefix(id, "kobo.") {
+		return "", false
+	}
+	return id, true
+}
+
+// formatContainerPath replaces the span id in a container path.
+func formatContainerPath(s, id string) string {
+	if i := strings.LastIndexByte(s, '#'); i != -1 {
+		s = s[:i]
+	} else {
+		s = "span"
+	}
+	return s + "#" + strings.ReplaceAll(id, ".", `\.`)
+}
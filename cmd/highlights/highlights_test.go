@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pgaskin/kepubify/v4/kepub"
+)
+
+// testKEPUB converts an EPUB with the specified content documents (in spine
+// order by name) and returns the spans.
+func testKEPUB(t *testing.T, docs map[string]string) ([]byte, []kepub.SpanDocument) {
+	t.Helper()
+
+	var names []string
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var manifest, spine strings.Builder
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+	}
+	for i, name := range names {
+		fmt.Fprintf(&manifest, `<item id="doc%d" href="%s" media-type="application/xhtml+xml"/>`, i, name)
+		fmt.Fprintf(&spine, `<itemref idref="doc%d"/>`, i)
+		epub["OEBPS/"+name] = &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title>` + name + `</title></head><body>` + docs[name] + `</body></html>`)}
+	}
+	epub["OEBPS/content.opf"] = &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>Test Book</dc:title>
+		<dc:creator>Test Author</dc:creator>
+		<dc:identifier id="id">test</dc:identifier>
+		<dc:language>en</dc:language>
+	</metadata>
+	<manifest>` + manifest.String() + `</manifest>
+	<spine>` + spine.String() + `</spine>
+</package>`)}
+
+	var buf bytes.Buffer
+	if err := kepub.NewConverterWithOptions(kepub.ConverterOptionDummyTitlepage(false)).Convert(context.Background(), &buf, epub); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("read kepub: %v", err)
+	}
+	spans, err := kepub.ExportSpans(zr)
+	if err != nil {
+		t.Fatalf("export spans: %v", err)
+	}
+	return buf.Bytes(), spans
+}
+
+func TestRemap(t *testing.T) {
+	_, oldDocs := testKEPUB(t, map[string]string{
+		"ch1.xhtml": `<p>One. Two.</p><p>Three "quoted" here.</p><p>Four. Five.</p>`,
+	})
+	_, newDocs := testKEPUB(t, map[string]string{
+		"ch1.xhtml": `<p>Intro.</p><p>One. Two.</p><p>Three “quoted” here.</p><p>Five.</p>`,
+	})
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "KoboReader.sqlite"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	const volumeID = "file:///mnt/onboard/test.kepub.epub"
+	if _, err := db.Exec(`
+		CREATE TABLE Bookmark (
+			BookmarkID TEXT NOT NULL, VolumeID TEXT NOT NULL, ContentID TEXT NOT NULL,
+			StartContainerPath TEXT NOT NULL, StartContainerChildIndex INTEGER NOT NULL, StartOffset INTEGER NOT NULL,
+			EndContainerPath TEXT NOT NULL, EndContainerChildIndex INTEGER NOT NULL, EndOffset INTEGER NOT NULL,
+			Text TEXT, Annotation TEXT, Type TEXT, DateCreated TEXT,
+			PRIMARY KEY (BookmarkID)
+		);
+		INSERT INTO Bookmark VALUES
+			('a', '` + volumeID + `', '` + volumeID + `!OEBPS!ch1.xhtml', 'span#kobo\.2\.1', -99, 7, 'span#kobo\.2\.1', -99, 13, 'quoted', NULL, 'highlight', '2020-01-01T00:00:01Z'),
+			('b', '` + volumeID + `', '` + volumeID + `!OEBPS!ch1.xhtml', 'span#kobo\.1\.2', -99, 0, 'span#kobo\.2\.1', -99, 5, 'Two.Three', NULL, 'highlight', '2020-01-01T00:00:02Z'),
+			('c', '` + volumeID + `', '` + volumeID + `!OEBPS!ch1.xhtml', 'span#kobo\.3\.1', -99, 0, 'span#kobo\.3\.2', -99, 5, 'Four. Five.', NULL, 'highlight', '2020-01-01T00:00:03Z'),
+			('d', '` + volumeID + `', '` + volumeID + `!OEBPS!missing.xhtml', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 1, NULL, NULL, 'highlight', '2020-01-01T00:00:04Z'),
+			('e', 'file:///mnt/onboard/other.kepub.epub', 'file:///mnt/onboard/other.kepub.epub!OEBPS!ch1.xhtml', 'span#kobo\.1\.1', -99, 0, 'span#kobo\.1\.1', -99, 1, NULL, NULL, 'highlight', '2020-01-01T00:00:05Z');
+	`); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+
+	if id, err := findVolumeID(db, "test.kepub.epub"); err != nil || id != volumeID {
+		t.Errorf("find volume id: expected %q, got %q (err: %v)", volumeID, id, err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		var res []string
+		if err := remapBookmarks(db, volumeID, oldDocs, newDocs, dryRun, func(i, total int, r remapResult) {
+			if r.Err != nil {
+				res = append(res, fmt.Sprintf("%s: error: %v", r.BookmarkID, r.Err))
+			} else {
+				res = append(res, fmt.Sprintf("%s: %s -> %s %q", r.BookmarkID, r.Old, r.New, r.NewText))
+			}
+		}); err != nil {
+			t.Fatalf("remap (dry run: %t): unexpected error: %v", dryRun, err)
+		}
+		exp := []string{
+			`a: span#kobo\.2\.1:7-span#kobo\.2\.1:13 -> span#kobo\.3\.1:7-span#kobo\.3\.1:13 "quoted"`,
+			`b: span#kobo\.1\.2:0-span#kobo\.2\.1:5 -> span#kobo\.2\.2:0-span#kobo\.3\.1:5 "Two.\nThree"`,
+			`c: span#kobo\.3\.1:0-span#kobo\.3\.2:5 -> span#kobo\.4\.1:0-span#kobo\.4\.1:5 "Five."`,
+			`d: error: could not find content file for "` + volumeID + `!OEBPS!missing.xhtml"`,
+		}
+		if a, b := strings.Join(res, "\n"), strings.Join(exp, "\n"); a != b {
+			t.Errorf("incorrect results (dry run: %t):\n%s\n---\nexpected:\n%s", dryRun, a, b)
+		}
+	}
+
+	var sp, ep string
+	var so, eo int
+	if err := db.QueryRow(`SELECT StartContainerPath, StartOffset, EndContainerPath, EndOffset FROM Bookmark WHERE BookmarkID = 'b'`).Scan(&sp, &so, &ep, &eo); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if sp != `span#kobo\.2\.2` || so != 0 || ep != `span#kobo\.3\.1` || eo != 5 {
+		t.Errorf("database not updated: got %s:%d-%s:%d", sp, so, ep, eo)
+	}
+}
+
+func TestAlignOffset(t *testing.T) {
+	al := alignLines(strings.Split("abcdef", ""), strings.Split("abXdef", ""))
+	for _, c := range []struct {
+		K   int
+		End bool
+		Exp int
+	}{
+		{0, false, 0},
+		{2, false, 3}, // removed char, start moves to the next one
+		{3, true, 2},  // end after a removed char moves to after the previous one
+		{3, false, 3},
+		{6, true, 6},
+	} {
+		if act := alignOffset(al, 6, c.K, c.End); act != c.Exp {
+			t.Errorf("align offset %d (end: %t): expected %d, got %d", c.K, c.End, c.Exp, act)
+		}
+	}
+	if act := alignOffset(alignLines([]string{"a", "b"}, []string{"x", "y", "z"}), 3, 0, false); act != 0 {
+		t.Errorf("align offset in replaced text: expected start 0, got %d", act)
+	}
+	if act := alignOffset(alignLines([]string{"a", "b"}, []string{"x", "y", "z"}), 3, 2, true); act != 3 {
+		t.Errorf("align offset in replaced text: expected end 3, got %d", act)
+	}
+}
+
+func TestSpanDocUTF16(t *testing.T) {
+	d := newSpanDoc(kepub.SpanDocument{Paragraphs: []kepub.SpanParagraph{
+		{Para: 1, Spans: []kepub.Span{{ID: "kobo.1.1", Seg: 1, Text: "😀 Smile ", Offset: 0}, {ID: "kobo.1.2", Seg: 2, Text: "𠮷 kanji.", Offset: 9}}},
+		{Para: 2, Spans: []kepub.Span{{ID: "kobo.2.1", Seg: 1, Text: "End.", Offset: 18}}},
+	}})
+	for _, c := range []struct {
+		Pos bookmarkPosition
+		Exp string
+	}{
+		// offsets are in UTF-16 code units, so the emoji and 𠮷 are two each
+		{bookmarkPosition{`span#kobo\.1\.1`, 3, `span#kobo\.1\.1`, 8}, "Smile"},
+		{bookmarkPosition{`span#kobo\.1\.2`, 0, `span#kobo\.1\.2`, 2}, "𠮷"},
+		{bookmarkPosition{`span#kobo\.1\.2`, 3, `span#kobo\.2\.1`, 3}, "kanji.\nEnd"},
+	} {
+		if _, _, act, err := d.resolve(c.Pos); err != nil {
+			t.Errorf("resolve %s: unexpected error: %v", c.Pos, err)
+		} else if act != c.Exp {
+			t.Errorf("resolve %s: expected %q, got %q", c.Pos, c.Exp, act)
+		}
+	}
+}
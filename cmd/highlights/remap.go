@@ -0,0 +1,587 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/hexops/gotextdiff/myers"
+	"github.com/hexops/gotextdiff/span"
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+	"github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/spf13/pflag"
+)
+
+func remap(args []string) {
+	fs := pflag.NewFlagSet("remap", pflag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Show the changes without updating the database")
+	contentID := fs.String("content-id", "", "The ContentID of the book in the database (by default, it is found using the filename of new_kepub)")
+	bf := kobodb.AddBackupFlags(fs)
+	help := fs.BoolP("help", "h", false, "Show this help message")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+		return
+	}
+
+	if *help || (bf.Restore == "" && (fs.NArg() < 2 || fs.NArg() > 3)) || (bf.Restore != "" && fs.NArg() > 1) {
+		fmt.Fprintf(os.Stderr, "Usage: highlights remap [options] [kobo_path] old_kepub new_kepub\n       highlights remap --restore[=file] [kobo_path]\n\nOptions:\n%s", fs.FlagUsages())
+		fmt.Fprintf(os.Stderr, "\nArguments:\n  kobo_path is the path to the Kobo eReader. If not specified, highlights will try to automatically detect the Kobo.\n")
+		fmt.Fprintf(os.Stderr, "  old_kepub is the KEPUB the highlights were made in, and new_kepub is the KEPUB which replaced it on the device.\n")
+		fmt.Fprintf(os.Stderr, "\nHighlights and bookmarks are mapped to the new spans by aligning the text of each content file.\n")
+		if *help {
+			os.Exit(0)
+		} else {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if bf.Restore != "" {
+		fmt.Println("Opening kobo")
+		kp, err := findKobo(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not find Kobo eReader: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+		k, err := kobodb.Open(kp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open Kobo eReader: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+		ok := bf.RunRestore(k)
+		k.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var kp, oldFn, newFn string
+	if fs.NArg() == 3 {
+		kp, oldFn, newFn = fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	} else {
+		oldFn, newFn = fs.Arg(0), fs.Arg(1)
+	}
+
+	fmt.Println("Reading books")
+	oldDocs, err := exportSpans(oldFn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read old KEPUB: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+	newDocs, err := exportSpans(newFn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read new KEPUB: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	fmt.Println("Opening kobo")
+	kp, err = findKobo(kp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not find Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+	k, err := kobodb.Open(kp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	volumeID := *contentID
+	if volumeID == "" {
+		if volumeID, err = findVolumeID(k.DB, path.Base(strings.ReplaceAll(newFn, `\`, "/"))); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not find book: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+
+	if !*dryRun {
+		if !bf.RunBackup(k) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+
+	fmt.Println("Remapping highlights")
+	var nt, nu, nc, ne int
+	if err := remapBookmarks(k.DB, volumeID, oldDocs, newDocs, *dryRun, func(i, total int, r remapResult) {
+		nt = total
+		switch {
+		case r.Err != nil:
+			fmt.Printf("[%3d/%3d] %s\n--------- Error: %v\n", i+1, total, r.BookmarkID, r.Err)
+			ne++
+		case r.Old == r.New:
+			fmt.Printf("[%3d/%3d] %s: unchanged\n", i+1, total, r.BookmarkID)
+		default:
+			fmt.Printf("[%3d/%3d] %s: %s -> %s\n", i+1, total, r.BookmarkID, r.Old, r.New)
+			if r.OldText != "" && !r.TextMatches() {
+				fmt.Printf("--------- Text changed: %q -> %q\n", r.OldText, r.NewText)
+				nc++
+			}
+			nu++
+		}
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not remap highlights: %v.\n", err)
+		k.Close()
+		os.Exit(1)
+		return
+	}
+
+	if *dryRun {
+		fmt.Printf("%d total: %d would be updated (%d with changed text), %d errored\n", nt, nu, nc, ne)
+	} else {
+		fmt.Printf("%d total: %d updated (%d with changed text), %d errored\n", nt, nu, nc, ne)
+		if !bf.RunCheck(k) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+	if ne > 0 {
+		k.Close()
+		os.Exit(1)
+		return
+	}
+	k.Close()
+}
+
+// findVolumeID finds the VolumeID of the bookmarks for the book with the
+// specified filename.
+func findVolumeID(db *sql.DB, name string) (string, error) {
+	rows, err := db.Query("SELECT DISTINCT VolumeID FROM Bookmark")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(id, "/"+name) {
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no bookmarks for %q", name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("multiple books named %q (%s), use --content-id to choose one", name, strings.Join(ids, ", "))
+	}
+}
+
+// bookmarkPosition is the range of a bookmark.
+type bookmarkPosition struct {
+	StartPath   string
+	StartOffset int
+	EndPath     string
+	EndOffset   int
+}
+
+func (p bookmarkPosition) String() string {
+	return fmt.Sprintf("%s:%d-%s:%d", p.StartPath, p.StartOffset, p.EndPath, p.EndOffset)
+}
+
+// remapResult is the result of remapping a bookmark.
+type remapResult struct {
+	BookmarkID string
+	Old, New   bookmarkPosition
+	OldText    string // the text stored with the bookmark
+	NewText    string // the text at the new position
+	Err        error
+}
+
+// TextMatches checks if the text at the new position is the same as the text
+// stored with the bookmark, ignoring whitespace.
+func (r remapResult) TextMatches() bool {
+	return strings.Join(strings.Fields(r.OldText), " ") == strings.Join(strings.Fields(r.NewText), " ")
+}
+
+// remapBookmarks remaps the bookmarks for the book volumeID from oldDocs to
+// newDocs. If dryRun is false, the database is updated in a transaction.
+func remapBookmarks(db *sql.DB, volumeID string, oldDocs, newDocs []kepub.SpanDocument, dryRun bool, log func(i, total int, r remapResult)) error {
+	rows, err := db.Query("SELECT BookmarkID, ContentID, StartContainerPath, StartOffset, EndContainerPath, EndOffset, Text FROM Bookmark WHERE VolumeID = ? AND StartContainerPath IS NOT NULL AND StartContainerPath != '' ORDER BY DateCreated", volumeID)
+	if err != nil {
+		return fmt.Errorf("could not read bookmarks: %w", err)
+	}
+
+	type bookmark struct {
+		ID, ContentID string
+		Pos           bookmarkPosition
+		Text          sql.NullString
+	}
+	var bookmarks []bookmark
+	for rows.Next() {
+		var b bookmark
+		if err := rows.Scan(&b.ID, &b.ContentID, &b.Pos.StartPath, &b.Pos.StartOffset, &b.Pos.EndPath, &b.Pos.EndOffset, &b.Text); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not read bookmarks: %w", err)
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read bookmarks: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	m := newSpanMap(oldDocs, newDocs)
+	for i, b := range bookmarks {
+		r := remapResult{
+			BookmarkID: b.ID,
+			Old:        b.Pos,
+			OldText:    b.Text.String,
+		}
+		if fn, ok := bookmarkFile(oldDocs, volumeID, b.ContentID); !ok {
+			r.Err = fmt.Errorf("could not find content file for %q", b.ContentID)
+		} else {
+			r.New, r.NewText, r.Err = m.Map(fn, b.Pos)
+		}
+		if r.Err == nil && r.New != r.Old && !dryRun {
+			if _, err := tx.Exec(
+				"UPDATE Bookmark SET StartContainerPath = ?, StartOffset = ?, EndContainerPath = ?, EndOffset = ? WHERE BookmarkID = ?",
+				r.New.StartPath, r.New.StartOffset, r.New.EndPath, r.New.EndOffset, b.ID,
+			); err != nil {
+				r.Err = err
+			}
+		}
+		log(i, len(bookmarks), r)
+	}
+
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("could not commit db transaction: %w", err)
+		}
+	}
+	return nil
+}
+
+// spanDoc is a content document with the spans flattened.
+type spanDoc struct {
+	Spans []kepub.Span
+	Text  [][]uint16 // the text of each span in UTF-16 code units (like the offsets in Kobo bookmarks)
+	Para  []int      // the paragraph of each span
+	Index map[string]int
+}
+
+func newSpanDoc(doc kepub.SpanDocument) *spanDoc {
+	d := &spanDoc{Index: map[string]int{}}
+	for _, p := range doc.Paragraphs {
+		for _, s := range p.Spans {
+			if _, ok := d.Index[s.ID]; !ok {
+				d.Index[s.ID] = len(d.Spans)
+			}
+			d.Spans = append(d.Spans, s)
+			d.Text = append(d.Text, utf16.Encode([]rune(s.Text)))
+			d.Para = append(d.Para, p.Para)
+		}
+	}
+	return d
+}
+
+// position converts an offset from the start of the document to a span index
+// and offset. If end is true, offsets between spans are at the end of the
+// previous one rather than the start of the next one.
+func (d *spanDoc) position(q int, end bool) (int, int) {
+	for j := range d.Spans {
+		if l := len(d.Text[j]); q < l || (end && q == l) || j == len(d.Spans)-1 {
+			if q > l {
+				q = l
+			}
+			return j, q
+		}
+		q -= len(d.Text[j])
+	}
+	return -1, 0
+}
+
+// text gets the text between two offsets from the start of the document,
+// with paragraphs separated by newlines.
+func (d *spanDoc) text(start, end int) string {
+	var b []uint16
+	var o int
+	for i, t := range d.Text {
+		for _, u := range t {
+			if o >= start && o < end {
+				if len(b) != 0 && i != 0 && d.Para[i] != d.Para[i-1] && o == d.Spans[i].Offset {
+					b = append(b, '\n')
+				}
+				b = append(b, u)
+			}
+			o++
+		}
+	}
+	return string(utf16.Decode(b))
+}
+
+// offset converts a container path and offset to an offset from the start of
+// the document.
+func (d *spanDoc) offset(cp string, off int) (int, error) {
+	id, ok := parseContainerPath(cp)
+	if !ok {
+		return 0, fmt.Errorf("unsupported container path %q", cp)
+	}
+	i, ok := d.Index[id]
+	if !ok {
+		return 0, fmt.Errorf("span %q not found", id)
+	}
+	if off < 0 {
+		off = 0
+	} else if l := len(d.Text[i]); off > l {
+		off = l
+	}
+	return d.Spans[i].Offset + off, nil
+}
+
+// resolve gets the offsets and text for a bookmark.
+func (d *spanDoc) resolve(p bookmarkPosition) (int, int, string, error) {
+	start, err := d.offset(p.StartPath, p.StartOffset)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("resolve start: %w", err)
+	}
+	end, err := d.offset(p.EndPath, p.EndOffset)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("resolve end: %w", err)
+	}
+	if end < start {
+		end = start
+	}
+	return start, end, d.text(start, end), nil
+}
+
+// spanMap maps positions in the spans of one version of a KEPUB to another by
+// aligning the text of the content documents with the same path. The spans
+// are aligned first, then the text of the spans which changed is aligned by
+// character.
+type spanMap struct {
+	old, new map[string]*spanDoc
+	align    map[string][]int
+}
+
+func newSpanMap(oldDocs, newDocs []kepub.SpanDocument) *spanMap {
+	m := &spanMap{
+		old:   map[string]*spanDoc{},
+		new:   map[string]*spanDoc{},
+		align: map[string][]int{},
+	}
+	for _, doc := range oldDocs {
+		m.old[doc.File] = newSpanDoc(doc)
+	}
+	for _, doc := range newDocs {
+		m.new[doc.File] = newSpanDoc(doc)
+	}
+	return m
+}
+
+// Map maps a position in the content document fn, and returns the text at
+// the new position.
+func (m *spanMap) Map(fn string, p bookmarkPosition) (bookmarkPosition, string, error) {
+	od, nd := m.old[fn], m.new[fn]
+	if od == nil {
+		return p, "", fmt.Errorf("content file %q not in old KEPUB", fn)
+	}
+	if nd == nil {
+		return p, "", fmt.Errorf("content file %q not in new KEPUB", fn)
+	}
+	if len(nd.Spans) == 0 {
+		return p, "", fmt.Errorf("content file %q doesn't have any spans in new KEPUB", fn)
+	}
+
+	al, ok := m.align[fn]
+	if !ok {
+		ot, nt := make([]string, len(od.Text)), make([]string, len(nd.Text))
+		for i, t := range od.Text {
+			ot[i] = string(utf16.Decode(t))
+		}
+		for i, t := range nd.Text {
+			nt[i] = string(utf16.Decode(t))
+		}
+		al = alignLines(ot, nt)
+		m.align[fn] = al
+	}
+
+	var n bookmarkPosition
+	var start, end int
+	var err error
+	if n.StartPath, n.StartOffset, start, err = m.mapPoint(od, nd, al, p.StartPath, p.StartOffset, false); err != nil {
+		return p, "", fmt.Errorf("map start: %w", err)
+	}
+	if n.EndPath, n.EndOffset, end, err = m.mapPoint(od, nd, al, p.EndPath, p.EndOffset, true); err != nil {
+		return p, "", fmt.Errorf("map end: %w", err)
+	}
+	if end < start {
+		// the text was removed
+		j, o := nd.position(start, true)
+		n.EndPath, n.EndOffset, end = formatContainerPath(p.EndPath, nd.Spans[j].ID), o, start
+	}
+	return n, nd.text(start, end), nil
+}
+
+// mapPoint maps a container path and offset, returning the new container path
+// and offset, and the offset from the start of the new document.
+func (m *spanMap) mapPoint(od, nd *spanDoc, al []int, cp string, off int, end bool) (string, int, int, error) {
+	id, ok := parseContainerPath(cp)
+	if !ok {
+		return "", 0, 0, fmt.Errorf("unsupported container path %q", cp)
+	}
+	i, ok := od.Index[id]
+	if !ok {
+		return "", 0, 0, fmt.Errorf("span %q not in old KEPUB", id)
+	}
+	if off < 0 {
+		off = 0
+	} else if l := len(od.Text[i]); off > l {
+		off = l
+	}
+
+	var q int // offset from the start of the new document
+	if j := al[i]; j != -1 {
+		q = nd.Spans[j].Offset + off
+	} else {
+		// the block of changed spans around it
+		a, b := i, i+1
+		for a > 0 && al[a-1] == -1 {
+			a--
+		}
+		for b < len(al) && al[b] == -1 {
+			b++
+		}
+		c, d := 0, len(nd.Spans)
+		if a > 0 {
+			c = al[a-1] + 1
+		}
+		if b < len(al) {
+			d = al[b]
+		}
+
+		var ob, nb []string
+		var k int
+		for x := a; x < b; x++ {
+			if x == i {
+				k = len(ob) + off
+			}
+			for _, u := range od.Text[x] {
+				ob = append(ob, string([]byte{byte(u >> 8), byte(u)})) // code units, not runes, since offsets are in code units
+			}
+		}
+		for x := c; x < d; x++ {
+			for _, u := range nd.Text[x] {
+				nb = append(nb, string([]byte{byte(u >> 8), byte(u)}))
+			}
+		}
+
+		// the offset of the block in the new document
+		var base int
+		if c < len(nd.Spans) {
+			base = nd.Spans[c].Offset
+		} else {
+			base = nd.Spans[len(nd.Spans)-1].Offset + len(nd.Text[len(nd.Spans)-1])
+		}
+		q = base + alignOffset(alignLines(ob, nb), len(nb), k, end)
+	}
+
+	j, o := nd.position(q, end)
+	return formatContainerPath(cp, nd.Spans[j].ID), o, q, nil
+}
+
+// alignOffset maps an offset k (between characters) using the alignment al
+// of the characters to a sequence of n characters. Start offsets in changed
+// text are moved to the next unchanged character, and end offsets are moved
+// to the one after the previous unchanged character. If there aren't any, the
+// other direction is used, then the start or end of the sequence.
+func alignOffset(al []int, n, k int, end bool) int {
+	next := func() (int, bool) {
+		for x := k; x < len(al); x++ {
+			if al[x] != -1 {
+				return al[x], true
+			}
+		}
+		return 0, false
+	}
+	prev := func() (int, bool) {
+		for x := k - 1; x >= 0; x-- {
+			if al[x] != -1 {
+				return al[x] + 1, true
+			}
+		}
+		return 0, false
+	}
+	if end {
+		if o, ok := prev(); ok {
+			return o
+		}
+		if o, ok := next(); ok {
+			return o
+		}
+		return n
+	}
+	if o, ok := next(); ok {
+		return o
+	}
+	if o, ok := prev(); ok {
+		return o
+	}
+	return 0
+}
+
+// alignLines aligns a to b using a diff, returning the index in b of each
+// unchanged line in a, or -1 if it was changed.
+func alignLines(a, b []string) []int {
+	esc := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	join := func(x []string) string {
+		var s strings.Builder
+		for _, v := range x {
+			s.WriteString(esc.Replace(v))
+			s.WriteByte('\n')
+		}
+		return s.String()
+	}
+
+	al := make([]int, len(a))
+	for i := range al {
+		al[i] = -1
+	}
+
+	var i, j int
+	for _, e := range myers.ComputeEdits(span.URI(""), join(a), join(b)) {
+		for s := e.Span.Start().Line() - 1; i < s; i, j = i+1, j+1 {
+			al[i] = j
+		}
+		if e.NewText == "" {
+			i = e.Span.End().Line() - 1
+		} else {
+			j += strings.Count(e.NewText, "\n")
+		}
+	}
+	for ; i < len(a); i, j = i+1, j+1 {
+		al[i] = j
+	}
+	return al
+}
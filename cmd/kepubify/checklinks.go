@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+	"github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/spf13/pflag"
+)
+
+// checkLinks implements the check-links command, which shows the broken
+// internal links in EPUBs without converting them.
+func checkLinks(args []string) {
+	fs := pflag.NewFlagSet("check-links", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "Show this help text")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(2)
+		return
+	}
+
+	if *help || fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: kepubify check-links epub_path [epub_path]...\n")
+		fmt.Fprintf(os.Stderr, "\nShows the broken internal links in EPUBs, and how they would be fixed by --fix-links.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n%s", fs.FlagUsagesWrapped(160))
+		exit(0)
+		return
+	}
+
+	var broken, errored int
+	for _, fn := range fs.Args() {
+		reports, err := func() ([]kepub.Report, error) {
+			zr, err := zip.OpenReader(fn)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return kepub.CheckLinks(zr)
+		}()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n  Error: %v\n", fn, err)
+			errored++
+			continue
+		}
+		if len(reports) == 0 {
+			fmt.Printf("%s\n  No broken links\n", fn)
+			continue
+		}
+		fmt.Printf("%s\n", fn)
+		for _, r := range reports {
+			fmt.Printf("  %s: %s (%s)\n", r.File, r.Value, r.Message)
+		}
+		broken += len(reports)
+	}
+
+	fmt.Printf("\n%d broken links in %d EPUBs (%d errored)\n", broken, fs.NArg(), errored)
+	if broken != 0 || errored != 0 {
+		exit(1)
+		return
+	}
+	exit(0)
+}
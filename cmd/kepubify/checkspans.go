@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+	"github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/spf13/pflag"
+)
+
+// checkSpans implements the check-spans command, which shows the problems with
+// the existing Kobo spans in KEPUBs.
+func checkSpans(args []string) {
+	fs := pflag.NewFlagSet("check-spans", pflag.ContinueOnError)
+	help := fs.BoolP("help", "h", false, "Show this help text")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(2)
+		return
+	}
+
+	if *help || fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: kepubify check-spans kepub_path [kepub_path]...\n")
+		fmt.Fprintf(os.Stderr, "\nShows the content files in KEPUBs with missing, duplicate, or non-sequential Kobo spans, which can be fixed by converting them with --respan.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n%s", fs.FlagUsagesWrapped(160))
+		exit(0)
+		return
+	}
+
+	var problems, errored int
+	for _, fn := range fs.Args() {
+		reports, err := func() ([]kepub.Report, error) {
+			zr, err := zip.OpenReader(fn)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return kepub.CheckSpans(zr)
+		}()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n  Error: %v\n", fn, err)
+			errored++
+			continue
+		}
+		if len(reports) == 0 {
+			fmt.Printf("%s\n  No problems\n", fn)
+			continue
+		}
+		fmt.Printf("%s\n", fn)
+		for _, r := range reports {
+			fmt.Printf("  %s: %s (%s)\n", r.File, r.Value, r.Message)
+		}
+		problems += len(reports)
+	}
+
+	fmt.Printf("\n%d span problems in %d KEPUBs (%d errored)\n", problems, fs.NArg(), errored)
+	if problems != 0 || errored != 0 {
+		exit(1)
+		return
+	}
+	exit(0)
+}
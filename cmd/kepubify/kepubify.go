@@ -4,11 +4,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,11 +20,26 @@ import (
 	"github.com/pgaskin/kepubify/v4/internal/zip"
 	"github.com/pgaskin/kepubify/v4/kepub"
 	"github.com/spf13/pflag"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
 )
 
 var version = "v4-dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-links" {
+		checkLinks(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-spans" {
+		checkSpans(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "spans" {
+		spans(os.Args[2:])
+		return
+	}
+
 	pflag.CommandLine.SortFlags = false
 
 	verbose := pflag.BoolP("verbose", "v", false, "Show extra information in output")
@@ -44,16 +62,35 @@ func main() {
 	}
 
 	smartenpunct := pflag.Bool("smarten-punctuation", false, "Smarten punctuation (smart quotes, dashes, etc) (excluding pre and code tags)")
+	smartenpunctlocale := pflag.String("smarten-punctuation-locale", "", "Use the quotation marks and spacing for a language when smartening punctuation (e.g. de, fr, sv) (use \"auto\" to detect it from the content) (implies --smarten-punctuation)")
+	smartenpunctdashes := pflag.String("smarten-punctuation-dashes", "", "How to convert dashes when smartening punctuation (latex: -- is an en dash, --- is an em dash; oldschool: -- is an em dash, - is an en dash; none) (implies --smarten-punctuation) (default latex)")
+	smartenpunctellipsis := pflag.String("smarten-punctuation-ellipsis", "", "How to convert ellipses when smartening punctuation (char, none) (implies --smarten-punctuation) (default char)")
 	css := pflag.StringArrayP("css", "c", nil, "Custom CSS to add to ebook")
 	hyphenate := pflag.Bool("hyphenate", false, "Force enable hyphenation")
 	nohyphenate := pflag.Bool("no-hyphenate", false, "Force disable hyphenation")
 	fullscreenfixes := pflag.Bool("fullscreen-reading-fixes", false, "Enable fullscreen reading bugfixes based on https://www.mobileread.com/forums/showpost.php?p=3113460&postcount=16")
 	adddummytitlepage := pflag.Bool("add-dummy-titlepage", false, "Force-enables the dummy titlepage to fix layout issues with the first content file on certain books (this is enabled when needed using a heuristic if not specified)")
 	noadddummytitlepage := pflag.Bool("no-add-dummy-titlepage", false, "Force-disables the dummy titlepage")
+	dummytitlepageheuristic := pflag.String("dummy-titlepage-heuristic", "", "Change the thresholds for the dummy titlepage heuristic (format: comma-separated key=value pairs for name-hints (separated by |), max-paragraphs, min-word-length, max-words, min-words, and max-images) (e.g. \"max-words=40,name-hints=cover|title|front\") (use -v to show why it was added)")
+	dummytitlepagetemplate := pflag.String("dummy-titlepage-template", "", "Use a Go html/template file for the contents of the dummy titlepage (the fields are documented in kepub.PageData, e.g. {{.Title}}, {{.Authors}}, {{.Series}}, {{.Cover}})")
+	addpage := pflag.StringArray("add-page", nil, "Add a page generated from a Go html/template file (see --dummy-titlepage-template) to the book (repeat any number of times) (format: position:path, where position is start, end, or the index of the spine item to insert it before, negative to count from the end)")
 	replace := pflag.StringArrayP("replace", "r", nil, "Find and replace on all html files (repeat any number of times) (format: find|replace)")
-	charset := pflag.String("charset", "utf-8", "Override the HTML charset (use \"auto\" to detect it from the content)")
-
-	for _, flag := range []string{"smarten-punctuation", "css", "hyphenate", "no-hyphenate", "fullscreen-reading-fixes", "add-dummy-titlepage", "no-add-dummy-titlepage", "replace", "charset"} {
+	repair := pflag.Bool("repair", false, "Repair malformed EPUBs (missing or invalid container, missing or undeclared files, incorrect media types, empty spine) (use -v to show the repairs made)")
+	checklinks := pflag.Bool("check-links", false, "Check for broken internal links (use -v to show them) (see the check-links command to check without converting)")
+	fixlinks := pflag.Bool("fix-links", false, "Fix broken internal links (wrong case, renamed files, and missing fragments) and remove dead links (implies --check-links)")
+	splitcontent := pflag.Int64("split-content", 0, "Split content files larger than the specified size in KB into smaller ones at chapter headings or block boundaries (this improves performance on Kobo eReaders for books with huge content files) (e.g. 256)")
+	excludefile := pflag.StringArray("exclude-file", nil, "Remove files matching a glob pattern from the EPUB and the manifest (repeat any number of times) (patterns without a slash match the file name anywhere, others match the full path) (e.g. \"*.ttf\")")
+	nospansfor := pflag.StringArray("no-spans-for", nil, "Don't add Kobo spans to content files matching a selector (repeat any number of times) (selectors: a glob for the path like --exclude-file, id:glob, properties:glob, linear:yes, or linear:no) (e.g. \"index*.xhtml\", \"properties:nav\")")
+	nodivsfor := pflag.StringArray("no-divs-for", nil, "Don't add the Kobo book-columns and book-inner divs to content files matching a selector (see --no-spans-for)")
+	nostylesfor := pflag.StringArray("no-styles-for", nil, "Don't add the Kobo style hacks to content files matching a selector (see --no-spans-for)")
+	respan := pflag.Bool("respan", false, "Remove and regenerate existing Kobo spans instead of leaving content files which already have them as-is (this fixes partially spanned books or ones spanned by buggy tools, but may break existing annotations) (see the check-spans command to find problems with existing spans)")
+	removeunreferenced := pflag.Bool("remove-unreferenced", false, "Remove files which aren't reachable from the spine, navigation, cover, or any content or stylesheet referenced by them (use -v to show the removed files)")
+	upgradeepub3 := pflag.Bool("upgrade-epub3", false, "Upgrade EPUB2 books to EPUB3 (generates a nav document from the NCX, converts series, cover, and contributor metadata) since Kobo handles EPUB3 metadata better")
+	convertimages := pflag.Bool("convert-images", false, "Convert images which Kobo eReaders can't display or have trouble with (WebP, CMYK and progressive JPEGs, and huge GIFs) to baseline JPEG or PNG (use -v to show the converted images)")
+	generatecover := pflag.String("generate-cover", "", "Generate a plain cover image with the title and authors if the book doesn't have one, using the specified TrueType or OpenType font file (which should support the scripts used by the titles) (use -v to show how the cover was found)")
+	charset := pflag.String("charset", "utf-8", "Override the HTML charset (use \"auto\" to detect it from the content, or \"detect\" or a comma-separated list of fallback charsets like \"utf-8,windows-1251,koi8-r\" to detect it for each file individually and show the charsets used)")
+
+	for _, flag := range []string{"smarten-punctuation", "smarten-punctuation-locale", "smarten-punctuation-dashes", "smarten-punctuation-ellipsis", "css", "hyphenate", "no-hyphenate", "fullscreen-reading-fixes", "add-dummy-titlepage", "no-add-dummy-titlepage", "dummy-titlepage-heuristic", "dummy-titlepage-template", "add-page", "replace", "repair", "check-links", "fix-links", "split-content", "exclude-file", "no-spans-for", "no-divs-for", "no-styles-for", "respan", "remove-unreferenced", "upgrade-epub3", "convert-images", "generate-cover", "charset"} {
 		pflag.CommandLine.SetAnnotation(flag, "category", []string{"3.Conversion Options"})
 	}
 
@@ -100,6 +137,33 @@ func main() {
 	if *smartenpunct {
 		opts = append(opts, kepub.ConverterOptionSmartypants())
 	}
+	if *smartenpunctlocale != "" {
+		opts = append(opts, kepub.ConverterOptionSmartypantsLocale(*smartenpunctlocale))
+	}
+	switch *smartenpunctdashes {
+	case "":
+	case "latex":
+		opts = append(opts, kepub.ConverterOptionSmartypantsDashes(kepub.SmartypantsDashesLatex))
+	case "oldschool":
+		opts = append(opts, kepub.ConverterOptionSmartypantsDashes(kepub.SmartypantsDashesOldschool))
+	case "none":
+		opts = append(opts, kepub.ConverterOptionSmartypantsDashes(kepub.SmartypantsDashesNone))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid --smarten-punctuation-dashes value %#v. See --help for more details.\n", *smartenpunctdashes)
+		exit(2)
+		return
+	}
+	switch *smartenpunctellipsis {
+	case "":
+	case "char":
+		opts = append(opts, kepub.ConverterOptionSmartypantsEllipsis(kepub.SmartypantsEllipsisChar))
+	case "none":
+		opts = append(opts, kepub.ConverterOptionSmartypantsEllipsis(kepub.SmartypantsEllipsisNone))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Invalid --smarten-punctuation-ellipsis value %#v. See --help for more details.\n", *smartenpunctellipsis)
+		exit(2)
+		return
+	}
 	if *fullscreenfixes {
 		opts = append(opts, kepub.ConverterOptionFullScreenFixes())
 	}
@@ -108,6 +172,54 @@ func main() {
 	} else if *noadddummytitlepage {
 		opts = append(opts, kepub.ConverterOptionDummyTitlepage(false))
 	}
+	if *dummytitlepageheuristic != "" {
+		h, err := parseTitlepageHeuristic(*dummytitlepageheuristic)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --dummy-titlepage-heuristic %#v: %v. See --help for more details.\n", *dummytitlepageheuristic, err)
+			exit(2)
+			return
+		}
+		opts = append(opts, kepub.ConverterOptionDummyTitlepageHeuristic(h))
+	}
+	if *dummytitlepagetemplate != "" {
+		t, err := template.ParseFiles(*dummytitlepagetemplate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Parse --dummy-titlepage-template %#v: %v\n", *dummytitlepagetemplate, err)
+			exit(1)
+			return
+		}
+		opts = append(opts, kepub.ConverterOptionDummyTitlepageTemplate(t))
+	}
+	for _, p := range *addpage {
+		spl := strings.SplitN(p, ":", 2)
+		if len(spl) != 2 {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --add-page value %#v: must be in format `position:path`. See --help for more details.\n", p)
+			exit(2)
+			return
+		}
+		var pos int
+		switch spl[0] {
+		case "start":
+			pos = 0
+		case "end":
+			pos = -1
+		default:
+			n, err := strconv.Atoi(spl[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --add-page position %#v. See --help for more details.\n", spl[0])
+				exit(2)
+				return
+			}
+			pos = n
+		}
+		t, err := template.ParseFiles(spl[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Parse --add-page template %#v: %v\n", spl[1], err)
+			exit(1)
+			return
+		}
+		opts = append(opts, kepub.ConverterOptionAddPage(t, pos))
+	}
 	for _, r := range *replace {
 		spl := strings.SplitN(r, "|", 2)
 		if len(spl) != 2 {
@@ -117,7 +229,79 @@ func main() {
 		}
 		opts = append(opts, kepub.ConverterOptionFindReplace(spl[0], spl[1]))
 	}
-	opts = append(opts, kepub.ConverterOptionCharset(*charset))
+	if *repair {
+		opts = append(opts, kepub.ConverterOptionRepair())
+	}
+	if *fixlinks {
+		opts = append(opts, kepub.ConverterOptionLinks(true))
+	} else if *checklinks {
+		opts = append(opts, kepub.ConverterOptionLinks(false))
+	}
+	if *splitcontent < 0 {
+		fmt.Fprintf(os.Stderr, "Error: Invalid --split-content size %d. See --help for more details.\n", *splitcontent)
+		exit(2)
+		return
+	} else if *splitcontent != 0 {
+		opts = append(opts, kepub.ConverterOptionSplitContent(*splitcontent*1024))
+	}
+	for _, p := range *excludefile {
+		if _, err := path.Match(p, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --exclude-file pattern %#v: %v. See --help for more details.\n", p, err)
+			exit(2)
+			return
+		}
+	}
+	if len(*excludefile) != 0 {
+		opts = append(opts, kepub.ConverterOptionExcludeFiles(*excludefile...))
+	}
+	for _, x := range []struct {
+		Flag      string
+		Selectors []string
+		Option    func(...string) kepub.ConverterOption
+	}{
+		{"--no-spans-for", *nospansfor, kepub.ConverterOptionNoSpansFor},
+		{"--no-divs-for", *nodivsfor, kepub.ConverterOptionNoDivsFor},
+		{"--no-styles-for", *nostylesfor, kepub.ConverterOptionNoStylesFor},
+	} {
+		for _, sel := range x.Selectors {
+			if err := checkContentSelector(sel); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Invalid %s selector %#v: %v. See --help for more details.\n", x.Flag, sel, err)
+				exit(2)
+				return
+			}
+		}
+		if len(x.Selectors) != 0 {
+			opts = append(opts, x.Option(x.Selectors...))
+		}
+	}
+	if *respan {
+		opts = append(opts, kepub.ConverterOptionRespan())
+	}
+	if *removeunreferenced {
+		opts = append(opts, kepub.ConverterOptionRemoveUnreferenced())
+	}
+	if *upgradeepub3 {
+		opts = append(opts, kepub.ConverterOptionUpgradeEPUB3())
+	}
+	if *convertimages {
+		opts = append(opts, kepub.ConverterOptionConvertImages())
+	}
+	if *generatecover != "" {
+		title, authors, err := loadCoverFont(*generatecover)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Load --generate-cover font %#v: %v\n", *generatecover, err)
+			exit(1)
+			return
+		}
+		opts = append(opts, kepub.ConverterOptionGenerateCover(title, authors))
+	}
+	if *charset == "detect" {
+		opts = append(opts, kepub.ConverterOptionCharsetDetect())
+	} else if strings.Contains(*charset, ",") {
+		opts = append(opts, kepub.ConverterOptionCharsetDetect(strings.Split(*charset, ",")...))
+	} else {
+		opts = append(opts, kepub.ConverterOptionCharset(*charset))
+	}
 	converter := kepub.NewConverterWithOptions(opts...)
 
 	// --- Transform paths --- //
@@ -265,6 +449,7 @@ func main() {
 							log(true, "          Error (%d): %v\n", i, err)
 							continue
 						}
+						var reports []kepub.Report
 						if err := func() error {
 							fi, err := zip.OpenReader(input)
 							if err != nil {
@@ -278,7 +463,11 @@ func main() {
 							}
 							defer os.Remove(fo.Name())
 
-							if err := converter.Convert(context.Background(), fo, fi); err != nil {
+							ctx := kepub.WithReport(context.Background(), func(r kepub.Report) {
+								reports = append(reports, r)
+							})
+
+							if err := converter.Convert(ctx, fo, fi); err != nil {
 								return err
 							}
 
@@ -296,11 +485,13 @@ func main() {
 
 							return nil
 						}(); err != nil {
+							logReports(log, reports, *verbose)
 							errs.Store(input, err)
 							atomic.AddInt64(&errored, 1)
 							log(true, "          Error (%d): %v\n", i, err)
 							continue
 						}
+						logReports(log, reports, *verbose)
 						atomic.AddInt64(&converted, 1)
 					}
 				}
@@ -328,8 +519,175 @@ func main() {
 	exit(0)
 }
 
+// logReports shows the reports from a conversion. If verbose is false, only a
+// summary is shown.
+func logReports(log func(stderr bool, format string, a ...interface{}), reports []kepub.Report, verbose bool) {
+	if verbose {
+		sort.SliceStable(reports, func(i, j int) bool {
+			return reports[i].File < reports[j].File
+		})
+		for _, r := range reports {
+			log(false, "          Note: %s\n", r)
+		}
+		return
+	}
+
+	// show the charsets if there's more than one, since that's a sign the
+	// book might have mojibake
+	charsets := map[string]int{}
+	for _, r := range reports {
+		if r.Kind == kepub.ReportCharset {
+			charsets[r.Value]++
+		}
+	}
+	if len(charsets) > 1 {
+		var names []string
+		for name := range charsets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = fmt.Sprintf("%s (%d)", name, charsets[name])
+		}
+		log(false, "          Charsets: %s\n", strings.Join(names, ", "))
+	}
+
+	var links, repairs, removed, images int
+	var generated bool
+	var titlepage, coverErr string
+	for _, r := range reports {
+		switch r.Kind {
+		case kepub.ReportLink:
+			links++
+		case kepub.ReportRepair:
+			repairs++
+		case kepub.ReportUnreferenced:
+			removed++
+		case kepub.ReportImage:
+			images++
+		case kepub.ReportCover:
+			generated = generated || r.Message == "generated"
+			if r.Value == "error" {
+				coverErr = r.Message
+			}
+		case kepub.ReportTitlepage:
+			if r.Value == "added" {
+				titlepage = r.Message
+			}
+		}
+	}
+	if repairs != 0 {
+		log(false, "          Repairs: %d\n", repairs)
+	}
+	if removed != 0 {
+		log(false, "          Removed: %d\n", removed)
+	}
+	if images != 0 {
+		log(false, "          Converted images: %d\n", images)
+	}
+	if generated {
+		log(false, "          Generated cover\n")
+	}
+	if coverErr != "" {
+		log(false, "          Warning: Could not find the cover: %s\n", coverErr)
+	}
+	if titlepage != "" {
+		log(false, "          Added titlepage because %s\n", titlepage)
+	}
+	if links != 0 {
+		log(false, "          Broken links: %d\n", links)
+	}
+}
+
+// checkContentSelector checks if a content selector for --no-spans-for and
+// similar flags is valid.
+func checkContentSelector(sel string) error {
+	switch {
+	case sel == "linear:yes" || sel == "linear:no":
+		return nil
+	case strings.HasPrefix(sel, "linear:"):
+		return fmt.Errorf("linearity must be yes or no")
+	}
+	for _, prefix := range []string{"id:", "properties:", "path:"} {
+		if strings.HasPrefix(sel, prefix) {
+			sel = strings.TrimPrefix(sel, prefix)
+			break
+		}
+	}
+	if _, err := path.Match(sel, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseTitlepageHeuristic parses the --dummy-titlepage-heuristic flag,
+// starting with the default heuristic.
+func parseTitlepageHeuristic(s string) (kepub.TitlepageHeuristic, error) {
+	h := kepub.DefaultTitlepageHeuristic()
+	for _, kv := range strings.Split(s, ",") {
+		spl := strings.SplitN(kv, "=", 2)
+		if len(spl) != 2 {
+			return h, fmt.Errorf("%#v must be in format key=value", kv)
+		}
+		if spl[0] == "name-hints" {
+			h.NameHints = []string{} // not nil, since that means the default
+			for _, v := range strings.Split(spl[1], "|") {
+				if v != "" {
+					h.NameHints = append(h.NameHints, v)
+				}
+			}
+			continue
+		}
+		n, err := strconv.Atoi(spl[1])
+		if err != nil || n < 0 {
+			return h, fmt.Errorf("%s must be a non-negative integer", spl[0])
+		}
+		if n == 0 {
+			n = -1 // zero means the default
+		}
+		switch spl[0] {
+		case "max-paragraphs":
+			h.MaxParagraphs = n
+		case "min-word-length":
+			h.MinWordLength = n
+		case "max-words":
+			h.MaxWords = n
+		case "min-words":
+			h.MinWords = n
+		case "max-images":
+			h.MaxImages = n
+		default:
+			return h, fmt.Errorf("unknown key %#v", spl[0])
+		}
+	}
+	return h, nil
+}
+
+// loadCoverFont loads the title and author font faces for --generate-cover
+// from a TrueType or OpenType font file.
+func loadCoverFont(fn string) (title, authors font.Face, err error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := opentype.Parse(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if title, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 84, DPI: 72, Hinting: font.HintingFull}); err != nil {
+		return nil, nil, err
+	}
+	if authors, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 52, DPI: 72, Hinting: font.HintingFull}); err != nil {
+		return nil, nil, err
+	}
+	return title, authors, nil
+}
+
 func helpExit() {
 	fmt.Fprintf(os.Stderr, "Usage: kepubify [options] input_path [input_path]...\n")
+	fmt.Fprintf(os.Stderr, "       kepubify check-links epub_path [epub_path]...\n")
+	fmt.Fprintf(os.Stderr, "       kepubify check-spans kepub_path [kepub_path]...\n")
+	fmt.Fprintf(os.Stderr, "       kepubify spans [--json] kepub_path\n")
 	fmt.Fprintf(os.Stderr, "\nVersion:\n  kepubify %s\n", version)
 
 	categories := map[string]*pflag.FlagSet{}
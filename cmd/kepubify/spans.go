@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+	"github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/spf13/pflag"
+)
+
+// spans implements the spans command, which shows the text of the Kobo spans
+// in a KEPUB.
+func spans(args []string) {
+	fs := pflag.NewFlagSet("spans", pflag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Output JSON (an array of objects with the file and paragraphs, each containing the paragraph number and the spans with their id, segment number, text, and offset in UTF-16 code units from the start of the document)")
+	help := fs.BoolP("help", "h", false, "Show this help text")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(2)
+		return
+	}
+
+	if *help || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: kepubify spans [--json] kepub_path\n")
+		fmt.Fprintf(os.Stderr, "\nShows the text of the Kobo spans in each content file of a KEPUB, which can be used to resolve highlights and bookmarks back to the text.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n%s", fs.FlagUsagesWrapped(160))
+		if *help {
+			exit(0)
+		} else {
+			exit(2)
+		}
+		return
+	}
+
+	docs, err := func() ([]kepub.SpanDocument, error) {
+		zr, err := zip.OpenReader(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return kepub.ExportSpans(zr)
+	}()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+		return
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(docs); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+			return
+		}
+		exit(0)
+		return
+	}
+
+	for _, doc := range docs {
+		fmt.Printf("%s\n", doc.File)
+		for _, p := range doc.Paragraphs {
+			for _, s := range p.Spans {
+				fmt.Printf("  %s (%d): %q\n", s.ID, s.Offset, s.Text)
+			}
+		}
+	}
+	exit(0)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pgaskin/kepubify/v4/internal/kobopath"
+	"github.com/pgaskin/koboutils/v2/kobo"
+)
+
+// SeriesOverride is a manual correction for the series of a book, which takes
+// precedence over the series metadata in the book. If Series is empty, the
+// book will not have a series.
+type SeriesOverride struct {
+	Series       string
+	SeriesNumber string
+}
+
+// ExportSeries writes the current series metadata for all sideloaded books in
+// the database as CSV, and returns the number of books.
+func (k *Kobo) ExportSeries(w io.Writer) (int, error) {
+	rows, err := k.DB.Query(`
+		SELECT ContentID, Title, Attribution, Series, SeriesNumber
+		FROM content
+		WHERE ContentType = 6 AND (ContentID LIKE 'file:///mnt/onboard/%' OR ContentID LIKE 'file:///mnt/sd/%')
+		ORDER BY ContentID
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("could not read books: %w", err)
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"ContentID", "Title", "Author", "Series", "SeriesNumber"}); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for rows.Next() {
+		var contentID string
+		var title, author, series, number sql.NullString
+		if err := rows.Scan(&contentID, &title, &author, &series, &number); err != nil {
+			return n, fmt.Errorf("could not read books: %w", err)
+		}
+		if err := cw.Write([]string{contentID, title.String, author.String, series.String, number.String}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("could not read books: %w", err)
+	}
+
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// ReadSeriesCSV reads series corrections in the format written by
+// ExportSeries, keyed by the ImageId. Columns other than ContentID, Series, and
+// SeriesNumber are ignored.
+func ReadSeriesCSV(r io.Reader) (map[string]SeriesOverride, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	hdr, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header")
+	} else if err != nil {
+		return nil, err
+	}
+
+	col := map[string]int{}
+	for i, name := range hdr {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"contentid", "series", "seriesnumber"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	overrides := map[string]SeriesOverride{}
+	for row := 2; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		get := func(name string) string {
+			if i := col[name]; i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+
+		contentID := get("contentid")
+		if _, _, ok := kobopath.Path(contentID); !ok {
+			return nil, fmt.Errorf("row %d: %q is not a sideloaded book", row, contentID)
+		}
+
+		o := SeriesOverride{get("series"), get("seriesnumber")}
+		if o.SeriesNumber != "" {
+			if o.Series == "" {
+				return nil, fmt.Errorf("row %d: series number without a series", row)
+			}
+			if _, err := strconv.ParseFloat(o.SeriesNumber, 64); err != nil {
+				return nil, fmt.Errorf("row %d: invalid series number %q", row, o.SeriesNumber)
+			}
+		}
+
+		imageID := kobo.ContentIDToImageID(contentID)
+		if _, ok := overrides[imageID]; ok {
+			return nil, fmt.Errorf("row %d: duplicate book %q", row, contentID)
+		}
+		overrides[imageID] = o
+	}
+	return overrides, nil
+}
+
+// RemoveUnchangedSeriesOverrides removes the corrections which are the same as
+// the series metadata in the books on the device (and on the SD card if sd is
+// not empty), so importing an unedited export doesn't prevent the series from
+// being updated from the books later. Corrections for books which aren't found
+// or can't be read are kept. It returns the number of corrections removed.
+func (k *Kobo) RemoveUnchangedSeriesOverrides(overrides map[string]SeriesOverride, sd string) (int, error) {
+	var n int
+	for _, root := range []string{k.Path, sd} {
+		if root == "" {
+			continue
+		}
+		epubs, err := scanEPUBs(root)
+		if err != nil {
+			return n, err
+		}
+		for _, rel := range epubs {
+			imageID := kobopath.ImageID(rel, root == sd)
+			o, ok := overrides[imageID]
+			if !ok {
+				continue
+			}
+			meta, err := readEPUBMeta(filepath.Join(root, rel), []SeriesField{SeriesFieldSeries})
+			if err != nil {
+				continue
+			}
+			if o.Series == meta["Series"] && seriesNumberEqual(o.SeriesNumber, meta["SeriesNumber"]) {
+				delete(overrides, imageID)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// seriesNumberEqual checks if two series numbers are the same, ignoring the
+// formatting (e.g., 2 and 2.0).
+func seriesNumberEqual(a, b string) bool {
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	if errx != nil || erry != nil {
+		return a == b
+	}
+	return x == y
+}
+
+// SeriesOverrides gets the series corrections from the database, keyed by the
+// ImageId.
+func (k *Kobo) SeriesOverrides() (map[string]SeriesOverride, error) {
+	var n int
+	if err := k.DB.QueryRow(`SELECT count() FROM sqlite_master WHERE type = 'table' AND name = '_seriesmeta_override'`).Scan(&n); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, nil // seriesmeta hasn't been set up yet
+	}
+
+	rows, err := k.DB.Query(`SELECT ImageId, Series, SeriesNumber FROM _seriesmeta_override`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := map[string]SeriesOverride{}
+	for rows.Next() {
+		var imageID string
+		var series, number sql.NullString
+		if err := rows.Scan(&imageID, &series, &number); err != nil {
+			return nil, err
+		}
+		overrides[imageID] = SeriesOverride{series.String, number.String}
+	}
+	return overrides, rows.Err()
+}
+
+// SetSeriesOverrides replaces the series corrections in the database.
+// SeriesConfig must have been called first.
+func (k *Kobo) SetSeriesOverrides(overrides map[string]SeriesOverride) error {
+	tx, err := k.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM _seriesmeta_override`); err != nil {
+		return err
+	}
+	for imageID, o := range overrides {
+		if _, err := tx.Exec(
+			`INSERT INTO _seriesmeta_override (ImageId, Series, SeriesNumber) VALUES (?, ?, ?)`,
+			imageID,
+			sql.NullString{String: o.Series, Valid: o.Series != ""},
+			sql.NullString{String: o.SeriesNumber, Valid: o.SeriesNumber != ""},
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit db transaction: %w", err)
+	}
+	return nil
+}
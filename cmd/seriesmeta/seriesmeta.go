@@ -1,4 +1,4 @@
-// Command seriesmeta updates series metadata for EPUB/KEPUB books in the Kobo database.
+// Command seriesmeta updates series and other metadata for EPUB/KEPUB books in the Kobo database.
 package main
 
 import (
@@ -13,8 +13,9 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/beevik/etree"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/pgaskin/kepubify/v4/internal/epubmeta"
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+	"github.com/pgaskin/kepubify/v4/internal/kobopath"
 	"github.com/pgaskin/koboutils/v2/kobo"
 	"github.com/spf13/pflag"
 )
@@ -22,9 +23,15 @@ import (
 var version = "dev"
 
 func main() {
-	noPersist := pflag.BoolP("no-persist", "p", false, "Don't ensure metadata is always set (this will cause series metadata to be lost if opening a book after an import but before a reboot)")
-	noReplace := pflag.BoolP("no-replace", "n", false, "Don't replace existing series metadata (you probably don't want this option)")
-	uninstall := pflag.BoolP("uninstall", "u", false, "Uninstall seriesmeta table and hooks (imported series metadata will be left untouched)")
+	fields := pflag.StringSliceP("fields", "f", []string{"series"}, "The metadata to update (series, subtitle, publisher, isbn, description, language) (the other fields are opt-in since the Kobo usually gets them right, e.g. --fields=series,subtitle)")
+	noPersist := pflag.BoolP("no-persist", "p", false, "Don't ensure metadata is always set (this will cause metadata to be lost if opening a book after an import but before a reboot)")
+	noReplace := pflag.BoolP("no-replace", "n", false, "Don't replace existing metadata (you probably don't want this option)")
+	sd := pflag.StringP("sd", "s", "", "Path to the SD card in the Kobo eReader (the books on it will be updated too)")
+	dryRun := pflag.Bool("dry-run", false, "Show what would be changed without changing anything")
+	export := pflag.String("export", "", "Export the current series metadata of all sideloaded books to a CSV file, then exit")
+	imp := pflag.String("import", "", "Import series corrections from a CSV file in the same format as --export (these take precedence over the metadata in the books, and replace previously imported ones) (rows which are the same as the metadata in the books are ignored)")
+	uninstall := pflag.BoolP("uninstall", "u", false, "Uninstall seriesmeta table and hooks (imported metadata will be left untouched)")
+	bf := kobodb.AddBackupFlags(pflag.CommandLine)
 	help := pflag.BoolP("help", "h", false, "Show this help message")
 	pflag.Parse()
 
@@ -40,6 +47,54 @@ func main() {
 		return
 	}
 
+	var sf []SeriesField
+	for _, f := range *fields {
+		var ok bool
+		for _, x := range SeriesFields {
+			if strings.EqualFold(f, string(x)) {
+				sf, ok = append(sf, x), true
+				break
+			}
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: Unknown field %q.\n", f)
+			os.Exit(2)
+			return
+		}
+	}
+	if len(sf) == 0 && !*uninstall {
+		fmt.Fprintf(os.Stderr, "Error: No fields specified.\n")
+		os.Exit(2)
+		return
+	}
+	if *export != "" && (*imp != "" || *dryRun || *uninstall) {
+		fmt.Fprintf(os.Stderr, "Error: --export cannot be used with --import, --dry-run, or --uninstall.\n")
+		os.Exit(2)
+		return
+	}
+	if *uninstall && (*imp != "" || *dryRun) {
+		fmt.Fprintf(os.Stderr, "Error: --uninstall cannot be used with --import or --dry-run.\n")
+		os.Exit(2)
+		return
+	}
+
+	var overrides map[string]SeriesOverride
+	if *imp != "" {
+		f, err := os.Open(*imp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read series corrections: %v.\n", err)
+			os.Exit(1)
+			return
+		}
+		overrides, err = ReadSeriesCSV(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read series corrections from %q: %v.\n", *imp, err)
+			os.Exit(1)
+			return
+		}
+	}
+
 	fmt.Println("Note: You might be interested in NickelSeries (https://pgaskin.net/kepubify/ns), which will automatically import series and subtitle metadata along with the book itself.")
 
 	fmt.Println("Finding kobo")
@@ -58,6 +113,18 @@ func main() {
 		kp = kobos[0]
 	}
 
+	if *sd != "" {
+		if fi, err := os.Stat(*sd); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not access SD card: %v.\n", err)
+			os.Exit(1)
+			return
+		} else if !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "Could not access SD card: %q is not a directory.\n", *sd)
+			os.Exit(1)
+			return
+		}
+	}
+
 	fmt.Println("Opening kobo")
 	k, err := OpenKobo(kp)
 	if err != nil {
@@ -66,28 +133,131 @@ func main() {
 		return
 	}
 
-	fmt.Println("Setting up database")
-	if err := k.SeriesConfig(*noReplace, *noPersist, *uninstall); err != nil {
-		fmt.Fprintf(os.Stderr, "Could not set up database: %v.\n", err)
-		os.Exit(1)
+	if bf.Restore != "" {
+		ok := bf.RunRestore(k.Kobo)
+		k.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *export != "" {
+		fmt.Println("Exporting series metadata")
+		f, err := os.Create(*export)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export series metadata: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+		n, err := k.ExportSeries(f)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not export series metadata: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+		fmt.Printf("Exported %d books to %s\n", n, *export)
+		k.Close()
 		return
 	}
 
+	if !*dryRun {
+		if !bf.RunBackup(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+
+		fmt.Println("Setting up database")
+		if err := k.SeriesConfig(sf, *noReplace, *noPersist, *uninstall); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set up database: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+
 	if *uninstall {
+		if !bf.RunCheck(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+		k.Close()
 		os.Exit(0)
 		return
 	}
 
-	fmt.Println("Updating metadata")
-	var nt, nu, ne, nn int
-	if err := k.UpdateSeries(func(filename string, i, total int, series string, index float64, err error) {
-		fmt.Printf("[%3d/%3d] %-40s %s\n", i+1, total, fmt.Sprintf("(%-34s %3v)", series, index), filename)
+	if *imp == "" {
+		if overrides, err = k.SeriesOverrides(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read series corrections: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	} else {
+		n, err := k.RemoveUnchangedSeriesOverrides(overrides, *sd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not compare series corrections: %v.\n", err)
+			k.Close()
+			os.Exit(1)
+			return
+		}
+		fmt.Printf("Ignoring %d series corrections which are the same as the metadata in the books\n", n)
+
+		if !*dryRun {
+			fmt.Println("Importing series corrections")
+			if err := k.SetSeriesOverrides(overrides); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not import series corrections: %v.\n", err)
+				k.Close()
+				os.Exit(1)
+				return
+			}
+		}
+	}
+
+	if *dryRun {
+		fmt.Println("Checking metadata (dry run)")
+	} else {
+		fmt.Println("Updating metadata")
+	}
+	var nt, nu, ne, nn, ni int
+	if err := k.UpdateSeries(sf, *sd, overrides, *dryRun, func(filename string, i, total int, meta, current map[string]string, err error) {
+		fmt.Printf("[%3d/%3d] %-40s %s\n", i+1, total, fmt.Sprintf("(%-34s %3s)", meta["Series"], meta["SeriesNumber"]), filename)
 		if err != nil {
 			fmt.Printf("--------- Error: %v\n", err)
 			ne++
-		} else if series == "" {
+		} else if *dryRun {
+			if current == nil {
+				fmt.Printf("          not imported by the Kobo yet\n")
+				ni++
+			} else if changed := seriesChanges(sf, *noReplace, meta, current); len(changed) != 0 {
+				for _, col := range changed {
+					fmt.Printf("          %-13s %s -> %s\n", col+":", preview(current[col]), preview(meta[col]))
+				}
+				nu++
+			} else {
+				nn++
+			}
+		} else if len(meta) == 0 {
 			nn++
 		} else {
+			var found []string
+			for _, f := range sf {
+				if _, ok := meta[string(f)]; ok && f != SeriesFieldSeries {
+					found = append(found, string(f))
+				}
+			}
+			if len(found) != 0 {
+				fmt.Printf("          %s\n", strings.Join(found, ", "))
+			}
 			nu++
 		}
 		nt = total
@@ -98,7 +268,16 @@ func main() {
 		return
 	}
 
-	fmt.Printf("%d total: %d updated, %d errored, %d without metadata\n", nt, nu, ne, nn)
+	if *dryRun {
+		fmt.Printf("%d total: %d would be changed, %d errored, %d unchanged, %d not imported yet\n", nt, nu, ne, nn, ni)
+	} else {
+		fmt.Printf("%d total: %d updated, %d errored, %d without metadata\n", nt, nu, ne, nn)
+		if !bf.RunCheck(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
 	if ne > 0 {
 		k.Close()
 		os.Exit(1)
@@ -107,53 +286,138 @@ func main() {
 	k.Close()
 }
 
+// preview formats a value for the dry run output.
+func preview(val string) string {
+	if val == "" {
+		return "(none)"
+	}
+	if r := []rune(val); len(r) > 40 {
+		val = string(r[:39]) + "…"
+	}
+	return strconv.Quote(val)
+}
+
 // Kobo is a Kobo eReader.
 type Kobo struct {
-	Path string
-	DB   *sql.DB
+	*kobodb.Kobo
 }
 
 // OpenKobo opens a Kobo eReader device and the database.
 func OpenKobo(path string) (*Kobo, error) {
-	if _, err := os.Stat(path); err != nil {
-		return nil, err
-	} else if _, err = os.Stat(filepath.Join(path, ".kobo")); err != nil {
-		return nil, fmt.Errorf("could not access .kobo directory, is this a Kobo eReader: %v", err)
-	}
-
-	path, err := filepath.Abs(path)
+	k, err := kobodb.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	return &Kobo{k}, nil
+}
 
-	db, err := sql.Open("sqlite3", filepath.Join(path, ".kobo", "KoboReader.sqlite"))
-	if err != nil {
-		return nil, fmt.Errorf("could not open KoboReader.sqlite: %w", err)
-	}
+// SeriesField is metadata set by seriesmeta. The value is the name of the
+// column in the content table.
+type SeriesField string
+
+const (
+	SeriesFieldSeries      SeriesField = "Series" // also sets SeriesNumber and SeriesID
+	SeriesFieldSubtitle    SeriesField = "Subtitle"
+	SeriesFieldPublisher   SeriesField = "Publisher"
+	SeriesFieldISBN        SeriesField = "ISBN"
+	SeriesFieldDescription SeriesField = "Description"
+	SeriesFieldLanguage    SeriesField = "Language"
+)
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("could not open KoboReader.sqlite: %w", err)
-	}
+// SeriesFields is every SeriesField, in the order of the columns in the table.
+var SeriesFields = []SeriesField{
+	SeriesFieldSeries,
+	SeriesFieldSubtitle,
+	SeriesFieldPublisher,
+	SeriesFieldISBN,
+	SeriesFieldDescription,
+	SeriesFieldLanguage,
+}
 
-	return &Kobo{path, db}, nil
+// columns returns the columns in the seriesmeta table for the field.
+func (f SeriesField) columns() []string {
+	if f == SeriesFieldSeries {
+		return []string{"Series", "SeriesNumber"}
+	}
+	return []string{string(f)}
 }
 
-// Close closes the reader and the database.
-func (k *Kobo) Close() error {
-	return k.DB.Close()
+// seriesColumns returns the columns in the seriesmeta table for all fields.
+func seriesColumns() []string {
+	var cols []string
+	for _, f := range SeriesFields {
+		cols = append(cols, f.columns()...)
+	}
+	return cols
 }
 
-// SeriesConfig sets up the table and triggers for seriesmeta. noReplace prevents
-// series metadata from seriesmeta from replacing existing metadata, and noPersist
-// allows the series metadata to be changed by something else later. If uninstall
-// is true, the table and triggers will be removed.
-func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
+// SeriesConfig sets up the table and triggers for seriesmeta. fields is the
+// metadata which will be set by the triggers. noReplace prevents metadata from
+// seriesmeta from replacing existing metadata, and noPersist allows the
+// metadata to be changed by something else later. If uninstall is true, the
+// table and triggers will be removed.
+//
+// Unlike the series, which is always replaced (or removed) unless noReplace is
+// set, the other fields are only set if the book has them, since the Kobo
+// usually gets them right for most books.
+func (k *Kobo) SeriesConfig(fields []SeriesField, noReplace, noPersist, uninstall bool) error {
+	if !uninstall {
+		if len(fields) == 0 {
+			return errors.New("no fields specified")
+		}
+		if err := k.migrateSeriesTable(); err != nil {
+			return fmt.Errorf("could not update seriesmeta table: %w", err)
+		}
+	}
+
 	buf := bytes.NewBuffer(nil)
 	template.Must(template.New("").Parse(`
+		{{define "update"}}
+				UPDATE content
+				SET
+					{{- range $i, $f := .Fields}}{{if $i}},{{end}}
+					{{- if eq $f "Series"}}
+					{{- if $.NoReplace}}
+					/* Only set the series if there isn't one already (the other columns use the old value of Series, not the new one) */
+					SeriesNumber = CASE WHEN Series IS NULL THEN (SELECT SeriesNumber FROM _seriesmeta WHERE ImageId = new.ImageId) ELSE SeriesNumber END,
+					SeriesID     = CASE WHEN Series IS NULL THEN {{template "seriesid"}} ELSE SeriesID END,
+					Series       = coalesce(Series, (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId))
+					{{- else}}
+					Series       = (SELECT Series       FROM _seriesmeta WHERE ImageId = new.ImageId),
+					SeriesNumber = (SELECT SeriesNumber FROM _seriesmeta WHERE ImageId = new.ImageId),
+					SeriesID     = {{template "seriesid"}}
+					{{- end}}
+					{{- else}}
+					{{- if $.NoReplace}}
+					{{$f}} = coalesce(nullif({{$f}}, ''), (SELECT {{$f}} FROM _seriesmeta WHERE ImageId = new.ImageId), {{$f}})
+					{{- else}}
+					{{$f}} = coalesce((SELECT {{$f}} FROM _seriesmeta WHERE ImageId = new.ImageId), {{$f}})
+					{{- end}}
+					{{- end}}
+					{{- end}}
+				WHERE ImageId = new.ImageId;
+				{{if .NoPersist}}DELETE FROM _seriesmeta WHERE ImageId = new.ImageId;{{end}}
+		{{end}}
+
+		{{define "seriesid"}}
+			{{- /* Get the SeriesID from books from the Kobo Store (WorkId NOT NULL) where the series name matches, otherwise just use the series name as the SeriesID (https://www.mobileread.com/forums/showthread.php?p=3959768) */ -}}
+			coalesce((SELECT SeriesID FROM content WHERE Series = (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId) AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId))
+		{{- end}}
+
 		{{if .Uninstall}}
 		DROP TABLE _seriesmeta;
+		DROP TABLE IF EXISTS _seriesmeta_override;
 		{{else}}
 		CREATE TABLE IF NOT EXISTS _seriesmeta (
+			ImageId      TEXT NOT NULL UNIQUE,
+			{{- range .Columns}}
+			{{.}} TEXT,
+			{{- end}}
+			PRIMARY KEY(ImageId)
+		);
+
+		/* Manual corrections from --import (these are only used by seriesmeta itself, not the triggers) */
+		CREATE TABLE IF NOT EXISTS _seriesmeta_override (
 			ImageId      TEXT NOT NULL UNIQUE,
 			Series       TEXT,
 			SeriesNumber TEXT,
@@ -161,24 +425,16 @@ func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
 		);
 		{{end}}
 
-		/* Adding series metadata on import */
+		/* Adding metadata on import */
 
 		DROP TRIGGER IF EXISTS _seriesmeta_content_insert;
 		{{if not .Uninstall}}
 		CREATE TRIGGER _seriesmeta_content_insert
 			AFTER INSERT ON content WHEN
-				{{if .NoReplace}}(new.Series IS NULL) AND{{end}}
-				(new.ImageId LIKE "file____mnt_onboard_%") AND
+				(new.ImageId LIKE "file____mnt_onboard_%" OR new.ImageId LIKE "file____mnt_sd_%") AND
 				(SELECT count() FROM _seriesmeta WHERE ImageId = new.ImageId)
 			BEGIN
-				UPDATE content
-				SET
-					Series       = (SELECT Series       FROM _seriesmeta WHERE ImageId = new.ImageId),
-					SeriesNumber = (SELECT SeriesNumber FROM _seriesmeta WHERE ImageId = new.ImageId),
-					/* Get the SeriesID from books from the Kobo Store (WorkId NOT NULL) where the series name matches, otherwise just use the series name as the SeriesID (https://www.mobileread.com/forums/showthread.php?p=3959768) */
-					SeriesID     = coalesce((SELECT SeriesID FROM content WHERE Series = (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId) AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId))
-				WHERE ImageId = new.ImageId;
-				{{if .NoPersist}}DELETE FROM _seriesmeta WHERE ImageId = new.ImageId;{{end}}
+				{{- template "update" .}}
 			END;
 		{{end}}
 
@@ -186,18 +442,10 @@ func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
 		{{if not .Uninstall}}
 		CREATE TRIGGER _seriesmeta_content_update
 			AFTER UPDATE ON content WHEN
-				{{if .NoReplace}}(new.Series IS NULL) AND{{end}}
-				(new.ImageId LIKE "file____mnt_onboard_%") AND
+				(new.ImageId LIKE "file____mnt_onboard_%" OR new.ImageId LIKE "file____mnt_sd_%") AND
 				(SELECT count() FROM _seriesmeta WHERE ImageId = new.ImageId)
 			BEGIN
-				UPDATE content
-				SET
-					Series       = (SELECT Series       FROM _seriesmeta WHERE ImageId = new.ImageId),
-					SeriesNumber = (SELECT SeriesNumber FROM _seriesmeta WHERE ImageId = new.ImageId),
-					/* Get the SeriesID from books from the Kobo Store (WorkId NOT NULL) where the series name matches, otherwise just use the series name as the SeriesID (https://www.mobileread.com/forums/showthread.php?p=3959768) */
-					SeriesID     = coalesce((SELECT SeriesID FROM content WHERE Series = (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId) AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), (SELECT Series FROM _seriesmeta WHERE ImageId = new.ImageId))
-				WHERE ImageId = new.ImageId;
-				{{if .NoPersist}}DELETE FROM _seriesmeta WHERE ImageId = new.ImageId;{{end}}
+				{{- template "update" .}}
 			END;
 		{{end}}
 
@@ -210,23 +458,15 @@ func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
 			END;
 		{{end}}
 
-		/* Adding series metadata directly when already imported */
+		/* Adding metadata directly when already imported */
 
-		{{if not .Uninstall}}
 		DROP TRIGGER IF EXISTS _seriesmeta_seriesmeta_insert;
+		{{if not .Uninstall}}
 		CREATE TRIGGER _seriesmeta_seriesmeta_insert
 			AFTER INSERT ON _seriesmeta WHEN
 				(SELECT count() FROM content WHERE ImageId = new.ImageId)
-				{{if .NoReplace}}AND ((SELECT Series FROM content WHERE ImageId = new.ImageId) IS NULL){{end}}
 			BEGIN
-				UPDATE content
-				SET
-					Series       = new.Series,
-					SeriesNumber = new.SeriesNumber,
-					/* Get the SeriesID from books from the Kobo Store (WorkId NOT NULL) where the series name matches, otherwise just use the series name as the SeriesID (https://www.mobileread.com/forums/showthread.php?p=3959768) */
-					SeriesID     = coalesce((SELECT SeriesID FROM content WHERE Series = new.Series AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), new.Series)
-				WHERE ImageId = new.ImageId;
-				{{if .NoPersist}}DELETE FROM _seriesmeta WHERE ImageId = new.ImageId;{{end}}
+				{{- template "update" .}}
 			END;
 		{{end}}
 
@@ -235,19 +475,13 @@ func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
 		CREATE TRIGGER _seriesmeta_seriesmeta_update
 			AFTER UPDATE ON _seriesmeta WHEN
 				(SELECT count() FROM content WHERE ImageId = new.ImageId)
-				{{if .NoReplace}}AND ((SELECT Series FROM content WHERE ImageId = new.ImageId) IS NULL){{end}}
 			BEGIN
-				UPDATE content
-				SET
-					Series       = new.Series,
-					SeriesNumber = new.SeriesNumber,
-					/* Get the SeriesID from books from the Kobo Store (WorkId NOT NULL) where the series name matches, otherwise just use the series name as the SeriesID (https://www.mobileread.com/forums/showthread.php?p=3959768) */
-					SeriesID     = coalesce((SELECT SeriesID FROM content WHERE Series = new.Series AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), new.Series)
-				WHERE ImageId = new.ImageId;
-				{{if .NoPersist}}DELETE FROM _seriesmeta WHERE ImageId = new.ImageId;{{end}}
+				{{- template "update" .}}
 			END;
 		{{end}}
 	`)).Execute(buf, map[string]interface{}{
+		"Fields":    fields,
+		"Columns":   seriesColumns(),
 		"NoReplace": noReplace,
 		"NoPersist": noPersist,
 		"Uninstall": uninstall,
@@ -256,60 +490,136 @@ func (k *Kobo) SeriesConfig(noReplace, noPersist, uninstall bool) error {
 	return err
 }
 
-// UpdateSeries updates the series metadata for all epub books on the device. All
-// errors from individual books are returned through the log callback.
-func (k *Kobo) UpdateSeries(log func(filename string, i, total int, series string, index float64, err error)) error {
-	var epubs []string
-	err := filepath.Walk(k.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			if path != k.Path {
-				fmt.Fprintf(os.Stderr, "Warning: Failed to scan %q: %v.\n", path, err)
-			} else {
-				return fmt.Errorf("error scanning %q: %w", path, err)
-			}
-		}
-		if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".epub") {
-			epubs = append(epubs, path)
-		}
-		return nil
-	})
+// migrateSeriesTable adds the columns which are missing from a seriesmeta table
+// created by an older version of seriesmeta. If the table doesn't exist, it
+// does nothing.
+func (k *Kobo) migrateSeriesTable() error {
+	rows, err := k.DB.Query(`PRAGMA table_info(_seriesmeta)`)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	cols := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var cid, typ, notnull, dflt, pk interface{}
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		cols[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
 
-	relEpubs := make([]string, len(epubs))
-	for i, epub := range epubs {
-		relEpubs[i], err = filepath.Rel(k.Path, epub)
+	if len(cols) == 0 {
+		return nil
+	}
+	for _, col := range seriesColumns() {
+		if !cols[col] {
+			if _, err := k.DB.Exec(`ALTER TABLE _seriesmeta ADD COLUMN ` + col + ` TEXT`); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateSeries updates the metadata for the specified fields for all epub
+// books on the device, and on the SD card if sd is not empty. The series from
+// overrides (keyed by the ImageId) take precedence over the ones in the books.
+// If dryRun is true, the database isn't changed.
+//
+// The metadata for each book is returned through the log callback as a map of
+// the column names to the values, only including the ones which were found.
+// The current values of the columns in the database are returned the same way,
+// or as nil if the book hasn't been imported by the Kobo yet. The filename is
+// relative to the device, or the full path for books on the SD card. All
+// errors from individual books are returned through the log callback.
+func (k *Kobo) UpdateSeries(fields []SeriesField, sd string, overrides map[string]SeriesOverride, dryRun bool, log func(filename string, i, total int, meta, current map[string]string, err error)) error {
+	type book struct {
+		Path, Rel string
+		SD        bool
+	}
+
+	var books []book
+	for _, root := range []string{k.Path, sd} {
+		if root == "" {
+			continue
+		}
+		epubs, err := scanEPUBs(root)
 		if err != nil {
-			return fmt.Errorf("could not resolve relative path to %#v: %w", epub, err)
+			return err
+		}
+		for _, rel := range epubs {
+			books = append(books, book{filepath.Join(root, rel), rel, root == sd})
 		}
 	}
 
+	var series bool
+	for _, f := range fields {
+		series = series || f == SeriesFieldSeries
+	}
+
+	cols := seriesColumns()
+	query := "INSERT OR REPLACE INTO _seriesmeta (ImageId, " + strings.Join(cols, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(cols)) + ")"
+
 	tx, err := k.DB.Begin()
 	if err != nil {
 		return fmt.Errorf("could not begin db transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	for i, epub := range epubs {
-		relEpub := relEpubs[i]
+	for i, b := range books {
+		fn := b.Rel
+		if b.SD {
+			fn = b.Path
+		}
+		imageID := kobopath.ImageID(b.Rel, b.SD)
 
-		series, index, err := readEPUBSeriesInfo(epub)
+		current, err := currentSeriesMeta(tx, imageID, fields)
 		if err != nil {
-			log(relEpub, i, len(epubs), series, index, err)
+			log(fn, i, len(books), nil, nil, fmt.Errorf("could not read current metadata: %w", err))
 			continue
 		}
 
-		if _, err := tx.Exec(
-			"INSERT OR REPLACE INTO _seriesmeta (ImageId, Series, SeriesNumber) VALUES (?, ?, ?)",
-			kobo.ContentIDToImageID(kobo.PathToContentID(relEpub)),
-			sql.NullString{String: series, Valid: len(series) > 0},
-			sql.NullString{String: strconv.FormatFloat(index, 'f', -1, 64), Valid: index > 0},
-		); err != nil {
-			log(relEpub, i, len(epubs), series, index, err)
+		meta, err := readEPUBMeta(b.Path, fields)
+		if err != nil {
+			log(fn, i, len(books), meta, current, err)
 			continue
 		}
 
-		log(relEpub, i, len(epubs), series, index, nil)
+		if o, ok := overrides[imageID]; ok && series {
+			delete(meta, "Series")
+			delete(meta, "SeriesNumber")
+			if o.Series != "" {
+				meta["Series"] = o.Series
+				if o.SeriesNumber != "" {
+					meta["SeriesNumber"] = o.SeriesNumber
+				}
+			}
+		}
+
+		if !dryRun {
+			args := []interface{}{imageID}
+			for _, col := range cols {
+				val, ok := meta[col]
+				args = append(args, sql.NullString{String: val, Valid: ok})
+			}
+
+			if _, err := tx.Exec(query, args...); err != nil {
+				log(fn, i, len(books), meta, current, err)
+				continue
+			}
+		}
+
+		log(fn, i, len(books), meta, current, nil)
+	}
+
+	if dryRun {
+		return nil
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -319,85 +629,123 @@ func (k *Kobo) UpdateSeries(log func(filename string, i, total int, series strin
 	return nil
 }
 
-// readEPUBSeriesInfo reads the series metadata from an epub book.
-func readEPUBSeriesInfo(filename string) (series string, index float64, err error) {
-	zr, err := zip.OpenReader(filename)
-	if err != nil {
-		return "", 0, fmt.Errorf("could not open ebook: %w", err)
+// currentSeriesMeta gets the current values of the columns for the specified
+// fields from the database in the same format as readEPUBMeta, or nil if the
+// book isn't in the database.
+func currentSeriesMeta(tx *sql.Tx, imageID string, fields []SeriesField) (map[string]string, error) {
+	var cols []string
+	for _, f := range fields {
+		cols = append(cols, f.columns()...)
 	}
-	defer zr.Close()
 
-	var rootfile string
-	for _, f := range zr.File {
-		if strings.TrimLeft(strings.ToLower(f.Name), "/") == "meta-inf/container.xml" {
-			rc, err := f.Open()
-			if err != nil {
-				return "", 0, fmt.Errorf("could not open container.xml: %w", err)
-			}
-			doc := etree.NewDocument()
-			_, err = doc.ReadFrom(rc)
-			if err != nil {
-				rc.Close()
-				return "", 0, fmt.Errorf("could not parse container.xml: %w", err)
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	if err := tx.QueryRow("SELECT "+strings.Join(cols, ", ")+" FROM content WHERE ImageId = ? AND ContentType = 6 LIMIT 1", imageID).Scan(ptrs...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	current := map[string]string{}
+	for i, col := range cols {
+		if vals[i].String != "" {
+			current[col] = vals[i].String
+		}
+	}
+	return current, nil
+}
+
+// seriesChanges returns the columns which would be changed by the triggers set
+// up by SeriesConfig for a book with the metadata from readEPUBMeta and the
+// current metadata from currentSeriesMeta.
+func seriesChanges(fields []SeriesField, noReplace bool, meta, current map[string]string) []string {
+	var changed []string
+	for _, f := range fields {
+		if f == SeriesFieldSeries {
+			if noReplace && current["Series"] != "" {
+				continue
 			}
-			if el := doc.FindElement("//rootfiles/rootfile[@full-path]"); el != nil {
-				rootfile = el.SelectAttrValue("full-path", "")
+			for _, col := range f.columns() {
+				if meta[col] != current[col] {
+					changed = append(changed, col)
+				}
 			}
-			rc.Close()
-			break
+			continue
+		}
+		col := string(f)
+		if val, ok := meta[col]; ok && val != current[col] && !(noReplace && current[col] != "") {
+			changed = append(changed, col)
 		}
 	}
-	if rootfile == "" {
-		return "", 0, errors.New("could not open ebook: could not find package document")
-	}
+	return changed
+}
 
-	for _, f := range zr.File {
-		if strings.TrimLeft(strings.ToLower(f.Name), "/") == strings.TrimLeft(strings.ToLower(rootfile), "/") {
-			rc, err := f.Open()
-			if err != nil {
-				return "", 0, fmt.Errorf("could not open container.xml: %w", err)
+// scanEPUBs finds all epub books in root, and returns the paths relative to it.
+func scanEPUBs(root string) ([]string, error) {
+	var epubs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != root {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to scan %q: %v.\n", path, err)
+				return nil
 			}
-			doc := etree.NewDocument()
-			_, err = doc.ReadFrom(rc)
+			return fmt.Errorf("error scanning %q: %w", path, err)
+		}
+		if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".epub") {
+			rel, err := filepath.Rel(root, path)
 			if err != nil {
-				rc.Close()
-				return "", 0, fmt.Errorf("could not parse container.xml: %w", err)
+				return fmt.Errorf("could not resolve relative path to %#v: %w", path, err)
 			}
+			epubs = append(epubs, rel)
+		}
+		return nil
+	})
+	return epubs, err
+}
 
-			// Calibre series metadata
-			if el := doc.FindElement("//meta[@name='calibre:series']"); el != nil {
-				series = el.SelectAttrValue("content", "")
+// readEPUBMeta reads the metadata for the specified fields from an epub book,
+// keyed by the column name. Metadata which isn't set is not included.
+func readEPUBMeta(filename string, fields []SeriesField) (map[string]string, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open ebook: %w", err)
+	}
+	defer zr.Close()
 
-				if el := doc.FindElement("//meta[@name='calibre:series_index']"); el != nil {
-					index, _ = strconv.ParseFloat(el.SelectAttrValue("content", "0"), 64)
-				}
-			}
+	m, err := epubmeta.Read(zr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ebook metadata: %w", err)
+	}
 
-			// EPUB3 series metadata
-			if series == "" {
-				if el := doc.FindElement("//meta[@property='belongs-to-collection']"); el != nil {
-					series = strings.TrimSpace(el.Text())
-
-					var ctype string
-					if id := el.SelectAttrValue("id", ""); id != "" {
-						for _, el := range doc.FindElements("//meta[@refines='#" + id + "']") {
-							val := strings.TrimSpace(el.Text())
-							switch el.SelectAttrValue("property", "") {
-							case "collection-type":
-								ctype = val
-							case "group-position":
-								index, _ = strconv.ParseFloat(val, 64)
-							}
-						}
-					}
-
-					if ctype != "" && ctype != "series" {
-						series, index = "", 0
-					}
-				}
+	meta := map[string]string{}
+	set := func(col, val string) {
+		if val != "" {
+			meta[col] = val
+		}
+	}
+	for _, f := range fields {
+		switch f {
+		case SeriesFieldSeries:
+			set("Series", m.Series)
+			if m.Series != "" && m.SeriesIndex > 0 {
+				set("SeriesNumber", strconv.FormatFloat(m.SeriesIndex, 'f', -1, 64))
 			}
-			break
+		case SeriesFieldSubtitle:
+			set(string(f), m.Subtitle)
+		case SeriesFieldPublisher:
+			set(string(f), m.Publisher)
+		case SeriesFieldISBN:
+			set(string(f), m.ISBN)
+		case SeriesFieldDescription:
+			set(string(f), m.Description)
+		case SeriesFieldLanguage:
+			set(string(f), m.Language)
 		}
 	}
-	return series, index, nil
+	return meta, nil
 }
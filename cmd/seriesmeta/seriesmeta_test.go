@@ -0,0 +1,657 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	"github.com/pgaskin/kepubify/v4/internal/kobodb/kobodbtest"
+	"github.com/pgaskin/koboutils/v2/kobo"
+)
+
+// testKobo creates a Kobo with an empty database.
+func testKobo(t *testing.T) *Kobo {
+	t.Helper()
+
+	k, err := OpenKobo(kobodbtest.New(t))
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	t.Cleanup(func() { k.Close() })
+	return k
+}
+
+// testImport adds a book to the content table like the Kobo does when it
+// imports a sideloaded book. The extra columns are set to the specified
+// values.
+func testImport(t *testing.T, k *Kobo, fn string, extra map[string]string) {
+	t.Helper()
+	kobodbtest.Import(t, k.DB, kobo.PathToContentID(fn), extra)
+}
+
+// testUpdateSeries runs UpdateSeries and returns the log.
+func testUpdateSeries(t *testing.T, k *Kobo, sd string, fields ...SeriesField) []string {
+	t.Helper()
+	return testUpdateSeriesWith(t, k, sd, nil, false, fields...)
+}
+
+// testUpdateSeriesWith is like testUpdateSeries, but with overrides and
+// dry-run. The current metadata is included in the log after a "|".
+func testUpdateSeriesWith(t *testing.T, k *Kobo, sd string, overrides map[string]SeriesOverride, dryRun bool, fields ...SeriesField) []string {
+	t.Helper()
+	var res []string
+	if err := k.UpdateSeries(fields, sd, overrides, dryRun, func(filename string, i, total int, meta, current map[string]string, err error) {
+		s := []string{filepath.ToSlash(filename)}
+		s = append(s, testMeta(meta)...)
+		if overrides != nil || dryRun {
+			if current == nil {
+				s = append(s, "| (not imported)")
+			} else {
+				s = append(s, "|")
+				s = append(s, testMeta(current)...)
+			}
+		}
+		if err != nil {
+			s = append(s, "(error)")
+		}
+		res = append(res, strings.Join(s, " "))
+	}); err != nil {
+		t.Fatalf("update series: unexpected error: %v", err)
+	}
+	return res
+}
+
+// testMeta formats metadata from UpdateSeries.
+func testMeta(meta map[string]string) []string {
+	var s []string
+	for col, val := range meta {
+		s = append(s, fmt.Sprintf("%s=%q", col, val))
+	}
+	sort.Strings(s)
+	return s
+}
+
+const (
+	testMetadata = `
+		<dc:title id="t">Title</dc:title>
+		<dc:title id="s">Subtitle</dc:title>
+		<meta refines="#s" property="title-type">subtitle</meta>
+		<dc:publisher>Publisher</dc:publisher>
+		<dc:identifier>urn:isbn:978-0-00-000000-2</dc:identifier>
+		<dc:description>Description.</dc:description>
+		<dc:language>en</dc:language>
+		<meta name="calibre:series" content="Saga"/>
+		<meta name="calibre:series_index" content="2.5"/>`
+	testBookQuery = `SELECT Series, SeriesNumber, SeriesID, Subtitle, Publisher, ISBN, Description, Language FROM content WHERE ContentID = ?`
+)
+
+func TestSeriesMeta(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+	kobodbtest.WriteEPUB(t, k.Path, "b.epub", `<dc:title>B</dc:title>`)
+	kobodbtest.WriteEPUB(t, k.Path, "c.kepub.epub", testMetadata)
+	kobodbtest.WriteFile(t, k.Path, "broken.epub", []byte("not a zip"))
+
+	if _, err := k.DB.Exec(`INSERT INTO content (ContentID, ContentType, MimeType, ___UserID, Series, SeriesID, WorkId) VALUES ('00000000-0000-0000-0000-000000000000', 6, 'application/x-kobo-epub+zip', 'user', 'Saga', 'store-id', 'work-id')`); err != nil {
+		t.Fatalf("insert store book: %v", err)
+	}
+	testImport(t, k, "a.epub", map[string]string{"Publisher": "Kobo Publisher", "Description": "Kobo description."})
+	testImport(t, k, "b.epub", map[string]string{"Publisher": "Kobo Publisher", "Series": "Kobo Series"})
+
+	if err := k.SeriesConfig(SeriesFields, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	kobodbtest.Check(t, "result", testUpdateSeries(t, k, "", SeriesFields...),
+		`a.epub Description="Description." ISBN="9780000000002" Language="en" Publisher="Publisher" Series="Saga" SeriesNumber="2.5" Subtitle="Subtitle"`,
+		`b.epub`,
+		`broken.epub (error)`,
+		`c.kepub.epub Description="Description." ISBN="9780000000002" Language="en" Publisher="Publisher" Series="Saga" SeriesNumber="2.5" Subtitle="Subtitle"`,
+	)
+
+	// already imported
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/a.epub"),
+		`Series="Saga" SeriesNumber="2.5" SeriesID="store-id" Subtitle="Subtitle" Publisher="Publisher" ISBN="9780000000002" Description="Description." Language="en"`,
+	)
+
+	// the series is removed, but the other metadata is left as-is
+	kobodbtest.Check(t, "book without metadata", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/b.epub"),
+		`Series=NULL SeriesNumber=NULL SeriesID=NULL Subtitle=NULL Publisher="Kobo Publisher" ISBN=NULL Description=NULL Language=NULL`,
+	)
+
+	// imported later
+	testImport(t, k, "c.kepub.epub", nil)
+	kobodbtest.Check(t, "book imported later", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/c.kepub.epub"),
+		`Series="Saga" SeriesNumber="2.5" SeriesID="store-id" Subtitle="Subtitle" Publisher="Publisher" ISBN="9780000000002" Description="Description." Language="en"`,
+	)
+
+	// and it's kept when the Kobo changes it
+	if _, err := k.DB.Exec(`UPDATE content SET Series = NULL, Subtitle = NULL, ___PercentRead = 50 WHERE ContentID = 'file:///mnt/onboard/c.kepub.epub'`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	kobodbtest.Check(t, "book after update", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/c.kepub.epub"),
+		`Series="Saga" SeriesNumber="2.5" SeriesID="store-id" Subtitle="Subtitle" Publisher="Publisher" ISBN="9780000000002" Description="Description." Language="en"`,
+	)
+
+	// unless it's uninstalled
+	if err := k.SeriesConfig(nil, false, false, true); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	kobodbtest.Check(t, "schema after uninstall", kobodbtest.Query(t, k.DB, `SELECT type, name FROM sqlite_master WHERE name LIKE '%seriesmeta%'`))
+	if _, err := k.DB.Exec(`UPDATE content SET Series = NULL WHERE ContentID = 'file:///mnt/onboard/c.kepub.epub'`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	kobodbtest.Check(t, "book after uninstall", kobodbtest.Query(t, k.DB, `SELECT Series, Subtitle FROM content WHERE ContentID = ?`, "file:///mnt/onboard/c.kepub.epub"),
+		`Series=NULL Subtitle="Subtitle"`,
+	)
+}
+
+func TestSeriesMetaFields(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+	testImport(t, k, "a.epub", map[string]string{"Series": "Kobo Series", "Language": "fr"})
+
+	if err := k.SeriesConfig([]SeriesField{SeriesFieldSubtitle, SeriesFieldISBN}, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	kobodbtest.Check(t, "result", testUpdateSeries(t, k, "", SeriesFieldSubtitle, SeriesFieldISBN),
+		`a.epub ISBN="9780000000002" Subtitle="Subtitle"`,
+	)
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/a.epub"),
+		`Series="Kobo Series" SeriesNumber=NULL SeriesID=NULL Subtitle="Subtitle" Publisher=NULL ISBN="9780000000002" Description=NULL Language="fr"`,
+	)
+
+	if err := k.SeriesConfig(nil, false, false, false); err == nil {
+		t.Errorf("expected error without fields")
+	}
+}
+
+func TestSeriesMetaDefaultFields(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+	testImport(t, k, "a.epub", map[string]string{"Publisher": "Kobo Publisher", "Language": "fr"})
+
+	// only the series is updated by default
+	if err := k.SeriesConfig([]SeriesField{SeriesFieldSeries}, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	kobodbtest.Check(t, "result", testUpdateSeries(t, k, "", SeriesFieldSeries),
+		`a.epub Series="Saga" SeriesNumber="2.5"`,
+	)
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/a.epub"),
+		`Series="Saga" SeriesNumber="2.5" SeriesID="Saga" Subtitle=NULL Publisher="Kobo Publisher" ISBN=NULL Description=NULL Language="fr"`,
+	)
+}
+
+func TestSeriesMetaNoReplace(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+	kobodbtest.WriteEPUB(t, k.Path, "b.epub", testMetadata)
+	testImport(t, k, "a.epub", map[string]string{"Series": "Kobo Series", "SeriesNumber": "1", "SeriesID": "kobo-id", "Subtitle": "", "Language": "fr"})
+	testImport(t, k, "b.epub", nil)
+
+	if err := k.SeriesConfig(SeriesFields, true, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	testUpdateSeries(t, k, "", SeriesFields...)
+
+	kobodbtest.Check(t, "book with metadata", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/a.epub"),
+		`Series="Kobo Series" SeriesNumber="1" SeriesID="kobo-id" Subtitle="Subtitle" Publisher="Publisher" ISBN="9780000000002" Description="Description." Language="fr"`,
+	)
+	kobodbtest.Check(t, "book without metadata", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/b.epub"),
+		`Series="Saga" SeriesNumber="2.5" SeriesID="Saga" Subtitle="Subtitle" Publisher="Publisher" ISBN="9780000000002" Description="Description." Language="en"`,
+	)
+}
+
+func TestSeriesMetaNoPersist(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+
+	if err := k.SeriesConfig(SeriesFields, false, true, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	testUpdateSeries(t, k, "", SeriesFields...)
+	kobodbtest.Check(t, "table before import", kobodbtest.Query(t, k.DB, `SELECT ImageId FROM _seriesmeta`), `ImageId="file____mnt_onboard_a_epub"`)
+
+	testImport(t, k, "a.epub", nil)
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, `SELECT Series, Subtitle FROM content WHERE ContentID = ?`, "file:///mnt/onboard/a.epub"), `Series="Saga" Subtitle="Subtitle"`)
+	kobodbtest.Check(t, "table after import", kobodbtest.Query(t, k.DB, `SELECT ImageId FROM _seriesmeta`))
+}
+
+func TestSeriesMetaSD(t *testing.T) {
+	k := testKobo(t)
+	sd := t.TempDir()
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", `<meta name="calibre:series" content="Onboard"/>`)
+	kobodbtest.WriteEPUB(t, sd, "Books/b.epub", `<meta name="calibre:series" content="SD"/>`)
+	kobodbtest.WriteEPUB(t, sd, "c.epub", `<meta name="calibre:series" content="SD"/>`)
+	testImport(t, k, "a.epub", nil)
+	kobodbtest.Import(t, k.DB, "file:///mnt/sd/Books/b.epub", nil)
+
+	if err := k.SeriesConfig(SeriesFields, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	kobodbtest.Check(t, "result", testUpdateSeries(t, k, sd, SeriesFieldSeries),
+		`a.epub Series="Onboard"`,
+		filepath.ToSlash(filepath.Join(sd, "Books", "b.epub"))+` Series="SD"`,
+		filepath.ToSlash(filepath.Join(sd, "c.epub"))+` Series="SD"`,
+	)
+	kobodbtest.Check(t, "table", kobodbtest.Query(t, k.DB, `SELECT ImageId, Series FROM _seriesmeta ORDER BY ImageId`),
+		`ImageId="file____mnt_onboard_a_epub" Series="Onboard"`,
+		`ImageId="file____mnt_sd_Books_b_epub" Series="SD"`,
+		`ImageId="file____mnt_sd_c_epub" Series="SD"`,
+	)
+
+	kobodbtest.Import(t, k.DB, "file:///mnt/sd/c.epub", nil)
+	kobodbtest.Check(t, "books", kobodbtest.Query(t, k.DB, `SELECT ContentID, Series FROM content ORDER BY ContentID`),
+		`ContentID="file:///mnt/onboard/a.epub" Series="Onboard"`,
+		`ContentID="file:///mnt/sd/Books/b.epub" Series="SD"`,
+		`ContentID="file:///mnt/sd/c.epub" Series="SD"`,
+	)
+}
+
+func TestSeriesMetaMigrate(t *testing.T) {
+	k := testKobo(t)
+	if _, err := k.DB.Exec(`
+		CREATE TABLE _seriesmeta (
+			ImageId      TEXT NOT NULL UNIQUE,
+			Series       TEXT,
+			SeriesNumber TEXT,
+			PRIMARY KEY(ImageId)
+		);
+		INSERT INTO _seriesmeta (ImageId, Series, SeriesNumber) VALUES ('file____mnt_onboard_a_epub', 'Old', '1');
+	`); err != nil {
+		t.Fatalf("create old table: %v", err)
+	}
+
+	if err := k.SeriesConfig(SeriesFields, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	kobodbtest.Check(t, "table", kobodbtest.Query(t, k.DB, `SELECT * FROM _seriesmeta`),
+		`ImageId="file____mnt_onboard_a_epub" Series="Old" SeriesNumber="1" Subtitle=NULL Publisher=NULL ISBN=NULL Description=NULL Language=NULL`,
+	)
+
+	testImport(t, k, "a.epub", map[string]string{"Publisher": "Kobo Publisher"})
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, testBookQuery, "file:///mnt/onboard/a.epub"),
+		`Series="Old" SeriesNumber="1" SeriesID="Old" Subtitle=NULL Publisher="Kobo Publisher" ISBN=NULL Description=NULL Language=NULL`,
+	)
+}
+
+func TestSeriesMetaDryRun(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", testMetadata)
+	kobodbtest.WriteEPUB(t, k.Path, "b.epub", `<meta name="calibre:series" content="Saga"/><meta name="calibre:series_index" content="1"/><dc:language>en</dc:language>`)
+	kobodbtest.WriteEPUB(t, k.Path, "c.epub", ``)
+	testImport(t, k, "a.epub", map[string]string{"Series": "Old", "SeriesNumber": "1", "Language": "fr"})
+	testImport(t, k, "b.epub", map[string]string{"Series": "Saga", "SeriesNumber": "1", "Language": "en", "Publisher": "Kobo Publisher"})
+
+	kobodbtest.Check(t, "result", testUpdateSeriesWith(t, k, "", nil, true, SeriesFields...),
+		`a.epub Description="Description." ISBN="9780000000002" Language="en" Publisher="Publisher" Series="Saga" SeriesNumber="2.5" Subtitle="Subtitle" | Language="fr" Series="Old" SeriesNumber="1"`,
+		`b.epub Language="en" Series="Saga" SeriesNumber="1" | Language="en" Publisher="Kobo Publisher" Series="Saga" SeriesNumber="1"`,
+		`c.epub | (not imported)`,
+	)
+	kobodbtest.Check(t, "schema", kobodbtest.Query(t, k.DB, `SELECT name FROM sqlite_master WHERE name LIKE '%seriesmeta%'`))
+	kobodbtest.Check(t, "books", kobodbtest.Query(t, k.DB, `SELECT ContentID, Series FROM content ORDER BY ContentID`),
+		`ContentID="file:///mnt/onboard/a.epub" Series="Old"`,
+		`ContentID="file:///mnt/onboard/b.epub" Series="Saga"`,
+	)
+
+	if err := k.SeriesConfig(SeriesFields, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	testUpdateSeriesWith(t, k, "", nil, true, SeriesFields...)
+	kobodbtest.Check(t, "table", kobodbtest.Query(t, k.DB, `SELECT count() FROM _seriesmeta`), `count()="0"`)
+}
+
+func TestSeriesChanges(t *testing.T) {
+	meta := map[string]string{"Series": "Saga", "SeriesNumber": "2", "Language": "en", "ISBN": "9780000000002"}
+	for _, c := range []struct {
+		What      string
+		Fields    []SeriesField
+		NoReplace bool
+		Current   map[string]string
+		Exp       []string
+	}{
+		{"no changes", SeriesFields, false, map[string]string{"Series": "Saga", "SeriesNumber": "2", "Language": "en", "ISBN": "9780000000002", "Publisher": "Kobo"}, nil},
+		{"all changes", SeriesFields, false, map[string]string{}, []string{"Series", "SeriesNumber", "ISBN", "Language"}},
+		{"replaced", SeriesFields, false, map[string]string{"Series": "Other", "SeriesNumber": "2", "Language": "fr", "ISBN": "9780000000002"}, []string{"Series", "Language"}},
+		{"not replaced", SeriesFields, true, map[string]string{"Series": "Other", "Language": "fr"}, []string{"ISBN"}},
+		{"only some fields", []SeriesField{SeriesFieldLanguage}, false, map[string]string{}, []string{"Language"}},
+	} {
+		if act := seriesChanges(c.Fields, c.NoReplace, meta, c.Current); strings.Join(act, ",") != strings.Join(c.Exp, ",") {
+			t.Errorf("%s: expected %q, got %q", c.What, c.Exp, act)
+		}
+	}
+	if act := seriesChanges(SeriesFields, false, map[string]string{}, map[string]string{"Series": "Old", "Publisher": "Kobo"}); strings.Join(act, ",") != "Series" {
+		t.Errorf("removed series: expected [Series], got %q", act)
+	}
+}
+
+// TestReadEPUBMetaSeriesParity checks that the series metadata read using
+// epubmeta matches what seriesmeta's own parser (readEPUBSeriesInfoLegacy)
+// read before it was replaced. The known differences are that a missing
+// package document is now an error, an index without a series is ignored, and
+// the first refinement is used if there are duplicates.
+func TestReadEPUBMetaSeriesParity(t *testing.T) {
+	const container = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`
+	opf := func(version, metadata string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="` + version + `">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + metadata + `</metadata>
+	<manifest/>
+	<spine/>
+</package>`
+	}
+	for _, c := range []struct {
+		What  string
+		Files map[string]string
+	}{
+		{"no series", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<dc:title>Title</dc:title>`),
+		}},
+		{"calibre series", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="2.5"/>`),
+		}},
+		{"calibre series without index", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/>`),
+		}},
+		{"calibre series with invalid index", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="two"/>`),
+		}},
+		{"calibre series with zero index", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="0"/>`),
+		}},
+		{"calibre series untrimmed", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content=" Series "/><meta name="calibre:series_index" content="1"/>`),
+		}},
+		{"epub3 series", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta property="belongs-to-collection" id="c1"> Series </meta><meta refines="#c1" property="collection-type">series</meta><meta refines="#c1" property="group-position">3</meta>`),
+		}},
+		{"epub3 series without collection type", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta property="belongs-to-collection" id="c1">Series</meta><meta refines="#c1" property="group-position">4</meta>`),
+		}},
+		{"epub3 series without id", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta property="belongs-to-collection">Series</meta>`),
+		}},
+		{"epub3 set", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta property="belongs-to-collection" id="c1">Set</meta><meta refines="#c1" property="collection-type">set</meta><meta refines="#c1" property="group-position">1</meta>`),
+		}},
+		{"calibre and epub3 series", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta property="belongs-to-collection" id="c1">EPUB3</meta><meta refines="#c1" property="group-position">3</meta><meta name="calibre:series" content="Calibre"/><meta name="calibre:series_index" content="1"/>`),
+		}},
+		{"empty calibre series and epub3 series", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("3.0", `<meta name="calibre:series" content=""/><meta property="belongs-to-collection" id="c1">EPUB3</meta><meta refines="#c1" property="group-position">3</meta>`),
+		}},
+		{"nested metadata", map[string]string{
+			"META-INF/container.xml": container,
+			"OEBPS/content.opf":      opf("2.0", `<dc-metadata><dc:title>Title</dc:title></dc-metadata><x-metadata><meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="5"/></x-metadata>`),
+		}},
+		{"case-insensitive package document path", map[string]string{
+			"META-INF/container.xml": container,
+			"oebps/CONTENT.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="6"/>`),
+		}},
+		{"package document path with leading slash", map[string]string{
+			"META-INF/container.xml": strings.Replace(container, `full-path="OEBPS`, `full-path="/OEBPS`, 1),
+			"OEBPS/content.opf":      opf("2.0", `<meta name="calibre:series" content="Series"/><meta name="calibre:series_index" content="7"/>`),
+		}},
+	} {
+		t.Run(c.What, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "book.epub")
+			f, err := os.Create(fn)
+			if err != nil {
+				t.Fatalf("write epub: %v", err)
+			}
+			zw := zip.NewWriter(f)
+			for name, data := range c.Files {
+				w, err := zw.Create(name)
+				if err != nil {
+					t.Fatalf("write epub: %v", err)
+				}
+				if _, err := w.Write([]byte(data)); err != nil {
+					t.Fatalf("write epub: %v", err)
+				}
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatalf("write epub: %v", err)
+			}
+			f.Close()
+
+			series, index, err := readEPUBSeriesInfoLegacy(fn)
+			if err != nil {
+				t.Fatalf("legacy: unexpected error: %v", err)
+			}
+			exp := map[string]string{}
+			if series != "" {
+				exp["Series"] = series
+				if index > 0 {
+					exp["SeriesNumber"] = strconv.FormatFloat(index, 'f', -1, 64)
+				}
+			}
+
+			meta, err := readEPUBMeta(fn, []SeriesField{SeriesFieldSeries})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			kobodbtest.Check(t, "series", testMeta(meta), testMeta(exp)...)
+		})
+	}
+}
+
+func TestSeriesMetaCSV(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "a.epub", `<meta name="calibre:series" content="Wrong"/><meta name="calibre:series_index" content="1"/><dc:language>en</dc:language>`)
+	kobodbtest.WriteEPUB(t, k.Path, "b.epub", `<meta name="calibre:series" content="Saga"/>`)
+	kobodbtest.WriteEPUB(t, k.Path, "c.epub", `<meta name="calibre:series" content="Saga"/>`)
+	kobodbtest.WriteEPUB(t, k.Path, "e.epub", `<meta name="calibre:series" content="Saga"/><meta name="calibre:series_index" content="1"/>`)
+	testImport(t, k, "a.epub", map[string]string{"Title": "A", "Attribution": "Author, Other"})
+	testImport(t, k, "b.epub", map[string]string{"Title": "B"})
+	testImport(t, k, "c.epub", map[string]string{"Title": "C"})
+	if _, err := k.DB.Exec(`INSERT INTO content (ContentID, ContentType, MimeType, ___UserID, Title, Series) VALUES ('00000000-0000-0000-0000-000000000000', 6, 'application/x-kobo-epub+zip', 'user', 'Store Book', 'Saga')`); err != nil {
+		t.Fatalf("insert store book: %v", err)
+	}
+
+	if err := k.SeriesConfig(SeriesFields, false, false, false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	testUpdateSeries(t, k, "", SeriesFields...)
+
+	var buf strings.Builder
+	if n, err := k.ExportSeries(&buf); err != nil {
+		t.Fatalf("export: %v", err)
+	} else if n != 3 {
+		t.Errorf("export: expected 3 books, got %d", n)
+	}
+	kobodbtest.Check(t, "export", strings.Split(buf.String(), "\n"),
+		`ContentID,Title,Author,Series,SeriesNumber`,
+		`file:///mnt/onboard/a.epub,A,"Author, Other",Wrong,1`,
+		`file:///mnt/onboard/b.epub,B,,Saga,`,
+		`file:///mnt/onboard/c.epub,C,,Saga,`,
+		``,
+	)
+
+	overrides, err := ReadSeriesCSV(strings.NewReader("\ufeffcontentid,Series,SeriesNumber\r\n" +
+		"file:///mnt/onboard/a.epub, Right ,2\r\n" +
+		"file:///mnt/onboard/b.epub,,\r\n" +
+		"file:///mnt/onboard/c.epub,Saga,\r\n" +
+		"file:///mnt/onboard/e.epub,Saga,1.0\r\n" +
+		"file:///mnt/sd/d.epub,Saga,3\r\n"))
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+
+	// unedited rows are ignored
+	if n, err := k.RemoveUnchangedSeriesOverrides(overrides, ""); err != nil {
+		t.Fatalf("remove unchanged overrides: %v", err)
+	} else if n != 2 {
+		t.Errorf("remove unchanged overrides: expected 2, got %d", n)
+	}
+	kobodbtest.Check(t, "dry run result", testUpdateSeriesWith(t, k, "", overrides, true, SeriesFields...),
+		`a.epub Language="en" Series="Right" SeriesNumber="2" | Language="en" Series="Wrong" SeriesNumber="1"`,
+		`b.epub | Series="Saga"`,
+		`c.epub Series="Saga" | Series="Saga"`,
+		`e.epub Series="Saga" SeriesNumber="1" | (not imported)`,
+	)
+
+	if err := k.SetSeriesOverrides(overrides); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	stored, err := k.SeriesOverrides()
+	if err != nil {
+		t.Fatalf("read overrides: %v", err)
+	}
+	kobodbtest.Check(t, "stored overrides", kobodbtest.Query(t, k.DB, `SELECT * FROM _seriesmeta_override ORDER BY ImageId`),
+		`ImageId="file____mnt_onboard_a_epub" Series="Right" SeriesNumber="2"`,
+		`ImageId="file____mnt_onboard_b_epub" Series=NULL SeriesNumber=NULL`,
+		`ImageId="file____mnt_sd_d_epub" Series="Saga" SeriesNumber="3"`,
+	)
+
+	testUpdateSeriesWith(t, k, "", stored, false, SeriesFields...)
+	kobodbtest.Check(t, "books", kobodbtest.Query(t, k.DB, `SELECT ContentID, Series, SeriesNumber, Language FROM content ORDER BY ContentID`),
+		`ContentID="00000000-0000-0000-0000-000000000000" Series="Saga" SeriesNumber=NULL Language=NULL`,
+		`ContentID="file:///mnt/onboard/a.epub" Series="Right" SeriesNumber="2" Language="en"`,
+		`ContentID="file:///mnt/onboard/b.epub" Series=NULL SeriesNumber=NULL Language=NULL`,
+		`ContentID="file:///mnt/onboard/c.epub" Series="Saga" SeriesNumber=NULL Language=NULL`,
+	)
+
+	if err := k.SetSeriesOverrides(nil); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if stored, err := k.SeriesOverrides(); err != nil {
+		t.Fatalf("read overrides: %v", err)
+	} else if len(stored) != 0 {
+		t.Errorf("expected overrides to be replaced, got %v", stored)
+	}
+
+	if err := k.SeriesConfig(nil, false, false, true); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if stored, err := k.SeriesOverrides(); err != nil || stored != nil {
+		t.Errorf("expected no overrides after uninstall, got %v, %v", stored, err)
+	}
+}
+
+func TestReadSeriesCSV(t *testing.T) {
+	for _, c := range []struct {
+		What, CSV, Err string
+	}{
+		{"empty", "", "missing header"},
+		{"missing column", "ContentID,Series\n", `missing column "seriesnumber"`},
+		{"store book", "ContentID,Series,SeriesNumber\n00000000-0000-0000-0000-000000000000,Saga,1\n", `row 2: "00000000-0000-0000-0000-000000000000" is not a sideloaded book`},
+		{"number without series", "ContentID,Series,SeriesNumber\nfile:///mnt/onboard/a.epub,,1\n", "row 2: series number without a series"},
+		{"invalid number", "ContentID,Series,SeriesNumber\nfile:///mnt/onboard/a.epub,Saga,one\n", `row 2: invalid series number "one"`},
+		{"duplicate", "ContentID,Series,SeriesNumber\nfile:///mnt/onboard/a.epub,Saga,1\nfile:///mnt/onboard/a.epub,Saga,2\n", `row 3: duplicate book "file:///mnt/onboard/a.epub"`},
+		{"short row", "ContentID,Title,Series,SeriesNumber\nfile:///mnt/onboard/a.epub,Title\n", ""},
+	} {
+		if _, err := ReadSeriesCSV(strings.NewReader(c.CSV)); c.Err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.What, err)
+		} else if c.Err != "" && (err == nil || err.Error() != c.Err) {
+			t.Errorf("%s: expected error %q, got %v", c.What, c.Err, err)
+		}
+	}
+}
+
+// readEPUBSeriesInfoLegacy is the parser used by seriesmeta before it was
+// switched to epubmeta, kept as-is for TestReadEPUBMetaSeriesParity.
+func readEPUBSeriesInfoLegacy(filename string) (series string, index float64, err error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not open ebook: %w", err)
+	}
+	defer zr.Close()
+
+	var rootfile string
+	for _, f := range zr.File {
+		if strings.TrimLeft(strings.ToLower(f.Name), "/") == "meta-inf/container.xml" {
+			rc, err := f.Open()
+			if err != nil {
+				return "", 0, fmt.Errorf("could not open container.xml: %w", err)
+			}
+			doc := etree.NewDocument()
+			_, err = doc.ReadFrom(rc)
+			if err != nil {
+				rc.Close()
+				return "", 0, fmt.Errorf("could not parse container.xml: %w", err)
+			}
+			if el := doc.FindElement("//rootfiles/rootfile[@full-path]"); el != nil {
+				rootfile = el.SelectAttrValue("full-path", "")
+			}
+			rc.Close()
+			break
+		}
+	}
+	if rootfile == "" {
+		return "", 0, errors.New("could not open ebook: could not find package document")
+	}
+
+	for _, f := range zr.File {
+		if strings.TrimLeft(strings.ToLower(f.Name), "/") == strings.TrimLeft(strings.ToLower(rootfile), "/") {
+			rc, err := f.Open()
+			if err != nil {
+				return "", 0, fmt.Errorf("could not open container.xml: %w", err)
+			}
+			doc := etree.NewDocument()
+			_, err = doc.ReadFrom(rc)
+			if err != nil {
+				rc.Close()
+				return "", 0, fmt.Errorf("could not parse container.xml: %w", err)
+			}
+
+			// Calibre series metadata
+			if el := doc.FindElement("//meta[@name='calibre:series']"); el != nil {
+				series = el.SelectAttrValue("content", "")
+
+				if el := doc.FindElement("//meta[@name='calibre:series_index']"); el != nil {
+					index, _ = strconv.ParseFloat(el.SelectAttrValue("content", "0"), 64)
+				}
+			}
+
+			// EPUB3 series metadata
+			if series == "" {
+				if el := doc.FindElement("//meta[@property='belongs-to-collection']"); el != nil {
+					series = strings.TrimSpace(el.Text())
+
+					var ctype string
+					if id := el.SelectAttrValue("id", ""); id != "" {
+						for _, el := range doc.FindElements("//meta[@refines='#" + id + "']") {
+							val := strings.TrimSpace(el.Text())
+							switch el.SelectAttrValue("property", "") {
+							case "collection-type":
+								ctype = val
+							case "group-position":
+								index, _ = strconv.ParseFloat(val, 64)
+							}
+						}
+					}
+
+					if ctype != "" && ctype != "series" {
+						series, index = "", 0
+					}
+				}
+			}
+			break
+		}
+	}
+	return series, index, nil
+}
@@ -0,0 +1,426 @@
+// Command shelves creates Kobo collections (shelves) for EPUB/KEPUB books from
+// folders, series, or tags.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/kepubify/v4/internal/epubmeta"
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/spf13/pflag"
+)
+
+var version = "dev"
+
+func main() {
+	sources := pflag.StringSliceP("source", "s", []string{"folder"}, "Where to get the shelves from (folder, series, tags)")
+	mirror := pflag.BoolP("mirror", "m", false, "Remove books from shelves which don't match anymore, and delete the shelves if they're empty (only shelves previously created by this tool are affected)")
+	uninstall := pflag.BoolP("uninstall", "u", false, "Uninstall shelves table and hooks (imported shelves will be left untouched)")
+	bf := kobodb.AddBackupFlags(pflag.CommandLine)
+	help := pflag.BoolP("help", "h", false, "Show this help message")
+	pflag.Parse()
+
+	if *help || pflag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: shelves [options] [kobo_path]\n\nVersion:\n  shelves %s\n\nOptions:\n", version)
+		pflag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n  kobo_path is the path to the Kobo eReader. If not specified, shelves will try to automatically detect the Kobo.\n")
+		fmt.Fprintf(os.Stderr, "\nSources:\n  folder  the name of the folder containing the book (books in the root of the Kobo are skipped)\n  series  the Calibre or EPUB3 series\n  tags    the Calibre tags (dc:subject)\n")
+		if pflag.NArg() > 1 {
+			os.Exit(2)
+		} else {
+			os.Exit(0)
+		}
+		return
+	}
+
+	var src []ShelfSource
+	for _, s := range *sources {
+		switch s := ShelfSource(s); s {
+		case ShelfSourceFolder, ShelfSourceSeries, ShelfSourceTags:
+			src = append(src, s)
+		default:
+			fmt.Fprintf(os.Stderr, "Error: Unknown source %q.\n", s)
+			os.Exit(2)
+			return
+		}
+	}
+
+	fmt.Println("Finding kobo")
+	var kp string
+	if pflag.NArg() == 1 {
+		kp = pflag.Arg(0)
+	} else {
+		kobos, err := kobo.Find()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not automatically detect a Kobo eReader: %v.\n", err)
+			os.Exit(1)
+		} else if len(kobos) == 0 {
+			fmt.Fprintf(os.Stderr, "Could not automatically detect a Kobo eReader.\n")
+			os.Exit(1)
+		}
+		kp = kobos[0]
+	}
+
+	fmt.Println("Opening kobo")
+	k, err := OpenKobo(kp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	if bf.Restore != "" {
+		ok := bf.RunRestore(k.Kobo)
+		k.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !bf.RunBackup(k.Kobo) {
+		k.Close()
+		os.Exit(1)
+		return
+	}
+
+	fmt.Println("Setting up database")
+	if err := k.ShelfConfig(*uninstall); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up database: %v.\n", err)
+		k.Close()
+		os.Exit(1)
+		return
+	}
+
+	if *uninstall {
+		if !bf.RunCheck(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+		k.Close()
+		os.Exit(0)
+		return
+	}
+
+	fmt.Println("Updating shelves")
+	var nt, nu, ne, nn int
+	removed, err := k.UpdateShelves(src, *mirror, func(filename string, i, total int, shelves []string, err error) {
+		fmt.Printf("[%3d/%3d] %-40s %s\n", i+1, total, "("+strings.Join(shelves, ", ")+")", filename)
+		if err != nil {
+			fmt.Printf("--------- Error: %v\n", err)
+			ne++
+		} else if len(shelves) == 0 {
+			nn++
+		} else {
+			nu++
+		}
+		nt = total
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not update shelves: %v.\n", err)
+		k.Close()
+		os.Exit(1)
+		return
+	}
+
+	fmt.Printf("%d total: %d updated, %d errored, %d without shelves", nt, nu, ne, nn)
+	if *mirror {
+		fmt.Printf(", %d removed from shelves", removed)
+	}
+	fmt.Printf("\n")
+	if !bf.RunCheck(k.Kobo) {
+		k.Close()
+		os.Exit(1)
+		return
+	}
+	if ne > 0 {
+		k.Close()
+		os.Exit(1)
+		return
+	}
+	k.Close()
+}
+
+// Kobo is a Kobo eReader.
+type Kobo struct {
+	*kobodb.Kobo
+}
+
+// OpenKobo opens a Kobo eReader device and the database.
+func OpenKobo(path string) (*Kobo, error) {
+	k, err := kobodb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Kobo{k}, nil
+}
+
+// ShelfSource is where shelves are generated from.
+type ShelfSource string
+
+const (
+	ShelfSourceFolder ShelfSource = "folder"
+	ShelfSourceSeries ShelfSource = "series"
+	ShelfSourceTags   ShelfSource = "tags"
+)
+
+// ShelfConfig sets up the table and triggers for shelves. The table contains
+// the shelves for each book, and the triggers add the books to the shelves
+// when they are (re-)imported or added to the table, and remove them when
+// they are removed from the table. If uninstall is true, the table and
+// triggers will be removed.
+func (k *Kobo) ShelfConfig(uninstall bool) error {
+	buf := bytes.NewBuffer(nil)
+	template.Must(template.New("").Parse(`
+		{{if .Uninstall}}
+		DROP TABLE IF EXISTS _shelfmeta;
+		{{else}}
+		CREATE TABLE IF NOT EXISTS _shelfmeta (
+			ContentID TEXT NOT NULL,
+			ShelfName TEXT NOT NULL,
+			PRIMARY KEY(ContentID, ShelfName)
+		);
+		{{end}}
+
+		/* Adding books to shelves on import */
+
+		DROP TRIGGER IF EXISTS _shelfmeta_content_insert;
+		{{if not .Uninstall}}
+		CREATE TRIGGER _shelfmeta_content_insert
+			AFTER INSERT ON content WHEN
+				(new.ContentType = '6') AND /* new.* doesn't have the column affinity */
+				(SELECT count() FROM _shelfmeta WHERE ContentID = new.ContentID)
+			BEGIN
+				INSERT INTO Shelf (CreationDate, Id, InternalName, LastModified, Name, Type, _IsDeleted, _IsVisible, _IsSynced)
+				SELECT DISTINCT strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), ShelfName, ShelfName, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), ShelfName, 'UserTag', 'false', 'true', 'false'
+				FROM _shelfmeta WHERE ContentID = new.ContentID AND ShelfName NOT IN (SELECT Name FROM Shelf WHERE Name NOT NULL);
+
+				UPDATE Shelf
+				SET _IsDeleted = 'false', _IsVisible = 'true', _IsSynced = 'false', LastModified = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+				WHERE _IsDeleted = 'true' AND Name IN (SELECT ShelfName FROM _shelfmeta WHERE ContentID = new.ContentID);
+
+				INSERT OR REPLACE INTO ShelfContent (ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced)
+				SELECT ShelfName, ContentID, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), 'false', 'false'
+				FROM _shelfmeta WHERE ContentID = new.ContentID AND ShelfName NOT IN (SELECT ShelfName FROM ShelfContent WHERE ContentId = new.ContentID AND _IsDeleted = 'false');
+			END;
+		{{end}}
+
+		/* Adding books to shelves directly when already imported */
+
+		DROP TRIGGER IF EXISTS _shelfmeta_shelfmeta_insert;
+		{{if not .Uninstall}}
+		CREATE TRIGGER _shelfmeta_shelfmeta_insert
+			AFTER INSERT ON _shelfmeta WHEN
+				(SELECT count() FROM content WHERE ContentID = new.ContentID AND ContentType = 6)
+			BEGIN
+				INSERT INTO Shelf (CreationDate, Id, InternalName, LastModified, Name, Type, _IsDeleted, _IsVisible, _IsSynced)
+				SELECT strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), new.ShelfName, new.ShelfName, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), new.ShelfName, 'UserTag', 'false', 'true', 'false'
+				WHERE new.ShelfName NOT IN (SELECT Name FROM Shelf WHERE Name NOT NULL);
+
+				UPDATE Shelf
+				SET _IsDeleted = 'false', _IsVisible = 'true', _IsSynced = 'false', LastModified = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+				WHERE _IsDeleted = 'true' AND Name = new.ShelfName;
+
+				INSERT OR REPLACE INTO ShelfContent (ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced)
+				SELECT new.ShelfName, new.ContentID, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), 'false', 'false'
+				WHERE new.ShelfName NOT IN (SELECT ShelfName FROM ShelfContent WHERE ContentId = new.ContentID AND _IsDeleted = 'false');
+			END;
+		{{end}}
+
+		/* Removing books from shelves (only done with --mirror) */
+
+		DROP TRIGGER IF EXISTS _shelfmeta_shelfmeta_delete;
+		{{if not .Uninstall}}
+		CREATE TRIGGER _shelfmeta_shelfmeta_delete
+			AFTER DELETE ON _shelfmeta
+			BEGIN
+				UPDATE ShelfContent
+				SET _IsDeleted = 'true', _IsSynced = 'false', DateModified = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+				WHERE ShelfName = old.ShelfName AND ContentId = old.ContentID AND _IsDeleted != 'true';
+
+				/* Delete the shelf if it's empty now */
+				UPDATE Shelf
+				SET _IsDeleted = 'true', _IsSynced = 'false', LastModified = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+				WHERE Name = old.ShelfName AND _IsDeleted != 'true' AND
+					(SELECT count() FROM _shelfmeta WHERE ShelfName = old.ShelfName) = 0 AND
+					(SELECT count() FROM ShelfContent WHERE ShelfName = old.ShelfName AND _IsDeleted != 'true') = 0;
+			END;
+		{{end}}
+	`)).Execute(buf, map[string]interface{}{
+		"Uninstall": uninstall,
+	})
+	_, err := k.DB.Exec(buf.String())
+	return err
+}
+
+// UpdateShelves updates the shelves for all epub books on the device from the
+// specified sources. If mirror is true, books are removed from shelves created
+// by this tool if they don't match anymore (or don't exist anymore), and the
+// number of books removed from shelves is returned. All errors from individual
+// books are returned through the log callback.
+func (k *Kobo) UpdateShelves(sources []ShelfSource, mirror bool, log func(filename string, i, total int, shelves []string, err error)) (int, error) {
+	var epubs []string
+	err := filepath.Walk(k.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != k.Path {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to scan %q: %v.\n", path, err)
+				return nil
+			}
+			return fmt.Errorf("error scanning %q: %w", path, err)
+		}
+		if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".epub") {
+			epubs = append(epubs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	relEpubs := make([]string, len(epubs))
+	for i, epub := range epubs {
+		relEpubs[i], err = filepath.Rel(k.Path, epub)
+		if err != nil {
+			return 0, fmt.Errorf("could not resolve relative path to %#v: %w", epub, err)
+		}
+	}
+
+	tx, err := k.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type entry struct{ ContentID, ShelfName string }
+	keep := map[entry]bool{}
+
+	for i, epub := range epubs {
+		relEpub := relEpubs[i]
+		contentID := kobo.PathToContentID(relEpub)
+
+		shelves, err := bookShelves(epub, relEpub, sources)
+		if err != nil {
+			log(relEpub, i, len(epubs), nil, err)
+
+			// don't remove it from any shelves since we don't know
+			keep[entry{contentID, ""}] = true
+			continue
+		}
+
+		// so a failed book doesn't leave partial rows
+		if _, err := tx.Exec(`SAVEPOINT shelves`); err != nil {
+			return 0, fmt.Errorf("could not create savepoint: %w", err)
+		}
+
+		for _, shelf := range shelves {
+			keep[entry{contentID, shelf}] = true
+			if _, err = tx.Exec("INSERT OR REPLACE INTO _shelfmeta (ContentID, ShelfName) VALUES (?, ?)", contentID, shelf); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if _, err := tx.Exec(`ROLLBACK TO shelves`); err != nil {
+				return 0, fmt.Errorf("could not roll back to savepoint: %w", err)
+			}
+
+			// don't remove it from any shelves since it wasn't updated
+			keep[entry{contentID, ""}] = true
+		}
+		if _, err := tx.Exec(`RELEASE shelves`); err != nil {
+			return 0, fmt.Errorf("could not release savepoint: %w", err)
+		}
+
+		log(relEpub, i, len(epubs), shelves, err)
+	}
+
+	var removed int
+	if mirror {
+		rows, err := tx.Query("SELECT ContentID, ShelfName FROM _shelfmeta")
+		if err != nil {
+			return 0, fmt.Errorf("could not read existing shelves: %w", err)
+		}
+		var stale []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.ContentID, &e.ShelfName); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("could not read existing shelves: %w", err)
+			}
+			if !keep[e] && !keep[entry{e.ContentID, ""}] {
+				stale = append(stale, e)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("could not read existing shelves: %w", err)
+		}
+
+		for _, e := range stale {
+			if _, err := tx.Exec("DELETE FROM _shelfmeta WHERE ContentID = ? AND ShelfName = ?", e.ContentID, e.ShelfName); err != nil {
+				return 0, fmt.Errorf("could not remove %q from shelf %q: %w", e.ContentID, e.ShelfName, err)
+			}
+		}
+		removed = len(stale)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not commit db transaction: %w", err)
+	}
+
+	return removed, nil
+}
+
+// bookShelves gets the shelves for an epub book from the specified sources.
+func bookShelves(filename, rel string, sources []ShelfSource) ([]string, error) {
+	var shelves []string
+	add := func(shelf string) {
+		if shelf = strings.TrimSpace(shelf); shelf != "" {
+			for _, x := range shelves {
+				if x == shelf {
+					return
+				}
+			}
+			shelves = append(shelves, shelf)
+		}
+	}
+
+	var m *epubmeta.Metadata
+	for _, src := range sources {
+		switch src {
+		case ShelfSourceFolder:
+			if dir := filepath.Dir(rel); dir != "." {
+				add(filepath.Base(dir))
+			}
+		case ShelfSourceSeries, ShelfSourceTags:
+			if m == nil {
+				zr, err := zip.OpenReader(filename)
+				if err != nil {
+					return nil, fmt.Errorf("could not open ebook: %w", err)
+				}
+				m, err = epubmeta.Read(zr)
+				zr.Close()
+				if err != nil {
+					return nil, fmt.Errorf("could not read ebook metadata: %w", err)
+				}
+			}
+			if src == ShelfSourceSeries {
+				add(m.Series)
+			} else {
+				for _, tag := range m.Subjects {
+					add(tag)
+				}
+			}
+		}
+	}
+	sort.Strings(shelves)
+	return shelves, nil
+}
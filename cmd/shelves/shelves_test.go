@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pgaskin/kepubify/v4/internal/kobodb/kobodbtest"
+)
+
+// testKobo creates a Kobo with an empty database and sets up shelves.
+func testKobo(t *testing.T) *Kobo {
+	t.Helper()
+
+	k, err := OpenKobo(kobodbtest.New(t))
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	t.Cleanup(func() { k.Close() })
+
+	if err := k.ShelfConfig(false); err != nil {
+		t.Fatalf("set up database: %v", err)
+	}
+	return k
+}
+
+// testImport adds a book to the content table like the Kobo does when it
+// imports a sideloaded book, replacing it if it already exists.
+func testImport(t *testing.T, k *Kobo, fn string) {
+	t.Helper()
+	id := "file:///mnt/onboard/" + fn
+	if _, err := k.DB.Exec(`DELETE FROM content WHERE ContentID = ?`, id); err != nil {
+		t.Fatalf("import %q: %v", fn, err)
+	}
+	kobodbtest.Import(t, k.DB, id, nil)
+}
+
+// testUpdateShelves runs UpdateShelves and returns the log.
+func testUpdateShelves(t *testing.T, k *Kobo, mirror bool, removed int, sources ...ShelfSource) []string {
+	t.Helper()
+	var res []string
+	n, err := k.UpdateShelves(sources, mirror, func(filename string, i, total int, shelves []string, err error) {
+		s := fmt.Sprintf("%s [%s]", filepath.ToSlash(filename), strings.Join(shelves, ", "))
+		if err != nil {
+			s += " (error)"
+		}
+		res = append(res, s)
+	})
+	if err != nil {
+		t.Fatalf("update shelves: unexpected error: %v", err)
+	}
+	if n != removed {
+		t.Errorf("update shelves: expected %d removed, got %d", removed, n)
+	}
+	return res
+}
+
+const (
+	testShelfQuery        = `SELECT Id, Name, Type, _IsDeleted, _IsVisible, CreationDate NOT NULL AS Created FROM Shelf ORDER BY Name`
+	testShelfContentQuery = `SELECT ShelfName, ContentId, _IsDeleted, DateModified NOT NULL AS Modified FROM ShelfContent ORDER BY ShelfName, ContentId`
+)
+
+func TestShelves(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "Fantasy/a.epub", `<dc:title>A</dc:title><dc:subject>Fiction</dc:subject><dc:subject>Fantasy</dc:subject><meta name="calibre:series" content="Saga"/>`)
+	kobodbtest.WriteEPUB(t, k.Path, "Fantasy/b.kepub.epub", `<dc:title>B</dc:title>`)
+	kobodbtest.WriteEPUB(t, k.Path, "c.epub", `<dc:title>C</dc:title><dc:subject> Fiction </dc:subject>`)
+	kobodbtest.WriteFile(t, k.Path, "Broken/broken.epub", []byte("not a zip"))
+	kobodbtest.WriteFile(t, k.Path, "Fantasy/notes.txt", []byte("not an epub"))
+
+	if _, err := k.DB.Exec(`INSERT INTO Shelf (CreationDate, Id, InternalName, LastModified, Name, Type, _IsDeleted, _IsVisible, _IsSynced) VALUES ('2020-01-01T00:00:00Z', 'existing-id', 'Fiction', '2020-01-01T00:00:00Z', 'Fiction', 'Custom', 'false', 'true', 'true')`); err != nil {
+		t.Fatalf("insert shelf: %v", err)
+	}
+	testImport(t, k, "Fantasy/a.epub")
+	testImport(t, k, "c.epub")
+
+	kobodbtest.Check(t, "folder result", testUpdateShelves(t, k, false, 0, ShelfSourceFolder),
+		`Broken/broken.epub [Broken]`,
+		`Fantasy/a.epub [Fantasy]`,
+		`Fantasy/b.kepub.epub [Fantasy]`,
+		`c.epub []`,
+	)
+	kobodbtest.Check(t, "result", testUpdateShelves(t, k, false, 0, ShelfSourceFolder, ShelfSourceSeries, ShelfSourceTags),
+		`Broken/broken.epub [] (error)`,
+		`Fantasy/a.epub [Fantasy, Fiction, Saga]`,
+		`Fantasy/b.kepub.epub [Fantasy]`,
+		`c.epub [Fiction]`,
+	)
+
+	kobodbtest.Check(t, "shelves", kobodbtest.Query(t, k.DB, testShelfQuery),
+		`Id="Fantasy" Name="Fantasy" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+		`Id="existing-id" Name="Fiction" Type="Custom" _IsDeleted="false" _IsVisible="true" Created="1"`,
+		`Id="Saga" Name="Saga" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+	)
+	kobodbtest.Check(t, "shelf contents", kobodbtest.Query(t, k.DB, testShelfContentQuery),
+		`ShelfName="Fantasy" ContentId="file:///mnt/onboard/Fantasy/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Fiction" ContentId="file:///mnt/onboard/Fantasy/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Fiction" ContentId="file:///mnt/onboard/c.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Saga" ContentId="file:///mnt/onboard/Fantasy/a.epub" _IsDeleted="false" Modified="1"`,
+	)
+
+	// the book is added to the shelf when it's imported
+	testImport(t, k, "Fantasy/b.kepub.epub")
+	kobodbtest.Check(t, "shelf contents after import", kobodbtest.Query(t, k.DB, testShelfContentQuery+` LIMIT 2`),
+		`ShelfName="Fantasy" ContentId="file:///mnt/onboard/Fantasy/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Fantasy" ContentId="file:///mnt/onboard/Fantasy/b.kepub.epub" _IsDeleted="false" Modified="1"`,
+	)
+
+	// and when it's re-imported after being removed from the shelf on the Kobo
+	if _, err := k.DB.Exec(`UPDATE ShelfContent SET _IsDeleted = 'true' WHERE ContentId = 'file:///mnt/onboard/c.epub'`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	testImport(t, k, "c.epub")
+	kobodbtest.Check(t, "shelf contents after re-import", kobodbtest.Query(t, k.DB, `SELECT ShelfName, ContentId, _IsDeleted, DateModified NOT NULL AS Modified FROM ShelfContent WHERE ContentId = 'file:///mnt/onboard/c.epub'`),
+		`ShelfName="Fiction" ContentId="file:///mnt/onboard/c.epub" _IsDeleted="false" Modified="1"`,
+	)
+
+	// and the shelf is restored if it was deleted on the Kobo
+	if _, err := k.DB.Exec(`UPDATE Shelf SET _IsDeleted = 'true' WHERE Name = 'Saga'`); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	testImport(t, k, "Fantasy/a.epub")
+	kobodbtest.Check(t, "shelves after re-import", kobodbtest.Query(t, k.DB, testShelfQuery),
+		`Id="Fantasy" Name="Fantasy" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+		`Id="existing-id" Name="Fiction" Type="Custom" _IsDeleted="false" _IsVisible="true" Created="1"`,
+		`Id="Saga" Name="Saga" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+	)
+	kobodbtest.Check(t, "shelf content count", kobodbtest.Query(t, k.DB, `SELECT count() FROM ShelfContent`), `count()="5"`)
+}
+
+func TestShelvesMirror(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "Old/a.epub", `<dc:subject>Tag</dc:subject>`)
+	kobodbtest.WriteEPUB(t, k.Path, "Old/b.epub", `<dc:subject>Tag</dc:subject>`)
+	testImport(t, k, "Old/a.epub")
+	testImport(t, k, "Old/b.epub")
+
+	if _, err := k.DB.Exec(`
+		INSERT INTO Shelf (Id, Name, Type, _IsDeleted, _IsVisible, _IsSynced) VALUES ('mine', 'Mine', 'Custom', 'false', 'true', 'true');
+		INSERT INTO ShelfContent (ShelfName, ContentId, _IsDeleted, _IsSynced) VALUES ('Mine', 'file:///mnt/onboard/Old/a.epub', 'false', 'true');
+	`); err != nil {
+		t.Fatalf("insert shelf: %v", err)
+	}
+
+	kobodbtest.Check(t, "result", testUpdateShelves(t, k, false, 0, ShelfSourceFolder, ShelfSourceTags),
+		`Old/a.epub [Old, Tag]`,
+		`Old/b.epub [Old, Tag]`,
+	)
+
+	// without mirror, nothing is removed
+	if err := os.Remove(filepath.Join(k.Path, "Old", "b.epub")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	kobodbtest.Check(t, "result after removing book", testUpdateShelves(t, k, false, 0, ShelfSourceFolder),
+		`Old/a.epub [Old]`,
+	)
+	kobodbtest.Check(t, "shelf contents", kobodbtest.Query(t, k.DB, testShelfContentQuery),
+		`ShelfName="Mine" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="false" Modified="0"`,
+		`ShelfName="Old" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Old" ContentId="file:///mnt/onboard/Old/b.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Tag" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Tag" ContentId="file:///mnt/onboard/Old/b.epub" _IsDeleted="false" Modified="1"`,
+	)
+
+	// with mirror, the removed book and the tags which aren't a source anymore
+	// are removed from the shelves, and empty shelves are deleted
+	kobodbtest.Check(t, "result with mirror", testUpdateShelves(t, k, true, 3, ShelfSourceFolder),
+		`Old/a.epub [Old]`,
+	)
+	kobodbtest.Check(t, "shelf contents with mirror", kobodbtest.Query(t, k.DB, testShelfContentQuery),
+		`ShelfName="Mine" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="false" Modified="0"`,
+		`ShelfName="Old" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="false" Modified="1"`,
+		`ShelfName="Old" ContentId="file:///mnt/onboard/Old/b.epub" _IsDeleted="true" Modified="1"`,
+		`ShelfName="Tag" ContentId="file:///mnt/onboard/Old/a.epub" _IsDeleted="true" Modified="1"`,
+		`ShelfName="Tag" ContentId="file:///mnt/onboard/Old/b.epub" _IsDeleted="true" Modified="1"`,
+	)
+	kobodbtest.Check(t, "shelves with mirror", kobodbtest.Query(t, k.DB, testShelfQuery),
+		`Id="mine" Name="Mine" Type="Custom" _IsDeleted="false" _IsVisible="true" Created="0"`,
+		`Id="Old" Name="Old" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+		`Id="Tag" Name="Tag" Type="UserTag" _IsDeleted="true" _IsVisible="true" Created="1"`,
+	)
+
+	// books which can't be read keep their shelves
+	kobodbtest.WriteFile(t, k.Path, "Old/a.epub", []byte("not a zip"))
+	kobodbtest.Check(t, "result with mirror and error", testUpdateShelves(t, k, true, 0, ShelfSourceTags),
+		`Old/a.epub [] (error)`,
+	)
+	kobodbtest.Check(t, "shelves with mirror and error", kobodbtest.Query(t, k.DB, testShelfQuery+` LIMIT 2`),
+		`Id="mine" Name="Mine" Type="Custom" _IsDeleted="false" _IsVisible="true" Created="0"`,
+		`Id="Old" Name="Old" Type="UserTag" _IsDeleted="false" _IsVisible="true" Created="1"`,
+	)
+
+	// but not once they're gone
+	if err := os.Remove(filepath.Join(k.Path, "Old", "a.epub")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	kobodbtest.Check(t, "result with mirror and no books", testUpdateShelves(t, k, true, 1, ShelfSourceFolder))
+	kobodbtest.Check(t, "shelves with mirror and no books", kobodbtest.Query(t, k.DB, testShelfQuery),
+		`Id="mine" Name="Mine" Type="Custom" _IsDeleted="false" _IsVisible="true" Created="0"`,
+		`Id="Old" Name="Old" Type="UserTag" _IsDeleted="true" _IsVisible="true" Created="1"`,
+		`Id="Tag" Name="Tag" Type="UserTag" _IsDeleted="true" _IsVisible="true" Created="1"`,
+	)
+	kobodbtest.Check(t, "table with mirror and no books", kobodbtest.Query(t, k.DB, `SELECT count() FROM _shelfmeta`), `count()="0"`)
+}
+
+func TestShelvesMirrorInsertError(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "Dir/a.epub", `<dc:subject>Good</dc:subject><dc:subject>Worse</dc:subject>`)
+	testImport(t, k, "Dir/a.epub")
+
+	kobodbtest.Check(t, "result", testUpdateShelves(t, k, false, 0, ShelfSourceFolder),
+		`Dir/a.epub [Dir]`,
+	)
+
+	if _, err := k.DB.Exec(`
+		CREATE TRIGGER test_shelfmeta_insert_error
+			BEFORE INSERT ON _shelfmeta
+			WHEN new.ShelfName = 'Worse'
+			BEGIN
+				SELECT RAISE(ABORT, 'test error');
+			END;
+	`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+
+	// books which can't be added to all of their shelves aren't added to any
+	// of them, and keep their existing ones
+	kobodbtest.Check(t, "result with mirror and insert error", testUpdateShelves(t, k, true, 0, ShelfSourceTags),
+		`Dir/a.epub [Good, Worse] (error)`,
+	)
+	kobodbtest.Check(t, "table with mirror and insert error", kobodbtest.Query(t, k.DB, `SELECT ContentID, ShelfName FROM _shelfmeta`),
+		`ContentID="file:///mnt/onboard/Dir/a.epub" ShelfName="Dir"`,
+	)
+	kobodbtest.Check(t, "shelf contents with mirror and insert error", kobodbtest.Query(t, k.DB, testShelfContentQuery),
+		`ShelfName="Dir" ContentId="file:///mnt/onboard/Dir/a.epub" _IsDeleted="false" Modified="1"`,
+	)
+}
+
+func TestShelfConfigUninstall(t *testing.T) {
+	k := testKobo(t)
+	kobodbtest.WriteEPUB(t, k.Path, "Dir/a.epub", ``)
+	testImport(t, k, "Dir/a.epub")
+	kobodbtest.Check(t, "result", testUpdateShelves(t, k, false, 0, ShelfSourceFolder), `Dir/a.epub [Dir]`)
+
+	if err := k.ShelfConfig(true); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	kobodbtest.Check(t, "schema", kobodbtest.Query(t, k.DB, `SELECT type, name FROM sqlite_master WHERE name LIKE '%shelfmeta%'`))
+	kobodbtest.Check(t, "shelf contents", kobodbtest.Query(t, k.DB, testShelfContentQuery),
+		`ShelfName="Dir" ContentId="file:///mnt/onboard/Dir/a.epub" _IsDeleted="false" Modified="1"`,
+	)
+
+	if err := k.ShelfConfig(true); err != nil {
+		t.Errorf("uninstall again: %v", err)
+	}
+}
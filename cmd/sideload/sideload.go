@@ -0,0 +1,384 @@
+// Command sideload adds KEPUBs on a Kobo eReader directly to the database.
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgaskin/kepubify/v4/internal/epubmeta"
+	"github.com/pgaskin/kepubify/v4/internal/kobodb"
+	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/spf13/pflag"
+)
+
+var version = "dev"
+
+func main() {
+	dir := pflag.StringP("dir", "d", "", "Only add books in this directory on the Kobo (relative to kobo_path)")
+	update := pflag.BoolP("update", "u", false, "Update the metadata of books which are already in the database (reading progress is kept)")
+	dryRun := pflag.Bool("dry-run", false, "Show the changes without updating the database")
+	bf := kobodb.AddBackupFlags(pflag.CommandLine)
+	help := pflag.BoolP("help", "h", false, "Show this help message")
+	pflag.Parse()
+
+	if *help || pflag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: sideload [options] [kobo_path]\n\nVersion:\n  sideload %s\n\nOptions:\n", version)
+		pflag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n  kobo_path is the path to the Kobo eReader. If not specified, sideload will try to automatically detect the Kobo.\n")
+		fmt.Fprintf(os.Stderr, "\nBooks are added with the same ContentID and ImageId as when they are imported by the Kobo, so covergen can be used to generate the covers.\n")
+		if pflag.NArg() > 1 {
+			os.Exit(2)
+		} else {
+			os.Exit(0)
+		}
+		return
+	}
+
+	fmt.Println("Finding kobo")
+	var kp string
+	if pflag.NArg() == 1 {
+		kp = pflag.Arg(0)
+	} else {
+		kobos, err := kobo.Find()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not automatically detect a Kobo eReader: %v.\n", err)
+			os.Exit(1)
+		} else if len(kobos) == 0 {
+			fmt.Fprintf(os.Stderr, "Could not automatically detect a Kobo eReader.\n")
+			os.Exit(1)
+		}
+		kp = kobos[0]
+	}
+
+	fmt.Println("Opening kobo")
+	k, err := OpenKobo(kp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Kobo eReader: %v.\n", err)
+		os.Exit(1)
+		return
+	}
+
+	if bf.Restore != "" {
+		ok := bf.RunRestore(k.Kobo)
+		k.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !*dryRun {
+		if !bf.RunBackup(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+
+	fmt.Println("Adding books")
+	var nt, na, nu, ns, ne int
+	if err := k.Sideload(*dir, *update, *dryRun, func(filename string, i, total int, status SideloadStatus, err error) {
+		fmt.Printf("[%3d/%3d] %-8s %s\n", i+1, total, status, filename)
+		switch {
+		case err != nil:
+			fmt.Printf("--------- Error: %v\n", err)
+			ne++
+		case status == SideloadAdded:
+			na++
+		case status == SideloadUpdated:
+			nu++
+		default:
+			ns++
+		}
+		nt = total
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not add books: %v.\n", err)
+		k.Close()
+		os.Exit(1)
+		return
+	}
+
+	if *dryRun {
+		fmt.Printf("%d total: %d would be added, %d would be updated, %d errored, %d skipped\n", nt, na, nu, ne, ns)
+	} else {
+		fmt.Printf("%d total: %d added, %d updated, %d errored, %d skipped\n", nt, na, nu, ne, ns)
+		if !bf.RunCheck(k.Kobo) {
+			k.Close()
+			os.Exit(1)
+			return
+		}
+	}
+	if ne > 0 {
+		k.Close()
+		os.Exit(1)
+		return
+	}
+	k.Close()
+}
+
+// Kobo is a Kobo eReader.
+type Kobo struct {
+	*kobodb.Kobo
+}
+
+// OpenKobo opens a Kobo eReader device and the database.
+func OpenKobo(path string) (*Kobo, error) {
+	k, err := kobodb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Kobo{k}, nil
+}
+
+// SideloadStatus is the result of adding a book.
+type SideloadStatus string
+
+const (
+	SideloadAdded   SideloadStatus = "added"
+	SideloadUpdated SideloadStatus = "updated"
+	SideloadExists  SideloadStatus = "exists"
+	SideloadError   SideloadStatus = "error"
+)
+
+// The content types used by sideloaded KEPUBs.
+const (
+	contentTypeBook    = 6
+	contentTypeChapter = 899
+)
+
+// now is the time used for DateAdded.
+var now = time.Now
+
+// Sideload adds content rows for all KEPUBs in dir (relative to the root of the
+// Kobo, or the entire Kobo if empty). Books already in the database are
+// skipped unless update is true, in which case the metadata is updated, but
+// the reading state is kept. If dryRun is true, the changes are rolled back.
+// All errors from individual books are returned through the log callback.
+func (k *Kobo) Sideload(dir string, update, dryRun bool, log func(filename string, i, total int, status SideloadStatus, err error)) error {
+	root := filepath.Join(k.Path, filepath.FromSlash(dir))
+
+	var kepubs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != root {
+				fmt.Fprintf(os.Stderr, "Warning: Failed to scan %q: %v.\n", path, err)
+				return nil
+			}
+			return fmt.Errorf("error scanning %q: %w", path, err)
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir // the Kobo doesn't import from hidden directories
+			}
+			return nil
+		}
+		if strings.HasSuffix(strings.ToLower(info.Name()), ".kepub.epub") && !strings.HasPrefix(info.Name(), ".") {
+			kepubs = append(kepubs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(kepubs)
+
+	relKepubs := make([]string, len(kepubs))
+	for i, kepub := range kepubs {
+		relKepubs[i], err = filepath.Rel(k.Path, kepub)
+		if err != nil {
+			return fmt.Errorf("could not resolve relative path to %#v: %w", kepub, err)
+		}
+	}
+
+	tx, err := k.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, kepub := range kepubs {
+		relKepub := relKepubs[i]
+
+		// so a failed book doesn't leave partial rows
+		if _, err := tx.Exec(`SAVEPOINT sideload`); err != nil {
+			return fmt.Errorf("could not create savepoint: %w", err)
+		}
+
+		status, err := sideloadBook(tx, kepub, relKepub, update)
+		if err != nil {
+			if _, err := tx.Exec(`ROLLBACK TO sideload`); err != nil {
+				return fmt.Errorf("could not roll back to savepoint: %w", err)
+			}
+			status = SideloadError
+		}
+		if _, err := tx.Exec(`RELEASE sideload`); err != nil {
+			return fmt.Errorf("could not release savepoint: %w", err)
+		}
+
+		log(relKepub, i, len(kepubs), status, err)
+	}
+
+	if dryRun {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit db transaction: %w", err)
+	}
+	return nil
+}
+
+// sideloadBook adds or updates the content rows for a KEPUB.
+func sideloadBook(tx *sql.Tx, fn, rel string, update bool) (SideloadStatus, error) {
+	contentID := kobo.PathToContentID(rel)
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT count() > 0 FROM content WHERE ContentID = ? AND ContentType = ?`, contentID, contentTypeBook).Scan(&exists); err != nil {
+		return SideloadError, fmt.Errorf("check existing book: %w", err)
+	}
+	if exists && !update {
+		return SideloadExists, nil
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return SideloadError, err
+	}
+
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return SideloadError, fmt.Errorf("could not open ebook: %w", err)
+	}
+	defer zr.Close()
+
+	m, err := epubmeta.Read(zr)
+	if err != nil {
+		return SideloadError, fmt.Errorf("could not read metadata: %w", err)
+	}
+
+	title := m.Title
+	if title == "" {
+		title = path.Base(filepath.ToSlash(rel))
+		title = title[:len(title)-len(".kepub.epub")]
+	}
+
+	var seriesID sql.NullString
+	if m.Series != "" {
+		// Get the SeriesID from books from the Kobo Store like seriesmeta
+		if err := tx.QueryRow(
+			`SELECT coalesce((SELECT SeriesID FROM content WHERE Series = ? AND WorkId NOT NULL AND SeriesID NOT NULL AND WorkId != "" AND SeriesID != "" LIMIT 1), ?)`,
+			m.Series, m.Series,
+		).Scan(&seriesID); err != nil {
+			return SideloadError, fmt.Errorf("get series id: %w", err)
+		}
+	}
+
+	meta := []interface{}{
+		title,
+		nullString(strings.Join(m.Creators, ", ")),
+		nullString(m.Description),
+		nullString(m.Publisher),
+		nullString(m.Language),
+		nullString(m.ISBN),
+		nullString(m.Series),
+		sql.NullString{String: strconv.FormatFloat(m.SeriesIndex, 'f', -1, 64), Valid: m.Series != "" && m.SeriesIndex > 0},
+		sql.NullFloat64{Float64: m.SeriesIndex, Valid: m.Series != "" && m.SeriesIndex > 0},
+		seriesID,
+		fi.Size(),
+	}
+
+	status := SideloadUpdated
+	if exists {
+		if _, err := tx.Exec(`
+			UPDATE content SET
+				Title = ?, Attribution = ?, Description = ?, Publisher = ?, Language = ?, ISBN = ?,
+				Series = ?, SeriesNumber = ?, SeriesNumberFloat = ?, SeriesID = ?, ___FileSize = ?
+			WHERE ContentID = ? AND ContentType = ?
+		`, append(meta, contentID, contentTypeBook)...); err != nil {
+			return SideloadError, fmt.Errorf("update book: %w", err)
+		}
+	} else {
+		status = SideloadAdded
+		if _, err := tx.Exec(`
+			INSERT INTO content (
+				Title, Attribution, Description, Publisher, Language, ISBN,
+				Series, SeriesNumber, SeriesNumberFloat, SeriesID, ___FileSize,
+				ContentID, ContentType, MimeType, ImageId, DateCreated, DateAdded,
+				___UserID, VolumeIndex, ReadStatus, ___PercentRead, IsDownloaded
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, append(meta,
+			contentID, contentTypeBook, "application/x-kobo-epub+zip", kobo.ContentIDToImageID(contentID), nullString(formatDate(m.Date)), now().UTC().Format(dateFormat),
+			"adobe_user", -1, 0, 0, "true",
+		)...); err != nil {
+			return SideloadError, fmt.Errorf("insert book: %w", err)
+		}
+	}
+
+	// chapters
+	var chapterIDs []interface{}
+	for i, item := range m.Spine {
+		var size int64
+		if fi, err := fs.Stat(zr, item); err == nil {
+			size = fi.Size()
+		}
+		chapterTitle := m.TOC[item]
+		if chapterTitle == "" {
+			chapterTitle = path.Base(item)
+		}
+		chapterID := contentID + "!" + strings.ReplaceAll(item, "/", "!")
+		chapterIDs = append(chapterIDs, chapterID)
+
+		if _, err := tx.Exec(`
+			INSERT INTO content (ContentID, ContentType, MimeType, BookID, BookTitle, Title, VolumeIndex, ___FileSize, ___UserID, ReadStatus, ___PercentRead, IsDownloaded)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (ContentID) DO UPDATE SET BookTitle = excluded.BookTitle, Title = excluded.Title, VolumeIndex = excluded.VolumeIndex, ___FileSize = excluded.___FileSize
+		`, chapterID, contentTypeChapter, "application/xhtml+xml", contentID, title, chapterTitle, i, size, "adobe_user", 0, 0, "true"); err != nil {
+			return SideloadError, fmt.Errorf("insert chapter %q: %w", item, err)
+		}
+	}
+
+	// remove chapters which aren't in the spine anymore
+	if exists {
+		q := `DELETE FROM content WHERE BookID = ? AND ContentType = ?`
+		if len(chapterIDs) != 0 {
+			q += ` AND ContentID NOT IN (?` + strings.Repeat(`, ?`, len(chapterIDs)-1) + `)`
+		}
+		if _, err := tx.Exec(q, append([]interface{}{contentID, contentTypeChapter}, chapterIDs...)...); err != nil {
+			return SideloadError, fmt.Errorf("remove old chapters: %w", err)
+		}
+	}
+
+	return status, nil
+}
+
+// dateFormat is the format used for dates in the database.
+const dateFormat = "2006-01-02T15:04:05Z"
+
+// formatDate converts a date from the EPUB metadata to the database format.
+// It returns an empty string if it isn't a valid date.
+func formatDate(s string) string {
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		"2006-01",
+		"2006",
+	} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t.UTC().Format(dateFormat)
+		}
+	}
+	return ""
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
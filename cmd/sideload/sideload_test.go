@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pgaskin/kepubify/v4/internal/kobodb/kobodbtest"
+	"github.com/pgaskin/kepubify/v4/kepub"
+)
+
+func init() {
+	now = func() time.Time {
+		return time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	}
+}
+
+// testKobo creates a Kobo with an empty database.
+//
+// Since sideload must update existing rows rather than replacing them (e.g.,
+// with INSERT OR REPLACE), triggers are added to remove the rows related to
+// deleted content, so the tests fail if anything is lost when a book is
+// updated.
+func testKobo(t *testing.T) *Kobo {
+	t.Helper()
+
+	k, err := OpenKobo(kobodbtest.New(t))
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	t.Cleanup(func() { k.Close() })
+
+	if _, err := k.DB.Exec(`
+		CREATE TRIGGER test_content_delete_chapter AFTER DELETE ON content WHEN old.ContentType = '899' BEGIN
+			DELETE FROM Bookmark WHERE ContentID = old.ContentID;
+			DELETE FROM volume_shortcovers WHERE shortcoverId = old.ContentID;
+		END;
+		CREATE TRIGGER test_content_delete_book AFTER DELETE ON content WHEN old.ContentType = '6' BEGIN
+			DELETE FROM Bookmark WHERE VolumeID = old.ContentID;
+			DELETE FROM volume_shortcovers WHERE volumeId = old.ContentID;
+			DELETE FROM ShelfContent WHERE ContentId = old.ContentID;
+		END;
+	`); err != nil {
+		t.Fatalf("create triggers: %v", err)
+	}
+	return k
+}
+
+// testWriteKEPUB converts and writes a KEPUB to fn (relative to the Kobo) with
+// the specified OPF metadata and chapters.
+func testWriteKEPUB(t *testing.T, k *Kobo, fn, metadata string, chapters ...string) {
+	t.Helper()
+
+	var manifest, spine, nav strings.Builder
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+	}
+	for i, ch := range chapters {
+		name := fmt.Sprintf("Text/ch%d.xhtml", i+1)
+		fmt.Fprintf(&manifest, `<item id="ch%d" href="%s" media-type="application/xhtml+xml"/>`, i+1, name)
+		fmt.Fprintf(&spine, `<itemref idref="ch%d"/>`, i+1)
+		fmt.Fprintf(&nav, `<li><a href="%s">Chapter %d</a></li>`, name, i+1)
+		epub["OEBPS/"+name] = &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml"><head><title>Chapter</title></head><body><p>` + ch + `</p></body></html>`)}
+	}
+	epub["OEBPS/nav.xhtml"] = &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><head><title>Contents</title></head><body><nav epub:type="toc"><ol>` + nav.String() + `</ol></nav></body></html>`)}
+	epub["OEBPS/content.opf"] = &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+		<dc:identifier id="id">test</dc:identifier>
+		` + metadata + `
+	</metadata>
+	<manifest><item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>` + manifest.String() + `</manifest>
+	<spine>` + spine.String() + `</spine>
+</package>`)}
+
+	var buf bytes.Buffer
+	if err := kepub.NewConverterWithOptions(kepub.ConverterOptionDummyTitlepage(false)).Convert(context.Background(), &buf, epub); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	kobodbtest.WriteFile(t, k.Path, fn, buf.Bytes())
+}
+
+// testSideload runs Sideload and returns the log.
+func testSideload(t *testing.T, k *Kobo, dir string, update, dryRun bool) []string {
+	t.Helper()
+	var res []string
+	if err := k.Sideload(dir, update, dryRun, func(filename string, i, total int, status SideloadStatus, err error) {
+		s := fmt.Sprintf("%s %s", status, filepath.ToSlash(filename))
+		if err != nil {
+			s += " (error)"
+		}
+		res = append(res, s)
+	}); err != nil {
+		t.Fatalf("sideload: unexpected error: %v", err)
+	}
+	return res
+}
+
+const testMetadata = `
+	<dc:title>Book Title</dc:title>
+	<dc:creator>Author One</dc:creator>
+	<dc:creator>Author Two</dc:creator>
+	<dc:creator id="ill">Illustrator</dc:creator>
+	<meta refines="#ill" property="role" scheme="marc:relators">ill</meta>
+	<dc:description>&lt;p&gt;Description.&lt;/p&gt;</dc:description>
+	<dc:publisher>Publisher</dc:publisher>
+	<dc:language>en-CA</dc:language>
+	<dc:date>2019-05-06</dc:date>
+	<dc:identifier opf:scheme="ISBN">978-0-00-000000-2</dc:identifier>
+	<meta name="calibre:series" content="Series Name"/>
+	<meta name="calibre:series_index" content="2"/>`
+
+func TestSideload(t *testing.T) {
+	k := testKobo(t)
+	testWriteKEPUB(t, k, "Books/book.kepub.epub", testMetadata, "One.", "Two.", "Three.")
+	testWriteKEPUB(t, k, "Books/Other/other book.kepub.epub", `<dc:title>Other</dc:title><meta property="belongs-to-collection" id="c">Another Series</meta><meta refines="#c" property="group-position">1.5</meta>`, "Text.")
+	testWriteKEPUB(t, k, "untitled.KEPUB.EPUB", ``, "Text.")
+	testWriteKEPUB(t, k, ".hidden/hidden.kepub.epub", `<dc:title>Hidden</dc:title>`, "Text.")
+	testWriteKEPUB(t, k, "Books/._book.kepub.epub", `<dc:title>Resource Fork</dc:title>`, "Text.")
+	testWriteKEPUB(t, k, "Books/book.epub", `<dc:title>EPUB</dc:title>`, "Text.")
+	kobodbtest.WriteFile(t, k.Path, "Books/broken.kepub.epub", []byte("not a zip"))
+
+	kobodbtest.Check(t, "dry run result", testSideload(t, k, "", false, true),
+		`added Books/Other/other book.kepub.epub`,
+		`added Books/book.kepub.epub`,
+		`error Books/broken.kepub.epub (error)`,
+		`added untitled.KEPUB.EPUB`,
+	)
+	kobodbtest.Check(t, "rows after dry run", kobodbtest.Query(t, k.DB, `SELECT count() FROM content`), `count()="0"`)
+
+	kobodbtest.Check(t, "result", testSideload(t, k, "", false, false),
+		`added Books/Other/other book.kepub.epub`,
+		`added Books/book.kepub.epub`,
+		`error Books/broken.kepub.epub (error)`,
+		`added untitled.KEPUB.EPUB`,
+	)
+
+	kobodbtest.Check(t, "books", kobodbtest.Query(t, k.DB, `
+		SELECT ContentID, ContentType, MimeType, ImageId, Title, Attribution, Description, Publisher, Language, ISBN, Series, SeriesNumber, SeriesNumberFloat, SeriesID, DateCreated, DateAdded, ___UserID, VolumeIndex, ReadStatus, IsDownloaded, BookID
+		FROM content WHERE ContentType = 6 ORDER BY ContentID
+	`),
+		`ContentID="file:///mnt/onboard/Books/Other/other book.kepub.epub" ContentType="6" MimeType="application/x-kobo-epub+zip" ImageId="file____mnt_onboard_Books_Other_other_book_kepub_epub" Title="Other" Attribution=NULL Description=NULL Publisher=NULL Language=NULL ISBN=NULL Series="Another Series" SeriesNumber="1.5" SeriesNumberFloat="1.5" SeriesID="Another Series" DateCreated=NULL DateAdded="2022-03-04T05:06:07Z" ___UserID="adobe_user" VolumeIndex="-1" ReadStatus="0" IsDownloaded="true" BookID=NULL`,
+		`ContentID="file:///mnt/onboard/Books/book.kepub.epub" ContentType="6" MimeType="application/x-kobo-epub+zip" ImageId="file____mnt_onboard_Books_book_kepub_epub" Title="Book Title" Attribution="Author One, Author Two" Description="<p>Description.</p>" Publisher="Publisher" Language="en-CA" ISBN="9780000000002" Series="Series Name" SeriesNumber="2" SeriesNumberFloat="2" SeriesID="Series Name" DateCreated="2019-05-06T00:00:00Z" DateAdded="2022-03-04T05:06:07Z" ___UserID="adobe_user" VolumeIndex="-1" ReadStatus="0" IsDownloaded="true" BookID=NULL`,
+		`ContentID="file:///mnt/onboard/untitled.KEPUB.EPUB" ContentType="6" MimeType="application/x-kobo-epub+zip" ImageId="file____mnt_onboard_untitled_KEPUB_EPUB" Title="untitled" Attribution=NULL Description=NULL Publisher=NULL Language=NULL ISBN=NULL Series=NULL SeriesNumber=NULL SeriesNumberFloat=NULL SeriesID=NULL DateCreated=NULL DateAdded="2022-03-04T05:06:07Z" ___UserID="adobe_user" VolumeIndex="-1" ReadStatus="0" IsDownloaded="true" BookID=NULL`,
+	)
+
+	kobodbtest.Check(t, "chapters", kobodbtest.Query(t, k.DB, `
+		SELECT ContentID, ContentType, MimeType, BookID, BookTitle, Title, VolumeIndex, ___FileSize > 0
+		FROM content WHERE BookID = ? ORDER BY VolumeIndex
+	`, "file:///mnt/onboard/Books/book.kepub.epub"),
+		`ContentID="file:///mnt/onboard/Books/book.kepub.epub!OEBPS!Text!ch1.xhtml" ContentType="899" MimeType="application/xhtml+xml" BookID="file:///mnt/onboard/Books/book.kepub.epub" BookTitle="Book Title" Title="Chapter 1" VolumeIndex="0" ___FileSize > 0="1"`,
+		`ContentID="file:///mnt/onboard/Books/book.kepub.epub!OEBPS!Text!ch2.xhtml" ContentType="899" MimeType="application/xhtml+xml" BookID="file:///mnt/onboard/Books/book.kepub.epub" BookTitle="Book Title" Title="Chapter 2" VolumeIndex="1" ___FileSize > 0="1"`,
+		`ContentID="file:///mnt/onboard/Books/book.kepub.epub!OEBPS!Text!ch3.xhtml" ContentType="899" MimeType="application/xhtml+xml" BookID="file:///mnt/onboard/Books/book.kepub.epub" BookTitle="Book Title" Title="Chapter 3" VolumeIndex="2" ___FileSize > 0="1"`,
+	)
+
+	kobodbtest.Check(t, "file size", kobodbtest.Query(t, k.DB, `SELECT ___FileSize = ? FROM content WHERE ContentID = ?`, testFileSize(t, k, "Books/book.kepub.epub"), "file:///mnt/onboard/Books/book.kepub.epub"), `___FileSize = ?="1"`)
+	kobodbtest.Check(t, "rows for broken book", kobodbtest.Query(t, k.DB, `SELECT count() FROM content WHERE ContentID LIKE '%broken%' OR BookID LIKE '%broken%'`), `count()="0"`)
+	kobodbtest.Check(t, "total rows", kobodbtest.Query(t, k.DB, `SELECT ContentType, count() FROM content GROUP BY ContentType ORDER BY ContentType`), `ContentType="6" count()="3"`, `ContentType="899" count()="5"`)
+
+	kobodbtest.Check(t, "result when already added", testSideload(t, k, "", false, false),
+		`exists Books/Other/other book.kepub.epub`,
+		`exists Books/book.kepub.epub`,
+		`error Books/broken.kepub.epub (error)`,
+		`exists untitled.KEPUB.EPUB`,
+	)
+	kobodbtest.Check(t, "total rows", kobodbtest.Query(t, k.DB, `SELECT ContentType, count() FROM content GROUP BY ContentType ORDER BY ContentType`), `ContentType="6" count()="3"`, `ContentType="899" count()="5"`)
+}
+
+func TestSideloadUpdate(t *testing.T) {
+	k := testKobo(t)
+	testWriteKEPUB(t, k, "book.kepub.epub", testMetadata, "One.", "Two.", "Three.")
+	kobodbtest.Check(t, "result", testSideload(t, k, "", false, false), `added book.kepub.epub`)
+
+	const id = "file:///mnt/onboard/book.kepub.epub"
+	if _, err := k.DB.Exec(`UPDATE content SET ReadStatus = 1, ___PercentRead = 50, DateLastRead = '2022-01-01T00:00:00Z', ChapterIDBookmarked = 'OEBPS/Text/ch1.xhtml' WHERE ContentID = ?`, id); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := k.DB.Exec(`UPDATE content SET ___PercentRead = 100 WHERE ContentID = ?`, id+"!OEBPS!Text!ch1.xhtml"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	for i, ch := range []string{"ch1", "ch3"} {
+		if _, err := k.DB.Exec(`
+			INSERT INTO Bookmark (BookmarkID, VolumeID, ContentID, StartContainerPath, StartContainerChildIndex, StartOffset, EndContainerPath, EndContainerChildIndex, EndOffset, Text)
+			VALUES (?, ?, ?, 'span#kobo\.1\.1', 0, 0, 'span#kobo\.1\.1', 0, 3, 'One')
+		`, fmt.Sprint(i), id, id+"!OEBPS!Text!"+ch+".xhtml"); err != nil {
+			t.Fatalf("insert bookmark: %v", err)
+		}
+	}
+	if _, err := k.DB.Exec(`INSERT INTO ShelfContent (ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced) VALUES ('Shelf', ?, '2022-01-01T00:00:00Z', 'false', 'false')`, id); err != nil {
+		t.Fatalf("insert shelf content: %v", err)
+	}
+
+	testWriteKEPUB(t, k, "book.kepub.epub", `<dc:title>New Title</dc:title><dc:creator>New Author</dc:creator>`, "One.", "Two, longer.")
+
+	kobodbtest.Check(t, "result without update", testSideload(t, k, "", false, false), `exists book.kepub.epub`)
+	kobodbtest.Check(t, "title without update", kobodbtest.Query(t, k.DB, `SELECT Title FROM content WHERE ContentID = ?`, id), `Title="Book Title"`)
+
+	kobodbtest.Check(t, "dry run result", testSideload(t, k, "", true, true), `updated book.kepub.epub`)
+	kobodbtest.Check(t, "title after dry run", kobodbtest.Query(t, k.DB, `SELECT Title FROM content WHERE ContentID = ?`, id), `Title="Book Title"`)
+
+	kobodbtest.Check(t, "result", testSideload(t, k, "", true, false), `updated book.kepub.epub`)
+	kobodbtest.Check(t, "book", kobodbtest.Query(t, k.DB, `
+		SELECT Title, Attribution, Description, Series, SeriesNumber, SeriesID, ReadStatus, ___PercentRead, DateLastRead, ChapterIDBookmarked, DateAdded, ___FileSize = ?
+		FROM content WHERE ContentID = ?
+	`, testFileSize(t, k, "book.kepub.epub"), id),
+		`Title="New Title" Attribution="New Author" Description=NULL Series=NULL SeriesNumber=NULL SeriesID=NULL ReadStatus="1" ___PercentRead="50" DateLastRead="2022-01-01T00:00:00Z" ChapterIDBookmarked="OEBPS/Text/ch1.xhtml" DateAdded="2022-03-04T05:06:07Z" ___FileSize = ?="1"`,
+	)
+	kobodbtest.Check(t, "chapters", kobodbtest.Query(t, k.DB, `SELECT ContentID, BookTitle, VolumeIndex, ___PercentRead FROM content WHERE BookID = ? ORDER BY VolumeIndex`, id),
+		`ContentID="file:///mnt/onboard/book.kepub.epub!OEBPS!Text!ch1.xhtml" BookTitle="New Title" VolumeIndex="0" ___PercentRead="100"`,
+		`ContentID="file:///mnt/onboard/book.kepub.epub!OEBPS!Text!ch2.xhtml" BookTitle="New Title" VolumeIndex="1" ___PercentRead="0"`,
+	)
+	kobodbtest.Check(t, "bookmarks", kobodbtest.Query(t, k.DB, `SELECT BookmarkID, ContentID FROM Bookmark ORDER BY BookmarkID`),
+		`BookmarkID="0" ContentID="file:///mnt/onboard/book.kepub.epub!OEBPS!Text!ch1.xhtml"`,
+	)
+	kobodbtest.Check(t, "shelf content", kobodbtest.Query(t, k.DB, `SELECT ShelfName, ContentId FROM ShelfContent`),
+		`ShelfName="Shelf" ContentId="file:///mnt/onboard/book.kepub.epub"`,
+	)
+}
+
+func TestSideloadDir(t *testing.T) {
+	k := testKobo(t)
+	testWriteKEPUB(t, k, "a/book.kepub.epub", `<dc:title>A</dc:title>`, "Text.")
+	testWriteKEPUB(t, k, "b/book.kepub.epub", `<dc:title>B</dc:title>`, "Text.")
+	testWriteKEPUB(t, k, "b/c/book.kepub.epub", `<dc:title>C</dc:title>`, "Text.")
+
+	kobodbtest.Check(t, "result", testSideload(t, k, "b", false, false), `added b/book.kepub.epub`, `added b/c/book.kepub.epub`)
+	kobodbtest.Check(t, "books", kobodbtest.Query(t, k.DB, `SELECT ContentID FROM content WHERE ContentType = 6 ORDER BY ContentID`),
+		`ContentID="file:///mnt/onboard/b/book.kepub.epub"`,
+		`ContentID="file:///mnt/onboard/b/c/book.kepub.epub"`,
+	)
+
+	if err := k.Sideload("missing", false, false, func(string, int, int, SideloadStatus, error) {}); err == nil {
+		t.Errorf("expected error for missing directory")
+	}
+}
+
+func TestSideloadSeriesID(t *testing.T) {
+	k := testKobo(t)
+	if _, err := k.DB.Exec(`
+		INSERT INTO content (ContentID, ContentType, MimeType, ___UserID, Title, Series, SeriesNumber, SeriesID, WorkId)
+		VALUES ('00000000-0000-0000-0000-000000000000', 6, 'application/x-kobo-epub+zip', 'user', 'Store Book', 'Series Name', '1', 'store-series-id', 'work-id')
+	`); err != nil {
+		t.Fatalf("insert store book: %v", err)
+	}
+	testWriteKEPUB(t, k, "book.kepub.epub", testMetadata, "Text.")
+	kobodbtest.Check(t, "result", testSideload(t, k, "", false, false), `added book.kepub.epub`)
+	kobodbtest.Check(t, "series", kobodbtest.Query(t, k.DB, `SELECT Series, SeriesNumber, SeriesID FROM content WHERE ContentID = 'file:///mnt/onboard/book.kepub.epub'`),
+		`Series="Series Name" SeriesNumber="2" SeriesID="store-series-id"`,
+	)
+}
+
+func TestFormatDate(t *testing.T) {
+	for _, c := range []struct {
+		In, Exp string
+	}{
+		{"2019-05-06T07:08:09Z", "2019-05-06T07:08:09Z"},
+		{"2019-05-06T07:08:09-04:00", "2019-05-06T11:08:09Z"},
+		{"2019-05-06T07:08:09", "2019-05-06T07:08:09Z"},
+		{" 2019-05-06 ", "2019-05-06T00:00:00Z"},
+		{"2019-05", "2019-05-01T00:00:00Z"},
+		{"2019", "2019-01-01T00:00:00Z"},
+		{"May 2019", ""},
+		{"", ""},
+	} {
+		if act := formatDate(c.In); act != c.Exp {
+			t.Errorf("format date %q: expected %q, got %q", c.In, c.Exp, act)
+		}
+	}
+}
+
+func testFileSize(t *testing.T, k *Kobo, fn string) int64 {
+	t.Helper()
+	fi, err := os.Stat(filepath.Join(k.Path, filepath.FromSlash(fn)))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return fi.Size()
+}
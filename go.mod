@@ -8,11 +8,12 @@ require (
 	github.com/kr/smartypants v0.1.0
 	github.com/pgaskin/kepubify/_/go116-zip.go117 v0.0.0-20210611152744-2d89b3182523
 	github.com/pgaskin/kepubify/_/html v0.0.0-20211223234002-6ee2cc632cdc
+	golang.org/x/image v0.0.0-20220302094943-723b81ca9867
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/text v0.3.6
 )
 
-// kepubify/covergen/seriesmeta/kobotest
+// kepubify/covergen/seriesmeta/highlights/sideload/shelves/kobotest
 require (
 	github.com/bamiaux/rez v0.0.0-20170731184118-29f4463c688b
 	github.com/hexops/gotextdiff v1.0.3
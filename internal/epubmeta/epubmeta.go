@@ -0,0 +1,324 @@
+// Package epubmeta reads the metadata used by the Kobo database from EPUBs for
+// the device tools (seriesmeta, shelves, sideload).
+package epubmeta
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// Metadata is the metadata of an EPUB.
+type Metadata struct {
+	Title       string
+	Subtitle    string   // from EPUB3 title-type refinements
+	Creators    []string // authors only
+	Description string
+	Publisher   string
+	Language    string
+	ISBN        string
+	Date        string   // the publication date, as-is
+	Subjects    []string // Calibre uses these for tags
+
+	Series      string
+	SeriesIndex float64
+
+	Spine []string          // paths of the spine items relative to the root of the EPUB
+	TOC   map[string]string // the first label in the table of contents for each path
+}
+
+// Read reads the metadata from an EPUB. If a file referenced by the EPUB
+// doesn't exist, it is matched case-insensitively.
+func Read(epub fs.FS) (*Metadata, error) {
+	container, err := readXML(epub, "META-INF/container.xml")
+	if err != nil {
+		return nil, fmt.Errorf("could not read container.xml: %w", err)
+	}
+
+	var rootfile string
+	if el := container.FindElement("//rootfiles/rootfile[@full-path]"); el != nil {
+		rootfile = el.SelectAttrValue("full-path", "")
+	}
+	if rootfile == "" {
+		return nil, errors.New("could not find package document")
+	}
+	rootfile = strings.TrimLeft(rootfile, "/")
+
+	opf, err := readXML(epub, rootfile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read package document: %w", err)
+	}
+
+	m := &Metadata{TOC: map[string]string{}}
+	m.read(opf)
+
+	manifest := map[string]*etree.Element{}
+	for _, el := range opf.FindElements("//manifest/item[@id]") {
+		manifest[el.SelectAttrValue("id", "")] = el
+	}
+	resolve := func(base, href string) string {
+		if i := strings.IndexByte(href, '#'); i != -1 {
+			href = href[:i]
+		}
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		if href == "" {
+			return ""
+		}
+		return strings.TrimLeft(path.Join(path.Dir(base), href), "/")
+	}
+
+	for _, el := range opf.FindElements("//spine/itemref[@idref]") {
+		if item := manifest[el.SelectAttrValue("idref", "")]; item != nil {
+			if href := resolve(rootfile, item.SelectAttrValue("href", "")); href != "" {
+				m.Spine = append(m.Spine, href)
+			}
+		}
+	}
+
+	// EPUB3 navigation document
+	for _, item := range opf.FindElements("//manifest/item[@properties]") {
+		if !hasToken(item.SelectAttrValue("properties", ""), "nav") {
+			continue
+		}
+		fn := resolve(rootfile, item.SelectAttrValue("href", ""))
+		doc, err := readXML(epub, fn)
+		if err != nil {
+			break // it's not important enough to fail
+		}
+		for _, nav := range doc.FindElements("//nav") {
+			if !hasToken(nav.SelectAttrValue("epub:type", nav.SelectAttrValue("type", "")), "toc") {
+				continue
+			}
+			for _, a := range nav.FindElements(".//a[@href]") {
+				m.addTOC(resolve(fn, a.SelectAttrValue("href", "")), textContent(a))
+			}
+		}
+		break
+	}
+
+	// EPUB2 NCX
+	if el := opf.FindElement("//spine[@toc]"); el != nil {
+		if item := manifest[el.SelectAttrValue("toc", "")]; item != nil {
+			fn := resolve(rootfile, item.SelectAttrValue("href", ""))
+			if doc, err := readXML(epub, fn); err == nil {
+				for _, np := range doc.FindElements("//navPoint") {
+					var label string
+					if el := np.FindElement("./navLabel/text"); el != nil {
+						label = el.Text()
+					}
+					if el := np.FindElement("./content[@src]"); el != nil {
+						m.addTOC(resolve(fn, el.SelectAttrValue("src", "")), label)
+					}
+				}
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// read reads the metadata from the package document.
+func (m *Metadata) read(opf *etree.Document) {
+	md := opf.FindElement("//metadata")
+	if md == nil {
+		return
+	}
+
+	// note: OPF 1.x and some OPF 2.0 package documents nest the metadata in
+	// dc-metadata and x-metadata elements, so descendants are searched too
+
+	// EPUB3 refinements
+	refines := map[string]map[string]string{}
+	for _, el := range md.FindElements(".//meta[@refines][@property]") {
+		id := strings.TrimPrefix(el.SelectAttrValue("refines", ""), "#")
+		if refines[id] == nil {
+			refines[id] = map[string]string{}
+		}
+		if p := el.SelectAttrValue("property", ""); refines[id][p] == "" {
+			refines[id][p] = strings.TrimSpace(el.Text())
+		}
+	}
+
+	var mainTitle bool
+	for _, el := range descendants(md) {
+		val := strings.TrimSpace(el.Text())
+		if val == "" || el.Space != "dc" {
+			continue
+		}
+		switch el.Tag {
+		case "title":
+			switch refines[el.SelectAttrValue("id", "")]["title-type"] {
+			case "main":
+				if !mainTitle {
+					m.Title, mainTitle = val, true
+				}
+			case "subtitle":
+				if m.Subtitle == "" {
+					m.Subtitle = val
+				}
+			default:
+				if m.Title == "" {
+					m.Title = val
+				}
+			}
+		case "creator":
+			role := el.SelectAttrValue("opf:role", el.SelectAttrValue("role", ""))
+			if r := refines[el.SelectAttrValue("id", "")]["role"]; r != "" {
+				role = r
+			}
+			if role == "" || role == "aut" {
+				m.Creators = append(m.Creators, val)
+			}
+		case "description":
+			if m.Description == "" {
+				m.Description = val
+			}
+		case "publisher":
+			if m.Publisher == "" {
+				m.Publisher = val
+			}
+		case "language":
+			if m.Language == "" {
+				m.Language = val
+			}
+		case "date":
+			if m.Date == "" {
+				m.Date = val
+			}
+		case "subject":
+			m.Subjects = append(m.Subjects, val)
+		case "identifier":
+			if m.ISBN == "" {
+				m.ISBN = parseISBN(val, el.SelectAttrValue("opf:scheme", el.SelectAttrValue("scheme", "")))
+			}
+		}
+	}
+
+	// Calibre series metadata
+	if el := md.FindElement(".//meta[@name='calibre:series']"); el != nil {
+		m.Series = el.SelectAttrValue("content", "")
+
+		if el := md.FindElement(".//meta[@name='calibre:series_index']"); el != nil {
+			m.SeriesIndex, _ = strconv.ParseFloat(el.SelectAttrValue("content", "0"), 64)
+		}
+	}
+
+	// EPUB3 series metadata
+	if m.Series == "" {
+		if el := md.FindElement(".//meta[@property='belongs-to-collection']"); el != nil {
+			r := refines[el.SelectAttrValue("id", "")]
+			if t := r["collection-type"]; t == "" || t == "series" {
+				m.Series = strings.TrimSpace(el.Text())
+				m.SeriesIndex, _ = strconv.ParseFloat(r["group-position"], 64)
+			}
+		}
+	}
+}
+
+// addTOC adds a label for a file if it doesn't already have one.
+func (m *Metadata) addTOC(fn, label string) {
+	if label = strings.Join(strings.Fields(label), " "); fn != "" && label != "" {
+		if _, ok := m.TOC[fn]; !ok {
+			m.TOC[fn] = label
+		}
+	}
+}
+
+// parseISBN gets the ISBN from an identifier, or returns an empty string if
+// it isn't one.
+func parseISBN(val, scheme string) string {
+	if lval := strings.ToLower(val); strings.HasPrefix(lval, "urn:isbn:") {
+		val = val[len("urn:isbn:"):]
+	} else if strings.HasPrefix(lval, "isbn:") {
+		val = val[len("isbn:"):]
+	} else if !strings.EqualFold(scheme, "isbn") {
+		return ""
+	}
+	isbn := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == 'x' || r == 'X':
+			return 'X'
+		case r == '-' || r == ' ':
+			return -1
+		}
+		return '?'
+	}, strings.TrimSpace(val))
+	if (len(isbn) != 10 && len(isbn) != 13) || strings.ContainsRune(isbn, '?') {
+		return ""
+	}
+	return isbn
+}
+
+// readXML parses a file from the EPUB, falling back to a case-insensitive
+// match if it doesn't exist.
+func readXML(epub fs.FS, name string) (*etree.Document, error) {
+	buf, err := fs.ReadFile(epub, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		var found string
+		fs.WalkDir(epub, ".", func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && strings.EqualFold(p, name) {
+				found = p
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if found != "" {
+			buf, err = fs.ReadFile(epub, found)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings.Permissive = true
+	doc.ReadSettings.Entity = xml.HTMLEntity // for navigation documents
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// hasToken checks if a space-separated list contains tok.
+func hasToken(s, tok string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == tok {
+			return true
+		}
+	}
+	return false
+}
+
+// descendants gets the descendant elements of an element in document order.
+func descendants(el *etree.Element) []*etree.Element {
+	var els []*etree.Element
+	for _, c := range el.ChildElements() {
+		els = append(els, c)
+		els = append(els, descendants(c)...)
+	}
+	return els
+}
+
+// textContent gets the text of an element and its children.
+func textContent(el *etree.Element) string {
+	var b strings.Builder
+	for _, t := range el.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.WriteString(t.Data)
+		case *etree.Element:
+			b.WriteString(textContent(t))
+		}
+	}
+	return b.String()
+}
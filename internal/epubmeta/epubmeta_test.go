@@ -0,0 +1,242 @@
+package epubmeta
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+const testContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`
+
+func TestRead(t *testing.T) {
+	for _, c := range []struct {
+		What  string
+		Files map[string]string
+		Exp   *Metadata
+		Err   bool
+	}{
+		{
+			What: "epub2 with calibre metadata and ncx",
+			Files: map[string]string{
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uuid_id">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+		<dc:title>Book Title</dc:title>
+		<dc:creator opf:role="aut" opf:file-as="Author, Test">Test Author</dc:creator>
+		<dc:creator opf:role="edt">Test Editor</dc:creator>
+		<dc:creator>Another Author</dc:creator>
+		<dc:description>&lt;p&gt;A description.&lt;/p&gt;</dc:description>
+		<dc:publisher>Publisher</dc:publisher>
+		<dc:language>en</dc:language>
+		<dc:date>2020-01-02T00:00:00+00:00</dc:date>
+		<dc:subject>Fiction</dc:subject>
+		<dc:subject> Fantasy </dc:subject>
+		<dc:subject></dc:subject>
+		<dc:identifier opf:scheme="uuid" id="uuid_id">7a1b5a1d-0000-0000-0000-000000000000</dc:identifier>
+		<dc:identifier opf:scheme="ISBN">978-0-00-000000-2</dc:identifier>
+		<meta name="calibre:series" content="Series Name"/>
+		<meta name="calibre:series_index" content="2.5"/>
+	</metadata>
+	<manifest>
+		<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+		<item id="c1" href="Text/ch%201.xhtml" media-type="application/xhtml+xml"/>
+		<item id="c2" href="Text/ch2.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine toc="ncx">
+		<itemref idref="c1"/>
+		<itemref idref="missing"/>
+		<itemref idref="c2"/>
+	</spine>
+</package>`,
+				"OEBPS/toc.ncx": `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+	<navMap>
+		<navPoint id="n1"><navLabel><text>Chapter
+			One</text></navLabel><content src="Text/ch%201.xhtml"/>
+			<navPoint id="n1a"><navLabel><text>Section</text></navLabel><content src="Text/ch%201.xhtml#s1"/></navPoint>
+		</navPoint>
+		<navPoint id="n2"><navLabel><text>Chapter Two</text></navLabel><content src="Text/ch2.xhtml#top"/></navPoint>
+	</navMap>
+</ncx>`,
+			},
+			Exp: &Metadata{
+				Title:       "Book Title",
+				Creators:    []string{"Test Author", "Another Author"},
+				Description: "<p>A description.</p>",
+				Publisher:   "Publisher",
+				Language:    "en",
+				ISBN:        "9780000000002",
+				Date:        "2020-01-02T00:00:00+00:00",
+				Subjects:    []string{"Fiction", "Fantasy"},
+				Series:      "Series Name",
+				SeriesIndex: 2.5,
+				Spine:       []string{"OEBPS/Text/ch 1.xhtml", "OEBPS/Text/ch2.xhtml"},
+				TOC: map[string]string{
+					"OEBPS/Text/ch 1.xhtml": "Chapter One",
+					"OEBPS/Text/ch2.xhtml":  "Chapter Two",
+				},
+			},
+		},
+		{
+			What: "epub3 with refinements and nav",
+			Files: map[string]string{
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:identifier id="id">urn:isbn:0-00-000000-0</dc:identifier>
+		<dc:title id="t0">Collection Title</dc:title>
+		<meta refines="#t0" property="title-type">collection</meta>
+		<dc:title id="t2">Subtitle</dc:title>
+		<meta refines="#t2" property="title-type">subtitle</meta>
+		<dc:title id="t1">Main Title</dc:title>
+		<meta refines="#t1" property="title-type">main</meta>
+		<dc:title id="t3">Another Main Title</dc:title>
+		<meta refines="#t3" property="title-type">main</meta>
+		<dc:creator id="c1">Test Author</dc:creator>
+		<meta refines="#c1" property="role" scheme="marc:relators">aut</meta>
+		<dc:creator id="c2">Test Illustrator</dc:creator>
+		<meta refines="#c2" property="role" scheme="marc:relators">ill</meta>
+		<meta property="belongs-to-collection" id="s1">Series Name</meta>
+		<meta refines="#s1" property="collection-type">series</meta>
+		<meta refines="#s1" property="group-position">3</meta>
+	</metadata>
+	<manifest>
+		<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+		<item id="c1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="c1"/>
+	</spine>
+</package>`,
+				"OEBPS/nav.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<body>
+	<nav epub:type="landmarks"><ol><li><a href="ch1.xhtml">Landmark</a></li></ol></nav>
+	<nav epub:type="toc"><ol><li><a href="ch1.xhtml"><span>Chapter&nbsp;1</span>: Start</a></li></ol></nav>
+</body>
+</html>`,
+			},
+			Exp: &Metadata{
+				Title:       "Main Title",
+				Subtitle:    "Subtitle",
+				Creators:    []string{"Test Author"},
+				ISBN:        "0000000000",
+				Series:      "Series Name",
+				SeriesIndex: 3,
+				Spine:       []string{"OEBPS/ch1.xhtml"},
+				TOC:         map[string]string{"OEBPS/ch1.xhtml": "Chapter 1: Start"},
+			},
+		},
+		{
+			What: "epub3 collection which isn't a series",
+			Files: map[string]string{
+				"META-INF/container.xml": testContainer,
+				"oebps/CONTENT.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+		<dc:title>Title</dc:title>
+		<meta property="belongs-to-collection" id="s1">Collection</meta>
+		<meta refines="#s1" property="collection-type">set</meta>
+		<meta refines="#s1" property="group-position">3</meta>
+	</metadata>
+	<manifest/>
+	<spine/>
+</package>`,
+			},
+			Exp: &Metadata{
+				Title: "Title",
+				TOC:   map[string]string{},
+			},
+		},
+		{
+			What: "opf with nested dc-metadata and x-metadata",
+			Files: map[string]string{
+				"META-INF/container.xml": testContainer,
+				"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+	<metadata>
+		<dc-metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:oebpackage="http://openebook.org/namespaces/oeb-package/1.0/">
+			<dc:title>Title</dc:title>
+			<dc:creator>Test Author</dc:creator>
+			<dc:language>en</dc:language>
+		</dc-metadata>
+		<x-metadata>
+			<meta name="calibre:series" content="Series Name"/>
+			<meta name="calibre:series_index" content="4"/>
+		</x-metadata>
+	</metadata>
+	<manifest/>
+	<spine/>
+</package>`,
+			},
+			Exp: &Metadata{
+				Title:       "Title",
+				Creators:    []string{"Test Author"},
+				Language:    "en",
+				Series:      "Series Name",
+				SeriesIndex: 4,
+			},
+		},
+		{
+			What: "missing package document",
+			Files: map[string]string{
+				"META-INF/container.xml": testContainer,
+			},
+			Err: true,
+		},
+		{
+			What:  "missing container",
+			Files: map[string]string{},
+			Err:   true,
+		},
+	} {
+		t.Run(c.What, func(t *testing.T) {
+			epub := fstest.MapFS{}
+			for fn, data := range c.Files {
+				epub[fn] = &fstest.MapFile{Data: []byte(data)}
+			}
+			m, err := Read(epub)
+			if c.Err {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.Exp.TOC == nil {
+				c.Exp.TOC = map[string]string{}
+			}
+			if !reflect.DeepEqual(m, c.Exp) {
+				t.Errorf("incorrect metadata:\n%#v\nexpected:\n%#v", m, c.Exp)
+			}
+		})
+	}
+}
+
+func TestParseISBN(t *testing.T) {
+	for _, c := range []struct {
+		Val, Scheme, Exp string
+	}{
+		{"978-0-00-000000-2", "ISBN", "9780000000002"},
+		{"978 0 00 000000 2", "isbn", "9780000000002"},
+		{"urn:isbn:9780000000002", "", "9780000000002"},
+		{"ISBN:000000000x", "", "000000000X"},
+		{"9780000000002", "", ""},
+		{"978000000000", "ISBN", ""},
+		{"urn:uuid:9780000000002", "", ""},
+		{"978-0-00-00000a-2", "ISBN", ""},
+	} {
+		if act := parseISBN(c.Val, c.Scheme); act != c.Exp {
+			t.Errorf("parse isbn %q (scheme %q): expected %q, got %q", c.Val, c.Scheme, c.Exp, act)
+		}
+	}
+}
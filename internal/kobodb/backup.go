@@ -0,0 +1,259 @@
+package kobodb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BackupDir is the directory backups are stored in, relative to the Kobo.
+var BackupDir = filepath.Join(".kobo", "kepubify-backups")
+
+var now = time.Now
+
+// copyDBTimeout is how long copyDB waits for a locked database.
+var copyDBTimeout = time.Second * 10
+
+// Backup checks the integrity of the database, then copies it to a new file in
+// BackupDir with the SQLite online backup API. Afterwards, the oldest backups
+// are removed so at most keep are left. It returns the path to the backup.
+func (k *Kobo) Backup(keep int) (string, error) {
+	if err := k.IntegrityCheck(); err != nil {
+		return "", err
+	}
+	fn, err := k.snapshot(true)
+	if err != nil {
+		return "", err
+	}
+	if keep < 1 {
+		keep = 1 // don't remove the one we just made
+	}
+	return fn, k.prune(keep)
+}
+
+// snapshot copies the database to a new file in BackupDir, checking the
+// integrity of the copy if check is true.
+func (k *Kobo) snapshot(check bool) (string, error) {
+	dir := filepath.Join(k.Path, BackupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create backup directory: %w", err)
+	}
+
+	fn := filepath.Join(dir, "KoboReader-"+now().UTC().Format("20060102-150405.000")+".sqlite")
+	if _, err := os.Stat(fn); err == nil {
+		return "", fmt.Errorf("backup %q already exists", fn)
+	}
+
+	if err := func() error {
+		db, err := sql.Open("sqlite3", fn)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := copyDB(db, k.DB); err != nil {
+			return err
+		}
+		if check {
+			if err := integrityCheck(db); err != nil {
+				return fmt.Errorf("check backup %q: %w", fn, err)
+			}
+		}
+		return db.Close()
+	}(); err != nil {
+		os.Remove(fn)
+		return "", err
+	}
+	return fn, nil
+}
+
+// prune removes the oldest backups so at most keep are left.
+func (k *Kobo) prune(keep int) error {
+	backups, err := k.Backups()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			return fmt.Errorf("could not remove old backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// Backups returns the paths to the backups in BackupDir, newest first.
+func (k *Kobo) Backups() ([]string, error) {
+	backups, err := filepath.Glob(filepath.Join(k.Path, BackupDir, "KoboReader-*.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// Restore replaces the database with a backup after checking the integrity of
+// the backup. If name is empty, the latest backup is used. If name is just a
+// filename, it is relative to BackupDir. Before the database is replaced, it is
+// copied to a new backup (without checking it, since it may be what's being
+// fixed) so the restore can be undone, and if keep is positive, the oldest
+// backups are removed afterwards so at most keep are left. It returns the path
+// to the backup which was restored and the path to the new backup.
+func (k *Kobo) Restore(name string, keep int) (string, string, error) {
+	fn := name
+	if fn == "" {
+		backups, err := k.Backups()
+		if err != nil {
+			return "", "", err
+		}
+		if len(backups) == 0 {
+			return "", "", errors.New("no backups found")
+		}
+		fn = backups[0]
+	} else if filepath.Base(fn) == fn {
+		fn = filepath.Join(k.Path, BackupDir, fn)
+	}
+
+	if _, err := os.Stat(fn); err != nil {
+		return fn, "", fmt.Errorf("open backup: %w", err)
+	}
+
+	dsn, err := readOnlyDSN(fn)
+	if err != nil {
+		return fn, "", fmt.Errorf("open backup %q: %w", fn, err)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return fn, "", fmt.Errorf("open backup %q: %w", fn, err)
+	}
+	defer db.Close()
+
+	if err := integrityCheck(db); err != nil {
+		return fn, "", fmt.Errorf("check backup %q: %w", fn, err)
+	}
+
+	bfn, err := k.snapshot(false)
+	if err != nil {
+		return fn, "", fmt.Errorf("back up database before restoring: %w", err)
+	}
+	if err := copyDB(k.DB, db); err != nil {
+		return fn, bfn, err
+	}
+	if err := k.IntegrityCheck(); err != nil {
+		return fn, bfn, fmt.Errorf("check restored database: %w", err)
+	}
+	if keep > 0 {
+		if err := k.prune(keep); err != nil {
+			return fn, bfn, err
+		}
+	}
+	return fn, bfn, nil
+}
+
+// readOnlyDSN returns a DSN which opens the database at fn as read-only and
+// immutable, so SQLite doesn't create journal files or take locks for it.
+func readOnlyDSN(fn string) (string, error) {
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.ToSlash(fn)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p // e.g., C:/...
+	}
+	return "file://" + (&url.URL{Path: p}).EscapedPath() + "?mode=ro&immutable=1", nil
+}
+
+// IntegrityCheck checks the integrity of the database.
+func (k *Kobo) IntegrityCheck() error {
+	return integrityCheck(k.DB)
+}
+
+// integrityCheck checks the integrity of a database.
+func integrityCheck(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("could not check database integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return fmt.Errorf("could not check database integrity: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not check database integrity: %w", err)
+	}
+
+	if len(msgs) != 1 || msgs[0] != "ok" {
+		return fmt.Errorf("database is corrupt: %s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// copyDB replaces the contents of dst with src using the SQLite online backup
+// API.
+func copyDB(dst, src *sql.DB) error {
+	ctx := context.Background()
+
+	dc, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	sc, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	return dc.Raw(func(d interface{}) error {
+		return sc.Raw(func(s interface{}) error {
+			dconn, ok1 := d.(*sqlite3.SQLiteConn)
+			sconn, ok2 := s.(*sqlite3.SQLiteConn)
+			if !ok1 || !ok2 {
+				return errors.New("not a sqlite3 connection")
+			}
+
+			b, err := dconn.Backup("main", sconn, "main")
+			if err != nil {
+				return err
+			}
+			// Step(-1) copies all pages at once, so it only returns without
+			// being done if one of the databases is locked or busy
+			// (go-sqlite3 doesn't return SQLITE_BUSY or SQLITE_LOCKED as
+			// errors), e.g., if the Kobo is still using it
+			deadline := now().Add(copyDBTimeout)
+			for {
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					break
+				}
+				if now().After(deadline) {
+					b.Finish()
+					return fmt.Errorf("database is locked (is it still being used by the Kobo?): %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			return b.Finish()
+		})
+	})
+}
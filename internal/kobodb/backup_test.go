@@ -0,0 +1,228 @@
+package kobodb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestBackupRestore(t *testing.T) {
+	kp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(kp, ".kobo"), 0755); err != nil {
+		t.Fatalf("create kobo: %v", err)
+	}
+
+	k, err := Open(kp)
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	defer k.Close()
+
+	defer func(orig func() time.Time) { now = orig }(now)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	now = func() time.Time {
+		ts = ts.Add(time.Second)
+		return ts
+	}
+
+	if _, _, err := k.Restore("", 0); err == nil {
+		t.Errorf("restore without backups: expected error")
+	}
+
+	if _, err := k.DB.Exec(`CREATE TABLE content (ContentID TEXT NOT NULL, Title TEXT, PRIMARY KEY (ContentID))`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+
+	var fns []string
+	for _, title := range []string{"one", "two", "three"} {
+		if _, err := k.DB.Exec(`INSERT OR REPLACE INTO content (ContentID, Title) VALUES ('book', ?)`, title); err != nil {
+			t.Fatalf("update title: %v", err)
+		}
+		fn, err := k.Backup(2)
+		if err != nil {
+			t.Fatalf("backup: %v", err)
+		}
+		fns = append(fns, fn)
+	}
+
+	if backups, err := k.Backups(); err != nil {
+		t.Fatalf("list backups: %v", err)
+	} else if len(backups) != 2 || backups[0] != fns[2] || backups[1] != fns[1] {
+		t.Errorf("expected the newest 2 backups %q, got %q", []string{fns[2], fns[1]}, backups)
+	}
+
+	title := func() string {
+		var title string
+		if err := k.DB.QueryRow(`SELECT Title FROM content WHERE ContentID = 'book'`).Scan(&title); err != nil {
+			t.Fatalf("get title: %v", err)
+		}
+		return title
+	}
+
+	if _, err := k.DB.Exec(`UPDATE content SET Title = 'four'`); err != nil {
+		t.Fatalf("update title: %v", err)
+	}
+	fn, bfn, err := k.Restore("", 0)
+	if err != nil {
+		t.Fatalf("restore latest: %v", err)
+	} else if fn != fns[2] {
+		t.Errorf("restore latest: expected %q to be restored, got %q", fns[2], fn)
+	}
+	if v := title(); v != "three" {
+		t.Errorf("restore latest: expected title %q, got %q", "three", v)
+	}
+
+	if _, _, err := k.Restore(filepath.Base(bfn), 0); err != nil {
+		t.Fatalf("undo restore: %v", err)
+	}
+	if v := title(); v != "four" {
+		t.Errorf("undo restore: expected title %q, got %q", "four", v)
+	}
+
+	if _, bfn, err = k.Restore(filepath.Base(fns[1]), 2); err != nil {
+		t.Fatalf("restore by name: %v", err)
+	}
+	if v := title(); v != "two" {
+		t.Errorf("restore by name: expected title %q, got %q", "two", v)
+	}
+
+	backups, err := k.Backups()
+	if err != nil {
+		t.Fatalf("list backups: %v", err)
+	} else if len(backups) != 2 || backups[0] != bfn {
+		t.Errorf("restore by name: expected 2 backups starting with the one before restoring %q, got %q", bfn, backups)
+	}
+
+	if _, _, err := k.Restore(fns[0], 0); err == nil {
+		t.Errorf("restore removed backup: expected error")
+	}
+
+	if err := os.WriteFile(backups[1], []byte("not a database"), 0644); err != nil {
+		t.Fatalf("corrupt backup: %v", err)
+	}
+	if _, _, err := k.Restore(backups[1], 0); err == nil {
+		t.Errorf("restore corrupt backup: expected error")
+	}
+	if v := title(); v != "two" {
+		t.Errorf("restore corrupt backup: expected title to be unchanged, got %q", v)
+	}
+	if n, _ := k.Backups(); len(n) != 2 {
+		t.Errorf("restore corrupt backup: expected no new backups, got %q", n)
+	}
+
+	// the backups are opened read-only, so there shouldn't be any journals
+	if ents, err := os.ReadDir(filepath.Join(kp, BackupDir)); err != nil {
+		t.Fatalf("list backup dir: %v", err)
+	} else {
+		for _, ent := range ents {
+			if filepath.Ext(ent.Name()) != ".sqlite" {
+				t.Errorf("unexpected file %q in backup dir", ent.Name())
+			}
+		}
+	}
+
+	if err := k.IntegrityCheck(); err != nil {
+		t.Errorf("integrity check: %v", err)
+	}
+}
+
+func TestCopyDBLocked(t *testing.T) {
+	dir := t.TempDir()
+
+	src, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "src.sqlite")+"?_busy_timeout=10")
+	if err != nil {
+		t.Fatalf("open source: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := sql.Open("sqlite3", filepath.Join(dir, "dst.sqlite"))
+	if err != nil {
+		t.Fatalf("open destination: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := src.Exec(`CREATE TABLE content (ContentID TEXT NOT NULL, PRIMARY KEY (ContentID))`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+
+	// lock the source from another connection like the Kobo would
+	other, err := sql.Open("sqlite3", filepath.Join(dir, "src.sqlite"))
+	if err != nil {
+		t.Fatalf("open source: %v", err)
+	}
+	defer other.Close()
+
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("lock source: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(context.Background(), `BEGIN EXCLUSIVE`); err != nil {
+		t.Fatalf("lock source: %v", err)
+	}
+
+	defer func(orig time.Duration) { copyDBTimeout = orig }(copyDBTimeout)
+	copyDBTimeout = time.Millisecond * 100
+
+	var serr sqlite3.Error
+	if err := copyDB(dst, src); err == nil {
+		t.Errorf("copy locked database: expected error")
+	} else if !errors.As(err, &serr) || serr.Code != sqlite3.ErrBusy {
+		t.Errorf("copy locked database: expected SQLITE_BUSY, got %v", err)
+	}
+
+	if _, err := conn.ExecContext(context.Background(), `ROLLBACK`); err != nil {
+		t.Fatalf("unlock source: %v", err)
+	}
+	if err := copyDB(dst, src); err != nil {
+		t.Errorf("copy unlocked database: %v", err)
+	}
+}
+
+func TestReadOnlyDSN(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "Kobo Reader 100%#1.sqlite")
+
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	if _, err := db.Exec(`PRAGMA journal_mode = WAL; CREATE TABLE content (ContentID TEXT NOT NULL, PRIMARY KEY (ContentID))`); err != nil {
+		db.Close()
+		t.Fatalf("create db: %v", err)
+	}
+	db.Close()
+
+	dsn, err := readOnlyDSN(fn)
+	if err != nil {
+		t.Fatalf("get dsn: %v", err)
+	}
+
+	ro, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer ro.Close()
+
+	if err := integrityCheck(ro); err != nil {
+		t.Errorf("check db: %v", err)
+	}
+
+	// a WAL database would normally get -wal and -shm files while it's open
+	if ents, err := os.ReadDir(dir); err != nil {
+		t.Fatalf("list dir: %v", err)
+	} else if len(ents) != 1 {
+		t.Errorf("expected no journal files while the database is open, got %d files", len(ents))
+	}
+
+	if _, err := ro.Exec(`DELETE FROM content`); err == nil {
+		t.Errorf("expected database to be read-only")
+	}
+}
@@ -0,0 +1,77 @@
+package kobodb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+)
+
+// BackupFlags are the command-line flags used by the device tools to back up
+// and restore the database.
+type BackupFlags struct {
+	Backups int    // the number of backups to keep, or 0 to only check the database
+	Restore string // the backup to restore, "latest", or empty
+}
+
+// AddBackupFlags adds --backups and --restore to fs.
+func AddBackupFlags(fs *pflag.FlagSet) *BackupFlags {
+	var f BackupFlags
+	fs.IntVar(&f.Backups, "backups", 3, "Number of database backups to keep in .kobo/kepubify-backups (0 disables backups)")
+	fs.StringVar(&f.Restore, "restore", "", "Restore the database from the latest backup, or a specific one with --restore=file, then exit")
+	fs.Lookup("restore").NoOptDefVal = "latest"
+	return &f
+}
+
+// RunRestore backs up the database, then restores it from the backup specified
+// by --restore, showing the progress. It returns false if it failed.
+func (f *BackupFlags) RunRestore(k *Kobo) bool {
+	name := f.Restore
+	if name == "latest" {
+		name = ""
+	}
+	fmt.Println("Restoring database")
+	fn, bfn, err := k.Restore(name, f.Backups)
+	if bfn != "" {
+		fmt.Printf("Backed up database to %s\n", bfn)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not restore database: %v.\n", err)
+		return false
+	}
+	fmt.Printf("Restored database from %s (use --restore=%s to undo)\n", fn, filepath.Base(bfn))
+	return true
+}
+
+// RunBackup backs up the database before it is changed, or only checks it if
+// backups are disabled, showing the progress. It returns false if it failed.
+func (f *BackupFlags) RunBackup(k *Kobo) bool {
+	if f.Backups <= 0 {
+		fmt.Println("Checking database")
+		if err := k.IntegrityCheck(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not check database: %v.\n", err)
+			return false
+		}
+		return true
+	}
+	fmt.Println("Backing up database")
+	fn, err := k.Backup(f.Backups)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not back up database: %v.\n", err)
+		return false
+	}
+	fmt.Printf("Backed up database to %s\n", fn)
+	return true
+}
+
+// RunCheck checks the database after it was changed, showing the progress. It
+// returns false if it failed.
+func (f *BackupFlags) RunCheck(k *Kobo) bool {
+	fmt.Println("Checking database")
+	if err := k.IntegrityCheck(); err != nil {
+		fmt.Fprintf(os.Stderr, "Database check failed: %v (use --restore to restore the latest backup).\n", err)
+		return false
+	}
+	return true
+}
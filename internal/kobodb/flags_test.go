@@ -0,0 +1,66 @@
+package kobodb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestBackupFlags(t *testing.T) {
+	kp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(kp, ".kobo"), 0755); err != nil {
+		t.Fatalf("create kobo: %v", err)
+	}
+
+	k, err := Open(kp)
+	if err != nil {
+		t.Fatalf("open kobo: %v", err)
+	}
+	defer k.Close()
+
+	parse := func(args ...string) *BackupFlags {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		bf := AddBackupFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("parse %q: %v", args, err)
+		}
+		return bf
+	}
+
+	if bf := parse(); bf.Backups != 3 || bf.Restore != "" {
+		t.Errorf("expected the default flags, got %+v", bf)
+	}
+	if bf := parse("--restore"); bf.Restore != "latest" {
+		t.Errorf("expected --restore to restore the latest backup, got %q", bf.Restore)
+	}
+	if bf := parse("--restore=backup.sqlite"); bf.Restore != "backup.sqlite" {
+		t.Errorf("expected --restore=file to restore a specific backup, got %q", bf.Restore)
+	}
+
+	if parse("--restore").RunRestore(k) {
+		t.Errorf("restore without backups: expected failure")
+	}
+	if !parse("--backups=0").RunBackup(k) {
+		t.Errorf("check: expected success")
+	}
+	if backups, _ := k.Backups(); len(backups) != 0 {
+		t.Errorf("check: expected no backups, got %q", backups)
+	}
+	if !parse().RunBackup(k) {
+		t.Errorf("backup: expected success")
+	}
+	if backups, _ := k.Backups(); len(backups) != 1 {
+		t.Errorf("backup: expected a backup, got %q", backups)
+	}
+	if !parse("--restore").RunRestore(k) {
+		t.Errorf("restore: expected success")
+	}
+	if backups, _ := k.Backups(); len(backups) != 2 {
+		t.Errorf("restore: expected a backup before restoring, got %q", backups)
+	}
+	if !parse().RunCheck(k) {
+		t.Errorf("check after change: expected success")
+	}
+}
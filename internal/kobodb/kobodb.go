@@ -0,0 +1,48 @@
+// Package kobodb opens the database on Kobo eReaders for the device tools
+// (seriesmeta, highlights, sideload, shelves).
+package kobodb
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Kobo is a Kobo eReader.
+type Kobo struct {
+	Path string
+	DB   *sql.DB
+}
+
+// Open opens a Kobo eReader device and the database.
+func Open(path string) (*Kobo, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if _, err = os.Stat(filepath.Join(path, ".kobo")); err != nil {
+		return nil, fmt.Errorf("could not access .kobo directory, is this a Kobo eReader: %v", err)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(path, ".kobo", "KoboReader.sqlite"))
+	if err != nil {
+		return nil, fmt.Errorf("could not open KoboReader.sqlite: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("could not open KoboReader.sqlite: %w", err)
+	}
+
+	return &Kobo{path, db}, nil
+}
+
+// Close closes the reader and the database.
+func (k *Kobo) Close() error {
+	return k.DB.Close()
+}
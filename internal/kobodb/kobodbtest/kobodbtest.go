@@ -0,0 +1,160 @@
+// Package kobodbtest has helpers for testing the device tools against a Kobo
+// eReader with the KoboReader.sqlite schema from firmware 4.x.
+package kobodbtest
+
+import (
+	"archive/zip"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pgaskin/koboutils/v2/kobo"
+)
+
+// Schema is the schema of KoboReader.sqlite.
+//
+//go:embed testdata/schema.sql
+var Schema string
+
+// New creates a Kobo eReader in a temporary directory with an empty database
+// and returns the path to it.
+func New(t testing.TB) string {
+	t.Helper()
+
+	kp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(kp, ".kobo"), 0755); err != nil {
+		t.Fatalf("create kobo: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(kp, ".kobo", "KoboReader.sqlite"))
+	if err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(Schema); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	return kp
+}
+
+// Import adds a book to the content table like the Kobo does when it imports
+// a sideloaded book. The extra columns are set to the specified values.
+func Import(t testing.TB, db *sql.DB, contentID string, extra map[string]string) {
+	t.Helper()
+	cols := []string{"ContentID", "ContentType", "MimeType", "ImageId", "___UserID"}
+	args := []interface{}{contentID, 6, "application/epub+zip", kobo.ContentIDToImageID(contentID), "adobe_user"}
+	for col, val := range extra {
+		cols = append(cols, col)
+		args = append(args, val)
+	}
+	if _, err := db.Exec(`INSERT INTO content (`+strings.Join(cols, ", ")+`) VALUES (?`+strings.Repeat(", ?", len(cols)-1)+`)`, args...); err != nil {
+		t.Fatalf("import %q: %v", contentID, err)
+	}
+}
+
+// WriteFile writes a file to fn (relative to dir), creating the parent
+// directories.
+func WriteFile(t testing.TB, dir, fn string, buf []byte) {
+	t.Helper()
+	fn = filepath.Join(dir, filepath.FromSlash(fn))
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatalf("write %q: %v", fn, err)
+	}
+	if err := os.WriteFile(fn, buf, 0644); err != nil {
+		t.Fatalf("write %q: %v", fn, err)
+	}
+}
+
+// WriteEPUB writes an EPUB to fn (relative to dir) with the specified OPF
+// metadata.
+func WriteEPUB(t testing.TB, dir, fn, metadata string) {
+	t.Helper()
+
+	var buf strings.Builder
+	zw := zip.NewWriter(&buf)
+	for _, x := range [][2]string{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`},
+		{"content.opf", `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">` + metadata + `</metadata>
+	<manifest/>
+	<spine/>
+</package>`},
+	} {
+		w, err := zw.Create(x[0])
+		if err != nil {
+			t.Fatalf("write %q: %v", fn, err)
+		}
+		if _, err := w.Write([]byte(x[1])); err != nil {
+			t.Fatalf("write %q: %v", fn, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("write %q: %v", fn, err)
+	}
+	WriteFile(t, dir, fn, []byte(buf.String()))
+}
+
+// Query returns the rows from a query as strings, with the columns formatted
+// as name="value" or name=NULL.
+func Query(t testing.TB, db *sql.DB, query string, args ...interface{}) []string {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+
+	var res []string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		var s []string
+		for i, v := range vals {
+			if v.Valid {
+				s = append(s, fmt.Sprintf("%s=%q", cols[i], v.String))
+			} else {
+				s = append(s, cols[i]+"=NULL")
+			}
+		}
+		res = append(res, strings.Join(s, " "))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	return res
+}
+
+// Check checks that the lines in act are the same as exp.
+func Check(t testing.TB, what string, act []string, exp ...string) {
+	t.Helper()
+	if a, b := strings.Join(act, "\n"), strings.Join(exp, "\n"); a != b {
+		t.Errorf("incorrect %s:\n%s\n---\nexpected:\n%s", what, a, b)
+	}
+}
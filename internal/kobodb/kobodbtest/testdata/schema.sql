@@ -0,0 +1,194 @@
+-- The schema of KoboReader.sqlite on firmware 4.x, trimmed to the tables used
+-- by the device tools or which reference content rows.
+
+CREATE TABLE content (
+	ContentID TEXT NOT NULL,
+	ContentType TEXT NOT NULL,
+	MimeType TEXT NOT NULL,
+	BookID TEXT,
+	BookTitle TEXT,
+	ImageId TEXT,
+	Title TEXT COLLATE NOCASE,
+	Attribution TEXT COLLATE NOCASE,
+	Description TEXT,
+	DateCreated TEXT,
+	ShortCoverKey TEXT,
+	adobe_location TEXT,
+	Publisher TEXT,
+	IsEncrypted BOOL,
+	DateLastRead TEXT,
+	FirstTimeReading BOOL,
+	ChapterIDBookmarked TEXT,
+	ParagraphBookmarked INTEGER,
+	BookmarkWordOffset INTEGER,
+	NumShortcovers INTEGER,
+	VolumeIndex INTEGER,
+	___NumPages INTEGER,
+	ReadStatus INTEGER,
+	___SyncTime TEXT,
+	___UserID TEXT NOT NULL,
+	PublicationId TEXT,
+	___FileOffset INTEGER,
+	___FileSize INTEGER,
+	___PercentRead INTEGER,
+	___ExpirationStatus INTEGER,
+	FavouritesIndex NUMERIC NOT NULL DEFAULT -1,
+	Accessibility INTEGER DEFAULT 1,
+	ContentURL TEXT,
+	Language TEXT,
+	BookshelfTags TEXT,
+	IsDownloaded BIT NOT NULL DEFAULT 1,
+	FeedbackType INTEGER DEFAULT 0,
+	AverageRating INTEGER DEFAULT 0,
+	Depth INTEGER,
+	PageProgressDirection TEXT,
+	InWishlist TEXT NOT NULL DEFAULT 'FALSE',
+	ISBN TEXT,
+	WishlistedDate TEXT NOT NULL DEFAULT '0000-00-00T00:00:00.000',
+	FeedbackTypeSynced INTEGER NOT NULL DEFAULT 0,
+	IsSocialEnabled TEXT NOT NULL DEFAULT 'true',
+	EpubType INTEGER DEFAULT -1,
+	Monetization INTEGER DEFAULT 2,
+	ExternalId TEXT,
+	Series TEXT COLLATE NOCASE,
+	SeriesNumber TEXT,
+	Subtitle TEXT,
+	WordCount INTEGER DEFAULT -1,
+	Fallback TEXT,
+	RestOfBookEstimate INTEGER,
+	CurrentChapterEstimate INTEGER,
+	CurrentChapterProgress FLOAT,
+	PocketStatus INTEGER DEFAULT 0,
+	UnsyncedPocketChanges TEXT,
+	ImageUrl TEXT,
+	DateAdded TEXT,
+	WorkId TEXT,
+	Properties TEXT,
+	RenditionSpread TEXT,
+	RatingCount INTEGER DEFAULT 0,
+	ReviewsSyncDate TEXT,
+	MediaOverlay TEXT,
+	MediaOverlayType TEXT,
+	RedirectPreviewUrl BOOL,
+	PreviewFileSize INTEGER,
+	EntitlementId TEXT,
+	CrossRevisionId TEXT,
+	DownloadUrl BOOL,
+	ReadStateSynced BOOL DEFAULT false,
+	TimesStartedReading INTEGER,
+	TimeSpentReading INTEGER,
+	LastTimeStartedReading TEXT,
+	LastTimeFinishedReading TEXT,
+	ApplicableSubscriptions TEXT,
+	ExternalIds TEXT,
+	PurchaseRate TEXT,
+	SeriesID TEXT,
+	SeriesNumberFloat REAL,
+	AdobeLoanExpiration TEXT,
+	HideFromHomePage BOOL,
+	IsInternetArchive BOOL,
+	titleKana TEXT,
+	subtitleKana TEXT,
+	seriesKana TEXT,
+	attributionKana TEXT,
+	publisherKana TEXT,
+	IsPurchaseable BOOL,
+	IsSupported BOOL,
+	AnnotationsSyncToken TEXT,
+	DateModified TEXT,
+	PRIMARY KEY (ContentID)
+);
+
+CREATE INDEX content_bookid ON content (BookID);
+CREATE INDEX content_series ON content (Series, SeriesNumber);
+
+CREATE TABLE content_keys (
+	volumeId TEXT NOT NULL,
+	elementId TEXT NOT NULL,
+	elementKey TEXT,
+	PRIMARY KEY (volumeId, elementId)
+);
+
+CREATE TABLE content_settings (
+	ContentID TEXT NOT NULL,
+	ContentType TEXT NOT NULL,
+	DateModified TEXT NOT NULL,
+	ReadingFontFamily TEXT,
+	ReadingFontSize REAL,
+	ReadingAlignment TEXT,
+	ReadingLineHeight REAL,
+	ReadingLeftMargin INTEGER,
+	ReadingRightMargin INTEGER,
+	ReadingPublisherMode BIT,
+	ActivityFacebookShare BIT DEFAULT 'true',
+	PRIMARY KEY (ContentID, ContentType)
+);
+
+CREATE TABLE volume_shortcovers (
+	volumeId TEXT NOT NULL,
+	shortcoverId TEXT NOT NULL,
+	VolumeIndex INTEGER,
+	PRIMARY KEY (volumeId, shortcoverId)
+);
+
+CREATE TABLE volume_tabs (
+	volumeId TEXT NOT NULL,
+	tabId TEXT NOT NULL,
+	PRIMARY KEY (volumeId, tabId)
+);
+
+CREATE TABLE Bookmark (
+	BookmarkID TEXT NOT NULL,
+	VolumeID TEXT NOT NULL,
+	ContentID TEXT NOT NULL,
+	StartContainerPath TEXT NOT NULL,
+	StartContainerChildIndex INTEGER NOT NULL,
+	StartOffset INTEGER NOT NULL,
+	EndContainerPath TEXT NOT NULL,
+	EndContainerChildIndex INTEGER NOT NULL,
+	EndOffset INTEGER NOT NULL,
+	Text TEXT,
+	Annotation TEXT,
+	ExtraAnnotationData BLOB,
+	DateCreated TEXT,
+	ChapterProgress FLOAT NOT NULL DEFAULT 0,
+	Hidden BOOL NOT NULL DEFAULT 0,
+	Version TEXT,
+	DateModified TEXT,
+	Creator TEXT,
+	UUID TEXT,
+	UserID TEXT,
+	SyncTime TEXT,
+	Published BIT DEFAULT false,
+	ContextString TEXT,
+	Type TEXT,
+	PRIMARY KEY (BookmarkID)
+);
+
+CREATE TABLE Shelf (
+	CreationDate TEXT,
+	Id TEXT,
+	InternalName TEXT,
+	LastModified TEXT,
+	Name TEXT,
+	Type TEXT,
+	_IsDeleted BOOL,
+	_IsVisible BOOL,
+	_IsSynced BOOL,
+	_SyncTime TEXT,
+	LastAccessed TEXT,
+	PRIMARY KEY (Id)
+);
+
+CREATE TABLE ShelfContent (
+	ShelfName TEXT,
+	ContentId TEXT,
+	DateModified TEXT,
+	_IsDeleted BOOL,
+	_IsSynced BOOL,
+	PRIMARY KEY (ShelfName, ContentId)
+);
+
+CREATE INDEX bookmark_content ON Bookmark (ContentID);
+CREATE INDEX bookmark_volume ON Bookmark (VolumeID);
+CREATE INDEX volume_shortcovers_shortcover ON volume_shortcovers (shortcoverId);
@@ -0,0 +1,44 @@
+// Package kobopath converts between the paths of sideloaded books and the
+// ContentIDs used by the Kobo database, for books on either the internal
+// storage or the SD card.
+package kobopath
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pgaskin/koboutils/v2/kobo"
+)
+
+const (
+	onboardPrefix = "file:///mnt/onboard/"
+	sdPrefix      = "file:///mnt/sd/"
+)
+
+// ContentID generates the ContentID for a path relative to the root of the
+// internal storage, or the SD card if sd is true.
+func ContentID(rel string, sd bool) string {
+	if sd {
+		return sdPrefix + filepath.ToSlash(rel)
+	}
+	return kobo.PathToContentID(rel)
+}
+
+// ImageID generates the ImageId for a path relative to the root of the internal
+// storage, or the SD card if sd is true.
+func ImageID(rel string, sd bool) string {
+	return kobo.ContentIDToImageID(ContentID(rel, sd))
+}
+
+// Path gets the path relative to the root of the internal storage or the SD
+// card from a ContentID. If the ContentID isn't for a sideloaded book, ok is
+// false.
+func Path(contentID string) (rel string, sd, ok bool) {
+	if rel := strings.TrimPrefix(contentID, onboardPrefix); rel != contentID && rel != "" {
+		return filepath.FromSlash(rel), false, true
+	}
+	if rel := strings.TrimPrefix(contentID, sdPrefix); rel != contentID && rel != "" {
+		return filepath.FromSlash(rel), true, true
+	}
+	return "", false, false
+}
@@ -0,0 +1,44 @@
+package kobopath
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestContentID(t *testing.T) {
+	for _, c := range []struct {
+		Rel     string
+		SD      bool
+		ID, IID string
+	}{
+		{"Books/a book.kepub.epub", false, "file:///mnt/onboard/Books/a book.kepub.epub", "file____mnt_onboard_Books_a_book_kepub_epub"},
+		{"Books/a book.kepub.epub", true, "file:///mnt/sd/Books/a book.kepub.epub", "file____mnt_sd_Books_a_book_kepub_epub"},
+		{"book.epub", true, "file:///mnt/sd/book.epub", "file____mnt_sd_book_epub"},
+	} {
+		rel := filepath.FromSlash(c.Rel)
+		if id := ContentID(rel, c.SD); id != c.ID {
+			t.Errorf("content id for %q (sd=%t): expected %q, got %q", c.Rel, c.SD, c.ID, id)
+		}
+		if iid := ImageID(rel, c.SD); iid != c.IID {
+			t.Errorf("image id for %q (sd=%t): expected %q, got %q", c.Rel, c.SD, c.IID, iid)
+		}
+		if r, sd, ok := Path(c.ID); !ok || r != rel || sd != c.SD {
+			t.Errorf("path for %q: expected (%q, %t, true), got (%q, %t, %t)", c.ID, rel, c.SD, r, sd, ok)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"file:///mnt/onboard/",
+		"file:///mnt/sd/",
+		"file:///mnt/other/book.epub",
+		"00000000-0000-0000-0000-000000000000",
+		"/mnt/onboard/book.epub",
+	} {
+		if rel, sd, ok := Path(id); ok {
+			t.Errorf("path for %q: expected not ok, got (%q, %t, %t)", id, rel, sd, ok)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	encunicode "golang.org/x/text/encoding/unicode"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/charset"
+)
+
+// detectCharset determines the charset of a content document. The byte order
+// mark is always trusted. The charset declared in the XML declaration or meta
+// tags is used if the content is valid for it (and isn't more likely to be
+// UTF-8). Otherwise, the most plausible charset from fallback is used (with
+// earlier ones being preferred).
+//
+// Content which is mostly valid UTF-8 is treated as UTF-8 even if it has a few
+// invalid bytes, and if none of the fallback charsets are plausible, the
+// content is also left as UTF-8. In both cases, the returned encoding replaces
+// the invalid bytes. An error is only returned if fallback contains an unknown
+// charset.
+//
+// The returned encoding is nil if the document is already UTF-8. The returned
+// message describes how the charset was determined.
+func detectCharset(buf []byte, fallback []string) (encoding.Encoding, string, string, error) {
+	for _, b := range []struct {
+		bom []byte
+		enc string
+	}{
+		{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+		{[]byte{0xFE, 0xFF}, "utf-16be"},
+		{[]byte{0xFF, 0xFE}, "utf-16le"},
+	} {
+		if bytes.HasPrefix(buf, b.bom) {
+			if b.enc == "utf-8" {
+				return nil, b.enc, "byte order mark", nil
+			}
+			e, name := charset.Lookup(b.enc)
+			return e, name, "byte order mark", nil
+		}
+	}
+
+	highBit := bytes.IndexFunc(buf, func(r rune) bool { return r >= 0x80 }) != -1
+	validUTF8 := utf8.Valid(buf)
+	mostlyUTF8 := !validUTF8 && mostlyValidUTF8(buf)
+
+	var declared string
+	if label, where := declaredCharset(buf); label != "" {
+		if e, name := charset.Lookup(label); e == nil {
+			declared = fmt.Sprintf("declared charset %q in %s is unknown", label, where)
+		} else if name == "utf-8" || name == "utf-16le" || name == "utf-16be" {
+			// utf-16 is treated as utf-8 when declared without a byte order
+			// mark (see the HTML spec) since the declaration itself couldn't
+			// have been read otherwise
+			if validUTF8 {
+				return nil, "utf-8", "declared in " + where, nil
+			}
+			if mostlyUTF8 {
+				return encunicode.UTF8, "utf-8", "declared in " + where + " (invalid bytes replaced)", nil
+			}
+			declared = fmt.Sprintf("declared charset %s in %s is invalid for the content", name, where)
+		} else if highBit && validUTF8 {
+			return nil, "utf-8", fmt.Sprintf("declared charset %s in %s, but the content is valid UTF-8", name, where), nil
+		} else if s, err := e.NewDecoder().Bytes(buf); err != nil || !plausibleCharset(string(s)) {
+			declared = fmt.Sprintf("declared charset %s in %s is invalid for the content", name, where)
+		} else {
+			return e, name, "declared in " + where, nil
+		}
+	}
+
+	msg := "detected from content"
+	if declared != "" {
+		msg = declared + ", " + msg
+	}
+
+	if !highBit {
+		return nil, "utf-8", msg + " (ASCII only)", nil // there isn't any way to tell, and it doesn't matter
+	}
+
+	var (
+		bestEnc   encoding.Encoding
+		bestName  string
+		bestScore float64
+	)
+	for _, label := range fallback {
+		e, name := charset.Lookup(label)
+		if e == nil {
+			return nil, "", "", fmt.Errorf("invalid charset %q", label)
+		}
+		if name == "utf-8" {
+			if validUTF8 {
+				return nil, name, msg, nil // valid UTF-8 with non-ASCII chars is almost certainly UTF-8
+			}
+			if mostlyUTF8 {
+				return encunicode.UTF8, name, msg + " (invalid bytes replaced)", nil
+			}
+			continue
+		}
+		s, err := e.NewDecoder().Bytes(buf)
+		if err != nil || !plausibleCharset(string(s)) {
+			continue
+		}
+		if score := charsetScore(string(s)); bestName == "" || score > bestScore {
+			bestEnc, bestName, bestScore = e, name, score
+		}
+	}
+	if bestName == "" {
+		return encunicode.UTF8, "utf-8", fmt.Sprintf("%s, but the content is not valid in any of the charsets %s (using utf-8 with invalid bytes replaced)", msg, strings.Join(fallback, ", ")), nil
+	}
+	return bestEnc, bestName, msg, nil
+}
+
+// mostlyValidUTF8 checks if buf has more valid multi-byte UTF-8 sequences than
+// invalid bytes. Text in other charsets almost never has valid multi-byte
+// sequences, so this means it is UTF-8 with some corruption.
+func mostlyValidUTF8(buf []byte) bool {
+	var valid, invalid int
+	for len(buf) != 0 {
+		r, n := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && n == 1 {
+			invalid++
+		} else if n > 1 {
+			valid++
+		}
+		buf = buf[n:]
+	}
+	return valid > invalid
+}
+
+var xmlDeclEncodingRe = regexp.MustCompile(`^\s*<\?xml[^>]+encoding\s*=\s*["']([A-Za-z][A-Za-z0-9._-]*)["']`)
+
+// declaredCharset gets the charset declared in the XML declaration or meta tags
+// in the first 1024 bytes of buf.
+func declaredCharset(buf []byte) (label, where string) {
+	if len(buf) > 1024 {
+		buf = buf[:1024]
+	}
+	if m := xmlDeclEncodingRe.FindSubmatch(buf); m != nil {
+		return string(m[1]), "XML declaration"
+	}
+	z := html.NewTokenizer(bytes.NewReader(buf))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "", ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if t := z.Token(); t.Data == "meta" {
+				var httpEquiv, content string
+				for _, a := range t.Attr {
+					switch strings.ToLower(a.Key) {
+					case "charset":
+						return strings.TrimSpace(a.Val), "meta tag"
+					case "http-equiv":
+						httpEquiv = strings.ToLower(a.Val)
+					case "content":
+						content = a.Val
+					}
+				}
+				if httpEquiv == "content-type" {
+					if _, p, err := mime.ParseMediaType(content); err == nil && p["charset"] != "" {
+						return p["charset"], "meta tag"
+					}
+				}
+			}
+		}
+	}
+}
+
+// plausibleCharset checks if the decoded string could be from the correct
+// charset (i.e., it doesn't contain undefined or C1 control characters).
+func plausibleCharset(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || (r >= 0x80 && r <= 0x9F) {
+			return false
+		}
+	}
+	return true
+}
+
+// charsetScore is a simple heuristic for how plausible the non-ASCII characters
+// in the decoded text are. A higher score is more likely. It is designed to
+// distinguish between single-byte charsets, which are all valid for most
+// content.
+//
+// Letters are preferred over symbols, lowercase letters are preferred over
+// uppercase ones (this distinguishes between charsets with the same letters,
+// but different cases, like Windows-1251 and KOI8-R), and words mixing scripts
+// or with runs of accented Latin letters (which are uncommon in real text, but
+// common when reading non-Latin text in a Latin charset) are penalized.
+func charsetScore(s string) float64 {
+	var n, score int
+	var prev rune
+	for _, r := range s {
+		if r < 0x80 {
+			if unicode.IsLetter(r) && unicode.IsLetter(prev) && prev >= 0x80 && !unicode.Is(unicode.Latin, prev) {
+				score -= 2 // mixed scripts
+			}
+			prev = r
+			continue
+		}
+		n++
+		switch {
+		case unicode.IsLetter(r):
+			score += 2
+			if unicode.IsLower(r) {
+				score++
+			} else if unicode.IsUpper(r) && unicode.IsLower(prev) {
+				score -= 3
+			}
+			if unicode.IsLetter(prev) {
+				if pl, l := unicode.Is(unicode.Latin, prev), unicode.Is(unicode.Latin, r); pl != l {
+					score -= 2 // mixed scripts
+				} else if l && prev >= 0x80 {
+					score -= 2 // runs of accented latin letters
+				}
+			}
+		case unicode.IsPunct(r), unicode.IsSpace(r), unicode.IsNumber(r):
+			// neutral
+		default:
+			score -= 2
+		}
+		prev = r
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(score) / float64(n)
+}
@@ -8,13 +8,17 @@ import (
 	"io"
 	"io/fs"
 	"math"
+	"net/url"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/pgaskin/kepubify/v4/internal/zip"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
 )
 
 // Convert converts the EPUB root r into a new EPUB written to w. If r is a
@@ -32,9 +36,13 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		FileActionIgnore           = 1
 		FileActionTransformContent = 2
 		FileActionTransformOPF     = 3
+		FileActionTransformNCX     = 4
+		FileActionTransformImage   = 5
+		FileActionTransformRefs    = 6
 	)
 
 	p := ctxProgress(ctx)
+	report := ctxReport(ctx)
 
 	if tmp, ok := r.(*zip.ReadCloser); ok {
 		r = &tmp.Reader
@@ -91,12 +99,33 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		fileIdx[f.Name] = i
 	}
 
-	opf, err := epubPackage(r)
-	if err != nil {
+	// pkg is used to read the package-level files (which may be repaired)
+	var (
+		pkg       fs.FS = r
+		opf       string
+		container []byte // if repaired
+		err       error
+	)
+	if c.repair {
+		var fns []string
+		for _, f := range files {
+			if !f.Mode().IsDir() && f.Name[len(f.Name)-1] != '/' {
+				fns = append(fns, f.Name)
+			}
+		}
+		if opf, container, err = epubRepairPackage(r, fns, report); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		buf, err := epubRepairOPF(r, opf, fns, report)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		pkg = overlayFS{r, map[string][]byte{opf: buf}}
+	} else if opf, err = epubPackage(r); err != nil {
 		return fmt.Errorf("read source EPUB: %w", err)
 	}
 
-	cd, err := epubContentDocuments(r, opf)
+	cd, err := epubContentDocuments(pkg, opf)
 	if err != nil {
 		return fmt.Errorf("read source EPUB: %w", err)
 	}
@@ -142,10 +171,283 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 		fileAct[i] = FileActionIgnore
 	}
 
+	// and the container if it was repaired
+	if i, ok := fileIdx["META-INF/container.xml"]; ok && container != nil {
+		fileAct[i] = FileActionIgnore
+	}
+
+	st := &convertState{Report: report, Removed: map[string]bool{}}
+	var ncxChanged bool
+
+	// remove the filtered files from the manifest too
+	for i, f := range files {
+		if fileAct[i] == FileActionIgnore && f.Name != "mimetype" && f.Name != "META-INF/container.xml" && !f.Mode().IsDir() && f.Name[len(f.Name)-1] != '/' {
+			st.Removed[f.Name] = true
+		}
+	}
+
+	// match the per-document transformation rules
+	if len(c.noSpansFor) != 0 || len(c.noDivsFor) != 0 || len(c.noStylesFor) != 0 {
+		items, err := epubContentItems(pkg, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		st.Skip = c.contentSkips(items)
+	}
+
+	// get the language of the book
+	if st.Language, err = epubLanguage(pkg, opf); err != nil {
+		return fmt.Errorf("read source EPUB: %w", err)
+	}
+
+	// get the text direction and writing mode (stylesheets are only checked
+	// if it might be a vertical book, since the page progression direction
+	// of those is always right-to-left)
+	if st.PageDirection, st.WritingMode, err = epubDirection(pkg, opf); err != nil {
+		return fmt.Errorf("read source EPUB: %w", err)
+	}
+	if st.PageDirection == "rtl" || st.WritingMode != "" {
+		st.VerticalCSS = map[string][]string{}
+		for i, f := range files {
+			if fileAct[i] == FileActionIgnore || !strings.EqualFold(path.Ext(f.Name), ".css") {
+				continue
+			}
+			buf, err := fs.ReadFile(pkg, f.Name)
+			if err != nil {
+				return fmt.Errorf("read source EPUB: %w", err)
+			}
+			if sels := cssVerticalSelectors(buf); len(sels) != 0 {
+				st.VerticalCSS[f.Name] = sels
+			}
+		}
+	}
+
+	// find the cover image if it's needed (this needs to be done before
+	// removing unreferenced files since it may only be found by the filename),
+	// otherwise, only the cheaper checks in transformOPFCoverImage are done
+	var coverErr bool
+	if c.generateCover || c.removeUnreferenced {
+		if cover, how, err := epubCover(pkg, opf); err != nil {
+			coverErr = true
+			if report != nil {
+				report(Report{Kind: ReportCover, Value: "error", Message: err.Error()})
+			}
+		} else if i, ok := fileIdx[cover]; ok && fileAct[i] != FileActionIgnore {
+			st.Cover = cover
+			if report != nil {
+				report(Report{Kind: ReportCover, File: cover, Message: how})
+			}
+		}
+	}
+
+	// remove unreferenced files
+	if c.removeUnreferenced {
+		var fns []string
+		for i, f := range files {
+			if fileAct[i] != FileActionIgnore || f.Name == "mimetype" {
+				fns = append(fns, f.Name)
+			}
+		}
+		reachable, err := epubReachable(pkg, opf, fns)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		for _, fn := range fns {
+			if !reachable[fn] && fn != st.Cover {
+				fileAct[fileIdx[fn]] = FileActionIgnore
+				st.Removed[fn] = true
+				if report != nil {
+					report(Report{Kind: ReportUnreferenced, File: fn, Message: "not reachable from the spine, navigation, or cover"})
+				}
+			}
+		}
+	}
+
+	// index the links (this needs to be done before anything is transformed
+	// since links need to be checked against other documents)
+	if c.links {
+		var fns []string
+		for i, f := range files {
+			if fileAct[i] != FileActionIgnore || f.Name == "mimetype" {
+				fns = append(fns, f.Name)
+			}
+		}
+		if st.Links, err = newLinkIndex(pkg, fns, opf); err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		st.FixLinks = c.linksFix
+		ncxChanged = true
+	}
+
+	// split oversized content documents (this needs to be done before anything
+	// is transformed since links to the moved elements need to be updated)
+	if c.splitSize > 0 {
+		splits := newContentSplits()
+		for i, f := range files {
+			if fileAct[i] != FileActionTransformContent || f.UncompressedSize64 <= uint64(c.splitSize) {
+				continue
+			}
+
+			rc, err := r.Open(f.Name)
+			if err != nil {
+				return fmt.Errorf("split %q: %w", f.Name, err)
+			}
+			doc, err := c.parseContent(rc, f.Name, report)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("split %q: %w", f.Name, err)
+			}
+
+			ext := path.Ext(f.Name)
+			parts := splitContentDocument(doc, int(c.splitSize), func(n int) string {
+				if n == 1 {
+					return f.Name
+				}
+				fn := fmt.Sprintf("%s_split%d%s", strings.TrimSuffix(f.Name, ext), n, ext)
+				for x := 1; ; x++ {
+					if _, exists := fileIdx[fn]; !exists {
+						return fn
+					}
+					fn = fmt.Sprintf("%s_split%d_%d%s", strings.TrimSuffix(f.Name, ext), n, x, ext)
+				}
+			})
+			if parts == nil {
+				parts = []contentSplitPart{{Name: f.Name, Doc: doc}} // so we don't need to parse it again
+			} else {
+				ncxChanged = true
+				if report != nil {
+					report(Report{Kind: ReportSplit, File: f.Name, Value: strconv.Itoa(len(parts)), Message: fmt.Sprintf("%d bytes", f.UncompressedSize64)})
+				}
+			}
+			splits.add(f.Name, parts)
+		}
+		st.Splits = splits
+	}
+
+	// convert unsupported images (this needs to be done before anything is
+	// transformed since references to renamed images need to be updated)
+	images := map[int]imageConversion{}
+	if c.convertImages {
+		renamed := map[string]string{}
+		taken := map[string]bool{}
+		for i, f := range files {
+			if fileAct[i] != FileActionCopy {
+				continue
+			}
+			switch strings.ToLower(path.Ext(f.Name)) {
+			case ".webp", ".jpg", ".jpeg", ".gif":
+			default:
+				continue
+			}
+
+			buf, err := fs.ReadFile(pkg, f.Name)
+			if err != nil {
+				return fmt.Errorf("convert image %q: %w", f.Name, err)
+			}
+
+			ic := imageCheck(f.Name, buf)
+			if ic.Format == "" {
+				continue
+			}
+			if ic.Name != f.Name {
+				ext := path.Ext(ic.Name)
+				fn := ic.Name
+				for x := 1; ; x++ {
+					if _, exists := fileIdx[fn]; !exists && !taken[fn] {
+						break
+					}
+					fn = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(ic.Name, ext), x, ext)
+				}
+				ic.Name = fn
+				taken[fn] = true
+				renamed[f.Name] = fn
+			}
+			fileAct[i] = FileActionTransformImage
+			images[i] = ic
+
+			if report != nil {
+				report(Report{Kind: ReportImage, File: f.Name, Value: ic.Name, Message: ic.Reason + ", converted to " + ic.Format})
+			}
+		}
+		if len(renamed) != 0 {
+			st.Renamed = renamed
+			for i, f := range files {
+				if fileAct[i] != FileActionCopy {
+					continue
+				}
+				switch strings.ToLower(path.Ext(f.Name)) {
+				case ".css", ".svg":
+					fileAct[i] = FileActionTransformRefs
+				}
+			}
+		}
+	}
+
+	// mark the ncx to be transformed if needed
+	if ncxChanged {
+		ncx, err := epubNCX(pkg, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if i, ok := fileIdx[ncx]; ok && fileAct[i] == FileActionCopy {
+			fileAct[i] = FileActionTransformNCX
+		}
+	}
+
+	// generate the nav document if upgrading to EPUB3 (this needs to be done
+	// after the splits and link index since the links are copied from the NCX)
+	var nav []byte
+	if c.upgrade {
+		ver, err := epubVersion(pkg, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		if strings.HasPrefix(ver, "2") {
+			ncx, err := epubNCX(pkg, opf)
+			if err != nil {
+				return fmt.Errorf("read source EPUB: %w", err)
+			}
+			if i, ok := fileIdx[ncx]; ok && fileAct[i] != FileActionIgnore {
+				fn := path.Join(path.Dir(ncx), "kepubify-nav.xhtml")
+				if nav, err = epubUpgradeNav(pkg, opf, ncx, fn, st); err != nil {
+					return fmt.Errorf("upgrade to EPUB3: %w", err)
+				}
+				st.Nav = fn
+			}
+		}
+	}
+
+	// generate a cover if there isn't one
+	var cover []byte
+	if c.generateCover && st.Cover == "" && !coverErr {
+		title, authors, err := epubMetadata(pkg, opf)
+		if err != nil {
+			return fmt.Errorf("read source EPUB: %w", err)
+		}
+		c.coverMu.Lock()
+		cover, err = generateCover(c.coverTitleFace, c.coverAuthorFace, title, authors)
+		c.coverMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("generate cover: %w", err)
+		}
+		fn := path.Join(path.Dir(opf), "kepubify-cover.png")
+		for x := 1; ; x++ {
+			if _, exists := fileIdx[fn]; !exists {
+				break
+			}
+			fn = path.Join(path.Dir(opf), fmt.Sprintf("kepubify-cover_%d.png", x))
+		}
+		st.GeneratedCover = fn
+		if report != nil {
+			report(Report{Kind: ReportCover, File: fn, Message: "generated"})
+		}
+	}
+
 	// start transforming and writing the content files in parallel
 	type File struct {
 		Index  int             // -1 for a new file
 		Header *zip.FileHeader // if Index is -1
+		Rename string          // if not empty, the new name of the file
 		// We could have passed around a *html.Node or a *etree.Document, and
 		// encoded it directly to the zip writer, but this gives better
 		// performance for a few reasons. Firstly, writing to the zip file can
@@ -176,6 +478,48 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 
 		// we don't need to do anything with files to be removed
 
+		// add the repaired container first
+		if container != nil {
+			fh := &zip.FileHeader{
+				Name:   "META-INF/container.xml",
+				Method: zip.Deflate,
+			}
+			fh.SetMode(0666)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: bytes.NewBuffer(container)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// and the generated nav
+		if nav != nil {
+			fh := &zip.FileHeader{
+				Name:   st.Nav,
+				Method: zip.Deflate,
+			}
+			fh.SetMode(0666)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: bytes.NewBuffer(nav)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// and the generated cover
+		if cover != nil {
+			fh := &zip.FileHeader{
+				Name:   st.GeneratedCover,
+				Method: zip.Store, // already compressed
+			}
+			fh.SetMode(0666)
+			select {
+			case output <- File{Index: -1, Header: fh, Bytes: bytes.NewBuffer(cover)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
 		// add copied files to the EPUB first (the order will be preserved)
 		for i := range files {
 			if fileAct[i] == FileActionCopy {
@@ -189,7 +533,7 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 
 		// then queue the files to be transformed in parallel
 		for i := range files {
-			if fileAct[i] == FileActionTransformOPF || fileAct[i] == FileActionTransformContent {
+			if fileAct[i] != FileActionCopy && fileAct[i] != FileActionIgnore {
 				select {
 				case queue <- i:
 				case <-ctx.Done():
@@ -207,7 +551,7 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 			for i := range queue {
 				f := files[i]
 
-				rc, err := r.Open(f.Name)
+				rc, err := pkg.Open(f.Name)
 				if err != nil {
 					return fmt.Errorf("transform %q: %w", f.Name, err)
 				}
@@ -216,30 +560,102 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 
 				switch a := fileAct[i]; a {
 				case FileActionTransformOPF:
-					err = c.TransformOPF(buf, rc)
+					err = c.transformOPF(buf, rc, f.Name, st)
+					var fns []string
+					var pages [][]byte
+					if err == nil {
+						fns, pages, err = c.transformPages(pkg, opf, buf)
+					}
+					for j := range pages {
+						fh := &zip.FileHeader{
+							Name:   fns[j],
+							Method: zip.Deflate,
+						}
+						fh.SetMode(0666)
+						select {
+						case output <- File{Index: -1, Header: fh, Bytes: bytes.NewBuffer(pages[j])}:
+						case <-ctx.Done():
+							rc.Close()
+							return ctx.Err()
+						}
+					}
 					if err == nil {
-						if fn, r, a, err1 := c.TransformDummyTitlepage(r, opf, buf); err1 != nil {
+						// the heuristic needs to see the added pages
+						added := map[string][]byte{}
+						for j := range pages {
+							added[fns[j]] = pages[j]
+						}
+						if fn, r, a, why, err1 := c.transformDummyTitlepage(overlayFS{pkg, added}, opf, buf); err1 != nil {
 							err = err1
 						} else if a {
+							if report != nil {
+								report(Report{Kind: ReportTitlepage, File: fn, Value: "added", Message: why})
+							}
 							buf1 := pool.Get().(*bytes.Buffer)
-							if _, err := buf1.ReadFrom(r); err != nil {
-								err = fmt.Errorf("apply title page fix: %w", err)
+							if _, err1 := buf1.ReadFrom(r); err1 != nil {
+								err = fmt.Errorf("apply title page fix: %w", err1)
 							} else {
 								fh := &zip.FileHeader{
 									Name:   fn,
 									Method: zip.Deflate,
 								}
 								fh.SetMode(0666)
-								output <- File{
-									Index:  -1,
-									Header: fh,
-									Bytes:  buf1,
+								select {
+								case output <- File{Index: -1, Header: fh, Bytes: buf1}:
+								case <-ctx.Done():
+									rc.Close()
+									return ctx.Err()
 								}
 							}
+						} else if report != nil {
+							report(Report{Kind: ReportTitlepage, Value: "skipped", Message: why})
 						}
 					}
 				case FileActionTransformContent:
-					err = c.TransformContent(buf, rc)
+					var parts []contentSplitPart
+					if st.Splits != nil {
+						parts = st.Splits.Docs[f.Name]
+					}
+					if parts == nil {
+						var doc *html.Node
+						if doc, err = c.parseContent(rc, f.Name, report); err == nil {
+							parts = []contentSplitPart{{Name: f.Name, Doc: doc}}
+						}
+					}
+					for j, pt := range parts {
+						if j == 0 {
+							err = c.transformContentDoc(buf, pt.Doc, pt.Name, st)
+						} else {
+							buf1 := pool.Get().(*bytes.Buffer)
+							if err = c.transformContentDoc(buf1, pt.Doc, pt.Name, st); err != nil {
+								buf1.Reset()
+								pool.Put(buf1)
+								err = fmt.Errorf("split part %q: %w", pt.Name, err)
+								break
+							}
+							fh := &zip.FileHeader{
+								Name:     pt.Name,
+								Method:   zip.Deflate,
+								Modified: f.Modified,
+							}
+							fh.SetMode(0666)
+							select {
+							case output <- File{Index: -1, Header: fh, Bytes: buf1}:
+							case <-ctx.Done():
+								rc.Close()
+								return ctx.Err()
+							}
+						}
+						if err != nil {
+							break
+						}
+					}
+				case FileActionTransformNCX:
+					err = transformNCX(buf, rc, f.Name, st)
+				case FileActionTransformImage:
+					err = imageConvert(buf, rc, images[i].Format)
+				case FileActionTransformRefs:
+					err = transformReferences(buf, rc, f.Name, st.Renamed)
 				default:
 					panic(fmt.Sprintf("unexpected action %d in transformation goroutine", a))
 				}
@@ -252,8 +668,13 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 					return fmt.Errorf("transform %q: %w", f.Name, err)
 				}
 
+				var rename string
+				if fileAct[i] == FileActionTransformImage && images[i].Name != f.Name {
+					rename = images[i].Name
+				}
+
 				select {
-				case output <- File{Index: i, Bytes: buf}:
+				case output <- File{Index: i, Rename: rename, Bytes: buf}:
 				case <-ctx.Done():
 					return ctx.Err()
 				}
@@ -299,6 +720,11 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 				return fmt.Errorf("copy %q to output EPUB: %w", f.Name, err)
 			}
 		default:
+			if of.Rename != "" {
+				fh := *f
+				fh.Name = of.Rename
+				f = &fh
+			}
 			if err := zipReplace(zw, f, b); err != nil {
 				return fmt.Errorf("write %q to output EPUB: %w", f.Name, err)
 			}
@@ -325,6 +751,49 @@ func (c *Converter) Convert(ctx context.Context, w io.Writer, r fs.FS) error {
 	return nil
 }
 
+// convertState contains information about the whole EPUB which is needed while
+// transforming individual files.
+type convertState struct {
+	Splits   *contentSplits // nil if content documents aren't being split
+	Links    *linkIndex     // nil if links aren't being checked
+	FixLinks bool
+	Removed  map[string]bool        // files removed from the EPUB, which should also be removed from the manifest
+	Nav      string                 // the generated navigation document if the package is being upgraded to EPUB3
+	Renamed  map[string]string      // new names of converted images
+	Cover    string                 // the cover image found in the EPUB, if any
+	Skip     map[string]contentSkip // mandatory transformations to skip for content documents
+	Report   func(Report)           // may be nil
+
+	GeneratedCover string // the generated cover image, if any
+
+	Language      string              // the primary language of the package (dc:language)
+	PageDirection string              // the page progression direction of the spine
+	WritingMode   string              // the primary writing mode of the package
+	VerticalCSS   map[string][]string // the selectors of the rules setting a vertical writing mode in each stylesheet
+}
+
+// ncxSrc applies link fixes and split content documents to the src of a nav
+// point in the NCX fn. If report is not nil, broken links are reported.
+func (st *convertState) ncxSrc(fn, src string, report func(Report)) string {
+	if st.Links != nil {
+		if problem, action, fixed := st.Links.check(fn, src); problem != "" {
+			if action == linkFixRemove {
+				action = linkFixNone // we can't remove nav points
+			}
+			if report != nil {
+				report(Report{Kind: ReportLink, File: fn, Value: src, Message: linkMessage(problem, action, fixed, st.FixLinks)})
+			}
+			if st.FixLinks && action == linkFixReplace {
+				src = fixed
+			}
+		}
+	}
+	if st.Splits != nil {
+		src, _ = st.Splits.resolve(fn, src)
+	}
+	return src
+}
+
 // epubWriteMimetype writes the mimetype file to an EPUB. It must be called
 // before any other files are written.
 func epubWriteMimetype(epub *zip.Writer) error {
@@ -423,6 +892,70 @@ func epubContentDocuments(epub fs.FS, pkg string) ([]string, error) {
 	return docs, nil
 }
 
+// epubManifest gets the filenames of all items in the manifest of the provided
+// EPUB OPF package document.
+func epubManifest(epub fs.FS, pkg string) ([]string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	var items []string
+	for _, it := range opf.ManifestItem {
+		if u, err := url.PathUnescape(it.Href); err == nil {
+			items = append(items, path.Join(path.Dir(pkg), u))
+		} else {
+			items = append(items, path.Join(path.Dir(pkg), it.Href))
+		}
+	}
+	return items, nil
+}
+
+// epubNCX gets the filename of the EPUB2 NCX in the provided EPUB OPF package
+// document, or an empty string if there isn't one.
+func epubNCX(epub fs.FS, pkg string) (string, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			ID        string `xml:"id,attr"`
+			Href      string `xml:"href,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+		Spine struct {
+			Toc string `xml:"toc,attr"`
+		} `xml:"http://www.idpf.org/2007/opf spine"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	for _, it := range opf.ManifestItem {
+		if (opf.Spine.Toc != "" && it.ID == opf.Spine.Toc) || (opf.Spine.Toc == "" && it.MediaType == "application/x-dtbncx+xml") {
+			return path.Join(path.Dir(pkg), it.Href), nil
+		}
+	}
+	return "", nil
+}
+
 // zipReplace copies a file from one zip archive to another, preserving the
 // metadata, replacing the content, and force-enabling compression.
 func zipReplace(z *zip.Writer, f *zip.FileHeader, r io.Reader) error {
@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"html/template"
 	"image"
 	"image/png"
 	"io"
@@ -17,6 +18,9 @@ import (
 	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
+
+	"golang.org/x/image/font/basicfont"
 
 	"github.com/pgaskin/kepubify/v4/internal/zip"
 )
@@ -349,6 +353,644 @@ func TestConvert(t *testing.T) {
 		},
 	}.Run(t)
 
+	ConvertTestCase{
+		What: "with localized smart punctuation",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html lang="de"><head><title>Replaced Chapter</title></head><body><p>"asd sdf" 'asd asd' asd... sdf</p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionSmartypantsLocale("auto"),
+			ConverterOptionSmartypantsEllipsis(SmartypantsEllipsisNone),
+		},
+		Checks: []ShouldFunc{
+			FileShould("OEBPS/xhtml/ch01.xhtml", DocumentProbablyHasSpans),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				for _, x := range []string{
+					`„asd sdf“`, `‚asd asd‘`, `asd...`,
+				} {
+					if !strings.Contains(doc, x) {
+						return fmt.Errorf("%q does not contain %q", doc, x)
+					}
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with localized smart punctuation from the package language",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<dc:title>Test</dc:title>`, `<dc:title>Test</dc:title><dc:language>de</dc:language>`,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p>"asd sdf" 'asd asd'</p></body></html>`),
+				Mode: 0644,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html lang="en"><head><title>Replaced Chapter</title></head><body><p>"asd sdf"</p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionSmartypantsLocale("auto"),
+		},
+		Checks: []ShouldFunc{
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				for _, x := range []string{
+					`„asd sdf“`, `‚asd asd‘`,
+				} {
+					if !strings.Contains(doc, x) {
+						return fmt.Errorf("%q does not contain %q", doc, x)
+					}
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if x := `“asd sdf”`; !strings.Contains(doc, x) {
+					return fmt.Errorf("%q does not contain %q", doc, x)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with charset detection",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte("<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p>\xd3\xe6\xe5 \xe2\xe5\xf7\xe5\xf0, \xe8 \xec\xfb \xef\xee\xf8\xeb\xe8 \xe4\xee\xec\xee\xe9.</p></body></html>"),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionCharsetDetect("utf-8", "windows-1252", "windows-1251"),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/xhtml/ch01.xhtml", DocumentProbablyHasSpans),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				if x := "Уже вечер, и мы пошли домой."; !strings.Contains(doc, x) {
+					return fmt.Errorf("%q does not contain %q", doc, x)
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with content splitting",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body>` + stringFor(`<h1 id="c#">Chapter #</h1>`+strings.Repeat(`<p>Lorem ipsum dolor, sit amet consectetur adipisicing elit. Dolorem, placeat.</p>`, 300), 1, 5, func(s string, i int) string {
+					return strings.ReplaceAll(s, "#", strconv.Itoa(i))
+				}) + `<p><a href="#c1">Back</a></p></body></html>`),
+				Mode: 0644,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p><a href="ch01.xhtml#c2">Link</a></p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionSplitContent(40000),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(3),
+			ShouldHaveFile("OEBPS/xhtml/ch01_split2.xhtml", "OEBPS/xhtml/ch01_split3.xhtml", "OEBPS/xhtml/ch01_split4.xhtml"),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `id="c1"`) || strings.Contains(doc, `id="c2"`) {
+					return fmt.Errorf("first part should only have the first chapter")
+				}
+				return DocumentProbablyHasSpans(doc)
+			}),
+			FileShould("OEBPS/xhtml/ch01_split4.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `id="c4"`) || !strings.Contains(doc, `href="ch01.xhtml#c1"`) {
+					return fmt.Errorf("last part should have the last chapter and an updated link to the first one")
+				}
+				if !strings.Contains(doc, `id="kobo.1.1"`) {
+					return fmt.Errorf("last part should have its own span numbering")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `href="ch01_split2.xhtml#c2"`) {
+					return fmt.Errorf("link to moved chapter should have been updated")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if !strings.Contains(doc, `<itemref idref="xhtml_ch01"/>
+        <itemref idref="xhtml_ch01-split2"/>
+        <itemref idref="xhtml_ch01-split3"/>
+        <itemref idref="xhtml_ch01-split4"/>
+        <itemref idref="xhtml_ch02"/>`) {
+					return fmt.Errorf("split parts should have been added to the spine")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with link fixing",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p><a href="CH01.xhtml">Link</a> <a href="missing.xhtml">Dead</a></p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionLinks(true),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `href="ch01.xhtml"`) || strings.Contains(doc, `href="missing.xhtml"`) {
+					return fmt.Errorf("links should have been fixed")
+				}
+				return DocumentProbablyHasSpans(doc)
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with repair of missing container",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"META-INF/container.xml": nil,
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRepair(),
+		},
+		Checks: []ShouldFunc{
+			FileShould("META-INF/container.xml", func(doc string) error {
+				if !strings.Contains(doc, `full-path="OEBPS/content.opf"`) {
+					return fmt.Errorf("container should reference the package document")
+				}
+				return nil
+			}),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with repair of manifest",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`href="xhtml/ch03.xhtml" media-type="application/xhtml+xml"`), []byte(`href="xhtml/ch03.xhtml" media-type="text/plain"`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/xhtml/ch02.xhtml": nil,
+			"OEBPS/xhtml/extra.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Extra</title></head><body><p>Extra</p></body></html>`),
+				Mode: 0644,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRepair(),
+		},
+		Checks: []ShouldFunc{
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if strings.Contains(doc, `xhtml/ch02.xhtml`) {
+					return fmt.Errorf("missing file should have been removed from the manifest")
+				}
+				if !strings.Contains(doc, `<item id="xhtml_ch03" href="xhtml/ch03.xhtml" media-type="application/xhtml+xml"/>`) {
+					return fmt.Errorf("media type should have been fixed")
+				}
+				if !strings.Contains(doc, `<item href="nav.xhtml" media-type="application/xhtml+xml" properties="nav" id="kepubify-repair-1"/>`) {
+					return fmt.Errorf("missing id should have been added")
+				}
+				if !strings.Contains(doc, `<item id="kepubify-repair-2" href="xhtml/extra.xhtml" media-type="application/xhtml+xml"/>`) {
+					return fmt.Errorf("undeclared file should have been added to the manifest")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/extra.xhtml", DocumentProbablyHasSpans),
+			FileShould("OEBPS/xhtml/ch03.xhtml", DocumentProbablyHasSpans),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with unreferenced files removed",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`<item id="cover"`), []byte(`<item id="stray" href="stray.png" media-type="image/png"/><item id="cover"`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/stray.png":  testEPUB["OEBPS/cover.png"],
+			"OEBPS/unused.css": &fstest.MapFile{Data: []byte(`p { margin: 0; }`), Mode: 0644},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionRemoveUnreferenced(),
+		},
+		Checks: []ShouldFunc{
+			ShouldNotHaveFile("OEBPS/stray.png", "OEBPS/unused.css"),
+			ShouldHaveFile("OEBPS/cover.png", "OEBPS/nav.xhtml", "OEBPS/xhtml/title.xhtml", "OEBPS/xhtml/ch01.xhtml"),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if strings.Contains(doc, `stray.png`) {
+					return fmt.Errorf("unreferenced file should have been removed from the manifest")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with excluded files",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`<item id="cover"`), []byte(`<item id="font" href="fonts/Test.ttf" media-type="font/ttf"/><item id="cover"`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/fonts/Test.ttf": &fstest.MapFile{Data: []byte("\x00\x01\x00\x00"), Mode: 0644},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionExcludeFiles("*.ttf"),
+		},
+		Checks: []ShouldFunc{
+			ShouldNotHaveFile("OEBPS/fonts/Test.ttf"),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if strings.Contains(doc, `Test.ttf`) {
+					return fmt.Errorf("excluded file should have been removed from the manifest")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with epub3 upgrade",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`version="3.0"`, `version="2.0"`,
+					`<item href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`, `<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>`,
+					`<spine>`, `<spine toc="ncx">`,
+					`<dc:title>Test</dc:title>`, `<dc:title>Test</dc:title><dc:date>2020-01-02</dc:date>`,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/nav.xhtml": nil,
+			"OEBPS/toc.ncx": &fstest.MapFile{
+				Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+	<docTitle><text>Test</text></docTitle>
+	<navMap>
+		<navPoint id="np1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="xhtml/ch01.xhtml"/></navPoint>
+	</navMap>
+</ncx>`),
+				Mode: 0666,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionUpgradeEPUB3(),
+			ConverterOptionModified(time.Date(2021, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3600))),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveFile("OEBPS/toc.ncx", "OEBPS/kepubify-nav.xhtml"),
+			FileShould("OEBPS/kepubify-nav.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `<a href="xhtml/ch01.xhtml">Chapter 1</a>`) {
+					return fmt.Errorf("nav should have been generated from the ncx")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if !strings.Contains(doc, `version="3.0"`) {
+					return fmt.Errorf("version should have been bumped")
+				}
+				if !strings.Contains(doc, `<item id="kepubify-nav" href="kepubify-nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`) {
+					return fmt.Errorf("nav should have been added to the manifest")
+				}
+				if !strings.Contains(doc, `<meta property="dcterms:modified">2021-03-04T04:06:07Z</meta>`) {
+					return fmt.Errorf("modified date should have been added from the conversion time (not the publication date)")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with epub3 upgrade of epub3",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionUpgradeEPUB3(),
+		},
+		Checks: []ShouldFunc{
+			ShouldNotHaveFile("OEBPS/kepubify-nav.xhtml"),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if strings.Contains(doc, `dcterms:modified`) {
+					return fmt.Errorf("epub3 packages should be left as-is")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with image conversion",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`<item id="cover"`), []byte(`<item id="img" href="images/test.webp" media-type="image/webp"/><item id="css" href="style.css" media-type="text/css"/><item id="cover"`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/images/test.webp": &fstest.MapFile{Data: []byte(testWebP), Mode: 0644},
+			"OEBPS/style.css":        &fstest.MapFile{Data: []byte(`body { background: url("images/test.webp"); }`), Mode: 0644},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/xhtml/ch01.xhtml"].Data, []byte(`</body>`), []byte(`<img src="../images/test.webp"/></body>`), 1),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionConvertImages(),
+		},
+		Checks: []ShouldFunc{
+			ShouldNotHaveFile("OEBPS/images/test.webp"),
+			ShouldHaveFile("OEBPS/images/test.png"),
+			FileShould("OEBPS/images/test.png", func(img string) error {
+				if _, format, err := image.DecodeConfig(strings.NewReader(img)); err != nil || format != "png" {
+					return fmt.Errorf("should be a valid png (format: %q, err: %v)", format, err)
+				}
+				return nil
+			}),
+			FileShould("OEBPS/style.css", func(css string) error {
+				if css != `body { background: url("images/test.png"); }` {
+					return fmt.Errorf("reference in stylesheet should have been updated")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `<img src="../images/test.png"/>`) {
+					return fmt.Errorf("reference in content document should have been updated")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if !strings.Contains(doc, `<item id="img" href="images/test.png" media-type="image/png"/>`) {
+					return fmt.Errorf("manifest item should have been updated")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with cover fix forced and template",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionDummyTitlepage(true),
+			ConverterOptionDummyTitlepageTemplate(template.Must(template.New("").Parse(`<html><head><title>{{.Title}}</title></head><body><p>{{.Title}} by {{range .Authors}}{{.}}{{end}}</p>{{if .Cover}}<img src="{{.Cover}}"/>{{end}}</body></html>`))),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(1).Because("should have all source documents, and the new dummy titlepage"),
+			FileShould("OEBPS/kepubify-titlepage-dummy.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `Test by </span>`) || !strings.Contains(doc, `<img src="cover.png"/>`) {
+					return fmt.Errorf("should have used the template")
+				}
+				return nil
+			}),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml"}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with added pages",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionDummyTitlepage(false),
+			ConverterOptionAddPage(template.Must(template.New("ex libris.html").Parse(`<p>Ex libris: {{.Title}}</p>`)), 0),
+			ConverterOptionAddPage(template.Must(template.New("notes.html").Parse(`<p>Converted by kepubify.</p>`)), -1),
+			ConverterOptionAddPage(template.Must(template.New("notes.html").Parse(`<p>Second.</p>`)), 1000),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(3).Because("should have all source documents, and the new pages"),
+			ShouldHaveFile("OEBPS/kepubify-page-ex-libris.xhtml", "OEBPS/kepubify-page-notes.xhtml", "OEBPS/kepubify-page-notes_1.xhtml"),
+			FileShould("OEBPS/kepubify-page-ex-libris.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `Ex libris: Test`) || !strings.Contains(doc, `koboSpan`) {
+					return fmt.Errorf("should have been rendered and transformed")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				a := strings.Index(doc, `<itemref idref="kepubify-page-ex-libris"/>`)
+				b := strings.Index(doc, `<itemref idref="xhtml_title"/>`)
+				c := strings.Index(doc, `<itemref idref="xhtml_ch99"/>`)
+				d := strings.Index(doc, `<itemref idref="kepubify-page-notes"/>`)
+				e := strings.Index(doc, `<itemref idref="kepubify-page-notes_1"/>`)
+				if a == -1 || b == -1 || c == -1 || d == -1 || e == -1 || !(a < b && b < c && c < d && d < e) {
+					return fmt.Errorf("pages should have been added to the spine in the correct positions")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with per-document rules",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionNoSpansFor("properties:nav", "ch0[12].xhtml"),
+			ConverterOptionNoDivsFor("id:xhtml_ch02"),
+			ConverterOptionNoStylesFor("OEBPS/xhtml/ch02.xhtml"),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			AllDocumentsShould(DocumentProbablyHasSpans, []string{"OEBPS/xhtml/title.xhtml", "OEBPS/nav.xhtml", "OEBPS/xhtml/ch01.xhtml", "OEBPS/xhtml/ch02.xhtml"}),
+			FileShould("OEBPS/nav.xhtml", func(doc string) error {
+				if strings.Contains(doc, `koboSpan`) {
+					return fmt.Errorf("should not have spans")
+				}
+				if !strings.Contains(doc, `book-columns`) || !strings.Contains(doc, `kobostylehacks`) {
+					return fmt.Errorf("should still have divs and styles")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if strings.Contains(doc, `koboSpan`) || strings.Contains(doc, `book-columns`) || strings.Contains(doc, `kobostylehacks`) {
+					return fmt.Errorf("should not have spans, divs, or styles")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with respan",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(`<!DOCTYPE html><html><head><title>Replaced Chapter</title></head><body><p><span class="koboSpan" id="kobo.1.1">One. </span>Two.</p></body></html>`),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{ConverterOptionRespan()},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `<p><span class="koboSpan" id="kobo.1.1">One. </span><span class="koboSpan" id="kobo.1.2">Two.</span></p>`) {
+					return fmt.Errorf("should have regenerated spans")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with right-to-left page progression and vertical writing",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`<spine>`), []byte(`<spine page-progression-direction="rtl">`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/style/book-style.css": &fstest.MapFile{Data: []byte(testCSSJapanese), Mode: 0644},
+			"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`lang="en"`, `lang="ja" class="vrtl"`,
+					`</title>`, `</title><link rel="stylesheet" type="text/css" href="../style/book-style.css"/>`,
+				).Replace(string(testEPUB["OEBPS/xhtml/ch01.xhtml"].Data))),
+				Mode: testEPUB["OEBPS/xhtml/ch01.xhtml"].Mode,
+			},
+			"OEBPS/xhtml/ch02.xhtml": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/xhtml/ch02.xhtml"].Data, []byte(`lang="en"`), []byte(`lang="ar"`), 1),
+				Mode: testEPUB["OEBPS/xhtml/ch02.xhtml"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{},
+		Checks: []ShouldFunc{
+			ShouldHaveAllSourceDocumentsWithSaneOPF(0),
+			FileShould("OEBPS/xhtml/ch01.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `div#book-inner { margin-left: 0; margin-right: 0;}`) || strings.Contains(doc, `dir="rtl"`) {
+					return fmt.Errorf("should have vertical style hacks, but not right-to-left divs")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch02.xhtml", func(doc string) error {
+				if !strings.Contains(doc, `<div id="book-columns" dir="rtl"><div id="book-inner" dir="rtl">`) {
+					return fmt.Errorf("should have right-to-left divs")
+				}
+				return nil
+			}),
+			FileShould("OEBPS/xhtml/ch03.xhtml", func(doc string) error {
+				if strings.Contains(doc, `dir="rtl"`) || strings.Contains(doc, `div#book-inner { margin-left: 0; margin-right: 0;}`) {
+					return fmt.Errorf("should not have right-to-left divs or vertical style hacks for a left-to-right language")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with cover from cover page",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: bytes.Replace(testEPUB["OEBPS/content.opf"].Data, []byte(`<item id="cover" href="cover.png"`), []byte(`<item id="img" href="cover.png"`), 1),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{},
+		Checks: []ShouldFunc{
+			ShouldBeUnchanged("OEBPS/cover.png"),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if !strings.Contains(doc, `<item id="img" href="cover.png" media-type="image/png" properties="cover-image"/>`) {
+					return fmt.Errorf("cover-image property should have been set on the image in the guide cover page")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What: "with generated cover",
+		EPUB: overlayMapFS(testEPUB, fstest.MapFS{
+			"OEBPS/content.opf": &fstest.MapFile{
+				Data: []byte(strings.NewReplacer(
+					`<item id="cover" href="cover.png" media-type="image/png"/>`, ``,
+					`<reference href="xhtml/title.xhtml" title="Cover Page" type="cover"/>`, ``,
+					`<dc:title>Test</dc:title>`, `<dc:title>Test</dc:title><dc:creator>Author</dc:creator>`,
+				).Replace(string(testEPUB["OEBPS/content.opf"].Data))),
+				Mode: testEPUB["OEBPS/content.opf"].Mode,
+			},
+			"OEBPS/cover.png": nil,
+		}),
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateCover(basicfont.Face7x13, nil),
+		},
+		Checks: []ShouldFunc{
+			ShouldHaveFile("OEBPS/kepubify-cover.png"),
+			FileShould("OEBPS/kepubify-cover.png", func(img string) error {
+				if cfg, format, err := image.DecodeConfig(strings.NewReader(img)); err != nil || format != "png" || cfg.Width != coverWidth || cfg.Height != coverHeight {
+					return fmt.Errorf("should be a valid png of the right size (format: %q, err: %v)", format, err)
+				}
+				return nil
+			}),
+			FileShould("OEBPS/content.opf", func(doc string) error {
+				if !strings.Contains(doc, `<item id="kepubify-cover" href="kepubify-cover.png" media-type="image/png" properties="cover-image"/>`) {
+					return fmt.Errorf("manifest item should have been added")
+				}
+				if !strings.Contains(doc, `<meta name="cover" content="kepubify-cover"/>`) {
+					return fmt.Errorf("cover meta should have been added")
+				}
+				return nil
+			}),
+		},
+	}.Run(t)
+
+	ConvertTestCase{
+		What:        "with generated cover not needed",
+		EPUB:        testEPUB,
+		ShouldError: false,
+
+		Options: []ConverterOption{
+			ConverterOptionGenerateCover(basicfont.Face7x13, nil),
+		},
+		Checks: []ShouldFunc{
+			ShouldNotHaveFile("OEBPS/kepubify-cover.png"),
+			ShouldBeUnchanged("OEBPS/cover.png"),
+		},
+	}.Run(t)
+
 	ConvertTestCase{
 		What:        "with hyphenation enable css",
 		EPUB:        testEPUB,
@@ -431,6 +1073,44 @@ func TestConvert(t *testing.T) {
 	}.Run(t)
 }
 
+func TestConvertReport(t *testing.T) {
+	epub := overlayMapFS(testEPUB, fstest.MapFS{
+		"OEBPS/xhtml/ch01.xhtml": &fstest.MapFile{
+			Data: []byte("<!DOCTYPE html><html><head><meta charset=\"windows-1252\"/><title>Replaced Chapter</title></head><body><p>Caf\xe9</p></body></html>"),
+			Mode: 0644,
+		},
+	})
+
+	var reports []Report
+	ctx := WithReport(context.Background(), func(r Report) {
+		reports = append(reports, r)
+	})
+	if err := NewConverterWithOptions(ConverterOptionCharsetDetect()).Convert(ctx, io.Discard, epub); err != nil {
+		t.Fatalf("convert: unexpected error: %v", err)
+	}
+
+	var n int
+	for _, r := range reports {
+		if r.Kind != ReportCharset {
+			continue
+		}
+		n++
+		switch r.File {
+		case "OEBPS/xhtml/ch01.xhtml":
+			if r.Value != "windows-1252" {
+				t.Errorf("expected %s to be windows-1252, got %s (%s)", r.File, r.Value, r.Message)
+			}
+		default:
+			if r.Value != "utf-8" {
+				t.Errorf("expected %s to be utf-8, got %s (%s)", r.File, r.Value, r.Message)
+			}
+		}
+	}
+	if n == 0 {
+		t.Errorf("expected charset reports")
+	}
+}
+
 type ConvertTestCase struct {
 	What        string
 	EPUB        fs.FS
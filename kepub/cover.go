@@ -0,0 +1,397 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+)
+
+// opfCover finds the manifest item for the cover image in the OPF package
+// document opf (the full path), and returns it along with a short description
+// of how it was found. If sole is not nil, it is used to get the only image in
+// a content document so cover pages can be used. If a cover can't be found,
+// nil is returned.
+//
+// In order, the cover is found using the cover-image property (EPUB3), the
+// cover meta (EPUB2, which sometimes has a path rather than an id), the id
+// cover, the guide reference with the type cover (or the only image on the
+// page it references), the only image on a content document with cover in the
+// id or filename, and finally common cover filenames. Only image manifest
+// items are considered.
+func opfCover(doc *etree.Document, opf string, sole func(fn string) string) (*etree.Element, string) {
+	type item struct {
+		El   *etree.Element
+		ID   string
+		Href string // the full path
+	}
+
+	var items []item
+	byID, byHref := map[string]item{}, map[string]item{}
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		href := el.SelectAttrValue("href", "")
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		it := item{el, el.SelectAttrValue("id", ""), path.Join(path.Dir(opf), href)}
+		items = append(items, it)
+		byID[it.ID] = it
+		byHref[it.Href] = it
+	}
+
+	isImage := func(it item) bool {
+		return it.El != nil && strings.HasPrefix(it.El.SelectAttrValue("media-type", ""), "image/")
+	}
+	isContent := func(it item) bool {
+		return it.El != nil && (it.El.SelectAttrValue("media-type", "") == "application/xhtml+xml" || it.El.SelectAttrValue("media-type", "") == "text/html")
+	}
+	soleImage := func(it item) (item, bool) {
+		if sole == nil {
+			return item{}, false
+		}
+		if fn := sole(it.Href); fn != "" {
+			if img := byHref[fn]; isImage(img) {
+				return img, true
+			}
+		}
+		return item{}, false
+	}
+
+	for _, it := range items {
+		if isImage(it) && includes(it.El.SelectAttrValue("properties", ""), "cover-image") {
+			return it.El, "cover-image property"
+		}
+	}
+
+	if el := doc.FindElement("//meta[@name='cover']"); el != nil {
+		content := el.SelectAttrValue("content", "")
+		if it := byID[content]; isImage(it) {
+			return it.El, "cover meta"
+		}
+		if it := byHref[path.Join(path.Dir(opf), content)]; isImage(it) {
+			return it.El, "cover meta with a path" // some put the path directly in the value
+		}
+	}
+
+	if it := byID["cover"]; isImage(it) {
+		return it.El, "cover id"
+	}
+
+	for _, el := range doc.FindElements("/package/guide/reference[@href]") {
+		if !strings.EqualFold(el.SelectAttrValue("type", ""), "cover") {
+			continue
+		}
+		href := el.SelectAttrValue("href", "")
+		if u, err := url.Parse(href); err == nil {
+			href = u.Path
+		}
+		it := byHref[path.Join(path.Dir(opf), href)]
+		if isImage(it) {
+			return it.El, "guide cover"
+		}
+		if isContent(it) {
+			if img, ok := soleImage(it); ok {
+				return img.El, "guide cover page image"
+			}
+		}
+	}
+
+	for _, it := range items {
+		if isContent(it) && (strings.Contains(strings.ToLower(it.ID), "cover") || strings.Contains(strings.ToLower(path.Base(it.Href)), "cover")) {
+			if img, ok := soleImage(it); ok {
+				return img.El, "cover page image"
+			}
+		}
+	}
+
+	for _, it := range items {
+		if isImage(it) {
+			switch strings.ToLower(strings.TrimSuffix(path.Base(it.Href), path.Ext(it.Href))) {
+			case "cover", "cover-image", "cover_image", "coverimage", "front", "frontcover", "front-cover", "front_cover":
+				return it.El, "cover filename"
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// epubCover finds the cover image in the EPUB (see opfCover), and returns the
+// full path along with a short description of how it was found.
+func epubCover(epub fs.FS, opf string) (string, string, error) {
+	doc := etree.NewDocument()
+	if err := func() error {
+		f, err := epub.Open(opf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = doc.ReadFrom(f)
+		return err
+	}(); err != nil {
+		return "", "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	el, how := opfCover(doc, opf, func(fn string) string {
+		buf, err := fs.ReadFile(epub, fn)
+		if err != nil {
+			return ""
+		}
+		return coverSoleImage(fn, buf)
+	})
+	if el == nil {
+		return "", "", nil
+	}
+
+	href := el.SelectAttrValue("href", "")
+	if u, err := url.PathUnescape(href); err == nil {
+		href = u
+	}
+	return path.Join(path.Dir(opf), href), how, nil
+}
+
+// coverSoleImage returns the full path of the only image in the content
+// document fn, or an empty string if there isn't exactly one.
+func coverSoleImage(fn string, buf []byte) string {
+	var img string
+	z := html.NewTokenizer(bytes.NewReader(buf))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return img
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "img" && string(name) != "image" {
+				continue
+			}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if (string(name) == "img" && string(k) == "src") || (string(name) == "image" && (string(k) == "href" || string(k) == "xlink:href")) {
+					u, err := url.Parse(strings.TrimSpace(string(v)))
+					if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+						return ""
+					}
+					if t := path.Join(path.Dir(fn), u.Path); img == "" {
+						img = t
+					} else if img != t {
+						return ""
+					}
+				}
+			}
+		}
+	}
+}
+
+// transformOPFCoverImage adds the cover-image property to the manifest item
+// for the cover image found by opfCover (without looking at cover pages).
+func transformOPFCoverImage(doc *etree.Document) {
+	// property based on Kobo (checked with 3 books) as of 2020-01-12
+	if el, _ := opfCover(doc, "", nil); el != nil {
+		opfAddProperty(el, "cover-image")
+	}
+}
+
+// transformOPFCover adds the cover-image property to the manifest item for the
+// cover image cover (the full path) found by epubCover.
+func transformOPFCover(doc *etree.Document, opf, cover string) {
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		href := el.SelectAttrValue("href", "")
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		if path.Join(path.Dir(opf), href) == cover {
+			opfAddProperty(el, "cover-image")
+			return
+		}
+	}
+}
+
+// opfAddProperty adds a property to a manifest item if it isn't already there.
+func opfAddProperty(el *etree.Element, property string) {
+	if p := el.SelectAttrValue("properties", ""); !includes(p, property) {
+		el.CreateAttr("properties", strings.TrimSpace(p+" "+property))
+	}
+}
+
+// transformOPFAddCover adds a generated cover image fn (the full path) to the
+// manifest.
+func transformOPFAddCover(doc *etree.Document, opf, fn string) {
+	pkg := doc.FindElement("/package")
+	if pkg == nil {
+		return
+	}
+
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("//[@id]") {
+		ids[el.SelectAttrValue("id", "")] = true
+	}
+	id := "kepubify-cover"
+	for n := 1; ids[id]; n++ {
+		id = fmt.Sprintf("kepubify-cover-%d", n)
+	}
+
+	if manifest := pkg.SelectElement("manifest"); manifest != nil {
+		it := manifest.CreateElement("item")
+		it.Space = manifest.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		it.CreateAttr("id", id)
+		it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), fn)}).String())
+		it.CreateAttr("media-type", "image/png")
+		it.CreateAttr("properties", "cover-image")
+	}
+
+	if metadata := pkg.SelectElement("metadata"); metadata != nil {
+		if el := metadata.FindElement("meta[@name='cover']"); el != nil {
+			el.CreateAttr("content", id)
+		} else {
+			el := metadata.CreateElement("meta")
+			el.Space = pkg.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+			el.CreateAttr("name", "cover")
+			el.CreateAttr("content", id)
+		}
+	}
+}
+
+// epubMetadata gets the title and authors from the OPF package document.
+func epubMetadata(epub fs.FS, opf string) (title string, authors []string, err error) {
+	doc := etree.NewDocument()
+	if err := func() error {
+		f, err := epub.Open(opf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = doc.ReadFrom(f)
+		return err
+	}(); err != nil {
+		return "", nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	if el := doc.FindElement("/package/metadata/title"); el != nil {
+		title = strings.TrimSpace(el.Text())
+	}
+	for _, el := range doc.FindElements("/package/metadata/creator") {
+		if role := el.SelectAttrValue("role", "aut"); role == "aut" {
+			if v := strings.TrimSpace(el.Text()); v != "" {
+				authors = append(authors, v)
+			}
+		}
+	}
+	return title, authors, nil
+}
+
+// coverWidth and coverHeight are the dimensions of generated covers, which
+// are the same as the full-screen covers on most Kobo eReaders.
+const coverWidth, coverHeight = 1072, 1448
+
+// generateCover renders a plain cover image with the title and authors of a
+// book as a PNG using the provided font faces.
+func generateCover(titleFace, authorFace font.Face, title string, authors []string) ([]byte, error) {
+	if titleFace == nil || authorFace == nil {
+		return nil, fmt.Errorf("no font face")
+	}
+
+	img := image.NewGray(image.Rect(0, 0, coverWidth, coverHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xF2}), image.Point{}, draw.Src)
+
+	// frame
+	for _, r := range []image.Rectangle{
+		image.Rect(48, 48, coverWidth-48, 54),
+		image.Rect(48, coverHeight-54, coverWidth-48, coverHeight-48),
+		image.Rect(48, 48, 54, coverHeight-48),
+		image.Rect(coverWidth-54, 48, coverWidth-48, coverHeight-48),
+	} {
+		draw.Draw(img, r, image.Black, image.Point{}, draw.Src)
+	}
+
+	if title == "" {
+		title = "Untitled"
+	}
+
+	// title, centered in the top half
+	lines := coverWrap(titleFace, title, coverWidth-2*120, 6)
+	lh := titleFace.Metrics().Height.Ceil()
+	y := coverHeight*2/5 - lh*len(lines)/2 + titleFace.Metrics().Ascent.Ceil()
+	for _, line := range lines {
+		coverDrawCentered(img, titleFace, line, y)
+		y += lh
+	}
+
+	// separator
+	y += lh / 2
+	draw.Draw(img, image.Rect(coverWidth/2-120, y-4, coverWidth/2+120, y), image.Black, image.Point{}, draw.Src)
+
+	// authors
+	lh = authorFace.Metrics().Height.Ceil()
+	y += lh * 3 / 2
+	for _, line := range coverWrap(authorFace, strings.Join(authors, ", "), coverWidth-2*120, 3) {
+		coverDrawCentered(img, authorFace, line, y)
+		y += lh
+	}
+
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// coverWrap splits s into at most max lines which fit within width, adding an
+// ellipsis if it is truncated.
+func coverWrap(face font.Face, s string, width, max int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		if line == "" {
+			line = word
+		} else if font.MeasureString(face, line+" "+word).Ceil() <= width {
+			line += " " + word
+		} else {
+			lines, line = append(lines, line), word
+		}
+		for font.MeasureString(face, line).Ceil() > width && len([]rune(line)) > 1 {
+			// break words which are too long by themselves
+			r := []rune(line)
+			n := len(r) - 1
+			for n > 1 && font.MeasureString(face, string(r[:n])+"-").Ceil() > width {
+				n--
+			}
+			lines, line = append(lines, string(r[:n])+"-"), string(r[n:])
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > max {
+		lines = lines[:max]
+		l := []rune(lines[max-1])
+		for len(l) != 0 && font.MeasureString(face, string(l)+"…").Ceil() > width {
+			l = l[:len(l)-1]
+		}
+		lines[max-1] = strings.TrimSpace(string(l)) + "…"
+	}
+	return lines
+}
+
+// coverDrawCentered draws a line of text horizontally centered on the baseline
+// y.
+func coverDrawCentered(img draw.Image, face font.Face, s string, y int) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: face,
+	}
+	d.Dot = fixed.P((coverWidth-d.MeasureString(s).Ceil())/2, y)
+	d.DrawString(s)
+}
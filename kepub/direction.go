@@ -0,0 +1,244 @@
+package kepub
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// epubDirection gets the page progression direction of the spine and the
+// primary writing mode (a non-standard meta used by Kobo and Apple for
+// vertical writing) from the OPF package document.
+func epubDirection(epub fs.FS, pkg string) (ppd, writingMode string, err error) {
+	var opf struct {
+		XMLName xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		Meta    []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"http://www.idpf.org/2007/opf metadata>meta"`
+		Spine struct {
+			PageProgressionDirection string `xml:"page-progression-direction,attr"`
+		} `xml:"http://www.idpf.org/2007/opf spine"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", "", fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	for _, m := range opf.Meta {
+		if m.Name == "primary-writing-mode" {
+			writingMode = strings.ToLower(strings.TrimSpace(m.Content))
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(opf.Spine.PageProgressionDirection)), writingMode, nil
+}
+
+var (
+	cssComment  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssRule     = regexp.MustCompile(`([^{}]+)\{([^{}]*)\}`)
+	cssVertical = regexp.MustCompile(`(?i)(?:-epub-|-webkit-)?writing-mode\s*:\s*(?:vertical|tb)`)
+)
+
+// cssVerticalSelectors returns the selectors of the rules in a stylesheet
+// which set a vertical writing mode.
+func cssVerticalSelectors(css []byte) []string {
+	var sels []string
+	for _, m := range cssRule.FindAllSubmatch(cssComment.ReplaceAll(css, nil), -1) {
+		if !cssVertical.Match(m[2]) {
+			continue
+		}
+		sel := string(m[1])
+		if i := strings.LastIndexByte(sel, ';'); i != -1 {
+			sel = sel[i+1:] // at-rules like @charset or @import
+		}
+		for _, s := range strings.Split(sel, ",") {
+			if s = strings.TrimSpace(s); s != "" && !strings.HasPrefix(s, "@") {
+				sels = append(sels, s)
+			}
+		}
+	}
+	return sels
+}
+
+// cssSelectorMatchesRoot checks if the last compound selector in sel (i.e.,
+// the part which selects the element itself) matches the root element or body
+// n. Only the element name, :root, classes, and ids are checked (other
+// attribute selectors and pseudo-classes are assumed to match), and
+// combinators are ignored.
+func cssSelectorMatchesRoot(sel string, n *html.Node) bool {
+	if i := strings.LastIndexAny(sel, " \t\n>+~"); i != -1 {
+		sel = sel[i+1:]
+	}
+	if sel == "" {
+		return false
+	}
+
+	var class, id string
+	for _, a := range n.Attr {
+		if a.Namespace == "" {
+			switch a.Key {
+			case "class":
+				class = a.Val
+			case "id":
+				id = a.Val
+			}
+		}
+	}
+
+	name := sel
+	if i := strings.IndexAny(sel, ".#[:"); i != -1 {
+		name, sel = sel[:i], sel[i:]
+	} else {
+		sel = ""
+	}
+	if name != "" && name != "*" && !strings.EqualFold(name, n.Data) {
+		return false
+	}
+	for sel != "" {
+		kind := sel[0]
+		end := len(sel)
+		if kind == '[' {
+			if i := strings.IndexByte(sel, ']'); i != -1 {
+				end = i + 1
+			}
+		} else if i := strings.IndexAny(sel[1:], ".#[:"); i != -1 {
+			end = i + 1
+		}
+		part := sel[1:end]
+		switch kind {
+		case '.':
+			if !includes(class, part) {
+				return false
+			}
+		case '#':
+			if id != part {
+				return false
+			}
+		case ':':
+			if strings.EqualFold(part, "root") && n.DataAtom != atom.Html {
+				return false
+			}
+		}
+		sel = sel[end:]
+	}
+	return true
+}
+
+// rtlLanguage checks if a language tag is for a language written
+// right-to-left.
+func rtlLanguage(lang string) bool {
+	if i := strings.IndexAny(lang, "-_"); i != -1 {
+		lang = lang[:i]
+	}
+	switch strings.ToLower(strings.TrimSpace(lang)) {
+	case "ar", "he", "fa", "ur", "yi":
+		return true
+	}
+	return false
+}
+
+// contentDirection determines whether the content document fn uses
+// right-to-left text or a vertical writing mode. The dir attribute and inline
+// styles on the root element and body take precedence, then stylesheets, then
+// the page progression direction and primary writing mode from the package
+// (if st is not nil). Since the page progression direction is also
+// right-to-left for vertical CJK books, it only implies right-to-left text if
+// the document (or package) language is written right-to-left.
+func contentDirection(doc *html.Node, fn string, st *convertState) (rtl, vertical bool) {
+	var dir string
+	root, body := findAtom(doc, atom.Html), findAtom(doc, atom.Body)
+	for _, n := range []*html.Node{root, body} {
+		if n == nil {
+			continue
+		}
+		for _, a := range n.Attr {
+			switch {
+			case a.Key == "dir" && a.Namespace == "":
+				if v := strings.ToLower(strings.TrimSpace(a.Val)); v == "rtl" || v == "ltr" {
+					dir = v
+				}
+			case a.Key == "style" && a.Namespace == "":
+				if cssVertical.MatchString(a.Val) {
+					vertical = true
+				}
+			}
+		}
+	}
+
+	matches := func(sels []string) bool {
+		for _, sel := range sels {
+			for _, n := range []*html.Node{root, body} {
+				if n != nil && cssSelectorMatchesRoot(sel, n) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if !vertical {
+		if head := findAtom(doc, atom.Head); head != nil {
+			for c := head.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type != html.ElementNode {
+					continue
+				}
+				switch c.DataAtom {
+				case atom.Style:
+					if c.FirstChild != nil && c.FirstChild.Type == html.TextNode && matches(cssVerticalSelectors([]byte(c.FirstChild.Data))) {
+						vertical = true
+					}
+				case atom.Link:
+					if st == nil || len(st.VerticalCSS) == 0 {
+						continue
+					}
+					var rel, href string
+					for _, a := range c.Attr {
+						switch a.Key {
+						case "rel":
+							rel = a.Val
+						case "href":
+							href = a.Val
+						}
+					}
+					if !includes(strings.ToLower(rel), "stylesheet") {
+						continue
+					}
+					if u, err := url.Parse(strings.TrimSpace(href)); err == nil && u.Scheme == "" && u.Host == "" && u.Path != "" {
+						if matches(st.VerticalCSS[path.Join(path.Dir(fn), u.Path)]) {
+							vertical = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if st != nil {
+		if !vertical && strings.HasPrefix(st.WritingMode, "vertical") {
+			vertical = true
+		}
+		if dir == "" && !vertical && st.PageDirection == "rtl" {
+			lang := documentLanguage(doc)
+			if lang == "" {
+				lang = st.Language
+			}
+			if rtlLanguage(lang) {
+				dir = "rtl"
+			}
+		}
+	}
+	return dir == "rtl", vertical
+}
@@ -0,0 +1,268 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+	"golang.org/x/image/webp"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// imageMaxGIFPixels is the size of the largest GIF which won't be converted to
+// a PNG. Kobo eReaders tend to run out of memory or become very slow with
+// larger ones, especially if they're animated.
+const imageMaxGIFPixels = 2048 * 2048
+
+// imageConversion is how an image should be converted.
+type imageConversion struct {
+	Name   string // the new filename (may be the same as the original)
+	Format string // jpeg or png
+	Reason string // a short description of why it needs to be converted
+}
+
+// imageCheck checks if the image fn needs to be converted to be displayed
+// correctly on Kobo eReaders. If it doesn't need to be converted, or it isn't
+// an image, an empty format is returned. The returned name will have the
+// extension changed if required, but it may conflict with an existing file.
+func imageCheck(fn string, buf []byte) imageConversion {
+	ext := path.Ext(fn)
+	switch strings.ToLower(ext) {
+	case ".webp":
+		cfg, err := webp.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			return imageConversion{}
+		}
+		if cfg.ColorModel == color.YCbCrModel {
+			return imageConversion{strings.TrimSuffix(fn, ext) + ".jpg", "jpeg", "webp"}
+		}
+		return imageConversion{strings.TrimSuffix(fn, ext) + ".png", "png", "webp with transparency"}
+	case ".jpg", ".jpeg":
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			return imageConversion{}
+		}
+		if cfg.ColorModel == color.CMYKModel {
+			return imageConversion{fn, "jpeg", "cmyk jpeg"}
+		}
+		if jpegProgressive(buf) {
+			return imageConversion{fn, "jpeg", "progressive jpeg"}
+		}
+	case ".gif":
+		cfg, err := gif.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			return imageConversion{}
+		}
+		if cfg.Width*cfg.Height > imageMaxGIFPixels {
+			return imageConversion{strings.TrimSuffix(fn, ext) + ".png", "png", fmt.Sprintf("%dx%d gif", cfg.Width, cfg.Height)}
+		}
+	}
+	return imageConversion{}
+}
+
+// jpegProgressive checks if a JPEG uses progressive (or another non-baseline)
+// encoding by looking at the start of frame marker.
+func jpegProgressive(b []byte) bool {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return false
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return false
+		}
+		m := b[i+1]
+		switch {
+		case m == 0xFF: // fill byte
+			i++
+			continue
+		case m == 0xD8 || m == 0x01 || (m >= 0xD0 && m <= 0xD7): // no length
+			i += 2
+			continue
+		case m == 0xC0 || m == 0xC1:
+			return false
+		case m >= 0xC2 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC:
+			return true
+		case m == 0xDA || m == 0xD9: // start of scan or end of image before the frame
+			return false
+		}
+		i += 2 + (int(b[i+2])<<8 | int(b[i+3]))
+	}
+	return false
+}
+
+// imageConvert decodes the image from r and re-encodes it as a baseline JPEG
+// or a PNG. Only the first frame of animated GIFs is kept.
+func imageConvert(w io.Writer, r io.Reader, format string) error {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+	switch format {
+	case "jpeg":
+		if _, ok := img.(*image.CMYK); ok {
+			// the jpeg encoder would do this anyways, but it's faster to do it
+			// all at once
+			rgba := image.NewRGBA(img.Bounds())
+			draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+			img = rgba
+		}
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(w, img)
+	default:
+		panic("unknown image format " + format)
+	}
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", format, err)
+	}
+	return nil
+}
+
+// renameRef updates href (relative to the file base) if it points to a renamed
+// file.
+func renameRef(base, href string, renamed map[string]string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return href, false
+	}
+	n, ok := renamed[path.Join(path.Dir(base), u.Path)]
+	if !ok {
+		return href, false
+	}
+	u.Path = relPath(path.Dir(base), n)
+	return u.String(), true
+}
+
+// renameSrcset updates the URLs in a srcset attribute.
+func renameSrcset(base, srcset string, renamed map[string]string) (string, bool) {
+	var changed bool
+	cs := strings.Split(srcset, ",")
+	for i, c := range cs {
+		f := strings.Fields(c)
+		if len(f) == 0 {
+			continue
+		}
+		if n, ok := renameRef(base, f[0], renamed); ok {
+			f[0], changed = n, true
+			cs[i] = strings.Join(f, " ")
+		}
+	}
+	if !changed {
+		return srcset, false
+	}
+	return strings.Join(cs, ", "), true
+}
+
+// renameCSS updates the url() references in a stylesheet.
+func renameCSS(base string, css []byte, renamed map[string]string) []byte {
+	return reachableCSSURL.ReplaceAllFunc(css, func(m []byte) []byte {
+		sm := reachableCSSURL.FindSubmatch(m)
+		for i, q := range []string{`"`, `'`, ``} {
+			if g := sm[i+1]; len(g) != 0 {
+				if n, ok := renameRef(base, string(g), renamed); ok {
+					return []byte(`url(` + q + n + q + `)`)
+				}
+				break
+			}
+		}
+		return m
+	})
+}
+
+var renameSVGHref = regexp.MustCompile(`(\s(?:xlink:)?href\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// renameSVG updates the href attributes and url() references in a standalone
+// SVG image. A regexp is used rather than parsing it so the rest of the file
+// is kept exactly as-is.
+func renameSVG(base string, svg []byte, renamed map[string]string) []byte {
+	svg = renameSVGHref.ReplaceAllFunc(svg, func(m []byte) []byte {
+		sm := renameSVGHref.FindSubmatch(m)
+		for i, q := range []string{`"`, `'`} {
+			if g := sm[i+2]; len(g) != 0 {
+				if n, ok := renameRef(base, html.UnescapeString(string(g)), renamed); ok {
+					return []byte(string(sm[1]) + q + html.EscapeString(n) + q)
+				}
+				break
+			}
+		}
+		return m
+	})
+	return renameCSS(base, svg, renamed)
+}
+
+// transformContentRename updates the references in the content document fn to
+// renamed files.
+func transformContentRename(doc *html.Node, fn string, renamed map[string]string) {
+	var cur *html.Node
+	stack := []*html.Node{doc}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.ElementNode:
+			for i, a := range cur.Attr {
+				switch {
+				case a.Key == "srcset" && a.Namespace == "":
+					cur.Attr[i].Val, _ = renameSrcset(fn, a.Val, renamed)
+				case a.Key == "style" && a.Namespace == "":
+					cur.Attr[i].Val = string(renameCSS(fn, []byte(a.Val), renamed))
+				case a.Namespace == "" && (a.Key == "src" || a.Key == "href" || a.Key == "poster" || a.Key == "xlink:href"), a.Namespace == "xlink" && a.Key == "href":
+					cur.Attr[i].Val, _ = renameRef(fn, a.Val, renamed)
+				}
+			}
+		case html.TextNode:
+			if cur.Parent != nil && cur.Parent.DataAtom == atom.Style {
+				cur.Data = string(renameCSS(fn, []byte(cur.Data), renamed))
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+// transformReferences updates the references to renamed files in the
+// stylesheet or SVG image fn.
+func transformReferences(w io.Writer, r io.Reader, fn string, renamed map[string]string) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if strings.EqualFold(path.Ext(fn), ".svg") {
+		buf = renameSVG(fn, buf, renamed)
+	} else {
+		buf = renameCSS(fn, buf, renamed)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+// transformOPFRename updates the manifest items for renamed files.
+func transformOPFRename(doc *etree.Document, opf string, renamed map[string]string) {
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		href := el.SelectAttrValue("href", "")
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		if n, ok := renamed[path.Join(path.Dir(opf), href)]; ok {
+			el.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), n)}).String())
+			if mt := repairMediaType(n); mt != "" {
+				el.CreateAttr("media-type", mt)
+			}
+		}
+	}
+}
@@ -3,7 +3,13 @@ package kepub
 
 import (
 	"context"
+	"html/template"
 	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
 )
 
 // Converter converts EPUB2/EPUB3 books to Kobo's KEPUB format.
@@ -13,7 +19,10 @@ type Converter struct {
 	extraCSSClass []string
 
 	// smart punctuation
-	smartypants bool
+	smartypants         bool
+	smartypantsLocale   string // "auto" for auto-detection
+	smartypantsDashes   SmartypantsDashes
+	smartypantsEllipsis SmartypantsEllipsis
 
 	// find/replace in raw html output
 	find    [][]byte
@@ -22,9 +31,50 @@ type Converter struct {
 	// titlepage fix
 	dummyTitlepageForce      bool
 	dummyTitlepageForceValue bool
+	dummyTitlepageTemplate   *template.Template
+	dummyTitlepageHeuristic  *TitlepageHeuristic
+
+	// extra pages
+	pages []converterPage
 
 	// charset override
-	charset string // "auto" for auto-detection
+	charset         string   // "auto" for auto-detection, "detect" for sniffing with a fallback
+	charsetFallback []string // for "detect"
+
+	// content splitting
+	splitSize int64 // 0 to disable
+
+	// link checking
+	links    bool
+	linksFix bool
+
+	// package repair
+	repair bool
+
+	// file removal
+	excludeFiles       []string
+	removeUnreferenced bool
+
+	// epub3 upgrade
+	upgrade  bool
+	modified time.Time // zero for the current time
+
+	// image conversion
+	convertImages bool
+
+	// cover generation
+	generateCover   bool
+	coverTitleFace  font.Face
+	coverAuthorFace font.Face
+	coverMu         sync.Mutex // font faces aren't safe for concurrent use
+
+	// per-document transformation rules
+	noSpansFor  []string
+	noDivsFor   []string
+	noStylesFor []string
+
+	// span regeneration
+	respan bool
 }
 
 // ConverterOption configures a Converter.
@@ -51,6 +101,36 @@ func ConverterOptionSmartypants() ConverterOption {
 	}
 }
 
+// ConverterOptionSmartypantsLocale enables smart punctuation using the
+// quotation marks and spacing conventions for a language (a BCP 47 tag like
+// "de", "fr-CA", or "sv"). Use "auto" to use the language of each content
+// document, or the language of the book if it isn't specified. Unknown
+// languages use English-style punctuation.
+func ConverterOptionSmartypantsLocale(locale string) ConverterOption {
+	return func(c *Converter) {
+		c.smartypants = true
+		c.smartypantsLocale = locale
+	}
+}
+
+// ConverterOptionSmartypantsDashes enables smart punctuation and sets how
+// dashes are converted.
+func ConverterOptionSmartypantsDashes(dashes SmartypantsDashes) ConverterOption {
+	return func(c *Converter) {
+		c.smartypants = true
+		c.smartypantsDashes = dashes
+	}
+}
+
+// ConverterOptionSmartypantsEllipsis enables smart punctuation and sets how
+// ellipses are converted.
+func ConverterOptionSmartypantsEllipsis(ellipsis SmartypantsEllipsis) ConverterOption {
+	return func(c *Converter) {
+		c.smartypants = true
+		c.smartypantsEllipsis = ellipsis
+	}
+}
+
 // ConverterOptionFindReplace replaces a raw string in the transformed HTML.
 func ConverterOptionFindReplace(find, replace string) ConverterOption {
 	return func(c *Converter) {
@@ -70,6 +150,43 @@ func ConverterOptionDummyTitlepage(add bool) ConverterOption {
 	}
 }
 
+// ConverterOptionDummyTitlepageHeuristic changes the thresholds used by the
+// heuristic which determines whether the dummy titlepage should be added (see
+// DefaultTitlepageHeuristic). Unset fields use the default values (see
+// TitlepageHeuristic). It has no effect if ConverterOptionDummyTitlepage is
+// set.
+func ConverterOptionDummyTitlepageHeuristic(h TitlepageHeuristic) ConverterOption {
+	return func(c *Converter) {
+		c.dummyTitlepageHeuristic = &h
+	}
+}
+
+// ConverterOptionDummyTitlepageTemplate replaces the contents of the dummy
+// titlepage (if it is added) with the output of a template. The template is
+// executed with a PageData, and the output is transformed like any other
+// content document.
+func ConverterOptionDummyTitlepageTemplate(t *template.Template) ConverterOption {
+	return func(c *Converter) {
+		c.dummyTitlepageTemplate = t
+	}
+}
+
+// ConverterOptionAddPage adds a page (e.g., an ex-libris, library card, or
+// conversion notes) generated from a template to the manifest and spine. The
+// template is executed with a PageData, and the output is transformed like any
+// other content document. The page is inserted before the spine item at
+// position, or if it is negative, counting from the end (i.e., 0 is the start,
+// and -1 is the end). The filename is based on the template name. This can be
+// specified multiple times, and pages at the same position are added in order.
+//
+// Pages are added before the dummy titlepage heuristic is applied, so pages
+// added to the start are taken into account.
+func ConverterOptionAddPage(t *template.Template, position int) ConverterOption {
+	return func(c *Converter) {
+		c.pages = append(c.pages, converterPage{t, position})
+	}
+}
+
 // ConverterOptionAddCSS adds CSS code to a book.
 func ConverterOptionAddCSS(css string) ConverterOption {
 	return converterOptionAddCSS("kepubify-extracss", css)
@@ -95,6 +212,179 @@ func ConverterOptionFullScreenFixes() ConverterOption {
 func ConverterOptionCharset(charset string) ConverterOption {
 	return func(c *Converter) {
 		c.charset = charset
+		c.charsetFallback = nil
+	}
+}
+
+// ConverterOptionCharsetDetect detects the charset of each content document
+// individually. The byte order mark, XML declaration, and meta tags are used if
+// present and valid for the content. Otherwise, the charsets in fallback are
+// checked in order against the content, and the most plausible one is used.
+// Content which is mostly valid UTF-8, or which isn't valid in any of them, is
+// kept as UTF-8 with the invalid bytes replaced. If fallback is empty, it
+// defaults to UTF-8 and Windows-1252. The charset used for each document is
+// reported with ReportCharset.
+func ConverterOptionCharsetDetect(fallback ...string) ConverterOption {
+	return func(c *Converter) {
+		c.charset = "detect"
+		c.charsetFallback = fallback
+		if len(c.charsetFallback) == 0 {
+			c.charsetFallback = []string{"utf-8", "windows-1252"}
+		}
+	}
+}
+
+// ConverterOptionSplitContent splits content documents larger than size bytes
+// into multiple smaller ones (at chapter headings where possible, or otherwise
+// at block boundaries) to improve performance on Kobo eReaders. The manifest,
+// spine, NCX, navigation document, and links to moved elements are updated. The
+// split documents are reported with ReportSplit. If size is zero, content
+// documents are not split.
+func ConverterOptionSplitContent(size int64) ConverterOption {
+	return func(c *Converter) {
+		c.splitSize = size
+	}
+}
+
+// ConverterOptionLinks checks the internal links (i.e., href and src
+// attributes) in content documents and the NCX, and reports broken ones with
+// ReportLink. If fix is true, links with the wrong case or to renamed files
+// are corrected, fragments which don't exist are removed, and dead anchors are
+// removed.
+func ConverterOptionLinks(fix bool) ConverterOption {
+	return func(c *Converter) {
+		c.links = true
+		c.linksFix = fix
+	}
+}
+
+// ConverterOptionRepair enables repairing malformed EPUB packages. If the OCF
+// container is missing or invalid, the package document is found by scanning
+// for it. Manifest items for missing files are removed, undeclared content
+// documents, stylesheets, and images are added, incorrect media types are
+// fixed by sniffing the content, and the spine is regenerated if it is empty.
+// Each repair is reported with ReportRepair.
+func ConverterOptionRepair() ConverterOption {
+	return func(c *Converter) {
+		c.repair = true
+	}
+}
+
+// ConverterOptionExcludeFiles removes files matching any of the glob patterns
+// (see path.Match) from the EPUB and the manifest, in addition to the ones
+// removed by default by TransformFileFilter. Patterns without a slash are
+// matched against the base name, and the others are matched against the full
+// path.
+func ConverterOptionExcludeFiles(patterns ...string) ConverterOption {
+	return func(c *Converter) {
+		c.excludeFiles = append(c.excludeFiles, patterns...)
+	}
+}
+
+// ConverterOptionRemoveUnreferenced removes files which can't be reached from
+// the spine, navigation documents, cover, or any links or stylesheet references
+// in them from the EPUB and the manifest. Each removed file is reported with
+// ReportUnreferenced.
+func ConverterOptionRemoveUnreferenced() ConverterOption {
+	return func(c *Converter) {
+		c.removeUnreferenced = true
+	}
+}
+
+// ConverterOptionUpgradeEPUB3 upgrades EPUB2 packages to EPUB3 during
+// conversion, since Kobo handles EPUB3 metadata better. The package version is
+// bumped, a navigation document is generated from the NCX and guide (the NCX
+// is kept), series metadata from calibre is converted to
+// belongs-to-collection, opf:role and opf:file-as are converted into refining
+// metadata, and the last modified date is added (the conversion time, unless
+// overridden by ConverterOptionModified). EPUB2 packages without an NCX are
+// left as-is.
+func ConverterOptionUpgradeEPUB3() ConverterOption {
+	return func(c *Converter) {
+		c.upgrade = true
+	}
+}
+
+// ConverterOptionModified sets the last modified date added when upgrading
+// packages to EPUB3 (see ConverterOptionUpgradeEPUB3) instead of using the
+// current time. This can be used to make the output reproducible.
+func ConverterOptionModified(t time.Time) ConverterOption {
+	return func(c *Converter) {
+		c.modified = t
+	}
+}
+
+// ConverterOptionConvertImages converts images which Kobo eReaders can't
+// display or have trouble with (WebP, CMYK and progressive JPEGs, and huge
+// GIFs) into baseline JPEGs or PNGs. If the extension changes, the file is
+// renamed, and the references in content documents, stylesheets, SVG images,
+// and the manifest are updated. Each converted image is reported with
+// ReportImage.
+func ConverterOptionConvertImages() ConverterOption {
+	return func(c *Converter) {
+		c.convertImages = true
+	}
+}
+
+// ConverterOptionGenerateCover generates a plain cover image with the title
+// and authors if a cover image can't be found, so the book doesn't show up as
+// a blank tile in the library. The title is drawn with the title face, and the
+// authors with the authors face (or the title face if nil), which should cover
+// the scripts used by the books being converted (covers are 1072x1448, so a
+// title size of around 84px works well). The cover is reported with
+// ReportCover, as are problems finding the existing one (with the value
+// error), which skip generating the cover rather than failing the conversion.
+func ConverterOptionGenerateCover(title, authors font.Face) ConverterOption {
+	return func(c *Converter) {
+		if authors == nil {
+			authors = title
+		}
+		c.generateCover = true
+		c.coverTitleFace = title
+		c.coverAuthorFace = authors
+	}
+}
+
+// ConverterOptionNoSpansFor disables adding Kobo spans to content documents
+// matching any of the selectors during conversion. This is useful for
+// documents like indexes or generated navigation documents where reading
+// position and highlighting don't matter. Selectors can be id:{glob} to match
+// the manifest item id, properties:{glob} to match any of the manifest item
+// properties (e.g., properties:nav), linear:yes or linear:no to match linear or
+// non-linear spine items, or path:{glob} or just {glob} to match the path like
+// ConverterOptionExcludeFiles. See path.Match for the glob syntax. This only
+// applies to Convert.
+func ConverterOptionNoSpansFor(selectors ...string) ConverterOption {
+	return func(c *Converter) {
+		c.noSpansFor = append(c.noSpansFor, selectors...)
+	}
+}
+
+// ConverterOptionNoDivsFor is like ConverterOptionNoSpansFor, but disables
+// wrapping the body in the Kobo book-columns and book-inner divs.
+func ConverterOptionNoDivsFor(selectors ...string) ConverterOption {
+	return func(c *Converter) {
+		c.noDivsFor = append(c.noDivsFor, selectors...)
+	}
+}
+
+// ConverterOptionNoStylesFor is like ConverterOptionNoSpansFor, but disables
+// adding the Kobo style hacks stylesheet.
+func ConverterOptionNoStylesFor(selectors ...string) ConverterOption {
+	return func(c *Converter) {
+		c.noStylesFor = append(c.noStylesFor, selectors...)
+	}
+}
+
+// ConverterOptionRespan removes existing Kobo spans from content documents and
+// adds them again, instead of leaving documents which already have spans as-is.
+// This is useful for books where only some content documents were spanned, or
+// which were spanned by an older tool with bugs (see CheckSpans). Note that
+// this may change the span ids, so existing annotations on the book may no
+// longer line up with the text.
+func ConverterOptionRespan() ConverterOption {
+	return func(c *Converter) {
+		c.respan = true
 	}
 }
 
@@ -137,6 +427,75 @@ body>div {
     padding-right: 0.2em !important;
 }`
 
+// Report contains information about a decision made or a problem found while
+// converting a book.
+type Report struct {
+	Kind    ReportKind
+	File    string // the path of the file in the EPUB, if applicable
+	Value   string // the value decided on, if applicable
+	Message string // a human-readable description
+}
+
+// String formats the report for display.
+func (r Report) String() string {
+	var b strings.Builder
+	b.WriteString(string(r.Kind))
+	if r.File != "" {
+		b.WriteString(": ")
+		b.WriteString(r.File)
+	}
+	if r.Value != "" {
+		b.WriteString(": ")
+		b.WriteString(r.Value)
+	}
+	if r.Message != "" {
+		b.WriteString(" (")
+		b.WriteString(r.Message)
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// ReportKind is the type of a Report.
+type ReportKind string
+
+const (
+	ReportCharset      ReportKind = "charset"      // the charset used for a content document
+	ReportSplit        ReportKind = "split"        // the number of parts a content document was split into
+	ReportLink         ReportKind = "link"         // a broken link in a content document or the NCX
+	ReportRepair       ReportKind = "repair"       // a repair made to the package
+	ReportUnreferenced ReportKind = "unreferenced" // a file removed since it wasn't referenced anywhere
+	ReportImage        ReportKind = "image"        // an image converted to another format (the value is the new filename)
+	ReportCover        ReportKind = "cover"        // how the cover image was found, or whether it was generated (the value is error if it couldn't be looked up)
+	ReportTitlepage    ReportKind = "titlepage"    // whether the dummy titlepage was added (the value is added or skipped) and why
+	ReportSpans        ReportKind = "spans"        // a problem with the existing Kobo spans in a content document (the value is missing, duplicate, or non-sequential)
+)
+
+type reportKey struct{}
+
+// WithReport returns a context which causes Convert to call fn with reports
+// about the conversion. The calls are synchronized, but will not necessarily
+// be in any specific order.
+func WithReport(ctx context.Context, fn func(Report)) context.Context {
+	return context.WithValue(ctx, reportKey{}, fn)
+}
+
+// ctxReport creates a synchronized report callback for the provided context.
+// It returns nil if a callback has not been set.
+func ctxReport(ctx context.Context) func(Report) {
+	if v := ctx.Value(reportKey{}); v != nil {
+		fn := v.(func(Report))
+
+		var mu sync.Mutex
+		return func(r Report) {
+			mu.Lock()
+			defer mu.Unlock()
+			fn(r)
+		}
+	}
+	return nil
+}
+
 // These are for use by certain kepubify frontends for progress information
 // during conversions. It is not exported for general use, must be imported via
 // an unsafe go:linkname directive, and is subject to change.
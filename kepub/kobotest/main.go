@@ -1,7 +1,11 @@
 // Command kobotest tests kepub span logic (only, not divs or other kepub stuff,
 // which is pretty straightforward anyways) against other kepubs. It reads the
 // HTML from stdin, removes spans, re-adds them with kepubify, and checks the
-// output.
+// output. Ruby annotations are also checked separately to make sure the base
+// text of each one ends up in the same span as in the original, and that the
+// readings aren't spanned. Documents with dir="rtl" or a right-to-left language on the root
+// element are split using the right-to-left rules, so right-to-left
+// Kobo-store kepubs can be checked too.
 package main
 
 import (
@@ -17,16 +21,15 @@ import (
 	"github.com/hexops/gotextdiff/span"
 
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
-	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
 
-	//go:linkname transformContentKoboSpans github.com/pgaskin/kepubify/v4/kepub.transformContentKoboSpans
+	//go:linkname removeKoboSpans github.com/pgaskin/kepubify/v4/kepub.removeKoboSpans
 
 	_ "unsafe"
 
-	_ "github.com/pgaskin/kepubify/v4/kepub"
+	"github.com/pgaskin/kepubify/v4/kepub"
 )
 
-func transformContentKoboSpans(*html.Node)
+func removeKoboSpans(*html.Node)
 
 func main() {
 	doc, err := html.ParseWithOptions(os.Stdin, html.ParseOptionIgnoreBOM(true), html.ParseOptionEnableScripting(true), html.ParseOptionLenientSelfClosing(true))
@@ -35,20 +38,26 @@ func main() {
 	}
 
 	koboTree := mkTree(doc)
+	koboRuby := mkRuby(doc)
 
 	fmt.Print("\n\n=== ORIGINAL ===\n\n")
 	if err := html.Render(os.Stdout, doc); err != nil {
 		panic(err)
 	}
 
-	removeSpans(doc)
+	removeKoboSpans(doc)
 
 	fmt.Print("\n\n=== SPANS REMOVED ===\n\n")
 	if err := html.Render(os.Stdout, doc); err != nil {
 		panic(err)
 	}
 
-	transformContentKoboSpans(doc)
+	rtl := isRTL(doc)
+	if rtl {
+		fmt.Print("\n\n=== RIGHT-TO-LEFT ===\n")
+	}
+
+	kepub.AddSpans(doc, kepub.SpanOptions{RTL: rtl})
 
 	fmt.Print("\n\n=== SPANS ADDED ===\n\n")
 	if err := html.Render(os.Stdout, doc); err != nil {
@@ -56,6 +65,27 @@ func main() {
 	}
 
 	kepubifyTree := mkTree(doc)
+	kepubifyRuby := mkRuby(doc)
+
+	var rubyFailed bool
+	if len(koboRuby) != 0 {
+		fmt.Print("\n\n=== RUBY (kepubify, kobo) ===\n\n")
+		for i := 0; i < len(koboRuby) || i < len(kepubifyRuby); i++ {
+			var a, b string
+			if i < len(kepubifyRuby) {
+				a = kepubifyRuby[i]
+			}
+			if i < len(koboRuby) {
+				b = koboRuby[i]
+			}
+			if a != b {
+				rubyFailed = true
+				fmt.Printf("\x1b[34m%s\x1b[0m\n\x1b[33m%s\x1b[0m\n", a, b)
+			} else {
+				fmt.Println(a)
+			}
+		}
+	}
 
 	fmt.Print("\n\n=== RESULT (blue=kepubify, yellow=kobo) ===\n\n")
 
@@ -93,65 +123,152 @@ func main() {
 		return
 	}
 
+	if rubyFailed {
+		fmt.Println("Spans match, but ruby annotations don't.")
+		os.Exit(1)
+		return
+	}
+
 	fmt.Println("All spans match.")
 	os.Exit(0)
 }
 
-func removeSpans(node *html.Node) {
+// isRTL checks if the root element of a document has dir="rtl" or a language
+// written right-to-left (like kepub.Convert does if the page progression
+// direction is right-to-left).
+func isRTL(doc *html.Node) bool {
+	for n := doc.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type != html.ElementNode || n.Data != "html" {
+			continue
+		}
+		var rtl bool
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "dir":
+				return strings.EqualFold(strings.TrimSpace(a.Val), "rtl")
+			case "lang", "xml:lang":
+				switch strings.ToLower(strings.SplitN(strings.TrimSpace(a.Val), "-", 2)[0]) {
+				case "ar", "he", "fa", "ur", "yi":
+					rtl = true
+				}
+			}
+		}
+		return rtl
+	}
+	return false
+}
+
+// mkRuby describes the spans around each ruby element in the document.
+func mkRuby(node *html.Node) []string {
+	var rubies []string
+
 	var stack []*html.Node
 	var cur *html.Node
 
-	stack = append(stack, node)
+	isSpan := func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Data == "span" {
+			for _, a := range n.Attr {
+				if a.Key == "class" && strings.TrimSpace(a.Val) == "koboSpan" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	spanID := func(n *html.Node) string {
+		for _, a := range n.Attr {
+			if a.Key == "id" {
+				return a.Val
+			}
+		}
+		return ""
+	}
 
+	stack = append(stack, node)
 	for len(stack) != 0 {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
 
-		for possibleSpan := cur.FirstChild; possibleSpan != nil; possibleSpan = possibleSpan.NextSibling {
-			var isKoboSpan bool
-			if possibleSpan.Type == html.ElementNode && possibleSpan.DataAtom == atom.Span {
-				for _, attr := range possibleSpan.Attr {
-					if attr.Key == "id" && strings.HasPrefix(attr.Val, "kobo.") {
-						isKoboSpan = true
-						break
-					}
-				}
+		if cur.Type != html.ElementNode || cur.Data != "ruby" {
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
 			}
+			continue
+		}
 
-			if isKoboSpan {
-				for spanChild := possibleSpan.FirstChild; spanChild != nil; spanChild = spanChild.NextSibling {
-					spanChild.Parent = possibleSpan.Parent
-				}
-
-				if possibleSpan.Parent.FirstChild == possibleSpan {
-					possibleSpan.Parent.FirstChild = possibleSpan.FirstChild
-				}
-
-				if possibleSpan.PrevSibling != nil {
-					possibleSpan.PrevSibling.NextSibling = possibleSpan.FirstChild
-				}
-
-				if possibleSpan.NextSibling != nil {
-					possibleSpan.NextSibling.PrevSibling = possibleSpan.LastChild
-				}
+		var base, annotation strings.Builder
+		var inner []string
+		var spannedAnnotation bool
 
-				if possibleSpan.Parent.LastChild == possibleSpan {
-					possibleSpan.Parent.LastChild = possibleSpan.LastChild
-				}
+		var rstack []*html.Node
+		var rcur *html.Node
+		var rann []bool
+		var ann bool
 
-				if possibleSpan.FirstChild != nil {
-					possibleSpan.FirstChild.PrevSibling = possibleSpan.PrevSibling
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			rstack = append(rstack, c)
+			rann = append(rann, false)
+		}
+		for len(rstack) != 0 {
+			rstack, rcur = rstack[:len(rstack)-1], rstack[len(rstack)-1]
+			rann, ann = rann[:len(rann)-1], rann[len(rann)-1]
+			if rcur.Type == html.ElementNode && (rcur.Data == "rt" || rcur.Data == "rp") {
+				ann = true
+			}
+			if isSpan(rcur) {
+				if ann {
+					spannedAnnotation = true
+				} else {
+					inner = append(inner, spanID(rcur))
 				}
-
-				if possibleSpan.LastChild != nil {
-					possibleSpan.LastChild.NextSibling = possibleSpan.NextSibling
+			}
+			if rcur.Type == html.TextNode {
+				if ann {
+					annotation.WriteString(rcur.Data)
+				} else {
+					base.WriteString(rcur.Data)
 				}
+			}
+			for c := rcur.LastChild; c != nil; c = c.PrevSibling {
+				rstack = append(rstack, c)
+				rann = append(rann, ann)
+			}
+		}
 
-				continue
+		var outer string
+		for p := cur.Parent; p != nil; p = p.Parent {
+			if isSpan(p) {
+				outer = spanID(p)
+				break
 			}
+		}
 
-			stack = append(stack, possibleSpan)
+		var b strings.Builder
+		b.WriteString(strings.TrimSpace(base.String()))
+		b.WriteString(" (")
+		b.WriteString(strings.TrimSpace(annotation.String()))
+		b.WriteString("): ")
+		switch {
+		case outer != "" && len(inner) == 0:
+			b.WriteString("in ")
+			b.WriteString(outer)
+		case outer == "" && len(inner) != 0:
+			b.WriteString("split into ")
+			b.WriteString(strings.Join(inner, " "))
+		case outer != "":
+			b.WriteString("in ")
+			b.WriteString(outer)
+			b.WriteString(", with nested ")
+			b.WriteString(strings.Join(inner, " "))
+		default:
+			b.WriteString("not spanned")
+		}
+		if spannedAnnotation {
+			b.WriteString(", with spanned readings")
 		}
+		rubies = append(rubies, b.String())
 	}
+
+	return rubies
 }
 
 func mkTree(node *html.Node) string {
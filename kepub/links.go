@@ -0,0 +1,332 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// linkIndex contains the files in an EPUB and the element IDs in the content
+// documents for checking internal links.
+type linkIndex struct {
+	Files    map[string]bool            // all files
+	Manifest map[string]bool            // files referenced by the manifest
+	IDs      map[string]map[string]bool // element IDs by content document
+	lower    map[string][]string        // lowercase filename
+	base     map[string][]string        // see linkBase
+}
+
+// linkBase returns the lowercase base name of fn, with the extension replaced
+// by the kind of file (so renamed files can be found).
+func linkBase(fn string) string {
+	b := strings.ToLower(path.Base(fn))
+	ext := path.Ext(b)
+	switch ext {
+	case ".xhtml", ".html", ".htm", ".xml":
+		ext = "html"
+	case ".jpg", ".jpeg", ".png", ".gif", ".svg", ".webp":
+		ext = "image"
+	}
+	return strings.TrimSuffix(b, path.Ext(b)) + "." + ext
+}
+
+// newLinkIndex indexes the files and content document IDs in the EPUB. The
+// provided files should not include directories.
+func newLinkIndex(epub fs.FS, files []string, opf string) (*linkIndex, error) {
+	x := &linkIndex{
+		Files:    map[string]bool{},
+		Manifest: map[string]bool{},
+		IDs:      map[string]map[string]bool{},
+		lower:    map[string][]string{},
+		base:     map[string][]string{},
+	}
+	for _, fn := range files {
+		x.Files[fn] = true
+		x.lower[strings.ToLower(fn)] = append(x.lower[strings.ToLower(fn)], fn)
+		x.base[linkBase(fn)] = append(x.base[linkBase(fn)], fn)
+	}
+
+	items, err := epubManifest(epub, opf)
+	if err != nil {
+		return nil, err
+	}
+	x.Manifest[opf] = true
+	for _, it := range items {
+		x.Manifest[it] = true
+	}
+
+	cd, err := epubContentDocuments(epub, opf)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range cd {
+		if fns := x.lower[strings.ToLower(fn)]; len(fns) == 1 {
+			fn = fns[0] // content documents are matched case-insensitively by Convert
+		}
+		if !x.Files[fn] {
+			continue
+		}
+		buf, err := fs.ReadFile(epub, fn)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", fn, err)
+		}
+		x.IDs[fn] = linkIDs(buf)
+	}
+	return x, nil
+}
+
+// linkIDs gets the element IDs (and the names of anchors) in the content
+// document. The tokenizer is used directly since this is much faster than
+// parsing the whole document, and the IDs will almost always be ASCII.
+func linkIDs(buf []byte) map[string]bool {
+	ids := map[string]bool{}
+	z := html.NewTokenizer(bytes.NewReader(buf))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ids
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) == "id" || (string(k) == "name" && string(name) == "a") {
+					ids[string(v)] = true
+				}
+			}
+		}
+	}
+}
+
+// linkFix is the action needed to fix a link.
+type linkFix int
+
+const (
+	linkFixNone    linkFix = iota // the link is fine, or can't be fixed
+	linkFixReplace                // the link should be replaced
+	linkFixRemove                 // the link should be removed
+)
+
+// check checks a link in base (the original filename of the document it is in).
+// If the link is broken, a short description of the problem is returned along
+// with the fix.
+func (x *linkIndex) check(base, href string) (problem string, fix linkFix, fixed string) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "invalid URL", linkFixRemove, ""
+	}
+	if u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return "", linkFixNone, "" // not an internal link
+	}
+	if u.Path == "" && u.Fragment == "" {
+		return "", linkFixNone, "" // refers to the document itself
+	}
+	if strings.HasPrefix(u.Path, "/") {
+		return "absolute path", linkFixNone, ""
+	}
+
+	target, how := base, ""
+	if u.Path != "" {
+		target = path.Join(path.Dir(base), u.Path)
+	}
+	if !x.Files[target] {
+		if fns := x.lower[strings.ToLower(target)]; len(fns) == 1 {
+			target, how = fns[0], "wrong case"
+		} else if fns := x.base[linkBase(target)]; len(fns) == 1 {
+			target, how = fns[0], "renamed file"
+		} else {
+			return "missing file", linkFixRemove, ""
+		}
+	}
+
+	if !x.Manifest[target] && how == "" {
+		problem = "file not in manifest" // this can't be fixed here, but it should still be reported
+	}
+
+	frag := u.Fragment
+	if ids, ok := x.IDs[target]; ok && frag != "" && !ids[frag] {
+		var match []string
+		for id := range ids {
+			if strings.EqualFold(id, frag) {
+				match = append(match, id)
+			}
+		}
+		if len(match) == 1 {
+			frag = match[0]
+			how = strings.TrimPrefix(how+", wrong fragment case", ", ")
+		} else {
+			frag = ""
+			how = strings.TrimPrefix(how+", missing fragment", ", ")
+		}
+	}
+
+	if how == "" {
+		return problem, linkFixNone, ""
+	}
+
+	f := &url.URL{Fragment: frag}
+	if target != base || u.Path != "" {
+		f.Path = relPath(path.Dir(base), target)
+	}
+	if frag == "" && f.Path == "" {
+		return how, linkFixRemove, ""
+	}
+	return how, linkFixReplace, f.String()
+}
+
+// linkAttr checks if the attribute a on the element n is a link which should
+// be checked.
+func linkAttr(n *html.Node, a html.Attribute) bool {
+	switch {
+	case a.Key == "href" && a.Namespace == "xlink":
+		return true
+	case a.Key == "xlink:href":
+		return true
+	case a.Namespace != "":
+		return false
+	}
+	switch n.DataAtom {
+	case atom.A, atom.Area, atom.Link:
+		return a.Key == "href"
+	case atom.Img, atom.Script, atom.Audio, atom.Video, atom.Source, atom.Track, atom.Iframe, atom.Embed:
+		return a.Key == "src"
+	}
+	return false
+}
+
+// transformContentLinks checks the links in the content document fn (the
+// original filename) against the index. Broken links are reported, and fixed
+// if fix is true. Dead anchors have their href removed, but other elements are
+// left as-is.
+func transformContentLinks(doc *html.Node, fn string, x *linkIndex, fix bool, report func(Report)) {
+	var cur *html.Node
+	stack := []*html.Node{doc}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			for i := 0; i < len(cur.Attr); i++ {
+				a := cur.Attr[i]
+				if !linkAttr(cur, a) {
+					continue
+				}
+				problem, action, fixed := x.check(fn, a.Val)
+				if problem == "" {
+					continue
+				}
+				if action == linkFixRemove && cur.DataAtom != atom.A && cur.DataAtom != atom.Area {
+					action = linkFixNone
+				}
+				if report != nil {
+					report(Report{Kind: ReportLink, File: fn, Value: a.Val, Message: linkMessage(problem, action, fixed, fix)})
+				}
+				if fix {
+					switch action {
+					case linkFixReplace:
+						cur.Attr[i].Val = fixed
+					case linkFixRemove:
+						cur.Attr = append(cur.Attr[:i], cur.Attr[i+1:]...)
+						i--
+					}
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+// linkMessage describes a broken link and the fix.
+func linkMessage(problem string, action linkFix, fixed string, applied bool) string {
+	switch {
+	case action == linkFixReplace && applied:
+		return fmt.Sprintf("%s, fixed to %q", problem, fixed)
+	case action == linkFixReplace:
+		return fmt.Sprintf("%s, can be fixed to %q", problem, fixed)
+	case action == linkFixRemove && applied:
+		return problem + ", removed"
+	case action == linkFixRemove:
+		return problem + ", can be removed"
+	}
+	return problem
+}
+
+// CheckLinks checks the internal links in the content documents of an EPUB,
+// and returns a ReportLink for each broken one. The message of each report
+// describes the problem and the fix which would be applied with
+// ConverterOptionLinks.
+func CheckLinks(epub fs.FS) ([]Report, error) {
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	var files []string
+	if err := fs.WalkDir(epub, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("find files: %w", err)
+	}
+
+	x, err := newLinkIndex(epub, files, opf)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	var reports []Report
+	report := func(r Report) {
+		reports = append(reports, r)
+	}
+
+	cd := make([]string, 0, len(x.IDs))
+	for fn := range x.IDs {
+		cd = append(cd, fn)
+	}
+	sort.Strings(cd)
+
+	for _, fn := range cd {
+		rc, err := epub.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", fn, err)
+		}
+		doc, err := html.ParseWithOptions(rc,
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", fn, err)
+		}
+		transformContentLinks(doc, fn, x, false, report)
+	}
+
+	if ncx, err := epubNCX(epub, opf); err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	} else if ncx != "" && x.Files[ncx] {
+		rc, err := epub.Open(ncx)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", ncx, err)
+		}
+		err = transformNCX(io.Discard, rc, ncx, &convertState{Links: x, Report: report})
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("check %q: %w", ncx, err)
+		}
+	}
+
+	return reports, nil
+}
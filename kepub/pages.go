@@ -0,0 +1,222 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+)
+
+// PageData is the data available to the templates for generated pages (see
+// ConverterOptionAddPage and ConverterOptionDummyTitlepageTemplate). It is
+// taken from the converted OPF package document.
+type PageData struct {
+	Title       string
+	Authors     []string
+	Series      string
+	SeriesIndex string
+	Language    string
+	Publisher   string
+	Identifier  string
+	Description string
+	Date        string
+	Cover       string // the URL of the cover image relative to the page, or empty if there isn't one
+}
+
+// converterPage is a page added by ConverterOptionAddPage.
+type converterPage struct {
+	Template *template.Template
+	Position int
+}
+
+// pageData gets the PageData for the page fn from the OPF package document
+// opfF.
+func pageData(opf []byte, opfF, fn string) (PageData, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(opf); err != nil {
+		return PageData{}, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	var d PageData
+	text := func(p string) string {
+		if el := doc.FindElement(p); el != nil {
+			return strings.TrimSpace(el.Text())
+		}
+		return ""
+	}
+	d.Title = text("/package/metadata/title")
+	d.Language = text("/package/metadata/language")
+	d.Publisher = text("/package/metadata/publisher")
+	d.Identifier = text("/package/metadata/identifier")
+	d.Description = text("/package/metadata/description")
+	d.Date = text("/package/metadata/date")
+
+	for _, el := range doc.FindElements("/package/metadata/creator") {
+		role := el.SelectAttrValue("role", "")
+		if id := el.SelectAttrValue("id", ""); role == "" && id != "" {
+			if m := doc.FindElement("/package/metadata/meta[@refines='#" + id + "'][@property='role']"); m != nil {
+				role = strings.TrimSpace(m.Text())
+			}
+		}
+		if v := strings.TrimSpace(el.Text()); v != "" && (role == "" || role == "aut") {
+			d.Authors = append(d.Authors, v)
+		}
+	}
+
+	if el := doc.FindElement("/package/metadata/meta[@property='belongs-to-collection']"); el != nil {
+		d.Series = strings.TrimSpace(el.Text())
+		if id := el.SelectAttrValue("id", ""); id != "" {
+			if m := doc.FindElement("/package/metadata/meta[@refines='#" + id + "'][@property='group-position']"); m != nil {
+				d.SeriesIndex = strings.TrimSpace(m.Text())
+			}
+		}
+	} else if el := doc.FindElement("/package/metadata/meta[@name='calibre:series']"); el != nil {
+		d.Series = strings.TrimSpace(el.SelectAttrValue("content", ""))
+		if m := doc.FindElement("/package/metadata/meta[@name='calibre:series_index']"); m != nil {
+			d.SeriesIndex = strings.TrimSpace(m.SelectAttrValue("content", ""))
+		}
+	}
+
+	// the cover-image property was already added by transformOPF
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		if includes(el.SelectAttrValue("properties", ""), "cover-image") {
+			href := el.SelectAttrValue("href", "")
+			if u, err := url.PathUnescape(href); err == nil {
+				href = u
+			}
+			d.Cover = (&url.URL{Path: relPath(path.Dir(fn), path.Join(path.Dir(opfF), href))}).String()
+			break
+		}
+	}
+
+	return d, nil
+}
+
+// renderPage executes a page template, then transforms it like any other
+// content document.
+func (c *Converter) renderPage(t *template.Template, opf []byte, opfF, fn string) ([]byte, error) {
+	d, err := pageData(opf, opfF, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, d); err != nil {
+		return nil, fmt.Errorf("execute template: %w", err)
+	}
+
+	doc, err := html.ParseWithOptions(&buf,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return nil, fmt.Errorf("parse html: %w", err)
+	}
+
+	buf.Reset()
+	if err := c.transformContentDoc(&buf, doc, fn, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// transformPages adds the pages from ConverterOptionAddPage to the OPF package
+// document opfF (which has already been transformed), and returns the
+// filenames and contents of the pages to add to the EPUB.
+func (c *Converter) transformPages(epub fs.FS, opfF string, opf *bytes.Buffer) ([]string, [][]byte, error) {
+	if len(c.pages) == 0 {
+		return nil, nil, nil
+	}
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(bytes.NewReader(opf.Bytes())); err != nil {
+		return nil, nil, fmt.Errorf("parse opf: %w", err)
+	}
+
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("//[@id]") {
+		ids[el.SelectAttrValue("id", "")] = true
+	}
+
+	manifest, spine := doc.FindElement("/package/manifest"), doc.FindElement("/package/spine")
+	if manifest == nil || spine == nil {
+		return nil, nil, fmt.Errorf("parse opf: missing manifest or spine")
+	}
+	itemrefs := spine.SelectElements("itemref")
+
+	var fns []string
+	var bufs [][]byte
+	for _, p := range c.pages {
+		name := pageName(p.Template.Name())
+
+		id, fn := "kepubify-page-"+name, path.Join(path.Dir(opfF), "kepubify-page-"+name+".xhtml")
+		for x := 1; ; x++ {
+			if _, err := fs.Stat(epub, fn); ids[id] || err == nil {
+				id, fn = fmt.Sprintf("kepubify-page-%s_%d", name, x), path.Join(path.Dir(opfF), fmt.Sprintf("kepubify-page-%s_%d.xhtml", name, x))
+				continue
+			}
+			break
+		}
+		ids[id] = true
+
+		buf, err := c.renderPage(p.Template, opf.Bytes(), opfF, fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("render page %q: %w", p.Template.Name(), err)
+		}
+		fns, bufs = append(fns, fn), append(bufs, buf)
+
+		it := manifest.CreateElement("item")
+		it.Space = manifest.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		it.CreateAttr("id", id)
+		it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opfF), fn)}).String())
+		it.CreateAttr("media-type", "application/xhtml+xml")
+
+		ref := etree.NewElement("itemref")
+		ref.Space = spine.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		ref.CreateAttr("idref", id)
+
+		// positions are relative to the original spine, and pages at the same
+		// position are kept in the order they were added
+		i := p.Position
+		if i < 0 {
+			i += len(itemrefs) + 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		if i < len(itemrefs) {
+			spine.InsertChildAt(itemrefs[i].Index(), ref)
+		} else {
+			spine.AddChild(ref)
+		}
+	}
+	doc.Indent(4) // same as TransformOPF
+
+	opf.Reset()
+	if _, err := doc.WriteTo(opf); err != nil {
+		return nil, nil, fmt.Errorf("render opf: %w", err)
+	}
+	return fns, bufs, nil
+}
+
+// pageName makes a page template name safe for use in a filename and id.
+func pageName(s string) string {
+	s = strings.TrimSuffix(path.Base(s), path.Ext(s))
+	s = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, s)
+	if s == "" || s == "-" {
+		s = "page"
+	}
+	return s
+}
@@ -0,0 +1,532 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/beevik/etree"
+	"github.com/kr/smartypants"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// SmartypantsDashes controls how dashes are converted by smart punctuation.
+type SmartypantsDashes int
+
+const (
+	SmartypantsDashesLatex     SmartypantsDashes = iota // -- is an en dash, --- is an em dash (default)
+	SmartypantsDashesOldschool                          // -- is an em dash, a hyphen surrounded by spaces is an en dash
+	SmartypantsDashesNone                               // dashes are left as-is
+)
+
+// SmartypantsEllipsis controls how ellipses are converted by smart punctuation.
+type SmartypantsEllipsis int
+
+const (
+	SmartypantsEllipsisChar SmartypantsEllipsis = iota // ... and . . . are replaced with … (default)
+	SmartypantsEllipsisNone                            // ellipses are left as-is
+)
+
+// smartypantsConfig configures transformContentPunctuation.
+type smartypantsConfig struct {
+	Locale   string // "" for English, "auto" to use the document language
+	Language string // the package language, used for "auto" if the document doesn't specify one
+	Dashes   SmartypantsDashes
+	Ellipsis SmartypantsEllipsis
+}
+
+// punctuationLocale describes the quotation and spacing conventions for a
+// language. The output of smartypants (which is always English-style) is
+// converted to it.
+type punctuationLocale struct {
+	DoubleOpen, DoubleClose string
+	SingleOpen, SingleClose string
+
+	// SpaceInside adds a narrow no-break space inside quotation marks.
+	SpaceInside bool
+
+	// SpaceBefore adds a narrow no-break space before ;:!?.
+	SpaceBefore bool
+}
+
+// punctuationLocales is keyed by the lowercase BCP 47 language tag, with either
+// only the primary language subtag, or the primary language subtag and the
+// region subtag.
+var punctuationLocales = map[string]punctuationLocale{
+	"en":    {"“", "”", "‘", "’", false, false},
+	"de":    {"„", "“", "‚", "‘", false, false},
+	"de-ch": {"«", "»", "‹", "›", false, false},
+	"fr":    {"«", "»", "‹", "›", true, true},
+	"fr-ch": {"«", "»", "‹", "›", true, true},
+	"sv":    {"”", "”", "’", "’", false, false},
+	"fi":    {"”", "”", "’", "’", false, false},
+	"da":    {"»", "«", "›", "‹", false, false},
+	"nb":    {"«", "»", "‘", "’", false, false},
+	"nn":    {"«", "»", "‘", "’", false, false},
+	"no":    {"«", "»", "‘", "’", false, false},
+}
+
+// lookupPunctuationLocale finds the punctuation conventions for a BCP 47
+// language tag. If the language is unknown, English is used.
+func lookupPunctuationLocale(tag string) punctuationLocale {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if l, ok := punctuationLocales[tag]; ok {
+		return l
+	}
+	if spl := strings.Split(tag, "-"); len(spl) > 1 {
+		for _, s := range spl[1:] {
+			if len(s) == 2 { // region subtag (skip the script subtag if any)
+				if l, ok := punctuationLocales[spl[0]+"-"+s]; ok {
+					return l
+				}
+				break
+			}
+		}
+		if l, ok := punctuationLocales[spl[0]]; ok {
+			return l
+		}
+	}
+	return punctuationLocales["en"]
+}
+
+// Private use characters are used to mark the boundaries between the pieces
+// of a run of text while it is being smartened as a whole.
+const (
+	punctuationMarkFirst rune = '\U000F0000'
+	punctuationMarkLast  rune = '\U000FFFFD'
+)
+
+func isPunctuationMark(r rune) bool {
+	return r >= punctuationMarkFirst && r <= punctuationMarkLast
+}
+
+// punctuationPiece is part of a run of text being smartened.
+type punctuationPiece struct {
+	Text   string
+	Node   int  // the text node it belongs to, or -1 if it's only context
+	Opaque bool // if the text is only used as context
+}
+
+// punctuationContext returns a character of the same class as r for
+// smartypants, which only looks at the bytes around a quote to decide which
+// way it faces.
+func punctuationContext(r rune) byte {
+	switch {
+	case r >= utf8.RuneSelf:
+		return 'a'
+	case strings.ContainsRune(" \t\n\r\f\v", r):
+		return ' '
+	case strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", r):
+		return '!' // punctuation without a smartypants conversion
+	default:
+		return 'a'
+	}
+}
+
+// applyRun smartens the punctuation in a run of inline text split across
+// nodes text nodes. Since the quote direction depends on the surrounding
+// characters, the run is converted at once, and opaque pieces (e.g., code or
+// protected sequences) are only used as context. It returns the new text for
+// each text node.
+func (p smartypantsConfig) applyRun(pieces []punctuationPiece, nodes int, lang string) []string {
+	res := make([]string, nodes)
+
+	// split out the sequences smartypants can't be told to leave alone
+	var split []punctuationPiece
+	for _, pc := range pieces {
+		if pc.Opaque {
+			split = append(split, pc)
+			continue
+		}
+		for s := pc.Text; s != ""; {
+			i, n := p.protected(s)
+			if i == -1 {
+				split = append(split, punctuationPiece{s, pc.Node, false})
+				break
+			}
+			if i != 0 {
+				split = append(split, punctuationPiece{s[:i], pc.Node, false})
+			}
+			split = append(split, punctuationPiece{s[i : i+n], pc.Node, true})
+			s = s[i+n:]
+		}
+	}
+
+	var b strings.Builder
+	var n int
+	for _, pc := range split {
+		b.WriteString(pc.Text)
+		if !pc.Opaque {
+			n++
+		}
+	}
+	text := b.String()
+
+	// this should never be needed in practice
+	individually := func() []string {
+		for i := range res {
+			res[i] = ""
+		}
+		for _, pc := range pieces {
+			if pc.Node != -1 {
+				if pc.Opaque {
+					res[pc.Node] += pc.Text
+				} else {
+					res[pc.Node] += p.apply(pc.Text, lang)
+				}
+			}
+		}
+		return res
+	}
+	if n == 0 || n >= int(punctuationMarkLast-punctuationMarkFirst) || strings.IndexFunc(text, isPunctuationMark) != -1 {
+		return individually()
+	}
+
+	// replace the boundaries before, between, and after the pieces being
+	// converted (including the opaque text between them) with a mark
+	// surrounded by characters of the same class as the ones on the other
+	// side of it (if there isn't any text before the first piece or after the
+	// last one, the boundary is left out so smartypants sees the start or end)
+	type boundary struct {
+		Omit          bool
+		Before, After byte
+	}
+	var in strings.Builder
+	var bounds []boundary
+	mark := func(start, end int) {
+		var bd boundary
+		if end == 0 || start == len(text) {
+			bd.Omit = true
+		} else {
+			r1, _ := utf8.DecodeRuneInString(text[start:])
+			r2, _ := utf8.DecodeLastRuneInString(text[:end])
+			bd.Before, bd.After = punctuationContext(r1), punctuationContext(r2)
+			in.WriteByte(bd.Before)
+			in.WriteRune(punctuationMarkFirst + rune(len(bounds)))
+			in.WriteByte(bd.After)
+		}
+		bounds = append(bounds, bd)
+	}
+	var off, gap int
+	for _, pc := range split {
+		if !pc.Opaque {
+			mark(gap, off)
+			in.WriteString(pc.Text)
+			gap = off + len(pc.Text)
+		}
+		off += len(pc.Text)
+	}
+	mark(gap, off)
+
+	var flags int
+	if p.Dashes == SmartypantsDashesLatex {
+		flags |= smartypants.LatexDashes
+	}
+
+	buf := bytes.NewBuffer(nil)
+	sp := smartypants.New(buf, flags)
+	if _, err := sp.Write([]byte(in.String())); err != nil {
+		panic(err) // smartypants should never error on its own
+	}
+
+	// (*smartypants.writer).write calls smartypants.attrEscape on the passed
+	// data (which has been unescaped by the parser), which escapes the HTML
+	// entities, so we need to unescape it after it has been processed.
+	out := html.UnescapeString(buf.String())
+
+	// remove the context characters, leaving only the marks
+	var clean strings.Builder
+	for i, bd := range bounds {
+		mr := string(punctuationMarkFirst + rune(i))
+		if bd.Omit {
+			if i != 0 {
+				clean.WriteString(out)
+				out = ""
+			}
+			clean.WriteString(mr)
+			continue
+		}
+		j := strings.Index(out, mr)
+		if j < 1 || out[j-1] != bd.Before || len(out) == j+len(mr) || out[j+len(mr)] != bd.After {
+			return individually() // smartypants changed a context character
+		}
+		clean.WriteString(out[:j-1])
+		clean.WriteString(mr)
+		out = out[j+len(mr)+1:]
+	}
+	r := clean.String()
+
+	switch p.Locale {
+	case "", "en":
+	case "auto":
+		if lang != "" {
+			r = lookupPunctuationLocale(lang).localize(r)
+		}
+	default:
+		r = lookupPunctuationLocale(p.Locale).localize(r)
+	}
+
+	// put the converted text back in the text nodes (the text before the
+	// first mark and after the last one is always empty)
+	var parts []string
+	for {
+		i := strings.IndexFunc(r, isPunctuationMark)
+		if i == -1 {
+			break
+		}
+		if len(parts) != 0 {
+			parts[len(parts)-1] = r[:i]
+		}
+		parts = append(parts, "")
+		r = r[i+utf8.RuneLen(punctuationMarkFirst):]
+	}
+	for _, pc := range split {
+		if pc.Node == -1 {
+			continue
+		}
+		if pc.Opaque {
+			res[pc.Node] += pc.Text
+		} else {
+			res[pc.Node] += parts[0]
+			parts = parts[1:]
+		}
+	}
+	return res
+}
+
+// apply smartens the punctuation in s.
+func (p smartypantsConfig) apply(s, lang string) string {
+	var flags int
+	if p.Dashes == SmartypantsDashesLatex {
+		flags |= smartypants.LatexDashes
+	}
+
+	buf := bytes.NewBuffer(nil)
+	sp := smartypants.New(buf, flags)
+	for s != "" {
+		// smartypants can't disable individual conversions, so write protected
+		// sequences directly to the buffer (the quote state is kept in the
+		// writer, so it will still be consistent)
+		i, n := p.protected(s)
+		if i == -1 {
+			sp.Write([]byte(s))
+			break
+		}
+		sp.Write([]byte(s[:i]))
+		buf.WriteString(html.EscapeString(s[i : i+n]))
+		s = s[i+n:]
+	}
+	if _, err := sp.Write(nil); err != nil {
+		panic(err) // smartypants should never error on its own
+	}
+
+	// (*smartypants.writer).write calls smartypants.attrEscape on the passed
+	// data (which has been unescaped by the parser), which escapes the HTML
+	// entities, so we need to unescape it after it has been processed.
+	r := html.UnescapeString(buf.String())
+
+	switch p.Locale {
+	case "", "en":
+		return r
+	case "auto":
+		if lang == "" {
+			return r
+		}
+		return lookupPunctuationLocale(lang).localize(r)
+	default:
+		return lookupPunctuationLocale(p.Locale).localize(r)
+	}
+}
+
+// protected returns the index and length of the first sequence in s which
+// shouldn't be touched by smartypants, or -1 if there aren't any.
+func (p smartypantsConfig) protected(s string) (int, int) {
+	i, n := -1, 0
+	if p.Ellipsis == SmartypantsEllipsisNone {
+		for _, x := range []string{"...", ". . ."} {
+			if j := strings.Index(s, x); j != -1 && (i == -1 || j < i) {
+				i, n = j, len(x)
+			}
+		}
+	}
+	if p.Dashes == SmartypantsDashesNone {
+		if j := strings.IndexByte(s, '-'); j != -1 && (i == -1 || j < i) {
+			i, n = j, len(s[j:])-len(strings.TrimLeft(s[j:], "-"))
+		}
+	}
+	return i, n
+}
+
+// localize converts English-style smart quotes to the conventions of the
+// locale. Apostrophes are preserved.
+func (l punctuationLocale) localize(s string) string {
+	const nnbsp = '\u202f' // narrow no-break space
+
+	isSpace := func(r rune) bool {
+		return r == ' ' || r == '\u00a0' || r == nnbsp
+	}
+	trimSpace := func(out []rune) []rune { // keeps the marks
+		var marks []rune
+		for len(out) != 0 {
+			if r := out[len(out)-1]; isPunctuationMark(r) {
+				marks = append(marks, r)
+			} else if !isSpace(r) {
+				break
+			}
+			out = out[:len(out)-1]
+		}
+		for i := len(marks) - 1; i >= 0; i-- {
+			out = append(out, marks[i])
+		}
+		return out
+	}
+	prevRune := func(out []rune) (rune, bool) { // ignores the marks
+		for i := len(out) - 1; i >= 0; i-- {
+			if !isPunctuationMark(out[i]) {
+				return out[i], true
+			}
+		}
+		return 0, false
+	}
+
+	out := make([]rune, 0, len(s))
+	var single int
+	var skipSpace bool
+	for i, r := range s {
+		if isPunctuationMark(r) {
+			out = append(out, r)
+			continue
+		}
+		if skipSpace {
+			if isSpace(r) {
+				continue
+			}
+			skipSpace = false
+		}
+		var next rune
+		if j := strings.IndexFunc(s[i+utf8.RuneLen(r):], func(r rune) bool { return !isPunctuationMark(r) }); j != -1 {
+			next, _ = utf8.DecodeRuneInString(s[i+utf8.RuneLen(r)+j:])
+		} else {
+			next = utf8.RuneError
+		}
+		switch r {
+		case '“', '‘':
+			if r == '‘' {
+				single++
+				out = append(out, []rune(l.SingleOpen)...)
+			} else {
+				out = append(out, []rune(l.DoubleOpen)...)
+			}
+			if l.SpaceInside {
+				out = append(out, nnbsp)
+				skipSpace = true
+			}
+		case '”', '’':
+			if r == '’' {
+				if single == 0 || unicode.IsLetter(next) {
+					out = append(out, r) // apostrophe
+					break
+				}
+				single--
+			}
+			if _, ok := prevRune(out); l.SpaceInside && ok {
+				out = append(trimSpace(out), nnbsp)
+			}
+			if r == '’' {
+				out = append(out, []rune(l.SingleClose)...)
+			} else {
+				out = append(out, []rune(l.DoubleClose)...)
+			}
+		case ';', ':', '!', '?':
+			if prev, ok := prevRune(out); l.SpaceBefore && ok {
+				if isSpace(prev) {
+					out = append(trimSpace(out), nnbsp)
+				} else if unicode.IsLetter(prev) || unicode.IsDigit(prev) || strings.ContainsRune(")]»›…", prev) {
+					if r != ':' || next == utf8.RuneError || unicode.IsSpace(next) {
+						out = append(out, nnbsp) // don't touch times, URLs, etc
+					}
+				}
+			}
+			out = append(out, r)
+		default:
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+// punctuationInline contains the elements which don't interrupt a run of text
+// when smartening punctuation.
+var punctuationInline = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Acronym: true, atom.B: true,
+	atom.Bdi: true, atom.Bdo: true, atom.Big: true, atom.Cite: true,
+	atom.Data: true, atom.Del: true, atom.Dfn: true, atom.Em: true,
+	atom.Font: true, atom.I: true, atom.Img: true, atom.Ins: true,
+	atom.Mark: true, atom.Nobr: true, atom.Q: true, atom.S: true,
+	atom.Small: true, atom.Span: true, atom.Strike: true, atom.Strong: true,
+	atom.Sub: true, atom.Sup: true, atom.Time: true, atom.Tt: true,
+	atom.U: true, atom.Var: true, atom.Wbr: true,
+}
+
+// nodeText gets the text content of a node.
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var stack []*html.Node
+	var cur *html.Node
+	stack = append(stack, n)
+
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch cur.Type {
+		case html.TextNode:
+			b.WriteString(cur.Data)
+		case html.ElementNode, html.DocumentNode:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// epubLanguage gets the first dc:language from the OPF package document.
+func epubLanguage(epub fs.FS, opf string) (string, error) {
+	doc := etree.NewDocument()
+	if err := func() error {
+		f, err := epub.Open(opf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = doc.ReadFrom(f)
+		return err
+	}(); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	for _, el := range doc.FindElements("/package/metadata//language") {
+		if v := strings.TrimSpace(el.Text()); v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// documentLanguage gets the language of a document from the lang or xml:lang
+// attribute on the root element.
+func documentLanguage(doc *html.Node) string {
+	if n := findAtom(doc, atom.Html); n != nil {
+		for _, a := range n.Attr {
+			if (a.Key == "lang" && a.Namespace == "") || a.Key == "xml:lang" || (a.Key == "lang" && a.Namespace == "xml") {
+				if v := strings.TrimSpace(a.Val); v != "" {
+					return v
+				}
+			}
+		}
+	}
+	return ""
+}
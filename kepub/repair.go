@@ -0,0 +1,343 @@
+package kepub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// epubRepairPackage is like epubPackage, but if the OCF container is missing or
+// invalid, it attempts to find the package document by looking at the rootfiles
+// in the container regardless of the version, then by scanning the files for
+// *.opf. If the container needed to be repaired, a new one is returned.
+func epubRepairPackage(epub fs.FS, files []string, report func(Report)) (string, []byte, error) {
+	exists := map[string]bool{}
+	for _, fn := range files {
+		exists[fn] = true
+	}
+
+	opf, err := epubPackage(epub)
+	if err == nil && exists[opf] {
+		return opf, nil, nil
+	} else if err == nil {
+		err = fmt.Errorf("package document %q does not exist", opf)
+	}
+
+	var found, how string
+	if f, err1 := epub.Open("META-INF/container.xml"); err1 == nil {
+		var ocf struct {
+			RootFile []struct {
+				FullPath string `xml:"full-path,attr"`
+			} `xml:"rootfiles>rootfile"`
+		}
+		if xml.NewDecoder(f).Decode(&ocf) == nil {
+			for _, rf := range ocf.RootFile {
+				if exists[rf.FullPath] && strings.EqualFold(path.Ext(rf.FullPath), ".opf") {
+					found, how = rf.FullPath, "using the package document from the invalid container"
+					break
+				}
+			}
+		}
+		f.Close()
+	}
+	if found == "" {
+		var opfs []string
+		for _, fn := range files {
+			if strings.EqualFold(path.Ext(fn), ".opf") {
+				opfs = append(opfs, fn)
+			}
+		}
+		sort.SliceStable(opfs, func(i, j int) bool {
+			if a, b := strings.Count(opfs[i], "/"), strings.Count(opfs[j], "/"); a != b {
+				return a < b
+			}
+			return opfs[i] < opfs[j]
+		})
+		if len(opfs) == 0 {
+			return "", nil, fmt.Errorf("%w (and no package documents were found)", err)
+		}
+		found, how = opfs[0], fmt.Sprintf("using the first of %d package documents found", len(opfs))
+	}
+
+	if report != nil {
+		report(Report{Kind: ReportRepair, File: "META-INF/container.xml", Value: found, Message: fmt.Sprintf("%v, %s", err, how)})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">` + "\n")
+	buf.WriteString(`    <rootfiles>` + "\n")
+	buf.WriteString(`        <rootfile full-path="`)
+	xml.EscapeText(&buf, []byte(found))
+	buf.WriteString(`" media-type="application/oebps-package+xml"/>` + "\n")
+	buf.WriteString(`    </rootfiles>` + "\n")
+	buf.WriteString(`</container>` + "\n")
+	return found, buf.Bytes(), nil
+}
+
+// epubRepairOPF repairs the manifest and spine of the OPF package document
+// opf. Items for missing files are removed (or fixed if only the case is
+// wrong), incorrect media types are fixed by sniffing the content, content
+// documents, stylesheets, and images which aren't in the manifest are added,
+// and the spine is regenerated from the content documents (including ones
+// incorrectly declared as text/html) if it is empty.
+func epubRepairOPF(epub fs.FS, opf string, files []string, report func(Report)) ([]byte, error) {
+	rep := func(value, format string, a ...interface{}) {
+		if report != nil {
+			report(Report{Kind: ReportRepair, File: opf, Value: value, Message: fmt.Sprintf(format, a...)})
+		}
+	}
+
+	exists := map[string]bool{}
+	lower := map[string][]string{}
+	for _, fn := range files {
+		exists[fn] = true
+		lower[strings.ToLower(fn)] = append(lower[strings.ToLower(fn)], fn)
+	}
+
+	doc := etree.NewDocument()
+	if err := func() error {
+		f, err := epub.Open(opf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = doc.ReadFrom(f)
+		return err
+	}(); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	pkg := doc.FindElement("/package")
+	if pkg == nil {
+		return nil, fmt.Errorf("parse OPF package: missing package element")
+	}
+
+	manifest := pkg.SelectElement("manifest")
+	if manifest == nil {
+		manifest = pkg.CreateElement("manifest")
+		manifest.Space = pkg.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		rep("manifest", "missing manifest, added")
+	}
+
+	ids := map[string]bool{}
+	for _, it := range manifest.SelectElements("item") {
+		ids[it.SelectAttrValue("id", "")] = true
+	}
+
+	declared := map[string]bool{}
+	for _, it := range manifest.SelectElements("item") {
+		id, href := it.SelectAttrValue("id", ""), it.SelectAttrValue("href", "")
+		fn := href
+		if u, err := url.PathUnescape(href); err == nil {
+			fn = u
+		}
+		fn = path.Join(path.Dir(opf), fn)
+
+		if !exists[fn] {
+			if fns := lower[strings.ToLower(fn)]; len(fns) == 1 {
+				fn = fns[0]
+				it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), fn)}).String())
+				rep(href, "wrong case, fixed to %q", it.SelectAttrValue("href", ""))
+			} else {
+				manifest.RemoveChild(it)
+				delete(ids, id)
+				rep(href, "missing file, removed from manifest")
+				continue
+			}
+		}
+		if id == "" {
+			id = repairID(ids)
+			it.CreateAttr("id", id)
+			rep(href, "missing id, set to %q", id)
+		}
+		ids[id] = true
+		declared[fn] = true
+
+		if mt := repairSniff(epub, fn); mt != "" {
+			// legacy font media types are fine
+			if cur := it.SelectAttrValue("media-type", ""); cur != mt && !(strings.HasPrefix(mt, "font/") && (strings.Contains(cur, "font") || strings.Contains(cur, "opentype"))) {
+				it.CreateAttr("media-type", mt)
+				rep(href, "wrong media type %q, fixed to %q", cur, mt)
+			}
+		}
+	}
+
+	var undeclared []string
+	for _, fn := range files {
+		if declared[fn] || fn == opf || fn == "mimetype" || strings.HasPrefix(fn, "META-INF/") {
+			continue
+		}
+		switch repairMediaType(fn) {
+		case "application/xhtml+xml", "text/css", "image/jpeg", "image/png", "image/gif", "image/svg+xml", "image/webp":
+			undeclared = append(undeclared, fn)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, fn := range undeclared {
+		mt := repairSniff(epub, fn)
+		if mt == "" {
+			mt = repairMediaType(fn)
+		}
+		id := repairID(ids)
+		ids[id] = true
+
+		it := manifest.CreateElement("item")
+		it.Space = manifest.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		it.CreateAttr("id", id)
+		it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), fn)}).String())
+		it.CreateAttr("media-type", mt)
+		rep(it.SelectAttrValue("href", ""), "not in manifest, added as %q", id)
+	}
+
+	spine := pkg.SelectElement("spine")
+	if spine == nil {
+		spine = pkg.CreateElement("spine")
+		spine.Space = pkg.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+	}
+	for _, it := range spine.SelectElements("itemref") {
+		if idref := it.SelectAttrValue("idref", ""); !ids[idref] {
+			spine.RemoveChild(it)
+			rep(idref, "spine item references a missing manifest item, removed")
+		}
+	}
+	if len(spine.SelectElements("itemref")) == 0 {
+		var n int
+		for _, it := range manifest.SelectElements("item") {
+			if mt := it.SelectAttrValue("media-type", ""); (mt == "application/xhtml+xml" || mt == "text/html") && !includes(it.SelectAttrValue("properties", ""), "nav") {
+				ref := spine.CreateElement("itemref")
+				ref.Space = spine.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+				ref.CreateAttr("idref", it.SelectAttrValue("id", ""))
+				n++
+			}
+		}
+		rep("spine", "empty spine, regenerated with %d items from the manifest", n)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if _, err := doc.WriteTo(buf); err != nil {
+		return nil, fmt.Errorf("render OPF package: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// repairID returns an unused manifest item ID.
+func repairID(ids map[string]bool) string {
+	for n := 1; ; n++ {
+		if id := "kepubify-repair-" + strconv.Itoa(n); !ids[id] {
+			return id
+		}
+	}
+}
+
+// repairMediaType guesses the media type of a file from the extension.
+func repairMediaType(fn string) string {
+	switch strings.ToLower(path.Ext(fn)) {
+	case ".xhtml", ".html", ".htm":
+		return "application/xhtml+xml"
+	case ".css":
+		return "text/css"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".svg":
+		return "image/svg+xml"
+	case ".webp":
+		return "image/webp"
+	case ".ncx":
+		return "application/x-dtbncx+xml"
+	}
+	return ""
+}
+
+// repairSniff detects the media type of a file from the content. If it can't
+// be determined, an empty string is returned.
+func repairSniff(epub fs.FS, fn string) string {
+	f, err := epub.Open(fn)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1024)
+	n, _ := io.ReadFull(f, buf)
+	return sniffMediaType(fn, buf[:n])
+}
+
+// sniffMediaType detects the media type of a file from the content and
+// extension. Only the types commonly found in EPUBs are detected. If it can't
+// be determined, an empty string is returned.
+func sniffMediaType(fn string, b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(b, []byte("\xFF\xD8\xFF")):
+		return "image/jpeg"
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return "image/gif"
+	case len(b) >= 12 && bytes.HasPrefix(b, []byte("RIFF")) && string(b[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(b, []byte("wOFF")):
+		return "font/woff"
+	case bytes.HasPrefix(b, []byte("wOF2")):
+		return "font/woff2"
+	case bytes.HasPrefix(b, []byte("OTTO")):
+		return "font/otf"
+	case bytes.HasPrefix(b, []byte("\x00\x01\x00\x00")):
+		return "font/ttf"
+	}
+
+	lb := bytes.ToLower(b)
+	switch ext := strings.ToLower(path.Ext(fn)); {
+	case bytes.Contains(lb, []byte("<ncx")):
+		return "application/x-dtbncx+xml"
+	case bytes.Contains(lb, []byte("<svg")) && !bytes.Contains(lb, []byte("<html")):
+		return "image/svg+xml"
+	case bytes.Contains(lb, []byte("<html")):
+		return "application/xhtml+xml"
+	case ext == ".css" && !bytes.ContainsRune(b, 0):
+		return "text/css"
+	}
+	return ""
+}
+
+// overlayFS replaces the contents of some files in a fs.FS.
+type overlayFS struct {
+	fs.FS
+	files map[string][]byte
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if b, ok := o.files[name]; ok {
+		return &overlayFile{bytes.NewReader(b), path.Base(name), int64(len(b))}, nil
+	}
+	return o.FS.Open(name)
+}
+
+type overlayFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func (f *overlayFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *overlayFile) Close() error               { return nil }
+func (f *overlayFile) Name() string               { return f.name }
+func (f *overlayFile) Size() int64                { return f.size }
+func (f *overlayFile) Mode() fs.FileMode          { return 0444 }
+func (f *overlayFile) ModTime() time.Time         { return time.Time{} }
+func (f *overlayFile) IsDir() bool                { return false }
+func (f *overlayFile) Sys() interface{}           { return nil }
@@ -0,0 +1,142 @@
+package kepub
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// contentSkip is a set of mandatory content document transformations to skip.
+type contentSkip uint8
+
+const (
+	contentSkipSpans contentSkip = 1 << iota
+	contentSkipDivs
+	contentSkipStyles
+)
+
+// contentItem contains information about the manifest item for a content
+// document for matching content selectors.
+type contentItem struct {
+	Name       string // the full path
+	ID         string
+	Properties string
+	Spine      bool // whether it's in the spine
+	SpineIndex int  // the position in the spine, if Spine is true
+	Linear     bool // whether it's a linear spine item
+}
+
+// epubContentItems gets information about the content documents in the EPUB
+// OPF package document, by the full path.
+func epubContentItems(epub fs.FS, pkg string) (map[string]contentItem, error) {
+	var opf struct {
+		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		ManifestItem []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"http://www.idpf.org/2007/opf manifest>item"`
+		SpineItemref []struct {
+			Idref  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"http://www.idpf.org/2007/opf spine>itemref"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	linear, index := map[string]bool{}, map[string]int{}
+	for i, it := range opf.SpineItemref {
+		linear[it.Idref] = it.Linear != "no"
+		if _, ok := index[it.Idref]; !ok {
+			index[it.Idref] = i
+		}
+	}
+
+	items := map[string]contentItem{}
+	for _, it := range opf.ManifestItem {
+		href := it.Href
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		l, ok := linear[it.ID]
+		fn := path.Join(path.Dir(pkg), href)
+		items[fn] = contentItem{
+			Name:       fn,
+			ID:         it.ID,
+			Properties: it.Properties,
+			Spine:      ok,
+			SpineIndex: index[it.ID],
+			Linear:     l,
+		}
+	}
+	return items, nil
+}
+
+// matchContentSelector checks whether a content document matches a selector
+// (see ConverterOptionNoSpansFor).
+func matchContentSelector(sel string, it contentItem) bool {
+	switch {
+	case strings.HasPrefix(sel, "id:"):
+		m, _ := path.Match(strings.TrimPrefix(sel, "id:"), it.ID)
+		return m
+	case strings.HasPrefix(sel, "properties:"):
+		for _, p := range strings.Fields(it.Properties) {
+			if m, _ := path.Match(strings.TrimPrefix(sel, "properties:"), p); m {
+				return true
+			}
+		}
+		return false
+	case sel == "linear:yes":
+		return it.Spine && it.Linear
+	case sel == "linear:no":
+		return it.Spine && !it.Linear
+	default:
+		p := strings.TrimPrefix(sel, "path:")
+		if m, _ := path.Match(p, it.Name); m {
+			return true
+		}
+		if m, _ := path.Match(p, path.Base(it.Name)); m && !strings.Contains(p, "/") {
+			return true
+		}
+		return false
+	}
+}
+
+// contentSkips gets the transformations to skip for each content document.
+func (c *Converter) contentSkips(items map[string]contentItem) map[string]contentSkip {
+	skips := map[string]contentSkip{}
+	for fn, it := range items {
+		var skip contentSkip
+		for _, x := range []struct {
+			Skip      contentSkip
+			Selectors []string
+		}{
+			{contentSkipSpans, c.noSpansFor},
+			{contentSkipDivs, c.noDivsFor},
+			{contentSkipStyles, c.noStylesFor},
+		} {
+			for _, sel := range x.Selectors {
+				if matchContentSelector(sel, it) {
+					skip |= x.Skip
+					break
+				}
+			}
+		}
+		if skip != 0 {
+			skips[fn] = skip
+		}
+	}
+	return skips
+}
@@ -0,0 +1,475 @@
+package kepub
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// SpanOptions configures AddSpans.
+type SpanOptions struct {
+	// Para and Seg are the paragraph and segment numbers of the last span added
+	// by a previous call, for continuing the numbering across documents. If
+	// both are zero, numbering starts like it does for a content document in
+	// a KEPUB (i.e., kobo.1.1 for the first paragraph).
+	Para, Seg int
+
+	// RTL splits sentences using the rules for right-to-left text, which
+	// handle Arabic punctuation and bidirectional control characters.
+	RTL bool
+
+	// Respan removes existing Kobo spans before adding them. Otherwise,
+	// documents which already have spans are left as-is.
+	Respan bool
+}
+
+// SpanResult contains information about the spans added by AddSpans.
+type SpanResult struct {
+	// Para and Seg are the paragraph and segment numbers of the last span
+	// added, which can be used for SpanOptions to continue the numbering in
+	// another document.
+	Para, Seg int
+
+	// Text is the text of each added span by id. Spans around images are
+	// empty, and spans around ruby annotations only contain the base text.
+	Text map[string]string
+}
+
+// AddSpans adds Kobo spans to the body of doc (or doc itself if it isn't a
+// document with a body) like Convert and TransformContent, but without any of
+// the other transformations. Note that doc must be from kepubify's fork of
+// golang.org/x/net/html (github.com/pgaskin/kepubify/_/html).
+func AddSpans(doc *html.Node, opts SpanOptions) SpanResult {
+	if opts.Respan {
+		removeKoboSpans(doc)
+	}
+	split := splitSentences
+	if opts.RTL {
+		split = splitSentencesBidi
+	}
+	r := SpanResult{Text: map[string]string{}}
+	r.Para, r.Seg = transformContentKoboSpansSplit(doc, split, opts.Para, opts.Seg, r.Text)
+	return r
+}
+
+// AddSpansHTML is like AddSpans, but parses a HTML document from r, and writes
+// it to w.
+func AddSpansHTML(w io.Writer, r io.Reader, opts SpanOptions) (SpanResult, error) {
+	doc, err := html.ParseWithOptions(r,
+		html.ParseOptionEnableScripting(true),
+		html.ParseOptionIgnoreBOM(true),
+		html.ParseOptionLenientSelfClosing(true))
+	if err != nil {
+		return SpanResult{}, fmt.Errorf("parse html: %w", err)
+	}
+
+	res := AddSpans(doc, opts)
+
+	if err := html.RenderWithOptions(w, doc,
+		html.RenderOptionAllowXMLDeclarations(true),
+		html.RenderOptionPolyglot(true)); err != nil {
+		return SpanResult{}, fmt.Errorf("render html: %w", err)
+	}
+	return res, nil
+}
+
+// spanText gets the text of a node without ruby annotations.
+func spanText(n *html.Node) string {
+	var b strings.Builder
+
+	var stack []*html.Node
+	var cur *html.Node
+
+	for c := n.LastChild; c != nil; c = c.PrevSibling {
+		stack = append(stack, c)
+	}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		switch {
+		case cur.Type == html.TextNode:
+			b.WriteString(cur.Data)
+		case cur.Type == html.ElementNode && cur.DataAtom != atom.Rt && cur.DataAtom != atom.Rp && cur.DataAtom != atom.Rtc:
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// SpanDocument contains the Kobo spans in a content document.
+type SpanDocument struct {
+	File       string          `json:"file"` // the path of the content document
+	Paragraphs []SpanParagraph `json:"paragraphs"`
+}
+
+// SpanParagraph contains consecutive Kobo spans with the same paragraph
+// number.
+type SpanParagraph struct {
+	Para  int    `json:"para"`
+	Spans []Span `json:"spans"`
+}
+
+// Span is a Kobo span.
+type Span struct {
+	ID     string `json:"id"`
+	Seg    int    `json:"seg"`
+	Text   string `json:"text"`   // without ruby annotations
+	Offset int    `json:"offset"` // the offset in UTF-16 code units (like the offsets in Kobo bookmarks) from the start of the text of the first span in the document
+}
+
+// ExportSpans gets the text of the Kobo spans in each content document in a
+// KEPUB, in spine order, followed by the content documents which aren't in the
+// spine. Highlights and bookmarks on Kobo eReaders refer to a span id and an
+// offset in UTF-16 code units in the span, so this can be used to resolve them
+// back to the text.
+func ExportSpans(epub fs.FS) ([]SpanDocument, error) {
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	cd, err := epubContentDocuments(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	items, err := epubContentItems(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	for i, fn := range cd {
+		if u, err := url.PathUnescape(fn); err == nil {
+			cd[i] = u
+		}
+	}
+	sort.SliceStable(cd, func(i, j int) bool {
+		a, b := items[cd[i]], items[cd[j]]
+		if a.Spine != b.Spine {
+			return a.Spine
+		}
+		if a.Spine {
+			return a.SpineIndex < b.SpineIndex
+		}
+		return cd[i] < cd[j]
+	})
+
+	docs := make([]SpanDocument, 0, len(cd))
+	for _, fn := range cd {
+		rc, err := epub.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", fn, err)
+		}
+		doc, err := html.ParseWithOptions(rc,
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", fn, err)
+		}
+		docs = append(docs, SpanDocument{
+			File:       fn,
+			Paragraphs: exportKoboSpans(doc),
+		})
+	}
+	return docs, nil
+}
+
+// exportKoboSpans gets the text of the Kobo spans in doc, grouped by
+// paragraph.
+func exportKoboSpans(doc *html.Node) []SpanParagraph {
+	paras := []SpanParagraph{}
+	var offset int
+
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return paras
+	}
+
+	var stack []*html.Node
+	var cur *html.Node
+
+	for c := body.LastChild; c != nil; c = c.PrevSibling {
+		stack = append(stack, c)
+	}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if !isKoboSpan(cur) {
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+			continue
+		}
+
+		var id string
+		for _, a := range cur.Attr {
+			if a.Key == "id" {
+				id = a.Val
+			}
+		}
+		para, seg, _ := parseKoboSpanID(id)
+		text := spanText(cur)
+
+		if len(paras) == 0 || paras[len(paras)-1].Para != para {
+			paras = append(paras, SpanParagraph{Para: para})
+		}
+		p := &paras[len(paras)-1]
+		p.Spans = append(p.Spans, Span{
+			ID:     id,
+			Seg:    seg,
+			Text:   text,
+			Offset: offset,
+		})
+		offset += utf16Len(text)
+	}
+	return paras
+}
+
+// utf16Len returns the length of s in UTF-16 code units, which is what Kobo
+// uses for offsets in spans.
+func utf16Len(s string) int {
+	var n int
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2 // surrogate pair
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// isKoboSpan checks if n is a Kobo span.
+func isKoboSpan(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.DataAtom != atom.Span {
+		return false
+	}
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "id":
+			if strings.HasPrefix(a.Val, "kobo.") {
+				return true
+			}
+		case "class":
+			if includes(a.Val, "koboSpan") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseKoboSpanID parses the paragraph and segment numbers from a Kobo span
+// id.
+func parseKoboSpanID(id string) (para, seg int, ok bool) {
+	spl := strings.Split(strings.TrimPrefix(id, "kobo."), ".")
+	if len(spl) != 2 || !strings.HasPrefix(id, "kobo.") {
+		return 0, 0, false
+	}
+	var err error
+	if para, err = strconv.Atoi(spl[0]); err != nil {
+		return 0, 0, false
+	}
+	if seg, err = strconv.Atoi(spl[1]); err != nil {
+		return 0, 0, false
+	}
+	return para, seg, true
+}
+
+// removeKoboSpans unwraps all Kobo spans in the document, and merges the text
+// nodes which were split by them so the spans can be added again consistently.
+func removeKoboSpans(doc *html.Node) {
+	var spans []*html.Node
+
+	var stack []*html.Node
+	var cur *html.Node
+
+	stack = append(stack, doc)
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if isKoboSpan(cur) {
+			spans = append(spans, cur)
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+
+	parents := map[*html.Node]bool{}
+	for _, s := range spans {
+		p := s.Parent
+		for c := s.FirstChild; c != nil; c = s.FirstChild {
+			s.RemoveChild(c)
+			p.InsertBefore(c, s)
+		}
+		p.RemoveChild(s)
+		parents[p] = true
+	}
+
+	for p := range parents {
+		for c := p.FirstChild; c != nil; {
+			if n := c.NextSibling; n != nil && c.Type == html.TextNode && n.Type == html.TextNode {
+				c.Data += n.Data
+				p.RemoveChild(n)
+				continue
+			}
+			c = c.NextSibling
+		}
+	}
+}
+
+// checkKoboSpans reports text outside Kobo spans, duplicate span ids, and span
+// ids which aren't sequential in the content document fn.
+func checkKoboSpans(doc *html.Node, fn string, report func(Report)) {
+	body := findAtom(doc, atom.Body)
+	if body == nil {
+		return
+	}
+
+	var spans, missing, duplicate, nonsequential int
+	var firstDuplicate, firstNonsequential string
+	var prevPara, prevSeg int
+	var prevID string
+	seen := map[string]bool{}
+
+	var stack []*html.Node
+	var cur *html.Node
+
+	var inSpans []bool
+	var inSpan bool
+
+	for c := body.LastChild; c != nil; c = c.PrevSibling {
+		stack = append(stack, c)
+		inSpans = append(inSpans, false)
+	}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		inSpans, inSpan = inSpans[:len(inSpans)-1], inSpans[len(inSpans)-1]
+
+		switch cur.Type {
+		case html.TextNode:
+			if !inSpan && !isSpace(cur.Data) {
+				missing++
+			}
+			continue
+		case html.ElementNode:
+		default:
+			continue
+		}
+
+		switch cur.DataAtom {
+		case atom.Script, atom.Style, atom.Pre, atom.Audio, atom.Video, atom.Svg, atom.Math, atom.Rt, atom.Rp, atom.Rtc:
+			continue // these don't get spans
+		}
+		if cur.Data == "math" || cur.Data == "svg" {
+			continue
+		}
+		if isKoboSpan(cur) {
+			spans++
+
+			var id string
+			for _, a := range cur.Attr {
+				if a.Key == "id" {
+					id = a.Val
+				}
+			}
+			if seen[id] {
+				if duplicate++; duplicate == 1 {
+					firstDuplicate = id
+				}
+			}
+			seen[id] = true
+
+			para, seg, ok := parseKoboSpanID(id)
+			if !ok || !(para == prevPara && seg == prevSeg+1) && !(para == prevPara+1 && seg == 1) {
+				if nonsequential++; nonsequential == 1 {
+					if prevID == "" {
+						firstNonsequential = fmt.Sprintf("%s at the start", id)
+					} else {
+						firstNonsequential = fmt.Sprintf("%s after %s", id, prevID)
+					}
+				}
+			}
+			if ok {
+				prevPara, prevSeg = para, seg
+			}
+			prevID = id
+
+			inSpan = true
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+			inSpans = append(inSpans, inSpan)
+		}
+	}
+
+	if missing != 0 {
+		if spans == 0 {
+			report(Report{Kind: ReportSpans, File: fn, Value: "missing", Message: "no kobo spans"})
+		} else {
+			report(Report{Kind: ReportSpans, File: fn, Value: "missing", Message: fmt.Sprintf("%d text nodes outside kobo spans", missing)})
+		}
+	}
+	if duplicate != 0 {
+		report(Report{Kind: ReportSpans, File: fn, Value: "duplicate", Message: fmt.Sprintf("%d duplicate ids, first %s", duplicate, firstDuplicate)})
+	}
+	if nonsequential != 0 {
+		report(Report{Kind: ReportSpans, File: fn, Value: "non-sequential", Message: fmt.Sprintf("%d non-sequential ids, first %s", nonsequential, firstNonsequential)})
+	}
+}
+
+// CheckSpans checks the Kobo spans in the content documents in the spine of a
+// KEPUB, and returns a ReportSpans for each document with text outside spans
+// (the value is missing), duplicate span ids (duplicate), or span ids which
+// aren't numbered sequentially (non-sequential). Documents with any of these
+// problems can be fixed with ConverterOptionRespan.
+func CheckSpans(epub fs.FS) ([]Report, error) {
+	opf, err := epubPackage(epub)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	items, err := epubContentItems(epub, opf)
+	if err != nil {
+		return nil, fmt.Errorf("read EPUB: %w", err)
+	}
+
+	var cd []string
+	for fn, it := range items {
+		if it.Spine && it.ID != dummyTitlepageID { // the dummy titlepage intentionally doesn't have spans
+			cd = append(cd, fn)
+		}
+	}
+	sort.Strings(cd)
+
+	var reports []Report
+	report := func(r Report) {
+		reports = append(reports, r)
+	}
+
+	for _, fn := range cd {
+		rc, err := epub.Open(fn)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", fn, err)
+		}
+		doc, err := html.ParseWithOptions(rc,
+			html.ParseOptionEnableScripting(true),
+			html.ParseOptionIgnoreBOM(true),
+			html.ParseOptionLenientSelfClosing(true))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", fn, err)
+		}
+		checkKoboSpans(doc, fn, report)
+	}
+	return reports, nil
+}
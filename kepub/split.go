@@ -0,0 +1,390 @@
+package kepub
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/beevik/etree"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+)
+
+// contentSplits contains the content documents which were split into multiple
+// parts, and where the elements in them ended up.
+type contentSplits struct {
+	Docs     map[string][]contentSplitPart // by the original filename
+	Original map[string]string             // the original filename for each part
+	Location map[string]string             // the part filename for each "original#id"
+}
+
+// contentSplitPart is part of a split content document. The first part keeps
+// the original filename.
+type contentSplitPart struct {
+	Name string
+	Doc  *html.Node
+}
+
+func newContentSplits() *contentSplits {
+	return &contentSplits{
+		Docs:     map[string][]contentSplitPart{},
+		Original: map[string]string{},
+		Location: map[string]string{},
+	}
+}
+
+// add adds the parts of a split content document.
+func (s *contentSplits) add(fn string, parts []contentSplitPart) {
+	s.Docs[fn] = parts
+	for _, p := range parts {
+		s.Original[p.Name] = fn
+
+		var cur *html.Node
+		stack := []*html.Node{p.Doc}
+		for len(stack) != 0 {
+			stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+			if cur.Type == html.ElementNode {
+				for _, a := range cur.Attr {
+					if a.Key == "id" || (a.Key == "name" && cur.DataAtom == atom.A) {
+						if _, ok := s.Location[fn+"#"+a.Val]; !ok {
+							s.Location[fn+"#"+a.Val] = p.Name
+						}
+					}
+				}
+			}
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+// resolve updates href (relative to the file base) if it points to an element
+// which was moved to another part of a split content document.
+func (s *contentSplits) resolve(base, href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.Fragment == "" {
+		return href, false
+	}
+
+	target := base
+	if u.Path != "" {
+		target = path.Join(path.Dir(base), u.Path)
+	}
+
+	orig := target
+	if o, ok := s.Original[target]; ok {
+		orig = o
+	}
+
+	loc, ok := s.Location[orig+"#"+u.Fragment]
+	if !ok || loc == target {
+		return href, false
+	}
+
+	if loc == base {
+		return (&url.URL{Fragment: u.Fragment}).String(), true
+	}
+	return (&url.URL{Path: relPath(path.Dir(base), loc), Fragment: u.Fragment}).String(), true
+}
+
+// splitContentDocument splits the body of a content document into parts with
+// an approximate rendered size of at most max bytes. Where possible, it is split
+// at chapter headings, and otherwise, at block boundaries. Elements are never
+// split, but wrapper elements containing the entire body are descended into.
+// The name of each part is determined by name (which is called with the part
+// number, starting at 1). If the document can't or doesn't need to be split,
+// nil is returned. The original document is modified to become the first part.
+func splitContentDocument(doc *html.Node, max int, name func(int) string) []contentSplitPart {
+	container := findAtom(doc, atom.Body)
+	if container == nil {
+		return nil
+	}
+
+	// find the element directly containing the content
+	for {
+		var only *html.Node
+		for c := container.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode && isSpace(c.Data) || c.Type == html.CommentNode {
+				continue
+			}
+			if only != nil || c.Type != html.ElementNode {
+				only = nil
+				break
+			}
+			only = c
+		}
+		if only == nil {
+			break
+		}
+		switch only.DataAtom {
+		case atom.Div, atom.Section, atom.Article, atom.Main:
+			container = only
+			continue
+		}
+		break
+	}
+
+	// group the content
+	var (
+		groups  [][]*html.Node
+		cur     []*html.Node
+		curSize int
+		heading int // index in cur of the last chapter heading (or 0 if none)
+		preSize int // size of cur before the last chapter heading
+	)
+	for c := container.FirstChild; c != nil; c = c.NextSibling {
+		var sz countWriter
+		if err := html.Render(&sz, c); err != nil {
+			panic(err) // the writer never returns an error
+		}
+
+		if splitBlock(c) {
+			if len(cur) != 0 && curSize+int(sz) > max {
+				if heading != 0 && preSize >= max/4 {
+					groups = append(groups, cur[:heading])
+					cur, curSize = append([]*html.Node(nil), cur[heading:]...), curSize-preSize
+				}
+				if curSize+int(sz) > max && !splitEmpty(cur) {
+					groups = append(groups, cur)
+					cur, curSize = nil, 0
+				}
+				heading = 0
+			}
+			if len(cur) != 0 && splitChapterHeading(c) {
+				heading, preSize = len(cur), curSize
+			}
+		}
+
+		cur = append(cur, c)
+		curSize += int(sz)
+	}
+	if len(cur) != 0 {
+		if len(groups) != 0 && splitEmpty(cur) {
+			groups[len(groups)-1] = append(groups[len(groups)-1], cur...)
+		} else {
+			groups = append(groups, cur)
+		}
+	}
+	if len(groups) < 2 {
+		return nil
+	}
+
+	// detach all groups other than the first one, then make copies of the
+	// document for the parts
+	for _, g := range groups[1:] {
+		for _, c := range g {
+			container.RemoveChild(c)
+		}
+	}
+
+	parts := make([]contentSplitPart, len(groups))
+	parts[0] = contentSplitPart{Name: name(1), Doc: doc}
+	for i, g := range groups[1:] {
+		pdoc, pcontainer := cloneNode(doc, container, func(n *html.Node) bool {
+			return n != container // skip the content of the first part
+		})
+		for _, c := range g {
+			pcontainer.AppendChild(c)
+		}
+		parts[i+1] = contentSplitPart{Name: name(i + 2), Doc: pdoc}
+	}
+	return parts
+}
+
+// splitBlock checks if a content document can be split before n.
+func splitBlock(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Aside, atom.Main,
+		atom.Header, atom.Footer, atom.Nav, atom.Blockquote, atom.Pre,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Hgroup,
+		atom.Ul, atom.Ol, atom.Dl, atom.Table, atom.Figure, atom.Hr, atom.Address:
+		return true
+	}
+	return false
+}
+
+// splitChapterHeading checks if n is the start of a chapter (i.e., a h1-h3
+// heading, or a block starting with one, or something marked as a chapter).
+func splitChapterHeading(n *html.Node) bool {
+	for n != nil && n.Type == html.ElementNode {
+		switch n.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.Hgroup:
+			return true
+		case atom.Div, atom.Section, atom.Article, atom.Header:
+			for _, a := range n.Attr {
+				if a.Key == "epub:type" || (a.Key == "type" && a.Namespace == "epub") {
+					if includes(a.Val, "chapter") || includes(a.Val, "part") {
+						return true
+					}
+				}
+			}
+			var first *html.Node
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.ElementNode {
+					first = c
+					break
+				}
+				if c.Type == html.TextNode && !isSpace(c.Data) {
+					break
+				}
+			}
+			n = first
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// splitEmpty checks if nodes don't contain any elements or non-whitespace
+// text.
+func splitEmpty(nodes []*html.Node) bool {
+	for _, c := range nodes {
+		if c.Type == html.ElementNode || (c.Type == html.TextNode && !isSpace(c.Data)) {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneNode deep-copies n, only descending into the nodes where descend
+// returns true. The copy of find (if it is a descendant of n) is also returned.
+func cloneNode(n, find *html.Node, descend func(*html.Node) bool) (*html.Node, *html.Node) {
+	m := &html.Node{
+		Type:      n.Type,
+		DataAtom:  n.DataAtom,
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      append([]html.Attribute(nil), n.Attr...),
+	}
+	var found *html.Node
+	if n == find {
+		found = m
+	}
+	if descend(n) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			cc, f := cloneNode(c, find, descend)
+			m.AppendChild(cc)
+			if f != nil {
+				found = f
+			}
+		}
+	}
+	return m, found
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
+
+// relPath returns target (a slash-separated path) relative to the directory
+// dir.
+func relPath(dir, target string) string {
+	ds, ts := strings.Split(path.Clean(dir), "/"), strings.Split(path.Clean(target), "/")
+	if ds[0] == "." {
+		ds = nil
+	}
+	var i int
+	for i < len(ds) && i < len(ts)-1 && ds[i] == ts[i] {
+		i++
+	}
+	var r []string
+	for range ds[i:] {
+		r = append(r, "..")
+	}
+	return strings.Join(append(r, ts[i:]...), "/")
+}
+
+// transformContentSplitLinks updates links in the content document fn pointing
+// to elements which were moved to another part of a split content document.
+func transformContentSplitLinks(doc *html.Node, fn string, splits *contentSplits) {
+	var cur *html.Node
+	stack := []*html.Node{doc}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur.Type == html.ElementNode {
+			for i, a := range cur.Attr {
+				if a.Key == "href" && (a.Namespace == "" || a.Namespace == "xlink") {
+					if href, ok := splits.resolve(fn, a.Val); ok {
+						cur.Attr[i].Val = href
+					}
+				}
+			}
+		}
+		for c := cur.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, c)
+		}
+	}
+}
+
+// transformOPFSplit adds the parts of split content documents to the manifest
+// and spine after the original document, and updates the guide references.
+func transformOPFSplit(doc *etree.Document, opf string, splits *contentSplits) {
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		ids[el.SelectAttrValue("id", "")] = true
+	}
+
+	newIDs := map[string][]string{} // by the original id
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		id := el.SelectAttrValue("id", "")
+		parts, ok := splits.Docs[path.Join(path.Dir(opf), el.SelectAttrValue("href", ""))]
+		if !ok || id == "" {
+			continue
+		}
+		for i, p := range parts[1:] {
+			nid := fmt.Sprintf("%s-split%d", id, i+2)
+			for n := 1; ids[nid]; n++ {
+				nid = fmt.Sprintf("%s-split%d-%d", id, i+2, n)
+			}
+			ids[nid] = true
+			newIDs[id] = append(newIDs[id], nid)
+
+			it := etree.NewElement("item")
+			it.Space = el.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+			it.CreateAttr("id", nid)
+			it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), p.Name)}).String())
+			it.CreateAttr("media-type", el.SelectAttrValue("media-type", "application/xhtml+xml"))
+			if v := strings.Fields(el.SelectAttrValue("properties", "")); len(v) != 0 {
+				var props []string
+				for _, x := range v {
+					if x != "nav" && x != "cover-image" {
+						props = append(props, x)
+					}
+				}
+				if len(props) != 0 {
+					it.CreateAttr("properties", strings.Join(props, " "))
+				}
+			}
+			el.Parent().InsertChildAt(el.Index()+1+i, it)
+		}
+	}
+
+	for _, el := range doc.FindElements("/package/spine/itemref") {
+		for i, nid := range newIDs[el.SelectAttrValue("idref", "")] {
+			it := etree.NewElement("itemref")
+			it.Space = el.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+			it.CreateAttr("idref", nid)
+			if v := el.SelectAttrValue("linear", ""); v != "" {
+				it.CreateAttr("linear", v)
+			}
+			el.Parent().InsertChildAt(el.Index()+1+i, it)
+		}
+	}
+
+	for _, el := range doc.FindElements("/package/guide/reference[@href]") {
+		if href, ok := splits.resolve(opf, el.SelectAttrValue("href", "")); ok {
+			el.CreateAttr("href", href)
+		}
+	}
+}
@@ -10,11 +10,12 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/beevik/etree"
-	"github.com/kr/smartypants"
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/transform"
 
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
@@ -32,7 +33,17 @@ import (
 //
 //  * [extra] remove Windows metadata
 //
+//  * [extra] remove files matching the patterns from ConverterOptionExcludeFiles
+//
 func (c *Converter) TransformFileFilter(fn string) bool {
+	for _, p := range c.excludeFiles {
+		if m, _ := path.Match(p, fn); m {
+			return true
+		}
+		if m, _ := path.Match(p, path.Base(fn)); m && !strings.Contains(p, "/") {
+			return true
+		}
+	}
 	switch path.Base(fn) {
 	case "calibre_bookmarks.txt": // Calibre
 		return true
@@ -57,19 +68,51 @@ func (c *Converter) TransformFileFilter(fn string) bool {
 //    cover (`manifest>item[properties="cover-image"]`), but most older EPUBs
 //    will reference the manifest item with a meta element like
 //    `meta[name="cover"][content="{manifest-item-id}"]`. or just set the
-//    manifest item ID to `cover` instead of using `properties`.
+//    manifest item ID to `cover` instead of using `properties`. If neither is
+//    present, the guide, the only image on a cover page, and common cover
+//    filenames are also checked. The property is only added to image manifest
+//    items.
 //
 //  * [extra] remove unnecessary Calibre metadata.
 //    Removes extraneous metadata elements commonly added by Calibre.
 //
 func (c *Converter) TransformOPF(w io.Writer, r io.Reader) error {
+	return c.transformOPF(w, r, "", nil)
+}
+
+// transformOPF is TransformOPF, but changes to other files (if st is not nil)
+// are applied to the OPF package document fn.
+func (c *Converter) transformOPF(w io.Writer, r io.Reader, fn string, st *convertState) error {
 	doc := etree.NewDocument()
 	if _, err := doc.ReadFrom(r); err != nil {
 		return fmt.Errorf("parse: %w", err)
 	}
 
-	transformOPFCoverImage(doc) // mandatory
+	if st != nil && st.Cover != "" {
+		transformOPFCover(doc, fn, st.Cover) // mandatory
+	} else {
+		transformOPFCoverImage(doc) // mandatory
+	}
 	transformOPFCalibreMeta(doc)
+	if st != nil && st.Splits != nil {
+		transformOPFSplit(doc, fn, st.Splits)
+	}
+	if st != nil && len(st.Removed) != 0 {
+		transformOPFRemove(doc, fn, st.Removed)
+	}
+	if st != nil && len(st.Renamed) != 0 {
+		transformOPFRename(doc, fn, st.Renamed)
+	}
+	if st != nil && st.Nav != "" {
+		modified := c.modified
+		if modified.IsZero() {
+			modified = time.Now()
+		}
+		transformOPFUpgrade(doc, fn, st.Nav, modified)
+	}
+	if st != nil && st.GeneratedCover != "" {
+		transformOPFAddCover(doc, fn, st.GeneratedCover)
+	}
 	doc.Indent(4)
 
 	if _, err := doc.WriteTo(w); err != nil {
@@ -79,15 +122,23 @@ func (c *Converter) TransformOPF(w io.Writer, r io.Reader) error {
 	return nil
 }
 
-func transformOPFCoverImage(doc *etree.Document) {
-	// property based on Kobo (checked with 3 books) as of 2020-01-12
-	coverID := "cover"
-	if el := doc.FindElement("//meta[@name='cover']"); el != nil {
-		coverID = el.SelectAttrValue("content", coverID)
+// transformNCX applies changes to other files (i.e., link fixes and split
+// content documents) to the EPUB2 NCX fn.
+func transformNCX(w io.Writer, r io.Reader, fn string, st *convertState) error {
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(r); err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	for _, el := range doc.FindElements("//content[@src]") {
+		el.CreateAttr("src", st.ncxSrc(fn, el.SelectAttrValue("src", ""), st.Report))
 	}
-	if el := doc.FindElement("//[@id='" + coverID + "']"); el != nil {
-		el.CreateAttr("properties", "cover-image")
+
+	if _, err := doc.WriteTo(w); err != nil {
+		return fmt.Errorf("render: %w", err)
 	}
+
+	return nil
 }
 
 func transformOPFCalibreMeta(doc *etree.Document) {
@@ -132,7 +183,8 @@ func transformOPFCalibreMeta(doc *etree.Document) {
 //    For customization or to fix common issues.
 //
 //  * [optional] smarten punctuation
-//    A common tweak to improve badly-formatted books.
+//    A common tweak to improve badly-formatted books. The quotation marks and
+//    spacing can be localized for the language of the book.
 //
 //  * [extra] content cleanup
 //    Removes Adept tags, extraneous MS Office tags, Unicode replacement chars,
@@ -155,22 +207,62 @@ func transformOPFCalibreMeta(doc *etree.Document) {
 //    To allow users to apply quick one-off fixes to the generated HTML.
 //
 //  * [important] ensure charset is UTF-8
-//    EPUBs (and KEPUBs by extension) must be UTF-8/UTF-16.
+//    EPUBs (and KEPUBs by extension) must be UTF-8/UTF-16. If enabled, the
+//    charset is detected for each document individually, and reported.
 //
 func (c *Converter) TransformContent(w io.Writer, r io.Reader) error {
+	return c.transformContent(w, r, "", nil)
+}
+
+// transformContent is TransformContent, but reports are sent to report (if not
+// nil) for the file fn.
+func (c *Converter) transformContent(w io.Writer, r io.Reader, fn string, report func(Report)) error {
+	doc, err := c.parseContent(r, fn, report)
+	if err != nil {
+		return err
+	}
+	return c.transformContentDoc(w, doc, fn, nil)
+}
+
+// parseContent parses a content document, decoding it to UTF-8 according to
+// the charset options.
+func (c *Converter) parseContent(r io.Reader, fn string, report func(Report)) (*html.Node, error) {
 	switch strings.ToLower(c.charset) {
 	case "utf-8", "":
 		// do nothing
 	case "auto":
-		cr, err := charset.NewReader(r, "")
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("parse html: detect charset: %w", err)
+		}
+		e, name, _ := charset.DetermineEncoding(buf, "")
+		if report != nil {
+			report(Report{Kind: ReportCharset, File: fn, Value: name, Message: "auto"})
+		}
+		r = bytes.NewReader(buf)
+		if e != encoding.Nop {
+			r = e.NewDecoder().Reader(r)
+		}
+	case "detect":
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("parse html: detect charset: %w", err)
+		}
+		e, name, msg, err := detectCharset(buf, c.charsetFallback)
 		if err != nil {
-			return fmt.Errorf("parse html: detect charset: %w", err)
+			return nil, fmt.Errorf("parse html: detect charset: %w", err)
+		}
+		if report != nil {
+			report(Report{Kind: ReportCharset, File: fn, Value: name, Message: msg})
+		}
+		r = bytes.NewReader(buf)
+		if e != nil {
+			r = e.NewDecoder().Reader(r)
 		}
-		r = cr
 	default:
 		enc, _ := charset.Lookup(c.charset)
 		if enc == nil {
-			return fmt.Errorf("parset html: invalid charset %q", c.charset)
+			return nil, fmt.Errorf("parset html: invalid charset %q", c.charset)
 		}
 		r = enc.NewDecoder().Reader(r)
 	}
@@ -180,21 +272,77 @@ func (c *Converter) TransformContent(w io.Writer, r io.Reader) error {
 		html.ParseOptionIgnoreBOM(true),
 		html.ParseOptionLenientSelfClosing(true))
 	if err != nil {
-		return fmt.Errorf("parse html: %w", err)
+		return nil, fmt.Errorf("parse html: %w", err)
 	}
 
 	transformContentCharsetUTF8(doc) // charset.NewReader always outputs UTF-8
 
-	transformContentKoboStyles(doc) // mandatory
-	transformContentKoboDivs(doc)   // mandatory
-	transformContentKoboSpans(doc)  // mandatory
+	return doc, nil
+}
+
+// transformContentDoc transforms and renders a parsed content document. If st
+// is not nil, changes to other files are applied to the links in it.
+func (c *Converter) transformContentDoc(w io.Writer, doc *html.Node, fn string, st *convertState) error {
+	var skip contentSkip
+	if st != nil {
+		orig := fn
+		if st.Splits != nil {
+			if o, ok := st.Splits.Original[fn]; ok {
+				orig = o
+			}
+		}
+		skip = st.Skip[orig]
+		if st.Links != nil {
+			transformContentLinks(doc, orig, st.Links, st.FixLinks, st.Report)
+		}
+		if st.Splits != nil {
+			transformContentSplitLinks(doc, fn, st.Splits)
+		}
+		if len(st.Renamed) != 0 {
+			transformContentRename(doc, fn, st.Renamed)
+		}
+	}
+
+	rtl, vertical := contentDirection(doc, fn, st)
+
+	if skip&contentSkipStyles == 0 {
+		if vertical {
+			transformContentKoboStylesVertical(doc) // mandatory
+		} else {
+			transformContentKoboStyles(doc) // mandatory
+		}
+	}
+	if skip&contentSkipDivs == 0 {
+		transformContentKoboDivs(doc) // mandatory
+		if rtl {
+			transformContentKoboDivsRTL(doc)
+		}
+	}
+	if skip&contentSkipSpans == 0 {
+		if c.respan {
+			removeKoboSpans(doc)
+		}
+		if rtl {
+			transformContentKoboSpansRTL(doc) // mandatory
+		} else {
+			transformContentKoboSpans(doc) // mandatory
+		}
+	}
 
 	for i := range c.extraCSS {
 		transformContentAddStyle(doc, c.extraCSSClass[i], c.extraCSS[i])
 	}
 
 	if c.smartypants {
-		transformContentPunctuation(doc)
+		cfg := smartypantsConfig{
+			Locale:   c.smartypantsLocale,
+			Dashes:   c.smartypantsDashes,
+			Ellipsis: c.smartypantsEllipsis,
+		}
+		if st != nil {
+			cfg.Language = st.Language
+		}
+		transformContentPunctuation(doc, cfg)
 	}
 
 	transformContentClean(doc)
@@ -205,10 +353,9 @@ func (c *Converter) TransformContent(w io.Writer, r io.Reader) error {
 		defer wc.Close()
 	}
 
-	err = html.RenderWithOptions(w, doc,
+	if err := html.RenderWithOptions(w, doc,
 		html.RenderOptionAllowXMLDeclarations(true),
-		html.RenderOptionPolyglot(true))
-	if err != nil {
+		html.RenderOptionPolyglot(true)); err != nil {
 		return fmt.Errorf("render html: %w", err)
 	}
 
@@ -264,6 +411,12 @@ func transformContentKoboStyles(doc *html.Node) {
 	transformContentAddStyle(doc, "kobostylehacks", `div#book-inner { margin-top: 0; margin-bottom: 0;}`)
 }
 
+// transformContentKoboStylesVertical is like transformContentKoboStyles, but
+// for vertical writing modes, where the block direction is horizontal.
+func transformContentKoboStylesVertical(doc *html.Node) {
+	transformContentAddStyle(doc, "kobostylehacks", `div#book-inner { margin-left: 0; margin-right: 0;}`)
+}
+
 func transformContentKoboDivs(doc *html.Node) {
 	// behavior matches Kobo (checked with 3 books) as of 2020-01-12
 	// wrap body contents with div#book-columns > div#book-inner
@@ -297,18 +450,67 @@ func transformContentKoboDivs(doc *html.Node) {
 	}
 }
 
+// transformContentKoboDivsRTL sets the direction of the Kobo divs for
+// right-to-left text, since the direction may have come from the package
+// rather than the content document itself.
+func transformContentKoboDivsRTL(doc *html.Node) {
+	var cur *html.Node
+	stack := []*html.Node{findAtom(doc, atom.Body)}
+	for len(stack) != 0 {
+		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur == nil || cur.Type != html.ElementNode {
+			continue
+		}
+		if matchAttr(cur, "id", "book-columns") || matchAttr(cur, "id", "book-inner") {
+			var has bool
+			for _, a := range cur.Attr {
+				if a.Key == "dir" {
+					has = true
+				}
+			}
+			if !has {
+				cur.Attr = append(cur.Attr, html.Attribute{Key: "dir", Val: "rtl"})
+			}
+		}
+		if cur.DataAtom == atom.Body || matchAttr(cur, "id", "book-columns") {
+			for c := cur.FirstChild; c != nil; c = c.NextSibling {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
 func transformContentKoboSpans(doc *html.Node) {
+	transformContentKoboSpansSplit(doc, splitSentences, 0, 0, nil)
+}
+
+// transformContentKoboSpansRTL is like transformContentKoboSpans, but uses
+// splitSentencesBidi for right-to-left text.
+func transformContentKoboSpansRTL(doc *html.Node) {
+	transformContentKoboSpansSplit(doc, splitSentencesBidi, 0, 0, nil)
+}
+
+// transformContentKoboSpansSplit adds Kobo spans to the body of doc (or doc
+// itself if it doesn't have one), splitting text with split, and continuing
+// from the paragraph and segment numbers para and seg. If text is not nil, the
+// text of each span is added to it. The final paragraph and segment numbers
+// are returned.
+func transformContentKoboSpansSplit(doc *html.Node, split func(string, []string) []string, para, seg int, text map[string]string) (int, int) {
+	root := findAtom(doc, atom.Body)
+	if root == nil {
+		root = doc
+	}
+
 	// behavior matches Kobo (checked with 3 books) as of 2020-01-12
-	if findClass(findAtom(doc, atom.Body), "koboSpan") != nil {
-		return // already has kobo spans
+	if findClass(root, "koboSpan") != nil {
+		return para, seg // already has kobo spans
 	}
 
-	var para, seg int
 	var incParaNext bool
 
 	var stack []*html.Node
 	var cur *html.Node
-	stack = append(stack, findAtom(doc, atom.Body))
+	stack = append(stack, root)
 
 	sentences := make([]string, 0, 8)
 
@@ -316,7 +518,7 @@ func transformContentKoboSpans(doc *html.Node) {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
 		switch cur.Type {
 		case html.TextNode:
-			sentences = splitSentences(cur.Data, sentences[:0])
+			sentences = split(cur.Data, sentences[:0])
 
 			// wrap each sentence in a span (don't wrap whitespace unless it is
 			// directly under a P tag [TODO: are there any other cases we wrap
@@ -337,6 +539,9 @@ func transformContentKoboSpans(doc *html.Node) {
 
 					seg++
 					cur.Parent.InsertBefore(withText(koboSpan(para, seg), sentence), cur)
+					if text != nil {
+						text[koboSpanID(para, seg)] = sentence
+					}
 				}
 			}
 
@@ -364,10 +569,34 @@ func transformContentKoboSpans(doc *html.Node) {
 				})
 				cur.Parent.InsertBefore(s, cur)
 				cur.Parent.RemoveChild(cur)
+				if text != nil {
+					text[koboSpanID(para, seg)] = ""
+				}
 
 				fallthrough
 			case atom.Script, atom.Style, atom.Pre, atom.Audio, atom.Video, atom.Svg, atom.Math:
 				continue // don't add spans to elements which should keep text as-is
+			case atom.Ruby:
+				// add a single span around the entire ruby annotation (the base
+				// text and the rt/rp elements need to stay together for it to
+				// render correctly, and for the whole thing to be highlighted)
+				if incParaNext {
+					para++
+					seg = 0
+					incParaNext = false
+				}
+
+				seg++
+				s := koboSpan(para, seg)
+				cur.Parent.InsertBefore(s, cur)
+				cur.Parent.RemoveChild(cur)
+				s.AppendChild(cur)
+				if text != nil {
+					text[koboSpanID(para, seg)] = spanText(cur)
+				}
+				continue
+			case atom.Rt, atom.Rp, atom.Rtc:
+				continue // don't add spans to stray ruby text outside a ruby element
 			case atom.P, atom.Ol, atom.Ul, atom.Table, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
 				incParaNext = true // increment it only if it will have spans in it
 				fallthrough
@@ -383,6 +612,7 @@ func transformContentKoboSpans(doc *html.Node) {
 			}
 		}
 	}
+	return para, seg
 }
 
 // splitSentences splits the string into sentences using the rules for creating
@@ -396,6 +626,19 @@ func transformContentKoboSpans(doc *html.Node) {
 // the sentences slice. It should have the same output. For the original
 // implementation, see splitSentencesRegexp in the tests.
 func splitSentences(str string, sentences []string) []string {
+	return splitSentencesMode(str, sentences, false)
+}
+
+// splitSentencesBidi is like splitSentences, but for right-to-left text. In
+// addition to the usual rules, the Arabic question mark and full stop end
+// sentences, directional marks and terminators are kept with the text before
+// them, and sentences are never split inside a directional embedding, override, or
+// isolate (since each one needs to be terminated in the same span).
+func splitSentencesBidi(str string, sentences []string) []string {
+	return splitSentencesMode(str, sentences, true)
+}
+
+func splitSentencesMode(str string, sentences []string, bidi bool) []string {
 	const (
 		InputPunct   = iota // sentence-terminating punctuation
 		InputExtra          // additional punctuation (one is optionionally consumed after punct if present)
@@ -420,6 +663,7 @@ func splitSentences(str string, sentences []string) []string {
 		sentences = make([]string, 0, 4) // pre-allocate some room
 	}
 
+	var depth int // for bidi
 	for i, state := 0, 0; state != -1; {
 		x, z := utf8.DecodeRuneInString(str[i:])
 
@@ -441,6 +685,20 @@ func splitSentences(str string, sentences []string) []string {
 		default:
 			input = InputAny
 		}
+		if bidi {
+			switch x {
+			case '؟', '۔': // arabic question mark, arabic full stop
+				input = InputPunct
+			case '\u200E', '\u200F', '\u061C', '\u202C', '\u2069': // lrm, rlm, alm, pdf, pdi
+				// directional marks and terminators are kept with the text
+				// before them without affecting the state
+				if (x == '\u202C' || x == '\u2069') && depth > 0 {
+					depth--
+				}
+				i += z
+				continue
+			}
+		}
 
 		var output int
 		switch state {
@@ -516,6 +774,16 @@ func splitSentences(str string, sentences []string) []string {
 			panic("unhandled state")
 		}
 
+		if bidi {
+			if output == OutputNext && depth > 0 {
+				output = OutputNone // don't split inside an embedding or isolate
+			}
+			switch x {
+			case '\u202A', '\u202B', '\u202D', '\u202E', '\u2066', '\u2067', '\u2068': // lre, rle, lro, rlo, lri, rli, fsi
+				depth++
+			}
+		}
+
 		switch output {
 		case OutputNone:
 			i += z
@@ -544,11 +812,15 @@ func koboSpan(para, seg int) *html.Node {
 		DataAtom: atom.Span,
 		Attr: []html.Attribute{
 			{Key: "class", Val: "koboSpan"},
-			{Key: "id", Val: "kobo." + strconv.Itoa(para) + "." + strconv.Itoa(seg)},
+			{Key: "id", Val: koboSpanID(para, seg)},
 		},
 	}
 }
 
+func koboSpanID(para, seg int) string {
+	return "kobo." + strconv.Itoa(para) + "." + strconv.Itoa(seg)
+}
+
 func transformContentAddStyle(doc *html.Node, class, css string) {
 	findAtom(doc, atom.Head).AppendChild(withText(&html.Node{
 		Type:     html.ElementNode,
@@ -561,37 +833,65 @@ func transformContentAddStyle(doc *html.Node, class, css string) {
 	}, css))
 }
 
-func transformContentPunctuation(doc *html.Node) {
+func transformContentPunctuation(doc *html.Node, cfg smartypantsConfig) {
+	var lang string
+	if cfg.Locale == "auto" {
+		if lang = documentLanguage(doc); lang == "" {
+			lang = cfg.Language
+		}
+	}
+
+	// the text is converted in runs of inline text so quotes next to inline
+	// elements face the right way
+	var run []punctuationPiece
+	var nodes []*html.Node
+	flush := func() {
+		if len(nodes) != 0 {
+			for i, s := range cfg.applyRun(run, len(nodes), lang) {
+				nodes[i].Data = s
+			}
+		}
+		run, nodes = run[:0], nodes[:0]
+	}
+
 	var stack []*html.Node
 	var cur *html.Node
 	stack = append(stack, findAtom(doc, atom.Body))
 
 	for len(stack) != 0 {
 		stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+		if cur == nil {
+			flush() // end of a block
+			continue
+		}
 		switch cur.Type {
 		case html.ElementNode:
 			switch cur.DataAtom {
-			case atom.Pre, atom.Code, atom.Style, atom.Script:
+			case atom.Style, atom.Script:
+				continue
+			case atom.Pre:
+				flush()
+				continue
+			case atom.Code, atom.Kbd, atom.Samp:
+				run = append(run, punctuationPiece{Text: nodeText(cur), Node: -1, Opaque: true})
+				continue
+			case atom.Br:
+				run = append(run, punctuationPiece{Text: "\n", Node: -1, Opaque: true})
 				continue
-			default:
-				for c := cur.LastChild; c != nil; c = c.PrevSibling {
-					stack = append(stack, c)
-				}
 			}
-		case html.TextNode:
-			if !isSpace(cur.Data) {
-				buf := bytes.NewBuffer(nil)
-				if _, err := smartypants.New(buf, smartypants.LatexDashes).Write([]byte(cur.Data)); err != nil {
-					panic(err) // smartypants should never error on its own
-				}
-				// (*smartypants.writer).write calls smartypants.attrEscape on
-				// the passed data (which has been unescaped by the parser),
-				// which escapes the HTML entities, so we need to unescape it
-				// after it has been processed.
-				cur.Data = html.UnescapeString(buf.String())
+			if !punctuationInline[cur.DataAtom] {
+				flush()
+				stack = append(stack, nil)
+			}
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
 			}
+		case html.TextNode:
+			run = append(run, punctuationPiece{Text: cur.Data, Node: len(nodes), Opaque: isSpace(cur.Data)})
+			nodes = append(nodes, cur)
 		}
 	}
+	flush()
 }
 
 func transformContentClean(doc *html.Node) {
@@ -658,28 +958,108 @@ func transformContentReplacements(w io.Writer, find, replace [][]byte) io.WriteC
 // adds a blank content document and modifies the OPF to add it to the manifest
 // and start of the spine. This is required because Kobo will treat the first
 // spine entry specially (e.g. no margins) for full-screen book covers. See #33.
+// The thresholds can be changed with ConverterOptionDummyTitlepageHeuristic.
+//
+// If ConverterOptionDummyTitlepageTemplate is set, it is used for the contents
+// of the titlepage.
 //
 // Note that the heuristic is subject to change between kepubify versions.
 func (c *Converter) TransformDummyTitlepage(epub fs.FS, opfF string, opf *bytes.Buffer) (string, io.Reader, bool, error) {
+	fn, r, a, _, err := c.transformDummyTitlepage(epub, opfF, opf)
+	return fn, r, a, err
+}
+
+// transformDummyTitlepage is TransformDummyTitlepage, but also returns the
+// reason for the decision.
+func (c *Converter) transformDummyTitlepage(epub fs.FS, opfF string, opf *bytes.Buffer) (string, io.Reader, bool, string, error) {
+	var reason string
 	if c.dummyTitlepageForce {
 		if !c.dummyTitlepageForceValue {
-			return "", nil, false, nil
+			return "", nil, false, "disabled", nil
 		}
+		reason = "forced"
 	} else {
-		if req, err := transformDummyTitlepageRequired(epub, opfF, bytes.NewReader(opf.Bytes())); err != nil {
-			return "", nil, false, fmt.Errorf("check if dummy titlepage is required: %w", err)
+		h := DefaultTitlepageHeuristic()
+		if c.dummyTitlepageHeuristic != nil {
+			h = *c.dummyTitlepageHeuristic
+		}
+		if req, why, err := transformDummyTitlepageRequired(epub, opfF, bytes.NewReader(opf.Bytes()), h); err != nil {
+			return "", nil, false, "", fmt.Errorf("check if dummy titlepage is required: %w", err)
 		} else if !req {
-			return "", nil, false, nil
+			return "", nil, false, why, nil
+		} else {
+			reason = why
 		}
 	}
 	fn, r, err := transformDummyTitlepageAdd(opf, opfF)
 	if err != nil {
-		return "", nil, true, fmt.Errorf("apply title page fix: %w", err)
+		return "", nil, true, reason, fmt.Errorf("apply title page fix: %w", err)
+	}
+	if c.dummyTitlepageTemplate != nil {
+		buf, err := c.renderPage(c.dummyTitlepageTemplate, opf.Bytes(), opfF, fn)
+		if err != nil {
+			return "", nil, true, reason, fmt.Errorf("apply title page fix: render template: %w", err)
+		}
+		r = bytes.NewReader(buf)
+	}
+	return fn, r, true, reason, nil
+}
+
+// TitlepageHeuristic contains the thresholds used to determine whether the
+// first linear content document in the spine is a title page without other
+// content (see TransformDummyTitlepage). Fields which are unset (zero or nil)
+// use the value from DefaultTitlepageHeuristic, so only the thresholds being
+// changed need to be set. To use zero for a threshold, set it to a negative
+// number, and to use no name hints, set NameHints to an empty non-nil slice.
+type TitlepageHeuristic struct {
+	NameHints     []string // if the filename contains one of these (case-insensitive), it is a titlepage
+	MaxParagraphs int      // if there are more paragraphs than this, it isn't a titlepage
+	MinWordLength int      // only words longer than this are counted
+	MaxWords      int      // if there are more words than this, it isn't a titlepage
+	MinWords      int      // if there are no images and fewer words than this, it isn't a titlepage (since it's probably blank)
+	MaxImages     int      // if there are more images than this, it isn't a titlepage
+}
+
+// DefaultTitlepageHeuristic returns the default TitlepageHeuristic.
+func DefaultTitlepageHeuristic() TitlepageHeuristic {
+	return TitlepageHeuristic{
+		NameHints:     []string{"cover", "title"},
+		MaxParagraphs: 4,
+		MinWordLength: 3,
+		MaxWords:      20,
+		MinWords:      5,
+		MaxImages:     4,
 	}
-	return fn, r, true, nil
 }
 
-func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (bool, error) {
+// withDefaults returns the heuristic with the unset fields replaced by the
+// default values and negative thresholds replaced by zero.
+func (h TitlepageHeuristic) withDefaults() TitlepageHeuristic {
+	d := DefaultTitlepageHeuristic()
+	if h.NameHints == nil {
+		h.NameHints = d.NameHints
+	}
+	for _, x := range []struct{ v, d *int }{
+		{&h.MaxParagraphs, &d.MaxParagraphs},
+		{&h.MinWordLength, &d.MinWordLength},
+		{&h.MaxWords, &d.MaxWords},
+		{&h.MinWords, &d.MinWords},
+		{&h.MaxImages, &d.MaxImages},
+	} {
+		if *x.v == 0 {
+			*x.v = *x.d
+		} else if *x.v < 0 {
+			*x.v = 0
+		}
+	}
+	return h
+}
+
+// transformDummyTitlepageRequired checks whether a dummy titlepage is required
+// using the heuristic (see TitlepageHeuristic for how unset fields are
+// handled), and returns a short description of the reason.
+func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader, h TitlepageHeuristic) (bool, string, error) {
+	h = h.withDefaults()
 	var opf struct {
 		XMLName      xml.Name `xml:"http://www.idpf.org/2007/opf package"`
 		ManifestItem []struct {
@@ -694,7 +1074,7 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 	}
 
 	if err := xml.NewDecoder(opfR).Decode(&opf); err != nil {
-		return false, fmt.Errorf("parse OPF package: %w", err)
+		return false, "", fmt.Errorf("parse OPF package: %w", err)
 	}
 
 	var idref string
@@ -705,7 +1085,7 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 		}
 	}
 	if idref == "" {
-		return false, nil // there should always be at least one linear spine item, and it should always reference something, but we'll be lenient
+		return false, "no linear spine items", nil // there should always be at least one linear spine item, and it should always reference something, but we'll be lenient
 	}
 
 	var href string
@@ -721,23 +1101,26 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 				href = it.Href
 				break
 			default:
-				return false, nil // the first spine item is not a content document, so let it be
+				return false, "first spine item is not a content document", nil // the first spine item is not a content document, so let it be
 			}
 		}
 	}
 	if href == "" {
-		return false, nil // the thing it references should always exist, but we'll be lenient
+		return false, "first spine item is missing from the manifest", nil // the thing it references should always exist, but we'll be lenient
 	}
 
-	if n := strings.ToLower(path.Base(href)); strings.Contains(n, "cover") || strings.Contains(n, "title") {
-		return false, nil // this is intended to be the cover/title page (or else why would it have cover/title in the name?)
+	n := strings.ToLower(path.Base(href))
+	for _, hint := range h.NameHints {
+		if hint != "" && strings.Contains(n, strings.ToLower(hint)) {
+			return false, fmt.Sprintf("first spine item filename contains %q", hint), nil // this is intended to be the cover/title page (or else why would it have cover/title in the name?)
+		}
 	}
 
 	href = path.Join(path.Dir(opfF), href)
 
 	rc, err := epub.Open(href)
 	if err != nil {
-		return false, nil // the file it references should exist, but we'll be lenient
+		return false, "first spine item is missing", nil // the file it references should exist, but we'll be lenient
 	}
 	defer rc.Close()
 
@@ -746,7 +1129,7 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 		html.ParseOptionIgnoreBOM(true),
 		html.ParseOptionLenientSelfClosing(true))
 	if err != nil {
-		return false, nil // we'll ignore it here
+		return false, "first spine item could not be parsed", nil // we'll ignore it here
 	}
 
 	var wc, pc, ic int
@@ -760,9 +1143,6 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 			switch cur.DataAtom {
 			case atom.P:
 				pc++
-				if pc > 4 {
-					return true, nil
-				}
 			case atom.Img, atom.Svg:
 				ic++
 				fallthrough
@@ -775,25 +1155,36 @@ func transformDummyTitlepageRequired(epub fs.FS, opfF string, opfR io.Reader) (b
 			}
 		case html.TextNode:
 			for _, w := range strings.Fields(cur.Data) {
-				if len(w) > 3 {
+				if len(w) > h.MinWordLength {
 					wc++
 				}
 			}
-			if wc > 20 {
-				return true, nil
-			}
 		}
 	}
 
-	if (ic == 0 && wc < 5) || ic > 4 {
-		return true, nil
+	// note: we count everything (rather than stopping early) so the reason is
+	// more useful
+	if wc > h.MaxWords {
+		return true, fmt.Sprintf("first spine item has %d words", wc), nil
 	}
-
-	return false, nil
+	if pc > h.MaxParagraphs {
+		return true, fmt.Sprintf("first spine item has %d paragraphs", pc), nil
+	}
+	if ic == 0 && wc < h.MinWords {
+		return true, fmt.Sprintf("first spine item has no images and %d words", wc), nil
+	}
+	if ic > h.MaxImages {
+		return true, fmt.Sprintf("first spine item has %d images", ic), nil
+	}
+	return false, fmt.Sprintf("first spine item looks like a titlepage (%d images, %d words, %d paragraphs)", ic, wc, pc), nil
 }
 
+// dummyTitlepageID is the manifest id of the dummy titlepage, which is also
+// used for the filename.
+const dummyTitlepageID = "kepubify-titlepage-dummy"
+
 func transformDummyTitlepageAdd(opf *bytes.Buffer, opfF string) (string, io.Reader, error) {
-	id, mime := "kepubify-titlepage-dummy", "application/xhtml+xml"
+	id, mime := dummyTitlepageID, "application/xhtml+xml"
 	href := id + ".xhtml"
 	fn := path.Join(path.Dir(opfF), href)
 
@@ -2,18 +2,32 @@ package kepub
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
 	"io"
 	"io/fs"
+	"os"
 	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/beevik/etree"
+	"github.com/pgaskin/kepubify/v4/internal/zip"
+	"golang.org/x/image/font/basicfont"
 
 	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/atom"
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html/charset"
 )
 
 func TestTransformContent(t *testing.T) {
@@ -192,6 +206,17 @@ func TestTransformContentParts(t *testing.T) {
 			Out:      `<p><span class="koboSpan" id="kobo.1.1">Test</span></p>`,
 		}.Run(t)
 
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				removeKoboSpans(doc)
+				transformContentKoboSpans(doc)
+			},
+			What:     "respan partially and incorrectly spanned content",
+			Fragment: true,
+			In:       `<p><span class="koboSpan" id="kobo.1.1">Sentence</span><span class="koboSpan" id="kobo.1.1"> one. Sen</span>tence two.</p><p><span class="koboSpan" id="kobo.5.2"><img src="test"/></span></p><p>Three.</p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Sentence one. </span><span class="koboSpan" id="kobo.1.2">Sentence two.</span></p><p><span class="koboSpan" id="kobo.2.1"><img src="test"/></span></p><p><span class="koboSpan" id="kobo.3.1">Three.</span></p>`,
+		}.Run(t)
+
 		transformContentCase{
 			Func:     transformContentKoboSpans,
 			What:     "increment segment counter from 1 for every sentence",
@@ -288,6 +313,22 @@ func TestTransformContentParts(t *testing.T) {
 			Out:      `<svg xmlns="http://www.w3.org/2000/svg"><g><text font-size="24" y="20" x="0">kepubify</text></g></svg><math xmlns="http://www.w3.org/1998/Math/MathML"><mi>x</mi><mo>=</mo><mfrac><mrow><mo>-</mo><mi>b</mi><mo>±</mo><msqrt><msup><mi>b</mi><mn>2</mn></msup><mo>-</mo><mn>4</mn><mi>a</mi><mi>c</mi></msqrt></mrow><mrow><mn>2</mn><mi>a</mi></mrow></mfrac></math>`,
 		}.Run(t)
 
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "treat ruby annotations as a single segment and don't add spans to the ruby text",
+			Fragment: true,
+			In:       `<p>彼は<ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby>を書いた。次の文。</p><p><ruby><rb>東</rb><rt>とう</rt><rb>京</rb><rt>きょう</rt></ruby></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">彼は</span><span class="koboSpan" id="kobo.1.2"><ruby>漢字<rp>(</rp><rt>かんじ</rt><rp>)</rp></ruby></span><span class="koboSpan" id="kobo.1.3">を書いた。次の文。</span></p><p><span class="koboSpan" id="kobo.2.1"><ruby><rb>東</rb><rt>とう</rt><rb>京</rb><rt>きょう</rt></ruby></span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     transformContentKoboSpans,
+			What:     "don't add spans to stray ruby text",
+			Fragment: true,
+			In:       `<p>Text.<rt>reading</rt><rp>(</rp></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">Text.</span><rt>reading</rt><rp>(</rp></p>`,
+		}.Run(t)
+
 		// The following cases were found after using kobotest on a bunch of files (the previous cases are also based on kepubs, but I did them manually and didn't keep track):
 
 		transformContentCase{
@@ -311,7 +352,7 @@ func TestTransformContentParts(t *testing.T) {
 
 	t.Run("SmartyPants", func(t *testing.T) {
 		transformContentCase{
-			Func:     transformContentPunctuation,
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{}) },
 			What:     "smart punctuation",
 			Fragment: true,
 			In:       `<p>This is a test sentence to test smartypants' conversion of "quotation marks", dashes like - / -- / ---, and symbols like (c).</p>`,
@@ -319,7 +360,7 @@ func TestTransformContentParts(t *testing.T) {
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentPunctuation,
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{}) },
 			What:     "skip pre, code, style, and script elements",
 			Fragment: true,
 			In:       `<p>This is a test sentence to test smartypants' conversion of <code>"quotation marks"</code>, dashes like <pre>- / -- / ---</pre>, and symbols like (c).</p><style>div{font-family:"Test"}</style><script>var a="test"</script>`,
@@ -327,12 +368,110 @@ func TestTransformContentParts(t *testing.T) {
 		}.Run(t)
 
 		transformContentCase{
-			Func:     transformContentPunctuation,
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{}) },
 			What:     "properly handle entity escaping",
 			Fragment: true,
 			In:       `<p>&amp;&quot;&lt;&gt;&quot;</p><pre>&quot;</pre>`,
 			Out:      `<p>&amp;“&lt;&gt;”</p><pre>&#34;</pre>`,
 		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentPunctuation(doc, smartypantsConfig{Dashes: SmartypantsDashesOldschool})
+			},
+			What:     "oldschool dashes",
+			Fragment: true,
+			In:       `<p>dashes like - / -- / ---</p>`,
+			Out:      `<p>dashes like – / — / —-</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentPunctuation(doc, smartypantsConfig{Dashes: SmartypantsDashesNone, Ellipsis: SmartypantsEllipsisNone})
+			},
+			What:     "no dashes or ellipses",
+			Fragment: true,
+			In:       `<p>"dashes" like - / -- / --- and "ellipses"... like . . . this's</p>`,
+			Out:      `<p>“dashes” like - / -- / --- and “ellipses”... like . . . this’s</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{}) },
+			What:     "quotes next to inline elements",
+			Fragment: true,
+			In:       `<p>"<em>Hello</em>," she said. "<a href="#">Bye</a>" 'Run <code>ls</code>' and "<b>go</b>"!</p><p>"</p><p>Yes"</p>`,
+			Out:      `<p>“<em>Hello</em>,” she said. “<a href="#">Bye</a>” ‘Run <code>ls</code>’ and “<b>go</b>”!</p><p>“</p><p>Yes”</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{}) },
+			What:     "quotes split across kobo spans",
+			Fragment: true,
+			In:       `<p><span class="koboSpan" id="kobo.1.1">He said "</span><span class="koboSpan" id="kobo.1.2">Stop.</span><span class="koboSpan" id="kobo.1.3">" Then left.</span></p>`,
+			Out:      `<p><span class="koboSpan" id="kobo.1.1">He said “</span><span class="koboSpan" id="kobo.1.2">Stop.</span><span class="koboSpan" id="kobo.1.3">” Then left.</span></p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentPunctuation(doc, smartypantsConfig{Dashes: SmartypantsDashesNone, Ellipsis: SmartypantsEllipsisNone})
+			},
+			What:     "quotes next to protected sequences",
+			Fragment: true,
+			In:       `<p>He said "... no" and "--"</p>`,
+			Out:      `<p>He said “... no” and “--”</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{Locale: "de-DE"}) },
+			What:     "german quotes",
+			Fragment: true,
+			In:       `<p>Er sagte: "Das ist 'nicht' gut." Wie geht's?</p>`,
+			Out:      `<p>Er sagte: „Das ist ‚nicht‘ gut.“ Wie geht’s?</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{Locale: "fr"}) },
+			What:     "french quotes and spacing",
+			Fragment: true,
+			In:       `<p>Il dit : "C'est l'heure !" Vraiment? Oui; à 10:30.</p>`,
+			Out:      "<p>Il dit\u202f: «\u202fC’est l’heure\u202f!\u202f» Vraiment\u202f? Oui\u202f; à 10:30.</p>",
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{Locale: "sv"}) },
+			What:     "swedish quotes",
+			Fragment: true,
+			In:       `<p>"Hej 'du'," sa han.</p>`,
+			Out:      `<p>”Hej ’du’,” sa han.</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{Locale: "auto"}) },
+			What:     "document language",
+			Fragment: false,
+			Contains: true,
+			In:       `<!DOCTYPE html><html lang="de"><head><title></title></head><body><p>"Test"</p></body></html>`,
+			Out:      `<p>„Test“</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func: func(doc *html.Node) {
+				transformContentPunctuation(doc, smartypantsConfig{Locale: "auto", Language: "de"})
+			},
+			What:     "package language",
+			Fragment: false,
+			Contains: true,
+			In:       `<!DOCTYPE html><html><head><title></title></head><body><p>"Test"</p></body></html>`,
+			Out:      `<p>„Test“</p>`,
+		}.Run(t)
+
+		transformContentCase{
+			Func:     func(doc *html.Node) { transformContentPunctuation(doc, smartypantsConfig{Locale: "fr"}) },
+			What:     "french quotes and spacing next to inline elements",
+			Fragment: true,
+			In:       `<p>Il dit : "<i>Bonjour</i>" ! <b>Vraiment</b>?</p>`,
+			Out:      "<p>Il dit\u202f: «\u202f<i>Bonjour</i>\u202f»\u202f! <b>Vraiment</b>\u202f?</p>",
+		}.Run(t)
 	})
 
 	t.Run("CleanHTML", func(t *testing.T) {
@@ -619,11 +758,205 @@ func TestTransformFileFilter(t *testing.T) {
 			t.Errorf("expected %q to be filtered", fn)
 		}
 	}
+
+	c := NewConverterWithOptions(ConverterOptionExcludeFiles("*.ttf", "OEBPS/extra/*"))
+	for fn, filtered := range map[string]bool{
+		"OEBPS/fonts/Test.ttf":    true,
+		"Test.ttf":                true,
+		"OEBPS/extra/notes.txt":   true,
+		"extra/notes.txt":         false,
+		"OEBPS/extra/sub/a.txt":   false,
+		"OEBPS/xhtml/ch01.xhtml":  false,
+		"OEBPS/fonts/Test.ttf.gz": false,
+	} {
+		if c.TransformFileFilter(fn) != filtered {
+			t.Errorf("expected %q filtered = %t", fn, filtered)
+		}
+	}
+}
+
+func TestReachable(t *testing.T) {
+	epub := fstest.MapFS{
+		"mimetype":               &fstest.MapFile{Data: []byte("application/epub+zip")},
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<container/>`)},
+		"book/package.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+    <metadata>
+        <meta name="cover" content="cover"/>
+    </metadata>
+    <manifest>
+        <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+        <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+        <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+        <item id="notes" href="text/notes.xhtml" media-type="application/xhtml+xml"/>
+        <item id="orphan" href="text/orphan.xhtml" media-type="application/xhtml+xml"/>
+        <item id="cover" href="images/cover.jpg" media-type="image/jpeg"/>
+        <item id="fig" href="images/fig.svg" media-type="image/svg+xml" fallback="figpng"/>
+        <item id="figpng" href="images/fig.png" media-type="image/png"/>
+        <item id="css" href="style/main.css" media-type="text/css"/>
+        <item id="unused" href="images/unused.png" media-type="image/png"/>
+    </manifest>
+    <spine toc="ncx">
+        <itemref idref="ch1"/>
+        <itemref idref="ch2"/>
+    </spine>
+</package>`)},
+		"book/nav.xhtml":            &fstest.MapFile{Data: []byte(`<html><body><nav><a href="text/ch1.xhtml">1</a></nav></body></html>`)},
+		"book/toc.ncx":              &fstest.MapFile{Data: []byte(`<ncx><navMap><navPoint><content src="text/ch2.xhtml"/></navPoint></navMap></ncx>`)},
+		"book/text/ch1.xhtml":       &fstest.MapFile{Data: []byte(`<html><head><link rel="stylesheet" href="../style/main.css"/><style>p { background: url('../images/bg.png') }</style></head><body><a href="Notes.xhtml#n1">1</a><img srcset="../images/a.png 1x, ../images/b.png 2x"/></body></html>`)},
+		"book/text/ch2.xhtml":       &fstest.MapFile{Data: []byte(`<html><body><svg><image xlink:href="../images/fig.svg"/></svg><a href="http://example.com/x.png">x</a></body></html>`)},
+		"book/text/notes.xhtml":     &fstest.MapFile{Data: []byte(`<html><body><p id="n1" style="background: url(../images/note.png)">1</p></body></html>`)},
+		"book/text/orphan.xhtml":    &fstest.MapFile{Data: []byte(`<html><body><img src="../images/orphan.png"/></body></html>`)},
+		"book/style/main.css":       &fstest.MapFile{Data: []byte(`@import "extra.css"; @font-face { src: url("../fonts/a.otf") }`)},
+		"book/style/extra.css":      &fstest.MapFile{Data: []byte(`h1 { background: url( ../images/h1.png ) }`)},
+		"book/style/unused.css":     &fstest.MapFile{Data: []byte(`h1 { background: url(../images/unused2.png) }`)},
+		"book/fonts/a.otf":          &fstest.MapFile{Data: []byte(`OTTO`)},
+		"book/images/cover.jpg":     &fstest.MapFile{Data: []byte(`jpg`)},
+		"book/images/fig.svg":       &fstest.MapFile{Data: []byte(`<svg><image href="fig-inner.png"/></svg>`)},
+		"book/images/fig-inner.png": &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/fig.png":       &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/bg.png":        &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/a.png":         &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/b.png":         &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/note.png":      &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/h1.png":        &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/orphan.png":    &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/unused.png":    &fstest.MapFile{Data: []byte(`png`)},
+		"book/images/unused2.png":   &fstest.MapFile{Data: []byte(`png`)},
+	}
+	var files []string
+	for fn := range epub {
+		files = append(files, fn)
+	}
+	sort.Strings(files)
+
+	reachable, err := epubReachable(epub, "book/package.opf", files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var unreachable []string
+	for _, fn := range files {
+		if !reachable[fn] {
+			unreachable = append(unreachable, fn)
+		}
+	}
+	if exp := []string{
+		"book/images/orphan.png",
+		"book/images/unused.png",
+		"book/images/unused2.png",
+		"book/style/unused.css",
+		"book/text/orphan.xhtml",
+	}; !reflect.DeepEqual(unreachable, exp) {
+		t.Errorf("expected unreachable files %q, got %q", exp, unreachable)
+	}
 }
 
 func TestTransformDummyTitlepage(t *testing.T) {
 	const lorem = "Lorem ipsum dolor, sit amet consectetur adipisicing elit. Dolorem, placeat. Porro animi architecto pariatur laudantium voluptate, at, odit delectus fugiat beatae autem odio. Iure iste maiores corrupti porro quibusdam. Sunt?"
 
+	transformDummyTitlepageTestCase{
+		What: "long first content document with reason",
+		OPFManifest: `
+			<item id="item1" href="item1.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"item1.html": `<!DOCTYPE html><html><head><title></title></head><body><div>` + lorem + `</div></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: true,
+		ShouldReason: "first spine item has 28 words",
+	}.Run(t)
+
+	transformDummyTitlepageTestCase{
+		What:      "long first content document with custom heuristic",
+		Converter: NewConverterWithOptions(ConverterOptionDummyTitlepageHeuristic(TitlepageHeuristic{MaxParagraphs: 4, MinWordLength: 3, MaxWords: 50, MinWords: 5, MaxImages: 4})),
+		OPFManifest: `
+			<item id="item1" href="item1.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"item1.html": `<!DOCTYPE html><html><head><title></title></head><body><div>` + lorem + `</div></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: false,
+		ShouldReason: "first spine item looks like a titlepage (0 images, 28 words, 0 paragraphs)",
+	}.Run(t)
+
+	transformDummyTitlepageTestCase{
+		What:      "first content document with custom name hint",
+		Converter: NewConverterWithOptions(ConverterOptionDummyTitlepageHeuristic(TitlepageHeuristic{NameHints: []string{"Front"}})),
+		OPFManifest: `
+			<item id="item1" href="frontmatter.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"frontmatter.html": `<!DOCTYPE html><html><head><title></title></head><body><p>` + lorem + `</p></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: false,
+		ShouldReason: `first spine item filename contains "Front"`,
+	}.Run(t)
+
+	transformDummyTitlepageTestCase{
+		What:      "long first content document with partial custom heuristic",
+		Converter: NewConverterWithOptions(ConverterOptionDummyTitlepageHeuristic(TitlepageHeuristic{MaxWords: 50})),
+		OPFManifest: `
+			<item id="item1" href="item1.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"item1.html": `<!DOCTYPE html><html><head><title></title></head><body><div>` + lorem + `</div></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: false,
+		ShouldReason: "first spine item looks like a titlepage (0 images, 28 words, 0 paragraphs)",
+	}.Run(t)
+
+	transformDummyTitlepageTestCase{
+		What:      "image with partial custom heuristic allowing no images",
+		Converter: NewConverterWithOptions(ConverterOptionDummyTitlepageHeuristic(TitlepageHeuristic{MaxImages: -1})),
+		OPFManifest: `
+			<item id="item1" href="item1.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"item1.html": `<!DOCTYPE html><html><head><title></title></head><body><img src="cover.png"></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: true,
+		ShouldReason: "first spine item has 1 images",
+	}.Run(t)
+
+	transformDummyTitlepageTestCase{
+		What:      "first content document with no name hints",
+		Converter: NewConverterWithOptions(ConverterOptionDummyTitlepageHeuristic(TitlepageHeuristic{NameHints: []string{}})),
+		OPFManifest: `
+			<item id="item1" href="cover.html" media-type="application/xhtml+xml"/>
+		`,
+		OPFSpine: `
+			<itemref idref="item1"/>
+		`,
+		Content: map[string]string{
+			"cover.html": `<!DOCTYPE html><html><head><title></title></head><body><div>` + lorem + `</div></body></html>`,
+		},
+		ShouldError:  false,
+		ShouldDetect: true,
+		ShouldReason: "first spine item has 28 words",
+	}.Run(t)
+
 	transformDummyTitlepageTestCase{
 		What: "separate titlepage (no dummy)",
 		OPFManifest: `
@@ -1031,6 +1364,7 @@ type transformDummyTitlepageTestCase struct {
 	Content      map[string]string // relative to the opf dir
 	ShouldError  bool
 	ShouldDetect bool
+	ShouldReason string // if not empty
 }
 
 func (tc transformDummyTitlepageTestCase) Run(t *testing.T) {
@@ -1058,7 +1392,10 @@ func (tc transformDummyTitlepageTestCase) Run(t *testing.T) {
 		c = NewConverter()
 	}
 
-	fn, r, a, err := c.TransformDummyTitlepage(epub, opf, buf)
+	fn, r, a, why, err := c.transformDummyTitlepage(epub, opf, buf)
+	if tc.ShouldReason != "" && why != tc.ShouldReason {
+		t.Errorf("case %q: expected reason %q, got %q", tc.What, tc.ShouldReason, why)
+	}
 	if tc.ShouldError {
 		if err == nil {
 			t.Errorf("case %q: expected error", tc.What)
@@ -1279,3 +1616,1249 @@ func splitSentencesRegexp(str string) (r []string) {
 	}
 	return
 }
+
+func TestDetectCharset(t *testing.T) {
+	const ru = `<!DOCTYPE html><html><head><title></title></head><body><p>Съешь же ещё этих мягких французских булок, да выпей чаю. Широкая электрификация южных губерний даст мощный толчок подъёму сельского хозяйства.</p></body></html>`
+	const fr = `<!DOCTYPE html><html><head><title></title></head><body><p>Voix ambiguë d’un cœur qui, au zéphyr, préfère les jattes de kiwis. À l’été, où il n’y a déjà plus de glaçons.</p></body></html>`
+	const en = `<!DOCTYPE html><html><head><title></title></head><body><p>The quick brown fox jumps over the lazy dog.</p></body></html>`
+
+	enc := func(name, s string) string {
+		e, _ := charset.Lookup(name)
+		b, err := e.NewEncoder().String(s)
+		if err != nil {
+			panic(err)
+		}
+		return b
+	}
+
+	for _, tc := range []struct {
+		What     string
+		In       string
+		Fallback []string
+		Charset  string
+		Error    bool
+	}{
+		{"utf-8 bom", "\xEF\xBB\xBF" + ru, []string{"windows-1251"}, "utf-8", false},
+		{"utf-16le bom", enc("utf-16le", "\uFEFF"+ru), []string{"windows-1251"}, "utf-16le", false},
+		{"utf-8 undeclared", ru, []string{"windows-1251", "utf-8"}, "utf-8", false},
+		{"ascii", en, []string{"windows-1251", "utf-8"}, "utf-8", false},
+		{"windows-1251 undeclared", enc("windows-1251", ru), []string{"utf-8", "windows-1251", "koi8-r"}, "windows-1251", false},
+		{"koi8-r undeclared", enc("koi8-r", ru), []string{"utf-8", "windows-1251", "koi8-r"}, "koi8-r", false},
+		{"koi8-r undeclared, prefer earlier", enc("koi8-r", ru), []string{"utf-8", "koi8-r", "windows-1251"}, "koi8-r", false},
+		{"windows-1251 undeclared, not latin", enc("windows-1251", ru), []string{"utf-8", "windows-1252", "windows-1251"}, "windows-1251", false},
+		{"windows-1252 undeclared, not cyrillic", enc("windows-1252", fr), []string{"utf-8", "windows-1251", "windows-1252"}, "windows-1252", false},
+		{"windows-1251 in meta", enc("windows-1251", strings.Replace(ru, `<title>`, `<meta charset="windows-1251"/><title>`, 1)), []string{"koi8-r"}, "windows-1251", false},
+		{"windows-1251 in xml declaration", enc("windows-1251", `<?xml version="1.0" encoding="windows-1251"?>`+ru), []string{"koi8-r"}, "windows-1251", false},
+		{"utf-8 in meta, but actually koi8-r", enc("koi8-r", strings.Replace(ru, `<title>`, `<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/><title>`, 1)), []string{"utf-8", "windows-1251", "koi8-r"}, "koi8-r", false},
+		{"koi8-r in meta, but actually utf-8", strings.Replace(ru, `<title>`, `<meta charset="koi8-r"/><title>`, 1), []string{"koi8-r"}, "utf-8", false},
+		{"utf-8 with an invalid byte", strings.Replace(ru, "булок", "булок\xFF", 1), []string{"utf-8", "windows-1252"}, "utf-8", false},
+		{"utf-8 in meta with an invalid byte", strings.Replace(strings.Replace(ru, `<title>`, `<meta charset="utf-8"/><title>`, 1), "булок", "булок\xFF", 1), []string{"windows-1252"}, "utf-8", false},
+		{"windows-1252 with a valid utf-8 sequence", enc("windows-1252", fr) + "\xC3\xA9", []string{"utf-8", "windows-1252"}, "windows-1252", false},
+		{"invalid fallback", enc("windows-1251", ru), []string{"invalid"}, "", true},
+	} {
+		e, name, msg, err := detectCharset([]byte(tc.In), tc.Fallback)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("case %q: expected error", tc.What)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("case %q: unexpected error: %v", tc.What, err)
+			continue
+		}
+		if name != tc.Charset {
+			t.Errorf("case %q: expected %s, got %s (%s)", tc.What, tc.Charset, name, msg)
+			continue
+		}
+		if e != nil {
+			if s, err := e.NewDecoder().String(tc.In); err != nil {
+				t.Errorf("case %q: decode: %v", tc.What, err)
+			} else if !strings.Contains(s, "булок") && !strings.Contains(s, "zéphyr") {
+				t.Errorf("case %q: decoded incorrectly", tc.What)
+			}
+		}
+	}
+
+	// the content should be passed through if nothing matches
+	if e, name, msg, err := detectCharset([]byte(enc("windows-1251", ru)), []string{"utf-8"}); err != nil {
+		t.Errorf("case %q: unexpected error: %v", "no valid fallback", err)
+	} else if name != "utf-8" || e == nil {
+		t.Errorf("case %q: expected utf-8 with invalid bytes replaced, got %s (%s)", "no valid fallback", name, msg)
+	}
+}
+
+func TestSplitContent(t *testing.T) {
+	const lorem = "Lorem ipsum dolor, sit amet consectetur adipisicing elit. Dolorem, placeat. Porro animi architecto pariatur."
+
+	parse := func(s string) *html.Node {
+		doc, err := html.Parse(strings.NewReader(s))
+		if err != nil {
+			panic(err)
+		}
+		return doc
+	}
+	name := func(n int) string {
+		if n == 1 {
+			return "OEBPS/text/ch.xhtml"
+		}
+		return fmt.Sprintf("OEBPS/text/ch_%d.xhtml", n)
+	}
+	first := func(doc *html.Node) string {
+		var cur *html.Node
+		stack := []*html.Node{findAtom(doc, atom.Body)}
+		for len(stack) != 0 {
+			stack, cur = stack[:len(stack)-1], stack[len(stack)-1]
+			if cur.Type == html.ElementNode && cur.DataAtom != atom.Body && cur.DataAtom != atom.Div && cur.DataAtom != atom.Section {
+				for _, a := range cur.Attr {
+					if a.Key == "id" {
+						return a.Val
+					}
+				}
+				return cur.Data
+			}
+			for c := cur.LastChild; c != nil; c = c.PrevSibling {
+				stack = append(stack, c)
+			}
+		}
+		return ""
+	}
+
+	chapters := `<!DOCTYPE html><html><head><title>Test</title></head><body><div class="wrap">` +
+		`<h1 id="c1">One</h1>` + strings.Repeat(`<p>`+lorem+`</p>`, 10) +
+		`<h1 id="c2">Two</h1>` + strings.Repeat(`<p>`+lorem+`</p>`, 10) +
+		`<section><h2 id="c3">Three</h2>` + strings.Repeat(`<p>`+lorem+`</p>`, 3) + `</section>` + strings.Repeat(`<p>`+lorem+`</p>`, 7) +
+		`</div></body></html>`
+
+	t.Run("Small", func(t *testing.T) {
+		if parts := splitContentDocument(parse(chapters), 1<<20, name); parts != nil {
+			t.Errorf("expected document not to be split, got %d parts", len(parts))
+		}
+	})
+
+	t.Run("Headings", func(t *testing.T) {
+		parts := splitContentDocument(parse(chapters), 1500, name)
+		if len(parts) != 3 {
+			t.Fatalf("expected 3 parts, got %d", len(parts))
+		}
+		for i, p := range parts {
+			if p.Name != name(i+1) {
+				t.Errorf("part %d: expected name %q, got %q", i+1, name(i+1), p.Name)
+			}
+			if id, exp := first(p.Doc), fmt.Sprintf("c%d", i+1); id != exp {
+				t.Errorf("part %d: expected to start with %q, got %q", i+1, exp, id)
+			}
+			if findAtom(p.Doc, atom.Title) == nil {
+				t.Errorf("part %d: expected head to be copied", i+1)
+			}
+			if findClass(p.Doc, "wrap") == nil {
+				t.Errorf("part %d: expected wrapper to be copied", i+1)
+			}
+		}
+
+		splits := newContentSplits()
+		splits.add("OEBPS/text/ch.xhtml", parts)
+		for _, c := range []struct {
+			Base, Href, Exp string
+		}{
+			{"OEBPS/nav.xhtml", "text/ch.xhtml#c1", "text/ch.xhtml#c1"},
+			{"OEBPS/nav.xhtml", "text/ch.xhtml#c2", "text/ch_2.xhtml#c2"},
+			{"OEBPS/nav.xhtml", "text/ch.xhtml", "text/ch.xhtml"},
+			{"OEBPS/nav.xhtml", "text/ch.xhtml#unknown", "text/ch.xhtml#unknown"},
+			{"OEBPS/other/x.xhtml", "../text/ch.xhtml#c3", "../text/ch_3.xhtml#c3"},
+			{"OEBPS/text/ch.xhtml", "#c3", "ch_3.xhtml#c3"},
+			{"OEBPS/text/ch_3.xhtml", "#c1", "ch.xhtml#c1"},
+			{"OEBPS/text/ch_3.xhtml", "#c3", "#c3"},
+			{"OEBPS/text/ch_3.xhtml", "ch.xhtml#c3", "#c3"},
+			{"OEBPS/text/ch_3.xhtml", "http://example.com/ch.xhtml#c3", "http://example.com/ch.xhtml#c3"},
+		} {
+			if href, _ := splits.resolve(c.Base, c.Href); href != c.Exp {
+				t.Errorf("resolve %q from %q: expected %q, got %q", c.Href, c.Base, c.Exp, href)
+			}
+		}
+	})
+
+	t.Run("Blocks", func(t *testing.T) {
+		parts := splitContentDocument(parse(`<!DOCTYPE html><html><head><title>Test</title></head><body>`+strings.Repeat(`<p>`+lorem+`</p>`, 30)+`</body></html>`), 1000, name)
+		if len(parts) < 3 {
+			t.Fatalf("expected at least 3 parts, got %d", len(parts))
+		}
+		var n int
+		for i, p := range parts {
+			buf := bytes.NewBuffer(nil)
+			if err := html.Render(buf, findAtom(p.Doc, atom.Body)); err != nil {
+				panic(err)
+			}
+			if buf.Len() > 1000+100 {
+				t.Errorf("part %d: expected body to be at most around 1000 bytes, got %d", i+1, buf.Len())
+			}
+			n += strings.Count(buf.String(), "<p>")
+		}
+		if n != 30 {
+			t.Errorf("expected 30 paragraphs in total, got %d", n)
+		}
+	})
+
+	t.Run("Inline", func(t *testing.T) {
+		if parts := splitContentDocument(parse(`<!DOCTYPE html><html><head><title>Test</title></head><body>`+strings.Repeat(`<span>`+lorem+`</span>`, 30)+`</body></html>`), 1000, name); parts != nil {
+			t.Errorf("expected document not to be split at inline elements, got %d parts", len(parts))
+		}
+	})
+
+	t.Run("OPF", func(t *testing.T) {
+		splits := newContentSplits()
+		splits.add("OEBPS/text/ch.xhtml", splitContentDocument(parse(chapters), 1500, name))
+		transformXMLTestCase{
+			Func: func(doc *etree.Document) {
+				transformOPFSplit(doc, "OEBPS/content.opf", splits)
+				doc.Indent(4) // same as TransformOPF
+			},
+			What: "add split parts to manifest and spine, and update guide",
+			In: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <manifest>
+        <item id="ch" href="text/ch.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch-split2" href="text/other.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    </manifest>
+    <spine toc="ncx">
+        <itemref idref="ch"/>
+        <itemref idref="ch-split2" linear="no"/>
+    </spine>
+    <guide>
+        <reference href="text/ch.xhtml#c3" title="Three" type="text"/>
+    </guide>
+</package>`,
+			Out: `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uuid_id">
+    <manifest>
+        <item id="ch" href="text/ch.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch-split2-1" href="text/ch_2.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch-split3" href="text/ch_3.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch-split2" href="text/other.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    </manifest>
+    <spine toc="ncx">
+        <itemref idref="ch"/>
+        <itemref idref="ch-split2-1"/>
+        <itemref idref="ch-split3"/>
+        <itemref idref="ch-split2" linear="no"/>
+    </spine>
+    <guide>
+        <reference href="text/ch_3.xhtml#c3" title="Three" type="text"/>
+    </guide>
+</package>`,
+		}.Run(t)
+	})
+
+	t.Run("NCX", func(t *testing.T) {
+		splits := newContentSplits()
+		splits.add("OEBPS/text/ch.xhtml", splitContentDocument(parse(chapters), 1500, name))
+
+		buf := bytes.NewBuffer(nil)
+		if err := transformNCX(buf, strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+    <navMap>
+        <navPoint id="c1" playOrder="1"><navLabel><text>One</text></navLabel><content src="text/ch.xhtml"/></navPoint>
+        <navPoint id="c2" playOrder="2"><navLabel><text>Two</text></navLabel><content src="text/ch.xhtml#c2"/></navPoint>
+        <navPoint id="c3" playOrder="3"><navLabel><text>Three</text></navLabel><content src="text/ch.xhtml#c3"/></navPoint>
+    </navMap>
+</ncx>`), "OEBPS/toc.ncx", &convertState{Splits: splits}); err != nil {
+			t.Fatalf("transform: unexpected error: %v", err)
+		}
+		for _, x := range []string{`src="text/ch.xhtml"`, `src="text/ch_2.xhtml#c2"`, `src="text/ch_3.xhtml#c3"`} {
+			if !strings.Contains(buf.String(), x) {
+				t.Errorf("expected ncx to contain %q", x)
+			}
+		}
+	})
+}
+
+func TestLinks(t *testing.T) {
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+		"OEBPS/content.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="ch1" href="text/Chapter1.xhtml" media-type="application/xhtml+xml"/>
+		<item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+		<item id="img" href="images/pic.png" media-type="image/png"/>
+		<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+	</manifest>
+	<spine toc="ncx">
+		<itemref idref="ch1"/>
+		<itemref idref="ch2"/>
+	</spine>
+</package>`)},
+		"OEBPS/toc.ncx": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+	<navMap>
+		<navPoint id="n1" playOrder="1"><navLabel><text>One</text></navLabel><content src="text/chapter1.xhtml"/></navPoint>
+		<navPoint id="n2" playOrder="2"><navLabel><text>Two</text></navLabel><content src="text/ch2.xhtml#Sec1"/></navPoint>
+	</navMap>
+</ncx>`)},
+		"OEBPS/text/Chapter1.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>1</title></head><body><p id="top">` +
+			`<a href="ch2.xhtml#sec1">ok</a>` +
+			`<a href="CH2.xhtml#sec1">case</a>` +
+			`<a href="ch2.html#SEC1">renamed, fragment case</a>` +
+			`<a href="ch2.xhtml#nope">missing fragment</a>` +
+			`<a href="#nope">missing local fragment</a>` +
+			`<a href="ch3.xhtml">missing</a>` +
+			`<a href="http://example.com/ch3.xhtml">external</a>` +
+			`<a href="extra.xhtml">not in manifest</a>` +
+			`<img src="../images/Pic.png"/>` +
+			`<img src="../images/missing.png"/>` +
+			`</p></body></html>`)},
+		"OEBPS/text/ch2.xhtml":   &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>2</title></head><body><h1 id="sec1">2</h1><a href="Chapter1.xhtml#top">back</a></body></html>`)},
+		"OEBPS/text/extra.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>extra</title></head><body></body></html>`)},
+		"OEBPS/images/pic.png":   &fstest.MapFile{Data: []byte(`not really a png`)},
+	}
+
+	reports, err := CheckLinks(epub)
+	if err != nil {
+		t.Fatalf("check links: unexpected error: %v", err)
+	}
+
+	exp := []string{
+		`link: OEBPS/text/Chapter1.xhtml: CH2.xhtml#sec1 (wrong case, can be fixed to "ch2.xhtml#sec1")`,
+		`link: OEBPS/text/Chapter1.xhtml: ch2.html#SEC1 (renamed file, wrong fragment case, can be fixed to "ch2.xhtml#sec1")`,
+		`link: OEBPS/text/Chapter1.xhtml: ch2.xhtml#nope (missing fragment, can be fixed to "ch2.xhtml")`,
+		`link: OEBPS/text/Chapter1.xhtml: #nope (missing fragment, can be removed)`,
+		`link: OEBPS/text/Chapter1.xhtml: ch3.xhtml (missing file, can be removed)`,
+		`link: OEBPS/text/Chapter1.xhtml: extra.xhtml (file not in manifest)`,
+		`link: OEBPS/text/Chapter1.xhtml: ../images/Pic.png (wrong case, can be fixed to "../images/pic.png")`,
+		`link: OEBPS/text/Chapter1.xhtml: ../images/missing.png (missing file)`,
+		`link: OEBPS/toc.ncx: text/chapter1.xhtml (wrong case, can be fixed to "text/Chapter1.xhtml")`,
+		`link: OEBPS/toc.ncx: text/ch2.xhtml#Sec1 (wrong fragment case, can be fixed to "text/ch2.xhtml#sec1")`,
+	}
+	var act []string
+	for _, r := range reports {
+		act = append(act, r.String())
+	}
+	if a, b := strings.Join(act, "\n"), strings.Join(exp, "\n"); a != b {
+		t.Errorf("incorrect reports:\n%s\n---\nexpected:\n%s", a, b)
+	}
+
+	x, err := newLinkIndex(epub, []string{"OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/text/Chapter1.xhtml", "OEBPS/text/ch2.xhtml", "OEBPS/text/extra.xhtml", "OEBPS/images/pic.png"}, "OEBPS/content.opf")
+	if err != nil {
+		t.Fatalf("index: unexpected error: %v", err)
+	}
+	doc, err := html.Parse(bytes.NewReader(epub["OEBPS/text/Chapter1.xhtml"].Data))
+	if err != nil {
+		panic(err)
+	}
+	transformContentLinks(doc, "OEBPS/text/Chapter1.xhtml", x, true, nil)
+
+	buf := bytes.NewBuffer(nil)
+	if err := html.Render(buf, doc); err != nil {
+		panic(err)
+	}
+	for _, x := range []string{
+		`<a href="ch2.xhtml#sec1">ok</a>`,
+		`<a href="ch2.xhtml#sec1">case</a>`,
+		`<a href="ch2.xhtml#sec1">renamed, fragment case</a>`,
+		`<a href="ch2.xhtml">missing fragment</a>`,
+		`<a>missing local fragment</a>`,
+		`<a>missing</a>`,
+		`<a href="http://example.com/ch3.xhtml">external</a>`,
+		`<a href="extra.xhtml">not in manifest</a>`,
+		`<img src="../images/pic.png"/>`,
+		`<img src="../images/missing.png"/>`,
+	} {
+		if !strings.Contains(buf.String(), x) {
+			t.Errorf("expected fixed document to contain %q, got %q", x, buf.String())
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n"
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="2.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="book/package.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+		"book/package.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+    <manifest>
+        <item id="ch1" href="Text/ch1.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch2" href="text/CH2.xhtml" media-type="text/html"/>
+        <item id="ch4" href="text/ch4.html" media-type="text/html"/>
+        <item id="missing" href="text/missing.xhtml" media-type="application/xhtml+xml"/>
+        <item id="img" href="img.jpg" media-type="image/jpeg"/>
+    </manifest>
+    <spine>
+        <itemref idref="missing"/>
+    </spine>
+</package>`)},
+		"book/text/ch1.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>1</title></head><body></body></html>`)},
+		"book/text/ch2.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>2</title></head><body></body></html>`)},
+		"book/text/ch3.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>3</title></head><body></body></html>`)},
+		"book/text/ch4.html":  &fstest.MapFile{Data: []byte(`<p>4</p>`)},
+		"book/style.css":      &fstest.MapFile{Data: []byte(`p { margin: 0; }`)},
+		"book/img.jpg":        &fstest.MapFile{Data: []byte(png)},
+		"book/notes.txt":      &fstest.MapFile{Data: []byte(`not added`)},
+	}
+	files := []string{"META-INF/container.xml", "book/package.opf", "book/text/ch1.xhtml", "book/text/ch2.xhtml", "book/text/ch3.xhtml", "book/text/ch4.html", "book/style.css", "book/img.jpg", "book/notes.txt"}
+
+	var reports []string
+	report := func(r Report) {
+		reports = append(reports, r.String())
+	}
+
+	opf, container, err := epubRepairPackage(epub, files, report)
+	if err != nil {
+		t.Fatalf("repair package: unexpected error: %v", err)
+	}
+	if opf != "book/package.opf" {
+		t.Errorf("expected package document to be found, got %q", opf)
+	}
+	if !bytes.Contains(container, []byte(`<container version="1.0"`)) || !bytes.Contains(container, []byte(`full-path="book/package.opf"`)) {
+		t.Errorf("expected valid container, got %q", container)
+	}
+
+	buf, err := epubRepairOPF(epub, opf, files, report)
+	if err != nil {
+		t.Fatalf("repair opf: unexpected error: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		t.Fatalf("parse repaired opf: %v", err)
+	}
+	doc.Indent(4)
+	out, _ := doc.WriteToString()
+
+	if a, b := strings.TrimSpace(out), strings.TrimSpace(`
+<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+    <manifest>
+        <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch4" href="text/ch4.html" media-type="text/html"/>
+        <item id="img" href="img.jpg" media-type="image/png"/>
+        <item id="kepubify-repair-1" href="style.css" media-type="text/css"/>
+        <item id="kepubify-repair-2" href="text/ch3.xhtml" media-type="application/xhtml+xml"/>
+    </manifest>
+    <spine>
+        <itemref idref="ch1"/>
+        <itemref idref="ch2"/>
+        <itemref idref="ch4"/>
+        <itemref idref="kepubify-repair-2"/>
+    </spine>
+</package>`); a != b {
+		t.Errorf("incorrect repaired opf:\n%s\n---\nexpected:\n%s", a, b)
+	}
+
+	if a, b := strings.Join(reports, "\n"), strings.Join([]string{
+		`repair: META-INF/container.xml: book/package.opf (parse OCF container: invalid OCF version "2.0", using the package document from the invalid container)`,
+		`repair: book/package.opf: Text/ch1.xhtml (wrong case, fixed to "text/ch1.xhtml")`,
+		`repair: book/package.opf: text/CH2.xhtml (wrong case, fixed to "text/ch2.xhtml")`,
+		`repair: book/package.opf: text/CH2.xhtml (wrong media type "text/html", fixed to "application/xhtml+xml")`,
+		`repair: book/package.opf: text/missing.xhtml (missing file, removed from manifest)`,
+		`repair: book/package.opf: img.jpg (wrong media type "image/jpeg", fixed to "image/png")`,
+		`repair: book/package.opf: style.css (not in manifest, added as "kepubify-repair-1")`,
+		`repair: book/package.opf: text/ch3.xhtml (not in manifest, added as "kepubify-repair-2")`,
+		`repair: book/package.opf: missing (spine item references a missing manifest item, removed)`,
+		`repair: book/package.opf: spine (empty spine, regenerated with 4 items from the manifest)`,
+	}, "\n"); a != b {
+		t.Errorf("incorrect reports:\n%s\n---\nexpected:\n%s", a, b)
+	}
+
+	if _, _, err := epubRepairPackage(fstest.MapFS{}, nil, nil); err == nil {
+		t.Errorf("expected error if there aren't any package documents")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	epub := fstest.MapFS{
+		"OEBPS/content.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+        <dc:title>Test</dc:title>
+        <dc:creator opf:role="aut" opf:file-as="Doe, John">John Doe</dc:creator>
+        <dc:contributor id="ill" opf:role="ill">Jane Doe</dc:contributor>
+        <dc:identifier id="uid">test</dc:identifier>
+        <dc:language>en</dc:language>
+        <dc:date>2020-01-02T03:04:05Z</dc:date>
+        <meta name="cover" content="cover"/>
+        <meta name="calibre:series" content="The Series"/>
+        <meta name="calibre:series_index" content="2.0"/>
+    </metadata>
+    <manifest>
+        <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+        <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+        <item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+        <item id="cover" href="cover.jpg" media-type="image/jpeg"/>
+    </manifest>
+    <spine toc="ncx">
+        <itemref idref="ch1"/>
+        <itemref idref="ch2"/>
+    </spine>
+    <guide>
+        <reference type="text" title="Start" href="text/ch1.xhtml"/>
+        <reference type="other.custom" title="Custom" href="text/ch2.xhtml#x"/>
+    </guide>
+</package>`)},
+		"OEBPS/toc.ncx": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+    <docTitle><text>Test &amp; Book</text></docTitle>
+    <navMap>
+        <navPoint id="np1" playOrder="1">
+            <navLabel><text>Part 1</text></navLabel>
+            <content src="text/ch1.xhtml"/>
+            <navPoint id="np2" playOrder="2">
+                <navLabel><text>Chapter 2</text></navLabel>
+                <content src="text/ch2.xhtml#c2"/>
+            </navPoint>
+        </navPoint>
+    </navMap>
+    <pageList>
+        <pageTarget id="p1" type="normal" value="1">
+            <navLabel><text>1</text></navLabel>
+            <content src="text/ch1.xhtml#p1"/>
+        </pageTarget>
+    </pageList>
+</ncx>`)},
+	}
+
+	nav, err := epubUpgradeNav(epub, "OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/kepubify-nav.xhtml", &convertState{})
+	if err != nil {
+		t.Fatalf("generate nav: unexpected error: %v", err)
+	}
+	for _, s := range []string{
+		`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">`,
+		`<title>Test &amp; Book</title>`,
+		`<nav epub:type="toc" id="toc">`,
+		`<li>
+                    <a href="text/ch1.xhtml">Part 1</a>
+                    <ol>
+                        <li>
+                            <a href="text/ch2.xhtml#c2">Chapter 2</a>
+                        </li>
+                    </ol>
+                </li>`,
+		`<nav epub:type="page-list" hidden="">`,
+		`<a href="text/ch1.xhtml#p1">1</a>`,
+		`<nav epub:type="landmarks" hidden="">`,
+		`<a href="text/ch1.xhtml" epub:type="bodymatter">Start</a>`,
+		`<a href="text/ch2.xhtml#x">Custom</a>`,
+	} {
+		if !bytes.Contains(nav, []byte(s)) {
+			t.Errorf("expected nav to contain %q, got:\n%s", s, nav)
+		}
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(epub["OEBPS/content.opf"].Data); err != nil {
+		panic(err)
+	}
+	transformOPFUpgrade(doc, "OEBPS/content.opf", "OEBPS/kepubify-nav.xhtml", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+	doc.Indent(4)
+
+	opf, err := doc.WriteToString()
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range []string{
+		`<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">`,
+		`<dc:creator id="creator1">John Doe</dc:creator>`,
+		`<meta property="role" refines="#creator1" scheme="marc:relators">aut</meta>`,
+		`<meta property="file-as" refines="#creator1">Doe, John</meta>`,
+		`<dc:contributor id="ill">Jane Doe</dc:contributor>`,
+		`<meta property="role" refines="#ill" scheme="marc:relators">ill</meta>`,
+		`<meta property="belongs-to-collection" id="series1">The Series</meta>`,
+		`<meta property="collection-type" refines="#series1">series</meta>`,
+		`<meta property="group-position" refines="#series1">2</meta>`,
+		`<meta property="dcterms:modified">2021-03-04T05:06:07Z</meta>`,
+		`<meta name="cover" content="cover"/>`,
+		`<item id="kepubify-nav" href="kepubify-nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`,
+		`<spine toc="ncx">`,
+	} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("expected OPF to contain %q, got:\n%s", s, opf)
+		}
+	}
+	if strings.Contains(opf, "opf:role") || strings.Contains(opf, "opf:file-as") {
+		t.Errorf("expected opf:role and opf:file-as to be removed, got:\n%s", opf)
+	}
+
+	for _, tc := range []struct {
+		metadata string
+		exp      string
+	}{
+		{``, "2021-03-04T05:06:07Z"},
+		{`<dc:date>2019-05-06</dc:date>`, "2021-03-04T05:06:07Z"},
+		{`<meta property="dcterms:modified">2019-05-06T07:08:09Z</meta>`, "2019-05-06T07:08:09Z"},
+	} {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(`<package version="2.0"><metadata>` + tc.metadata + `</metadata></package>`); err != nil {
+			panic(err)
+		}
+		transformOPFUpgrade(doc, "content.opf", "nav.xhtml", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+
+		if els := doc.FindElements("//meta[@property='dcterms:modified']"); len(els) != 1 {
+			t.Errorf("modified (metadata: %q): expected exactly one dcterms:modified, got %d", tc.metadata, len(els))
+		} else if act := els[0].Text(); act != tc.exp {
+			t.Errorf("modified (metadata: %q): expected %q, got %q", tc.metadata, tc.exp, act)
+		}
+	}
+
+	if v, err := epubVersion(epub, "OEBPS/content.opf"); err != nil {
+		t.Errorf("get version: unexpected error: %v", err)
+	} else if v != "2.0" {
+		t.Errorf("get version: expected 2.0, got %q", v)
+	}
+}
+
+// testWebP is a 1x1 lossless WebP.
+const testWebP = "RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00"
+
+// testWebPLossy is a 1x1 lossy WebP.
+const testWebPLossy = "RIFF\x22\x00\x00\x00WEBPVP8 \x16\x00\x00\x00\x30\x01\x00\x9d\x01\x2a\x01\x00\x01\x00\x0e\xc0\xfe\x25\xa4\x00\x03\x70\x00\x00\x00\x00"
+
+func TestImages(t *testing.T) {
+	var jpg, gifSmall, gifHuge bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		panic(err)
+	}
+	if err := gif.Encode(&gifSmall, image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9), nil); err != nil {
+		panic(err)
+	}
+	if err := gif.Encode(&gifHuge, image.NewPaletted(image.Rect(0, 0, 2049, 2048), palette.Plan9), nil); err != nil {
+		panic(err)
+	}
+	progressive := bytes.Replace(jpg.Bytes(), []byte{0xFF, 0xC0}, []byte{0xFF, 0xC2}, 1)
+
+	for _, tc := range []struct {
+		fn  string
+		buf []byte
+		exp imageConversion
+	}{
+		{"a/b.webp", []byte(testWebP), imageConversion{"a/b.png", "png", "webp with transparency"}},
+		{"a/b.WEBP", []byte(testWebPLossy), imageConversion{"a/b.jpg", "jpeg", "webp"}},
+		{"a/b.jpg", jpg.Bytes(), imageConversion{}},
+		{"a/b.jpg", progressive, imageConversion{"a/b.jpg", "jpeg", "progressive jpeg"}},
+		{"a/b.gif", gifSmall.Bytes(), imageConversion{}},
+		{"a/b.gif", gifHuge.Bytes(), imageConversion{"a/b.png", "png", "2049x2048 gif"}},
+		{"a/b.png", []byte(testWebP), imageConversion{}},
+		{"a/b.webp", []byte("invalid"), imageConversion{}},
+	} {
+		if act := imageCheck(tc.fn, tc.buf); act != tc.exp {
+			t.Errorf("check %q: expected %+v, got %+v", tc.fn, tc.exp, act)
+		}
+	}
+
+	for _, tc := range []struct {
+		buf    string
+		format string
+	}{
+		{testWebP, "png"},
+		{testWebPLossy, "jpeg"},
+	} {
+		var buf bytes.Buffer
+		if err := imageConvert(&buf, strings.NewReader(tc.buf), tc.format); err != nil {
+			t.Errorf("convert to %s: unexpected error: %v", tc.format, err)
+		} else if _, format, err := image.DecodeConfig(&buf); err != nil || format != tc.format {
+			t.Errorf("convert to %s: expected valid %s, got %q (err: %v)", tc.format, tc.format, format, err)
+		}
+	}
+	if err := imageConvert(io.Discard, strings.NewReader("invalid"), "png"); err == nil {
+		t.Errorf("convert: expected error for invalid image")
+	}
+
+	renamed := map[string]string{
+		"OEBPS/images/a.webp": "OEBPS/images/a.png",
+		"OEBPS/images/b.webp": "OEBPS/images/b.jpg",
+	}
+
+	if act, exp := string(renameCSS("OEBPS/css/style.css", []byte(`a { background: url(../images/a.webp) } b { background: url( "../images/b.webp#x" ) } c { background: url('../images/c.webp') }`), renamed)), `a { background: url(../images/a.png) } b { background: url("../images/b.jpg#x") } c { background: url('../images/c.webp') }`; act != exp {
+		t.Errorf("rename css: expected %q, got %q", exp, act)
+	}
+
+	if act, exp := string(renameSVG("OEBPS/images/c.svg", []byte(`<svg><image xlink:href="a.webp"/><image href='b.webp'/><a href="c.webp"/></svg>`), renamed)), `<svg><image xlink:href="a.png"/><image href='b.jpg'/><a href="c.webp"/></svg>`; act != exp {
+		t.Errorf("rename svg: expected %q, got %q", exp, act)
+	}
+
+	doc, err := html.Parse(strings.NewReader(`<html><head><style>p { background: url(../images/a.webp) }</style></head><body><img src="../images/a.webp" srcset="../images/a.webp 1x, ../images/b.webp 2x"/><p style="background: url(../images/b.webp)"></p><svg><image xlink:href="../images/b.webp"/></svg><a href="ch2.xhtml">a.webp</a></body></html>`))
+	if err != nil {
+		panic(err)
+	}
+	transformContentRename(doc, "OEBPS/text/ch1.xhtml", renamed)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		panic(err)
+	}
+	for _, s := range []string{
+		`<style>p { background: url(../images/a.png) }</style>`,
+		`<img src="../images/a.png" srcset="../images/a.png 1x, ../images/b.jpg 2x"/>`,
+		`<p style="background: url(../images/b.jpg)">`,
+		`<image xlink:href="../images/b.jpg">`,
+		`<a href="ch2.xhtml">a.webp</a>`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("rename content: expected document to contain %q, got %q", s, buf.String())
+		}
+	}
+
+	opf := etree.NewDocument()
+	if err := opf.ReadFromString(`<package><manifest><item id="a" href="images/a.webp" media-type="image/webp"/><item id="c" href="images/c.webp" media-type="image/webp"/></manifest></package>`); err != nil {
+		panic(err)
+	}
+	transformOPFRename(opf, "OEBPS/content.opf", renamed)
+	if act, _ := opf.WriteToString(); !strings.Contains(act, `<item id="a" href="images/a.png" media-type="image/png"/><item id="c" href="images/c.webp" media-type="image/webp"/>`) {
+		t.Errorf("rename opf: unexpected manifest %q", act)
+	}
+}
+
+func TestCover(t *testing.T) {
+	for _, tc := range []struct {
+		what string
+		opf  string
+		exp  string
+		how  string
+	}{
+		{"none", `<item id="a" href="a.png" media-type="image/png"/>`, "", ""},
+		{"property", `<item id="a" href="a.png" media-type="image/png"/><item id="b" href="b.png" media-type="image/png" properties="cover-image"/>`, "OEBPS/b.png", "cover-image property"},
+		{"meta", `<item id="a" href="a.png" media-type="image/png"/><item id="b" href="b.png" media-type="image/png"/></manifest><metadata><meta name="cover" content="b"/></metadata><manifest>`, "OEBPS/b.png", "cover meta"},
+		{"meta path", `<item id="a" href="a.png" media-type="image/png"/><item id="b" href="images/b.png" media-type="image/png"/></manifest><metadata><meta name="cover" content="images/b.png"/></metadata><manifest>`, "OEBPS/images/b.png", "cover meta with a path"},
+		{"meta non-image", `<item id="a" href="a.xhtml" media-type="application/xhtml+xml"/></manifest><metadata><meta name="cover" content="a"/></metadata><manifest>`, "", ""},
+		{"id", `<item id="cover" href="a.png" media-type="image/png"/>`, "OEBPS/a.png", "cover id"},
+		{"id non-image", `<item id="cover" href="a.xhtml" media-type="application/xhtml+xml"/>`, "", ""},
+		{"id non-manifest", `</manifest><metadata><meta id="cover"/></metadata><manifest><item id="a" href="a.png" media-type="image/png"/>`, "", ""},
+		{"guide image", `<item id="a" href="a.jpg" media-type="image/jpeg"/></manifest><guide><reference type="cover" href="a.jpg"/></guide><manifest>`, "OEBPS/a.jpg", "guide cover"},
+		{"guide page", `<item id="a" href="text/title.xhtml" media-type="application/xhtml+xml"/><item id="b" href="b.jpg" media-type="image/jpeg"/></manifest><guide><reference type="Cover" href="text/title.xhtml#x"/></guide><manifest>`, "OEBPS/b.jpg", "guide cover page image"},
+		{"cover page", `<item id="a" href="text/cover.xhtml" media-type="application/xhtml+xml"/><item id="b" href="b.jpg" media-type="image/jpeg"/>`, "OEBPS/b.jpg", "cover page image"},
+		{"cover page multiple images", `<item id="a" href="text/multiple.xhtml" media-type="application/xhtml+xml"/><item id="cover-page" href="text/multiple.xhtml" media-type="application/xhtml+xml"/><item id="b" href="b.jpg" media-type="image/jpeg"/>`, "", ""},
+		{"filename", `<item id="a" href="a.jpg" media-type="image/jpeg"/><item id="b" href="images/Front-Cover.JPG" media-type="image/jpeg"/>`, "OEBPS/images/Front-Cover.JPG", "cover filename"},
+	} {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromString(`<package><manifest>` + tc.opf + `</manifest></package>`); err != nil {
+			panic(err)
+		}
+		el, how := opfCover(doc, "OEBPS/content.opf", func(fn string) string {
+			switch fn {
+			case "OEBPS/text/title.xhtml", "OEBPS/text/cover.xhtml":
+				return coverSoleImage(fn, []byte(`<html><body><div><svg><image xlink:href="../b.jpg"/></svg><img src="../b.jpg"/></div></body></html>`))
+			case "OEBPS/text/multiple.xhtml":
+				return coverSoleImage(fn, []byte(`<html><body><img src="../b.jpg"/><img src="../a.jpg"/></body></html>`))
+			}
+			return ""
+		})
+		var act string
+		if el != nil {
+			act = path.Join("OEBPS", el.SelectAttrValue("href", ""))
+		}
+		if act != tc.exp || how != tc.how {
+			t.Errorf("%s: expected cover %q (%s), got %q (%s)", tc.what, tc.exp, tc.how, act, how)
+		}
+	}
+
+	face := basicfont.Face7x13
+	if _, err := generateCover(face, face, "A very long title which needs to be wrapped onto multiple lines", []string{"Author One", "Author Two"}); err != nil {
+		t.Errorf("generate cover: unexpected error: %v", err)
+	}
+	for _, s := range []string{"", "Supercalifragilisticexpialidocious" + strings.Repeat("x", 100)} {
+		if _, err := generateCover(face, face, s, nil); err != nil {
+			t.Errorf("generate cover: unexpected error: %v", err)
+		}
+	}
+	if _, err := generateCover(nil, nil, "Test", nil); err == nil {
+		t.Errorf("generate cover without a font face: expected error")
+	}
+}
+
+func TestPageData(t *testing.T) {
+	d, err := pageData([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:title> Title </dc:title>
+        <dc:creator id="a">Author</dc:creator>
+        <meta refines="#a" property="role">aut</meta>
+        <dc:creator id="b">Illustrator</dc:creator>
+        <meta refines="#b" property="role">ill</meta>
+        <dc:creator>Other</dc:creator>
+        <dc:language>en</dc:language>
+        <meta property="belongs-to-collection" id="s">Series</meta>
+        <meta refines="#s" property="group-position">2</meta>
+    </metadata>
+    <manifest>
+        <item id="img" href="images/cover%20image.jpg" media-type="image/jpeg" properties="cover-image"/>
+    </manifest>
+</package>`), "OEBPS/content.opf", "OEBPS/text/page.xhtml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := (PageData{
+		Title:       "Title",
+		Authors:     []string{"Author", "Other"},
+		Series:      "Series",
+		SeriesIndex: "2",
+		Language:    "en",
+		Cover:       "../images/cover%20image.jpg",
+	}); !reflect.DeepEqual(d, exp) {
+		t.Errorf("expected %#v, got %#v", exp, d)
+	}
+}
+
+// TestTransformDummyTitlepageCorpus runs the dummy titlepage heuristic over a
+// directory of EPUBs (set KEPUBIFY_TITLEPAGE_CORPUS) and summarizes the
+// decisions. If KEPUBIFY_TITLEPAGE_HEURISTIC is set to a JSON-encoded
+// TitlepageHeuristic, it is also run with that heuristic, and the books where
+// the decision differs from the default are shown. It is intended for checking
+// the effects of changes to the heuristic, and is skipped by default.
+func TestTransformDummyTitlepageCorpus(t *testing.T) {
+	dir := os.Getenv("KEPUBIFY_TITLEPAGE_CORPUS")
+	if dir == "" {
+		t.Skip("KEPUBIFY_TITLEPAGE_CORPUS not set")
+	}
+
+	type heuristic struct {
+		Name    string
+		H       TitlepageHeuristic
+		Added   int
+		Reasons map[string]int
+	}
+	hs := []*heuristic{{Name: "default", H: DefaultTitlepageHeuristic(), Reasons: map[string]int{}}}
+	if v := os.Getenv("KEPUBIFY_TITLEPAGE_HEURISTIC"); v != "" {
+		var h TitlepageHeuristic
+		if err := json.Unmarshal([]byte(v), &h); err != nil {
+			t.Fatalf("parse KEPUBIFY_TITLEPAGE_HEURISTIC: %v", err)
+		}
+		hs = append(hs, &heuristic{Name: "custom", H: h, Reasons: map[string]int{}})
+	}
+
+	var books, changed int
+	num := regexp.MustCompile(`[0-9]+`)
+
+	if err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(fn), ".epub") || strings.HasSuffix(strings.ToLower(fn), ".kepub.epub") {
+			return nil
+		}
+
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			t.Errorf("%s: open: %v", fn, err)
+			return nil
+		}
+		defer zr.Close()
+
+		opf, err := epubPackage(zr)
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			return nil
+		}
+		buf, err := fs.ReadFile(zr, opf)
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			return nil
+		}
+
+		var reqs []bool
+		var whys []string
+		for _, h := range hs {
+			req, why, err := transformDummyTitlepageRequired(zr, opf, bytes.NewReader(buf), h.H)
+			if err != nil {
+				t.Errorf("%s: %v", fn, err)
+				return nil
+			}
+			if req {
+				h.Added++
+			}
+			h.Reasons[fmt.Sprintf("%t: %s", req, num.ReplaceAllString(why, "N"))]++
+			reqs, whys = append(reqs, req), append(whys, why)
+		}
+
+		books++
+		t.Logf("%s: %t (%s)", fn, reqs[0], whys[0])
+		for i := 1; i < len(hs); i++ {
+			if reqs[i] != reqs[0] {
+				changed++
+				t.Logf("%s: %s: %t (%s)", fn, hs[i].Name, reqs[i], whys[i])
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("walk corpus: %v", err)
+	}
+
+	for _, h := range hs {
+		t.Logf("%s: added to %d of %d books", h.Name, h.Added, books)
+		var keys []string
+		for k := range h.Reasons {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			t.Logf("%s: %5d %s", h.Name, h.Reasons[k], k)
+		}
+	}
+	if len(hs) > 1 {
+		t.Logf("decision changed for %d of %d books", changed, books)
+	}
+}
+
+func TestContentSelector(t *testing.T) {
+	nav := contentItem{Name: "OEBPS/nav.xhtml", ID: "nav", Properties: "nav scripted"}
+	ch := contentItem{Name: "OEBPS/text/ch01.xhtml", ID: "ch01", Spine: true, Linear: true}
+	notes := contentItem{Name: "OEBPS/text/notes.xhtml", ID: "notes", Spine: true, Linear: false}
+	for _, tc := range []struct {
+		sel string
+		it  contentItem
+		exp bool
+	}{
+		{"properties:nav", nav, true},
+		{"properties:script*", nav, true},
+		{"properties:nav", ch, false},
+		{"id:ch*", ch, true},
+		{"id:ch*", nav, false},
+		{"linear:yes", ch, true},
+		{"linear:yes", notes, false},
+		{"linear:yes", nav, false},
+		{"linear:no", notes, true},
+		{"linear:no", nav, false},
+		{"ch01.xhtml", ch, true},
+		{"*.xhtml", nav, true},
+		{"path:OEBPS/text/*", ch, true},
+		{"OEBPS/text/*", nav, false},
+		{"text/*", ch, false},
+		{"[", ch, false},
+	} {
+		if act := matchContentSelector(tc.sel, tc.it); act != tc.exp {
+			t.Errorf("%q on %q: expected %t, got %t", tc.sel, tc.it.Name, tc.exp, act)
+		}
+	}
+}
+
+func TestSplitSentencesBidi(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		exp []string
+	}{
+		// same as splitSentences for ordinary text
+		{"First. Second! Third", []string{"First. ", "Second! ", "Third"}},
+		// arabic question mark and full stop
+		{"كيف حالك؟ أنا بخير.", []string{"كيف حالك؟ ", "أنا بخير."}},
+		{"یہ ایک جملہ ہے۔ دوسرا جملہ۔", []string{"یہ ایک جملہ ہے۔ ", "دوسرا جملہ۔"}},
+		// directional marks stay with the punctuation
+		{"שלום.‏ עולם.", []string{"שלום.‏ ", "עולם."}},
+		// not inside an embedding or isolate
+		{"‫אחד. שתיים.‬ שלוש.", []string{"‫אחד. שתיים.‬ ", "שלוש."}},
+		{"One ⁧אחד. שתיים⁩. Two.", []string{"One ⁧אחד. שתיים⁩. ", "Two."}},
+		{"Unterminated ⁧one. two.", []string{"Unterminated ⁧one. two."}},
+	} {
+		if act := splitSentencesBidi(tc.in, nil); !reflect.DeepEqual(act, tc.exp) {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.exp, act)
+		}
+		if act := strings.Join(splitSentencesBidi(tc.in, nil), ""); act != tc.in {
+			t.Errorf("%q: joined sentences %q should equal the original", tc.in, act)
+		}
+	}
+}
+
+// The following fixtures are simplified from the structure of Arabic, Hebrew,
+// and vertical Japanese books (the text direction and writing mode are set in
+// the same places).
+const (
+	testDocArabic   = `<?xml version="1.0" encoding="utf-8"?><!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" xml:lang="ar" lang="ar" dir="rtl"><head><title>الفصل الأول</title><link rel="stylesheet" type="text/css" href="../styles/style.css"/></head><body><h1>الفصل الأول</h1><p>كيف حالك؟ أنا بخير، شكراً.</p></body></html>`
+	testDocHebrew   = `<?xml version="1.0" encoding="utf-8"?><!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" xml:lang="he" lang="he"><head><title>פרק א</title></head><body><p>שלום.&#x200F; מה שלומך?</p></body></html>`
+	testDocJapanese = `<?xml version="1.0" encoding="utf-8"?><!DOCTYPE html><html xmlns="http://www.w3.org/1999/xhtml" xml:lang="ja" lang="ja" class="vrtl"><head><title>第一章</title><link rel="stylesheet" type="text/css" href="../style/book-style.css"/></head><body><p>吾輩は猫である。名前はまだ無い。</p></body></html>`
+	testCSSJapanese = `@charset "UTF-8";
+html.vrtl, body.vrtl {
+  -epub-writing-mode: vertical-rl;
+  -webkit-writing-mode: vertical-rl;
+  writing-mode: vertical-rl;
+}
+.tcy { -epub-text-combine: horizontal; }
+`
+)
+
+func TestContentDirection(t *testing.T) {
+	render := func(in, fn string, st *convertState) string {
+		doc, err := html.Parse(strings.NewReader(in))
+		if err != nil {
+			panic(err)
+		}
+		var buf bytes.Buffer
+		if err := NewConverter().transformContentDoc(&buf, doc, fn, st); err != nil {
+			panic(err)
+		}
+		return buf.String()
+	}
+
+	for _, tc := range []struct {
+		what     string
+		in       string
+		st       *convertState
+		rtl      bool
+		vertical bool
+		contains []string
+		excludes []string
+	}{
+		{
+			what: "arabic with dir", in: testDocArabic, rtl: true,
+			contains: []string{`<div id="book-columns" dir="rtl"><div id="book-inner" dir="rtl">`, `<span class="koboSpan" id="kobo.2.1">كيف حالك؟ </span><span class="koboSpan" id="kobo.2.2">أنا بخير، شكراً.</span>`, `margin-top: 0`},
+		},
+		{
+			what: "hebrew without dir", in: testDocHebrew,
+			excludes: []string{`dir="rtl"`},
+		},
+		{
+			what: "hebrew with page progression direction", in: testDocHebrew, st: &convertState{PageDirection: "rtl"}, rtl: true,
+			contains: []string{`<div id="book-columns" dir="rtl">`, "<span class=\"koboSpan\" id=\"kobo.1.1\">שלום.‏ </span>"},
+		},
+		{
+			what: "japanese with vertical stylesheet", in: testDocJapanese, st: &convertState{PageDirection: "rtl", VerticalCSS: map[string][]string{"OEBPS/style/book-style.css": cssVerticalSelectors([]byte(testCSSJapanese))}}, vertical: true,
+			contains: []string{`margin-left: 0; margin-right: 0;`, `<div id="book-columns"><div id="book-inner">`},
+			excludes: []string{`dir="rtl"`, `margin-top: 0`},
+		},
+		{
+			what: "japanese with primary writing mode", in: testDocJapanese, st: &convertState{PageDirection: "rtl", WritingMode: "vertical-rl"}, vertical: true,
+			excludes: []string{`dir="rtl"`},
+		},
+		{
+			what: "japanese with inline style", in: strings.Replace(testDocJapanese, `<title>`, `<style>html { writing-mode: vertical-rl; }</style><title>`, 1), vertical: true,
+		},
+		{
+			what: "japanese with vertical class stylesheet", in: testDocJapanese, st: &convertState{PageDirection: "rtl", VerticalCSS: map[string][]string{"OEBPS/style/book-style.css": cssVerticalSelectors([]byte(`.vrtl { writing-mode: vertical-rl; }`))}}, vertical: true,
+		},
+		{
+			what: "japanese with vertical class stylesheet not on the root", in: testDocJapanese, st: &convertState{PageDirection: "rtl", VerticalCSS: map[string][]string{"OEBPS/style/book-style.css": cssVerticalSelectors([]byte(`.tate { writing-mode: vertical-rl; }`))}},
+			excludes: []string{`dir="rtl"`},
+		},
+		{
+			what: "japanese without vertical stylesheet", in: testDocJapanese, st: &convertState{PageDirection: "rtl"},
+			excludes: []string{`dir="rtl"`},
+		},
+		{
+			what: "hebrew with page progression direction and package language", in: strings.Replace(testDocHebrew, ` xml:lang="he" lang="he"`, ``, 1), st: &convertState{PageDirection: "rtl", Language: "he-IL"}, rtl: true,
+		},
+		{
+			what: "english with page progression direction", in: strings.Replace(testDocHebrew, ` xml:lang="he" lang="he"`, ``, 1), st: &convertState{PageDirection: "rtl", Language: "en"},
+			excludes: []string{`dir="rtl"`},
+		},
+	} {
+		doc, err := html.Parse(strings.NewReader(tc.in))
+		if err != nil {
+			panic(err)
+		}
+		if rtl, vertical := contentDirection(doc, "OEBPS/text/ch1.xhtml", tc.st); rtl != tc.rtl || vertical != tc.vertical {
+			t.Errorf("%s: expected rtl=%t vertical=%t, got rtl=%t vertical=%t", tc.what, tc.rtl, tc.vertical, rtl, vertical)
+		}
+		out := render(tc.in, "OEBPS/text/ch1.xhtml", tc.st)
+		for _, s := range tc.contains {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: expected output to contain %q, got %q", tc.what, s, out)
+			}
+		}
+		for _, s := range tc.excludes {
+			if strings.Contains(out, s) {
+				t.Errorf("%s: expected output to not contain %q, got %q", tc.what, s, out)
+			}
+		}
+	}
+
+	doc, err := html.Parse(strings.NewReader(`<html class="vrtl" id="top"><body class="main"></body></html>`))
+	if err != nil {
+		panic(err)
+	}
+	root, body := findAtom(doc, atom.Html), findAtom(doc, atom.Body)
+	for _, tc := range []struct {
+		css string
+		exp bool
+	}{
+		{testCSSJapanese, true},
+		{`body{writing-mode:vertical-lr}`, true},
+		{`:root { -epub-writing-mode: tb-rl }`, true},
+		{`p { color: red; } html, body { writing-mode: vertical-rl; }`, true},
+		{`.vrtl { writing-mode: vertical-rl; }`, true},
+		{`#top { writing-mode: vertical-rl; }`, true},
+		{`body.main { writing-mode: vertical-rl; }`, true},
+		{`@media amzn-kf8 { html.vrtl { writing-mode: vertical-rl; } }`, true},
+		{`/* html { writing-mode: vertical-rl; } */ p { color: red; }`, false},
+		{`.tate { writing-mode: vertical-rl; }`, false},
+		{`body.vrtl { writing-mode: vertical-rl; }`, false},
+		{`body p { writing-mode: vertical-rl; }`, false},
+		{`html { writing-mode: horizontal-tb; }`, false},
+	} {
+		var act bool
+		for _, sel := range cssVerticalSelectors([]byte(tc.css)) {
+			act = act || cssSelectorMatchesRoot(sel, root) || cssSelectorMatchesRoot(sel, body)
+		}
+		if act != tc.exp {
+			t.Errorf("css %q: expected vertical=%t, got %t", tc.css, tc.exp, act)
+		}
+	}
+
+	for _, tc := range []struct {
+		lang string
+		exp  bool
+	}{
+		{"ar", true},
+		{"he-IL", true},
+		{"FA", true},
+		{"ur_PK", true},
+		{"yi", true},
+		{"ja", false},
+		{"en", false},
+		{"", false},
+	} {
+		if act := rtlLanguage(tc.lang); act != tc.exp {
+			t.Errorf("language %q: expected rtl=%t, got %t", tc.lang, tc.exp, act)
+		}
+	}
+}
+
+func TestCheckSpans(t *testing.T) {
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+		"OEBPS/content.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+		<item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+		<item id="ch3" href="ch3.xhtml" media-type="application/xhtml+xml"/>
+		<item id="ch4" href="ch4.xhtml" media-type="application/xhtml+xml"/>
+		<item id="ch5" href="ch5.xhtml" media-type="application/xhtml+xml"/>
+		<item id="kepubify-titlepage-dummy" href="kepubify-titlepage-dummy.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="ch1"/>
+		<itemref idref="ch2"/>
+		<itemref idref="ch3"/>
+		<itemref idref="ch4"/>
+		<itemref idref="ch5"/>
+		<itemref idref="kepubify-titlepage-dummy"/>
+	</spine>
+</package>`)},
+		"OEBPS/ch1.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>1</title></head><body><p><span class="koboSpan" id="kobo.1.1">One. </span><span class="koboSpan" id="kobo.1.2">Two.</span></p><p><span class="koboSpan" id="kobo.2.1"><img src="a.png"/></span></p><p><ruby>漢<rt>かん</rt></ruby></p></body></html>`)},
+		"OEBPS/ch2.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>2</title></head><body><p>Not spanned.</p><script>ignored</script></body></html>`)},
+		"OEBPS/ch3.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>3</title></head><body><p><span class="koboSpan" id="kobo.1.1">One.</span> Two.</p></body></html>`)},
+		"OEBPS/ch4.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>4</title></head><body><p><span class="koboSpan" id="kobo.1.1">One.</span></p><p><span class="koboSpan" id="kobo.1.1">Two.</span></p></body></html>`)},
+		"OEBPS/ch5.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>5</title></head><body><p><span class="koboSpan" id="kobo.1.1">One.</span></p><p><span class="koboSpan" id="kobo.3.1">Two.</span><span class="koboSpan" id="kobo.3.3">Three.</span></p></body></html>`)},
+
+		// this one is ignored since it intentionally doesn't have spans
+		"OEBPS/kepubify-titlepage-dummy.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title></title></head><body><p>Page intentionally left blank by kepubify.</p></body></html>`)},
+	}
+
+	reports, err := CheckSpans(epub)
+	if err != nil {
+		t.Fatalf("check spans: unexpected error: %v", err)
+	}
+
+	exp := []string{
+		`spans: OEBPS/ch1.xhtml: missing (1 text nodes outside kobo spans)`,
+		`spans: OEBPS/ch2.xhtml: missing (no kobo spans)`,
+		`spans: OEBPS/ch3.xhtml: missing (1 text nodes outside kobo spans)`,
+		`spans: OEBPS/ch4.xhtml: duplicate (1 duplicate ids, first kobo.1.1)`,
+		`spans: OEBPS/ch4.xhtml: non-sequential (1 non-sequential ids, first kobo.1.1 after kobo.1.1)`,
+		`spans: OEBPS/ch5.xhtml: non-sequential (2 non-sequential ids, first kobo.3.1 after kobo.1.1)`,
+	}
+	var act []string
+	for _, r := range reports {
+		act = append(act, r.String())
+	}
+	if a, b := strings.Join(act, "\n"), strings.Join(exp, "\n"); a != b {
+		t.Errorf("incorrect reports:\n%s\n---\nexpected:\n%s", a, b)
+	}
+}
+
+func TestAddSpans(t *testing.T) {
+	var buf bytes.Buffer
+	res, err := AddSpansHTML(&buf, strings.NewReader(`<!DOCTYPE html><html><head><title>Test</title></head><body><p>One. Two.</p><p><ruby>漢<rt>かん</rt></ruby><img src="test.png"/></p></body></html>`), SpanOptions{})
+	if err != nil {
+		t.Fatalf("add spans: unexpected error: %v", err)
+	}
+	if exp := `<body><p><span class="koboSpan" id="kobo.1.1">One. </span><span class="koboSpan" id="kobo.1.2">Two.</span></p><p><span class="koboSpan" id="kobo.2.1"><ruby>漢<rt>かん</rt></ruby></span><span class="koboSpan" id="kobo.3.1"><img src="test.png"/></span></p></body>`; !strings.Contains(buf.String(), exp) {
+		t.Errorf("incorrect output: expected %q in %q", exp, buf.String())
+	}
+	if res.Para != 3 || res.Seg != 1 {
+		t.Errorf("incorrect final numbers: expected 3.1, got %d.%d", res.Para, res.Seg)
+	}
+	if exp := map[string]string{"kobo.1.1": "One. ", "kobo.1.2": "Two.", "kobo.2.1": "漢", "kobo.3.1": ""}; !reflect.DeepEqual(res.Text, exp) {
+		t.Errorf("incorrect text: expected %q, got %q", exp, res.Text)
+	}
+
+	// continuing the numbering in a fragment without a body
+	frag := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	frag.AppendChild(withText(&html.Node{Type: html.ElementNode, Data: "p", DataAtom: atom.P}, "Three. "))
+	frag.AppendChild(&html.Node{Type: html.TextNode, Data: "Four."})
+	res = AddSpans(frag, SpanOptions{Para: res.Para, Seg: res.Seg})
+
+	buf.Reset()
+	if err := html.Render(&buf, frag); err != nil {
+		panic(err)
+	}
+	if exp := `<div><p><span class="koboSpan" id="kobo.4.1">Three. </span></p><span class="koboSpan" id="kobo.4.2">Four.</span></div>`; buf.String() != exp {
+		t.Errorf("incorrect output: expected %q, got %q", exp, buf.String())
+	}
+	if res.Para != 4 || res.Seg != 2 {
+		t.Errorf("incorrect final numbers: expected 4.2, got %d.%d", res.Para, res.Seg)
+	}
+
+	// respan
+	res = AddSpans(frag, SpanOptions{Respan: true})
+	if exp := map[string]string{"kobo.1.1": "Three. ", "kobo.1.2": "Four."}; !reflect.DeepEqual(res.Text, exp) {
+		t.Errorf("incorrect text after respan: expected %q, got %q", exp, res.Text)
+	}
+}
+
+func TestExportSpans(t *testing.T) {
+	epub := fstest.MapFS{
+		"META-INF/container.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)},
+		"OEBPS/content.opf": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="notes" href="notes.xhtml" media-type="application/xhtml+xml"/>
+		<item id="b" href="b.xhtml" media-type="application/xhtml+xml"/>
+		<item id="a" href="a%20b.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+	<spine>
+		<itemref idref="b"/>
+		<itemref idref="a"/>
+	</spine>
+</package>`)},
+		"OEBPS/b.xhtml":     &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>b</title></head><body><p><span class="koboSpan" id="kobo.1.1">Café. </span><span class="koboSpan" id="kobo.1.2">Two.</span></p><p><span class="koboSpan" id="kobo.2.1"><ruby>漢<rt>かん</rt></ruby></span><span class="koboSpan" id="kobo.2.2">𠮷. </span><span class="koboSpan" id="kobo.2.3">字</span></p></body></html>`)},
+		"OEBPS/a b.xhtml":   &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>a</title></head><body><p><span class="koboSpan" id="kobo.1.1"><img src="x.png"/></span></p></body></html>`)},
+		"OEBPS/notes.xhtml": &fstest.MapFile{Data: []byte(`<!DOCTYPE html><html><head><title>notes</title></head><body><p>No spans.</p></body></html>`)},
+	}
+
+	docs, err := ExportSpans(epub)
+	if err != nil {
+		t.Fatalf("export spans: unexpected error: %v", err)
+	}
+
+	exp := []SpanDocument{
+		{File: "OEBPS/b.xhtml", Paragraphs: []SpanParagraph{
+			{Para: 1, Spans: []Span{{ID: "kobo.1.1", Seg: 1, Text: "Café. ", Offset: 0}, {ID: "kobo.1.2", Seg: 2, Text: "Two.", Offset: 6}}},
+			{Para: 2, Spans: []Span{{ID: "kobo.2.1", Seg: 1, Text: "漢", Offset: 10}, {ID: "kobo.2.2", Seg: 2, Text: "𠮷. ", Offset: 11}, {ID: "kobo.2.3", Seg: 3, Text: "字", Offset: 15}}}, // 𠮷 is a surrogate pair in UTF-16
+		}},
+		{File: "OEBPS/a b.xhtml", Paragraphs: []SpanParagraph{
+			{Para: 1, Spans: []Span{{ID: "kobo.1.1", Seg: 1, Text: "", Offset: 0}}},
+		}},
+		{File: "OEBPS/notes.xhtml", Paragraphs: []SpanParagraph{}},
+	}
+	if !reflect.DeepEqual(docs, exp) {
+		t.Errorf("incorrect spans:\n%+v\n---\nexpected:\n%+v", docs, exp)
+	}
+}
@@ -0,0 +1,235 @@
+package kepub
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+
+	"github.com/pgaskin/kepubify/_/html/golang.org/x/net/html"
+)
+
+// epubReachable finds the files in the EPUB which can be reached from the
+// package document. The roots are the spine, navigation documents, NCX, cover,
+// and guide, and references are followed through content documents, SVG
+// images, stylesheets, manifest fallbacks, and media overlays. The files
+// required by the OCF container are always reachable. The provided files
+// should not include directories.
+func epubReachable(epub fs.FS, opf string, files []string) (map[string]bool, error) {
+	exists := map[string]bool{}
+	lower := map[string][]string{}
+	for _, fn := range files {
+		exists[fn] = true
+		lower[strings.ToLower(fn)] = append(lower[strings.ToLower(fn)], fn)
+	}
+
+	doc := etree.NewDocument()
+	if err := func() error {
+		f, err := epub.Open(opf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = doc.ReadFrom(f)
+		return err
+	}(); err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	reachable := map[string]bool{opf: true, "mimetype": true}
+	for _, fn := range files {
+		if strings.HasPrefix(fn, "META-INF/") {
+			reachable[fn] = true
+		}
+	}
+
+	// resolve gets the file referenced by href relative to base
+	resolve := func(base, href string) (string, bool) {
+		u, err := url.Parse(strings.TrimSpace(href))
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+			return "", false
+		}
+		fn := path.Join(path.Dir(base), u.Path)
+		if !exists[fn] {
+			// like Convert and the link checker, be lenient about the case
+			if fns := lower[strings.ToLower(fn)]; len(fns) == 1 {
+				return fns[0], true
+			}
+			return "", false
+		}
+		return fn, true
+	}
+
+	manifest := doc.FindElements("/package/manifest/item")
+	items := map[string]*etree.Element{} // by id
+	byFile := map[string]*etree.Element{}
+	for _, it := range manifest {
+		if fn, ok := resolve(opf, it.SelectAttrValue("href", "")); ok {
+			byFile[fn] = it
+			if id := it.SelectAttrValue("id", ""); id != "" {
+				items[id] = it
+			}
+		}
+	}
+
+	var queue []string
+	visit := func(fn string) {
+		if !reachable[fn] {
+			reachable[fn] = true
+			queue = append(queue, fn)
+		}
+	}
+	visitElement := func(it *etree.Element) {
+		if fn, ok := resolve(opf, it.SelectAttrValue("href", "")); ok {
+			visit(fn)
+		}
+	}
+	visitItem := func(id string) {
+		if it, ok := items[id]; ok {
+			visitElement(it)
+		}
+	}
+
+	for _, el := range doc.FindElements("/package/spine/itemref") {
+		visitItem(el.SelectAttrValue("idref", ""))
+	}
+	if el := doc.FindElement("/package/spine"); el != nil {
+		visitItem(el.SelectAttrValue("toc", ""))
+	}
+	for _, it := range manifest {
+		if p := it.SelectAttrValue("properties", ""); includes(p, "nav") || includes(p, "cover-image") {
+			visitElement(it)
+		}
+		if it.SelectAttrValue("media-type", "") == "application/x-dtbncx+xml" || it.SelectAttrValue("id", "") == "cover" {
+			visitElement(it)
+		}
+	}
+	for _, el := range doc.FindElements("/package/metadata/meta[@name='cover']") {
+		visitItem(el.SelectAttrValue("content", ""))
+	}
+	for _, el := range doc.FindElements("/package/guide/reference[@href]") {
+		if fn, ok := resolve(opf, el.SelectAttrValue("href", "")); ok {
+			visit(fn)
+		}
+	}
+
+	for len(queue) != 0 {
+		var fn string
+		fn, queue = queue[0], queue[1:]
+
+		if it, ok := byFile[fn]; ok {
+			visitItem(it.SelectAttrValue("fallback", ""))
+			visitItem(it.SelectAttrValue("fallback-style", ""))
+			visitItem(it.SelectAttrValue("media-overlay", ""))
+		}
+
+		var refs []string
+		switch ext := strings.ToLower(path.Ext(fn)); ext {
+		case ".xhtml", ".html", ".htm", ".xml", ".svg", ".ncx", ".smil":
+			buf, err := fs.ReadFile(epub, fn)
+			if err != nil {
+				return nil, fmt.Errorf("read %q: %w", fn, err)
+			}
+			refs = reachableMarkup(buf)
+		case ".css":
+			buf, err := fs.ReadFile(epub, fn)
+			if err != nil {
+				return nil, fmt.Errorf("read %q: %w", fn, err)
+			}
+			refs = reachableCSS(buf)
+		}
+		for _, href := range refs {
+			if t, ok := resolve(fn, href); ok {
+				visit(t)
+			}
+		}
+	}
+	return reachable, nil
+}
+
+// reachableMarkup gets the references in a (X)HTML, SVG, NCX, or SMIL document.
+// The tokenizer is used directly since we only need the attributes and
+// stylesheets.
+func reachableMarkup(buf []byte) []string {
+	var refs []string
+	var style bool
+	z := html.NewTokenizer(bytes.NewReader(buf))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return refs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			style = string(name) == "style"
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				switch string(k) {
+				case "href", "xlink:href", "src", "poster", "data":
+					refs = append(refs, string(v))
+				case "srcset":
+					for _, c := range strings.Split(string(v), ",") {
+						if f := strings.Fields(c); len(f) != 0 {
+							refs = append(refs, f[0])
+						}
+					}
+				case "style":
+					refs = append(refs, reachableCSS(v)...)
+				}
+			}
+		case html.TextToken:
+			if style {
+				refs = append(refs, reachableCSS(z.Text())...)
+			}
+		case html.EndTagToken:
+			style = false
+		}
+	}
+}
+
+var (
+	reachableCSSURL    = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+	reachableCSSImport = regexp.MustCompile(`(?i)@import\s+(?:"([^"]*)"|'([^']*)')`)
+)
+
+// reachableCSS gets the references in a stylesheet.
+func reachableCSS(buf []byte) []string {
+	var refs []string
+	for _, re := range []*regexp.Regexp{reachableCSSURL, reachableCSSImport} {
+		for _, m := range re.FindAllSubmatch(buf, -1) {
+			for _, g := range m[1:] {
+				if len(g) != 0 {
+					refs = append(refs, string(g))
+					break
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// transformOPFRemove removes the manifest items (and the spine items
+// referencing them) for the removed files.
+func transformOPFRemove(doc *etree.Document, opf string, removed map[string]bool) {
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("/package/manifest/item") {
+		href := el.SelectAttrValue("href", "")
+		if u, err := url.PathUnescape(href); err == nil {
+			href = u
+		}
+		if removed[path.Join(path.Dir(opf), href)] {
+			ids[el.SelectAttrValue("id", "")] = true
+			el.Parent().RemoveChild(el)
+		}
+	}
+	for _, el := range doc.FindElements("/package/spine/itemref") {
+		if ids[el.SelectAttrValue("idref", "")] {
+			el.Parent().RemoveChild(el)
+		}
+	}
+}
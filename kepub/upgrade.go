@@ -0,0 +1,295 @@
+package kepub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// epubVersion gets the version of the OPF package document.
+func epubVersion(epub fs.FS, pkg string) (string, error) {
+	var opf struct {
+		XMLName xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+		Version string   `xml:"version,attr"`
+	}
+
+	f, err := epub.Open(pkg)
+	if err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(&opf); err != nil {
+		return "", fmt.Errorf("parse OPF package: %w", err)
+	}
+	return opf.Version, nil
+}
+
+// epubUpgradeNav generates an EPUB3 navigation document nav from the NCX and
+// the guide in the OPF package document. The nav should be in the same
+// directory as the NCX. Link fixes and split content documents are applied to
+// the generated links, but they aren't reported.
+func epubUpgradeNav(epub fs.FS, opf, ncx, nav string, st *convertState) ([]byte, error) {
+	readDoc := func(fn string) (*etree.Document, error) {
+		doc := etree.NewDocument()
+		f, err := epub.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := doc.ReadFrom(f); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	ncxDoc, err := readDoc(ncx)
+	if err != nil {
+		return nil, fmt.Errorf("parse NCX: %w", err)
+	}
+	opfDoc, err := readDoc(opf)
+	if err != nil {
+		return nil, fmt.Errorf("parse OPF package: %w", err)
+	}
+
+	label := func(el *etree.Element) string {
+		if t := el.FindElement("navLabel/text"); t != nil {
+			return strings.TrimSpace(t.Text())
+		}
+		return ""
+	}
+	src := func(el *etree.Element) string {
+		if c := el.SelectElement("content"); c != nil {
+			if s := c.SelectAttrValue("src", ""); s != "" {
+				return st.ncxSrc(ncx, s, nil)
+			}
+		}
+		return ""
+	}
+	link := func(li *etree.Element, text, href string) *etree.Element {
+		var a *etree.Element
+		if href != "" {
+			a = li.CreateElement("a")
+			a.CreateAttr("href", href)
+		} else {
+			a = li.CreateElement("span")
+		}
+		a.SetText(text)
+		return a
+	}
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	doc.CreateDirective("DOCTYPE html")
+
+	root := doc.CreateElement("html")
+	root.CreateAttr("xmlns", "http://www.w3.org/1999/xhtml")
+	root.CreateAttr("xmlns:epub", "http://www.idpf.org/2007/ops")
+	if lang := opfDoc.FindElement("/package/metadata/language"); lang != nil {
+		root.CreateAttr("lang", strings.TrimSpace(lang.Text()))
+		root.CreateAttr("xml:lang", strings.TrimSpace(lang.Text()))
+	}
+
+	title := "Table of Contents"
+	if t := ncxDoc.FindElement("/ncx/docTitle/text"); t != nil && strings.TrimSpace(t.Text()) != "" {
+		title = strings.TrimSpace(t.Text())
+	}
+	head := root.CreateElement("head")
+	head.CreateElement("title").SetText(title)
+	meta := head.CreateElement("meta")
+	meta.CreateAttr("charset", "utf-8")
+
+	body := root.CreateElement("body")
+
+	toc := body.CreateElement("nav")
+	toc.CreateAttr("epub:type", "toc")
+	toc.CreateAttr("id", "toc")
+	var navPoints func(ol, parent *etree.Element)
+	navPoints = func(ol, parent *etree.Element) {
+		for _, np := range parent.SelectElements("navPoint") {
+			li := ol.CreateElement("li")
+			link(li, label(np), src(np))
+			if len(np.SelectElements("navPoint")) != 0 {
+				navPoints(li.CreateElement("ol"), np)
+			}
+		}
+	}
+	ol := toc.CreateElement("ol")
+	if navMap := ncxDoc.FindElement("/ncx/navMap"); navMap != nil {
+		navPoints(ol, navMap)
+	}
+
+	if pts := ncxDoc.FindElements("/ncx/pageList/pageTarget"); len(pts) != 0 {
+		pl := body.CreateElement("nav")
+		pl.CreateAttr("epub:type", "page-list")
+		pl.CreateAttr("hidden", "")
+		ol := pl.CreateElement("ol")
+		for _, pt := range pts {
+			link(ol.CreateElement("li"), label(pt), src(pt))
+		}
+	}
+
+	if refs := opfDoc.FindElements("/package/guide/reference[@href]"); len(refs) != 0 {
+		lm := body.CreateElement("nav")
+		lm.CreateAttr("epub:type", "landmarks")
+		lm.CreateAttr("hidden", "")
+		ol := lm.CreateElement("ol")
+		for _, ref := range refs {
+			href := ref.SelectAttrValue("href", "")
+			if st.Splits != nil {
+				href, _ = st.Splits.resolve(opf, href)
+			}
+			u, err := url.Parse(href)
+			if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+				continue
+			}
+			if u.Path != "" {
+				u.Path = relPath(path.Dir(nav), path.Join(path.Dir(opf), u.Path))
+			} else {
+				u.Path = relPath(path.Dir(nav), opf)
+			}
+			text := ref.SelectAttrValue("title", "")
+			if text == "" {
+				text = ref.SelectAttrValue("type", "")
+			}
+			a := link(ol.CreateElement("li"), text, u.String())
+			if t := upgradeGuideType(ref.SelectAttrValue("type", "")); t != "" {
+				a.CreateAttr("epub:type", t)
+			}
+		}
+	}
+
+	doc.Indent(4)
+
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("render nav: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// upgradeGuideType converts an EPUB2 guide reference type into an EPUB3
+// structural semantics type. If there isn't an equivalent, an empty string is
+// returned.
+func upgradeGuideType(t string) string {
+	switch t = strings.ToLower(t); t {
+	case "title-page":
+		return "titlepage"
+	case "text":
+		return "bodymatter"
+	case "cover", "toc", "index", "glossary", "acknowledgements", "bibliography", "colophon", "copyright-page", "dedication", "epigraph", "foreword", "loi", "lot", "preface":
+		return t
+	case "notes":
+		return "endnotes"
+	}
+	return ""
+}
+
+// transformOPFUpgrade upgrades an EPUB2 OPF package document to EPUB3 by
+// bumping the version, adding the navigation document nav (the full path), the
+// last modified date, and series metadata from calibre, and converting the
+// opf:role and opf:file-as attributes into refining metadata. The NCX, guide,
+// and cover meta are kept for compatibility.
+func transformOPFUpgrade(doc *etree.Document, opf, nav string, now time.Time) {
+	pkg := doc.FindElement("/package")
+	if pkg == nil {
+		return
+	}
+	pkg.CreateAttr("version", "3.0")
+
+	ids := map[string]bool{}
+	for _, el := range doc.FindElements("//[@id]") {
+		ids[el.SelectAttrValue("id", "")] = true
+	}
+	newID := func(prefix string) string {
+		for n := 1; ; n++ {
+			if id := prefix + strconv.Itoa(n); !ids[id] {
+				ids[id] = true
+				return id
+			}
+		}
+	}
+	newMeta := func(property, value string) *etree.Element {
+		el := etree.NewElement("meta")
+		el.Space = pkg.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		el.CreateAttr("property", property)
+		el.SetText(value)
+		return el
+	}
+
+	if metadata := pkg.SelectElement("metadata"); metadata != nil {
+		for _, el := range metadata.ChildElements() {
+			role, fileAs := el.SelectAttrValue("opf:role", ""), el.SelectAttrValue("opf:file-as", "")
+			el.RemoveAttr("opf:role")
+			el.RemoveAttr("opf:file-as")
+			if role == "" && fileAs == "" {
+				continue
+			}
+			id := el.SelectAttrValue("id", "")
+			if id == "" {
+				id = newID(el.Tag)
+				el.CreateAttr("id", id)
+			}
+			i := el.Index()
+			if fileAs != "" {
+				m := newMeta("file-as", fileAs)
+				m.CreateAttr("refines", "#"+id)
+				metadata.InsertChildAt(i+1, m)
+			}
+			if role != "" {
+				m := newMeta("role", role)
+				m.CreateAttr("refines", "#"+id)
+				m.CreateAttr("scheme", "marc:relators")
+				metadata.InsertChildAt(i+1, m)
+			}
+		}
+
+		if metadata.FindElement("meta[@property='belongs-to-collection']") == nil {
+			if series := metadata.FindElement("meta[@name='calibre:series']"); series != nil {
+				if name := strings.TrimSpace(series.SelectAttrValue("content", "")); name != "" {
+					id := newID("series")
+					m := newMeta("belongs-to-collection", name)
+					m.CreateAttr("id", id)
+					metadata.AddChild(m)
+
+					m = newMeta("collection-type", "series")
+					m.CreateAttr("refines", "#"+id)
+					metadata.AddChild(m)
+
+					if idx := metadata.FindElement("meta[@name='calibre:series_index']"); idx != nil {
+						if v, err := strconv.ParseFloat(strings.TrimSpace(idx.SelectAttrValue("content", "")), 64); err == nil {
+							m = newMeta("group-position", strconv.FormatFloat(v, 'f', -1, 64))
+							m.CreateAttr("refines", "#"+id)
+							metadata.AddChild(m)
+						}
+					}
+				}
+			}
+		}
+
+		if metadata.FindElement("meta[@property='dcterms:modified']") == nil {
+			metadata.AddChild(newMeta("dcterms:modified", now.UTC().Format("2006-01-02T15:04:05Z")))
+		}
+	}
+
+	if manifest := pkg.SelectElement("manifest"); manifest != nil {
+		it := manifest.CreateElement("item")
+		it.Space = manifest.Space // shouldn't usually be needed, but just in case they used a namespace prefix
+		id := "kepubify-nav"
+		if ids[id] {
+			id = newID(id + "-")
+		}
+		it.CreateAttr("id", id)
+		it.CreateAttr("href", (&url.URL{Path: relPath(path.Dir(opf), nav)}).String())
+		it.CreateAttr("media-type", "application/xhtml+xml")
+		it.CreateAttr("properties", "nav")
+	}
+}